@@ -6,6 +6,8 @@ import "time"
 
 type Clock interface {
 	Now() time.Time
+	// After sends the current time on the returned channel once the duration has elapsed.
+	After(d time.Duration) <-chan time.Time
 }
 
 type realClock struct{}
@@ -14,6 +16,10 @@ func (realClock) Now() time.Time {
 	return time.Now()
 }
 
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
 func NewClock() Clock {
 	return &realClock{}
 }
@@ -4,4 +4,7 @@ import "bytes"
 
 type Renderer interface {
 	TileImages(imageBufs []*bytes.Buffer) (*bytes.Buffer, error)
+	// LabeledGrid arranges the images row by row, with a column per column label, under a heading
+	// with the X title and the column labels and next to the row labels.
+	LabeledGrid(imageBufs []*bytes.Buffer, columnLabels, rowLabels []string, xTitle, yTitle string) (*bytes.Buffer, error)
 }
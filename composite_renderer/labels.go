@@ -0,0 +1,124 @@
+package composite_renderer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"unicode/utf8"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// labelScaleWidth is the image width per text scale step, so labels stay readable on large images.
+const labelScaleWidth = 256
+
+func (r *rendererImpl) LabeledGrid(imageBufs []*bytes.Buffer, columnLabels, rowLabels []string, xTitle, yTitle string) (*bytes.Buffer, error) {
+	if len(columnLabels) == 0 || len(rowLabels) == 0 || len(imageBufs) != len(columnLabels)*len(rowLabels) {
+		return nil, fmt.Errorf("%d images don't fill %d columns and %d rows", len(imageBufs), len(columnLabels), len(rowLabels))
+	}
+
+	images, err := decodeImages(imageBufs)
+	if err != nil {
+		return nil, err
+	}
+
+	cellSize := images[0].Bounds().Size()
+
+	face := basicfont.Face7x13
+	scale := max(1, cellSize.X/labelScaleWidth)
+	charWidth := face.Advance * scale
+	lineHeight := face.Height * scale
+	padding := lineHeight / 2
+
+	// the heading has a line for the X title and a line for the column labels
+	headerHeight := 2*lineHeight + 2*padding
+
+	labelChars := utf8.RuneCountInString(yTitle)
+	for _, label := range rowLabels {
+		labelChars = max(labelChars, utf8.RuneCountInString(label))
+	}
+
+	labelWidth := min(labelChars*charWidth+2*padding, cellSize.X)
+
+	retImage := image.NewRGBA(image.Rect(0, 0,
+		labelWidth+cellSize.X*len(columnLabels),
+		headerHeight+cellSize.Y*len(rowLabels)))
+
+	draw.Draw(retImage, retImage.Bounds(), image.White, image.Point{}, draw.Src)
+
+	gridWidth := cellSize.X * len(columnLabels)
+
+	drawCenteredLabel(retImage, xTitle, labelWidth, gridWidth, padding, scale)
+	drawLabel(retImage, fitLabel(yTitle, (labelWidth-2*padding)/charWidth), padding, padding+lineHeight, scale)
+
+	for col, label := range columnLabels {
+		drawCenteredLabel(retImage, label, labelWidth+col*cellSize.X, cellSize.X, padding+lineHeight, scale)
+	}
+
+	for row, label := range rowLabels {
+		rowTop := headerHeight + row*cellSize.Y
+
+		drawLabel(retImage, fitLabel(label, (labelWidth-2*padding)/charWidth), padding, rowTop+(cellSize.Y-lineHeight)/2, scale)
+	}
+
+	for i, img := range images {
+		offset := image.Pt(labelWidth+(i%len(columnLabels))*cellSize.X, headerHeight+(i/len(columnLabels))*cellSize.Y)
+
+		draw.Draw(retImage, img.Bounds().Sub(img.Bounds().Min).Add(offset), img, img.Bounds().Min, draw.Over)
+	}
+
+	return encodePNG(retImage)
+}
+
+// fitLabel shortens a label to the number of characters that fit.
+func fitLabel(label string, maxChars int) string {
+	runes := []rune(label)
+	if len(runes) <= maxChars {
+		return label
+	}
+
+	if maxChars <= 2 {
+		return string(runes[:max(maxChars, 0)])
+	}
+
+	return string(runes[:maxChars-2]) + ".."
+}
+
+// drawCenteredLabel draws a label centered in the horizontal span starting at left, shortened to fit.
+func drawCenteredLabel(dst *image.RGBA, label string, left, width, top, scale int) {
+	charWidth := basicfont.Face7x13.Advance * scale
+
+	label = fitLabel(label, width/charWidth)
+
+	drawLabel(dst, label, left+(width-utf8.RuneCountInString(label)*charWidth)/2, top, scale)
+}
+
+// drawLabel draws black text with its top left corner at x, y. The text is drawn with the
+// 7x13 bitmap font and enlarged by scale.
+func drawLabel(dst *image.RGBA, label string, x, y, scale int) {
+	if label == "" {
+		return
+	}
+
+	face := basicfont.Face7x13
+
+	textImage := image.NewRGBA(image.Rect(0, 0, utf8.RuneCountInString(label)*face.Advance, face.Height))
+
+	drawer := &font.Drawer{
+		Dst:  textImage,
+		Src:  image.NewUniform(color.Black),
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+
+	drawer.DrawString(label)
+
+	target := image.Rect(x, y, x+textImage.Bounds().Dx()*scale, y+textImage.Bounds().Dy()*scale)
+
+	xdraw.NearestNeighbor.Scale(dst, target, textImage, textImage.Bounds(), draw.Over, nil)
+}
@@ -6,6 +6,7 @@ import (
 	"image"
 	"image/draw"
 	"image/png"
+	"math"
 )
 
 type rendererImpl struct{}
@@ -16,12 +17,37 @@ func New(cfg Config) (Renderer, error) {
 	return &rendererImpl{}, nil
 }
 
+// TileImages arranges the images in a grid that is as square as possible,
+// e.g. 4 images as 2x2 and 3 images as 2x2 with an empty last cell.
 func (r *rendererImpl) TileImages(imageBufs []*bytes.Buffer) (*bytes.Buffer, error) {
-	if len(imageBufs) != 4 {
+	images, err := decodeImages(imageBufs)
+	if err != nil {
+		return nil, err
+	}
+
+	firstBounds := images[0].Bounds()
+
+	columns := int(math.Ceil(math.Sqrt(float64(len(images)))))
+	rows := (len(images) + columns - 1) / columns
+
+	retImage := image.NewRGBA(image.Rect(0, 0, firstBounds.Dx()*columns, firstBounds.Dy()*rows))
+
+	for i, img := range images {
+		offset := image.Pt((i%columns)*firstBounds.Dx(), (i/columns)*firstBounds.Dy())
+
+		draw.Draw(retImage, img.Bounds().Sub(img.Bounds().Min).Add(offset), img, img.Bounds().Min, draw.Over)
+	}
+
+	return encodePNG(retImage)
+}
+
+// decodeImages decodes the images, which all have to be of the same size.
+func decodeImages(imageBufs []*bytes.Buffer) ([]image.Image, error) {
+	if len(imageBufs) == 0 {
 		return nil, errors.New("invalid number of images")
 	}
 
-	images := make([]image.Image, 4)
+	images := make([]image.Image, len(imageBufs))
 
 	for i, buf := range imageBufs {
 		img, _, err := image.Decode(buf)
@@ -32,24 +58,19 @@ func (r *rendererImpl) TileImages(imageBufs []*bytes.Buffer) (*bytes.Buffer, err
 		images[i] = img
 	}
 
-	firstBounds := images[0].Bounds()
-
 	for _, img := range images {
-		if img.Bounds() != firstBounds {
+		if img.Bounds().Size() != images[0].Bounds().Size() {
 			return nil, errors.New("images are not the same size")
 		}
 	}
 
-	retImage := image.NewRGBA(image.Rect(0, 0, firstBounds.Max.X*2, firstBounds.Max.Y*2))
-
-	draw.Draw(retImage, images[0].Bounds().Add(image.Pt(0, 0)), images[0], image.Point{}, draw.Over)
-	draw.Draw(retImage, images[1].Bounds().Add(image.Pt(firstBounds.Max.X, 0)), images[1], image.Point{}, draw.Over)
-	draw.Draw(retImage, images[2].Bounds().Add(image.Pt(0, firstBounds.Max.Y)), images[2], image.Point{}, draw.Over)
-	draw.Draw(retImage, images[3].Bounds().Add(image.Pt(firstBounds.Max.X, firstBounds.Max.Y)), images[3], image.Point{}, draw.Over)
+	return images, nil
+}
 
+func encodePNG(img image.Image) (*bytes.Buffer, error) {
 	imageBuf := new(bytes.Buffer)
 
-	err := png.Encode(imageBuf, retImage)
+	err := png.Encode(imageBuf, img)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,406 @@
+package dashboard
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/repositories/image_generations"
+	"kinshi_vision_bot/stable_diffusion_api"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	tokenCookie = "dashboard_token"
+
+	recentGenerations = 20
+	statsDays         = 7
+	statsMembers      = 20
+	promptLength      = 160
+	thumbnailSize     = 256
+
+	// thumbnailCacheDuration keeps the page refreshes from looking up every message again,
+	// well within the lifetime of Discord attachment links.
+	thumbnailCacheDuration = time.Hour
+	healthCheckTimeout     = 5 * time.Second
+)
+
+//go:embed templates
+var templates embed.FS
+
+type dashboardImpl struct {
+	addr                string
+	token               string
+	invisionQueue       invision_queue.Queue
+	imageGenerationRepo image_generations.Repository
+	stableDiffusionAPI  stable_diffusion_api.StableDiffusionAPI
+	discordSession      *discordgo.Session
+	page                *template.Template
+	server              *http.Server
+	logger              *slog.Logger
+
+	thumbnailsMu sync.Mutex
+	thumbnails   map[int64]cachedThumbnail
+}
+
+type Config struct {
+	// Addr is the address to listen on, like "127.0.0.1:8080".
+	Addr string
+	// Token is the admin token every request must carry, as a bearer token or a token query parameter.
+	Token               string
+	InvisionQueue       invision_queue.Queue
+	ImageGenerationRepo image_generations.Repository
+	StableDiffusionAPI  stable_diffusion_api.StableDiffusionAPI
+	// DiscordSession looks up the posted images of generations for the thumbnails. It only needs
+	// to make REST calls, so it doesn't have to be opened.
+	DiscordSession *discordgo.Session
+	// Logger is optional, the default logger is used when nil.
+	Logger *slog.Logger
+}
+
+type cachedThumbnail struct {
+	url     string
+	expires time.Time
+}
+
+func New(cfg Config) (Dashboard, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("missing address")
+	}
+
+	if cfg.Token == "" {
+		return nil, errors.New("missing admin token")
+	}
+
+	if cfg.InvisionQueue == nil {
+		return nil, errors.New("missing invision queue")
+	}
+
+	if cfg.ImageGenerationRepo == nil {
+		return nil, errors.New("missing image generation repository")
+	}
+
+	if cfg.StableDiffusionAPI == nil {
+		return nil, errors.New("missing stable diffusion API")
+	}
+
+	if cfg.DiscordSession == nil {
+		return nil, errors.New("missing Discord session")
+	}
+
+	page, err := template.New("dashboard.html").Funcs(template.FuncMap{
+		"ago":     ago,
+		"percent": func(value float64) string { return strconv.FormatFloat(value*100, 'f', 0, 64) + "%" },
+		"seconds": func(value float64) string { return strconv.FormatFloat(value, 'f', 1, 64) + "s" },
+	}).ParseFS(templates, "templates/dashboard.html")
+	if err != nil {
+		return nil, err
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	newDashboard := &dashboardImpl{
+		addr:                cfg.Addr,
+		token:               cfg.Token,
+		invisionQueue:       cfg.InvisionQueue,
+		imageGenerationRepo: cfg.ImageGenerationRepo,
+		stableDiffusionAPI:  cfg.StableDiffusionAPI,
+		discordSession:      cfg.DiscordSession,
+		page:                page,
+		logger:              logger,
+		thumbnails:          make(map[int64]cachedThumbnail),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", newDashboard.handleDashboard)
+	mux.HandleFunc("/thumbnails/", newDashboard.handleThumbnail)
+
+	newDashboard.server = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           newDashboard.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return newDashboard, nil
+}
+
+func (d *dashboardImpl) Start() error {
+	listener, err := net.Listen("tcp", d.addr)
+	if err != nil {
+		return err
+	}
+
+	d.logger.Info("Serving dashboard", "addr", listener.Addr().String())
+
+	go func() {
+		err := d.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.logger.Error("Dashboard stopped", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (d *dashboardImpl) Shutdown(ctx context.Context) error {
+	return d.server.Shutdown(ctx)
+}
+
+// authenticate lets requests with the admin token through. A valid token query parameter is kept
+// in a cookie, so the links and refreshes of the page work without it.
+func (d *dashboardImpl) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && d.validToken(token) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+
+			query := r.URL.Query()
+			query.Del("token")
+
+			redirectURL := *r.URL
+			redirectURL.RawQuery = query.Encode()
+
+			http.Redirect(w, r, redirectURL.String(), http.StatusSeeOther)
+
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			if cookie, err := r.Cookie(tokenCookie); err == nil {
+				token = cookie.Value
+			}
+		}
+
+		if !d.validToken(token) {
+			http.Error(w, "A valid admin token is required.", http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (d *dashboardImpl) validToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+type backendHealth struct {
+	Up       bool
+	Error    string
+	Latency  time.Duration
+	Progress float64
+	ETA      float64
+}
+
+type jobView struct {
+	Position int
+	*invision_queue.JobStatus
+}
+
+type pageData struct {
+	Now       time.Time
+	Backend   backendHealth
+	Current   *invision_queue.JobStatus
+	Waiting   []jobView
+	Recent    []*entities.ImageGeneration
+	Stats     []*entities.MemberStats
+	StatsDays int
+}
+
+func (d *dashboardImpl) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	ctx := r.Context()
+	status := d.invisionQueue.Status()
+
+	data := &pageData{
+		Now:       time.Now(),
+		Backend:   d.backendHealth(ctx),
+		Current:   status.Current,
+		Waiting:   make([]jobView, 0, len(status.Waiting)),
+		StatsDays: statsDays,
+	}
+
+	for idx, job := range status.Waiting {
+		data.Waiting = append(data.Waiting, jobView{Position: idx + 1, JobStatus: job})
+	}
+
+	recent, err := d.imageGenerationRepo.ListRecent(ctx, recentGenerations)
+	if err != nil {
+		d.logger.Error("Error listing recent generations", "error", err)
+	}
+
+	for _, generation := range recent {
+		generation.Prompt = shortPrompt(generation.Prompt)
+	}
+
+	data.Recent = recent
+
+	data.Stats, err = d.imageGenerationRepo.ListMemberStats(ctx, time.Now().AddDate(0, 0, -statsDays), statsMembers)
+	if err != nil {
+		d.logger.Error("Error listing member stats", "error", err)
+	}
+
+	for _, job := range status.Waiting {
+		job.Prompt = shortPrompt(job.Prompt)
+	}
+
+	if status.Current != nil {
+		status.Current.Prompt = shortPrompt(status.Current.Prompt)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err = d.page.Execute(w, data)
+	if err != nil {
+		d.logger.Error("Error rendering dashboard", "error", err)
+	}
+}
+
+// backendHealth asks the WebUI for its progress, which also tells whether it is reachable.
+func (d *dashboardImpl) backendHealth(ctx context.Context) backendHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	progress, err := d.stableDiffusionAPI.GetCurrentProgress(ctx)
+	if err != nil {
+		return backendHealth{Error: err.Error()}
+	}
+
+	return backendHealth{
+		Up:       true,
+		Latency:  time.Since(start).Round(time.Millisecond),
+		Progress: progress.Progress,
+		ETA:      progress.EtaRelative,
+	}
+}
+
+// handleThumbnail redirects to a small version of the posted image of a generation, as served by
+// the media proxy of Discord.
+func (d *dashboardImpl) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	generationID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/thumbnails/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	thumbnailURL, err := d.thumbnailURL(r.Context(), generationID)
+	if err != nil {
+		d.logger.Warn("Error getting thumbnail", "generation_id", generationID, "error", err)
+
+		http.NotFound(w, r)
+
+		return
+	}
+
+	http.Redirect(w, r, thumbnailURL, http.StatusFound)
+}
+
+func (d *dashboardImpl) thumbnailURL(ctx context.Context, generationID int64) (string, error) {
+	d.thumbnailsMu.Lock()
+	cached, ok := d.thumbnails[generationID]
+	d.thumbnailsMu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.url, nil
+	}
+
+	generation, err := d.imageGenerationRepo.GetByID(ctx, generationID)
+	if err != nil {
+		return "", err
+	}
+
+	if generation.NSFW || generation.Deleted {
+		return "", errors.New("the image is not shown on the dashboard")
+	}
+
+	message, err := d.discordSession.ChannelMessage(generation.ChannelID, generation.MessageID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(message.Attachments) == 0 {
+		return "", errors.New("the message has no image")
+	}
+
+	proxyURL, err := url.Parse(message.Attachments[0].ProxyURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := proxyURL.Query()
+	query.Set("width", strconv.Itoa(thumbnailSize))
+	query.Set("height", strconv.Itoa(thumbnailSize))
+	proxyURL.RawQuery = query.Encode()
+
+	d.thumbnailsMu.Lock()
+	defer d.thumbnailsMu.Unlock()
+
+	for cachedID, cached := range d.thumbnails {
+		if time.Now().After(cached.expires) {
+			delete(d.thumbnails, cachedID)
+		}
+	}
+
+	d.thumbnails[generationID] = cachedThumbnail{url: proxyURL.String(), expires: time.Now().Add(thumbnailCacheDuration)}
+
+	return proxyURL.String(), nil
+}
+
+func shortPrompt(prompt string) string {
+	prompt = strings.Trim(prompt, "`")
+	if len([]rune(prompt)) > promptLength {
+		prompt = string([]rune(prompt)[:promptLength]) + "…"
+	}
+
+	return prompt
+}
+
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	elapsed := time.Since(t)
+
+	switch {
+	case elapsed < time.Minute:
+		return fmt.Sprintf("%ds ago", int(elapsed.Seconds()))
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%dm ago", int(elapsed.Minutes()))
+	case elapsed < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(elapsed.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(elapsed.Hours()/24))
+	}
+}
@@ -0,0 +1,9 @@
+package dashboard
+
+import "context"
+
+type Dashboard interface {
+	// Start serves the dashboard in the background. It fails when the address can't be listened on.
+	Start() error
+	Shutdown(ctx context.Context) error
+}
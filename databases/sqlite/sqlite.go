@@ -3,7 +3,7 @@ package sqlite
 import (
 	"context"
 	"database/sql"
-	"log"
+	"kinshi_vision_bot/logging"
 	"os"
 	"strconv"
 	"strings"
@@ -88,6 +88,214 @@ const addGenerationBatchSizeColumnQuery string = `
 ALTER TABLE image_generations ADD COLUMN batch_count INTEGER NOT NULL DEFAULT 0;
 `
 
+const addGenerationChannelColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN channel_id TEXT NOT NULL DEFAULT '';
+`
+
+const createMemberIndexIfNotExistsQuery string = `
+CREATE INDEX IF NOT EXISTS generation_member_index
+ON image_generations(member_id, created_at);
+`
+
+// The full-text index is an external content table over image_generations,
+// kept in sync by triggers and filled with the existing rows on creation.
+const createGenerationSearchIndexQuery string = `
+CREATE VIRTUAL TABLE IF NOT EXISTS image_generations_fts USING fts5(
+prompt,
+negative_prompt,
+content='image_generations',
+content_rowid='id'
+);
+
+CREATE TRIGGER IF NOT EXISTS image_generations_fts_insert AFTER INSERT ON image_generations BEGIN
+INSERT INTO image_generations_fts(rowid, prompt, negative_prompt) VALUES (new.id, new.prompt, new.negative_prompt);
+END;
+
+CREATE TRIGGER IF NOT EXISTS image_generations_fts_delete AFTER DELETE ON image_generations BEGIN
+INSERT INTO image_generations_fts(image_generations_fts, rowid, prompt, negative_prompt) VALUES ('delete', old.id, old.prompt, old.negative_prompt);
+END;
+
+CREATE TRIGGER IF NOT EXISTS image_generations_fts_update AFTER UPDATE OF prompt, negative_prompt ON image_generations BEGIN
+INSERT INTO image_generations_fts(image_generations_fts, rowid, prompt, negative_prompt) VALUES ('delete', old.id, old.prompt, old.negative_prompt);
+INSERT INTO image_generations_fts(rowid, prompt, negative_prompt) VALUES (new.id, new.prompt, new.negative_prompt);
+END;
+
+INSERT INTO image_generations_fts(image_generations_fts) VALUES ('rebuild');
+`
+
+const addSettingsLimitColumnsQuery string = `
+ALTER TABLE default_settings ADD COLUMN negative_prompt TEXT NOT NULL DEFAULT '';
+ALTER TABLE default_settings ADD COLUMN default_steps INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN max_steps INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN default_cfg_scale REAL NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN max_cfg_scale REAL NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN max_dimension INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN max_queue_length INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN max_queued_per_member INTEGER NOT NULL DEFAULT 0;
+`
+
+const createRolePoliciesTableIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS role_policies (
+role_id TEXT NOT NULL PRIMARY KEY,
+max_pixels INTEGER NOT NULL,
+max_steps INTEGER NOT NULL,
+allow_hires INTEGER NOT NULL,
+allow_upscale INTEGER NOT NULL,
+max_batch INTEGER NOT NULL
+);`
+
+const addGenerationGuildColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN guild_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS generation_guild_member_index
+ON image_generations(guild_id, member_id, created_at);
+`
+
+// The primary key changes to include the guild, which needs a rebuilt table.
+// Existing settings become the global row that new guilds start from.
+const addSettingsGuildColumnQuery string = `
+CREATE TABLE default_settings_new (
+guild_id TEXT NOT NULL DEFAULT '',
+member_id TEXT NOT NULL,
+width INTEGER NOT NULL,
+height INTEGER NOT NULL,
+batch_count INTEGER NOT NULL DEFAULT 0,
+batch_size INTEGER NOT NULL DEFAULT 0,
+negative_prompt TEXT NOT NULL DEFAULT '',
+default_steps INTEGER NOT NULL DEFAULT 0,
+max_steps INTEGER NOT NULL DEFAULT 0,
+default_cfg_scale REAL NOT NULL DEFAULT 0,
+max_cfg_scale REAL NOT NULL DEFAULT 0,
+max_dimension INTEGER NOT NULL DEFAULT 0,
+max_queue_length INTEGER NOT NULL DEFAULT 0,
+max_queued_per_member INTEGER NOT NULL DEFAULT 0,
+PRIMARY KEY (guild_id, member_id)
+);
+
+INSERT INTO default_settings_new (guild_id, member_id, width, height, batch_count, batch_size, negative_prompt, default_steps, max_steps, default_cfg_scale, max_cfg_scale, max_dimension, max_queue_length, max_queued_per_member)
+SELECT '', member_id, width, height, batch_count, batch_size, negative_prompt, default_steps, max_steps, default_cfg_scale, max_cfg_scale, max_dimension, max_queue_length, max_queued_per_member FROM default_settings;
+
+DROP TABLE default_settings;
+
+ALTER TABLE default_settings_new RENAME TO default_settings;
+`
+
+const addRolePolicyGuildColumnQuery string = `
+ALTER TABLE role_policies ADD COLUMN guild_id TEXT NOT NULL DEFAULT '';
+`
+
+const createChannelRulesTableIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS channel_rules (
+guild_id TEXT NOT NULL,
+channel_id TEXT NOT NULL,
+allowed INTEGER NOT NULL,
+PRIMARY KEY (guild_id, channel_id)
+);`
+
+const addSettingsNSFWColumnsQuery string = `
+ALTER TABLE default_settings ADD COLUMN nsfw_keywords TEXT NOT NULL DEFAULT '';
+ALTER TABLE default_settings ADD COLUMN nsfw_action TEXT NOT NULL DEFAULT '';
+`
+
+const addGenerationNSFWColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN nsfw INTEGER NOT NULL DEFAULT 0;
+`
+
+const createModerationTablesIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS moderation_rules (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+guild_id TEXT NOT NULL,
+pattern TEXT NOT NULL,
+is_regex INTEGER NOT NULL,
+action TEXT NOT NULL,
+replacement TEXT NOT NULL,
+created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS moderation_hits (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+guild_id TEXT NOT NULL,
+member_id TEXT NOT NULL,
+rule_id INTEGER NOT NULL,
+pattern TEXT NOT NULL,
+action TEXT NOT NULL,
+prompt TEXT NOT NULL,
+created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS moderation_hit_guild_index
+ON moderation_hits(guild_id, id);
+`
+
+const addQuotaColumnsQuery string = `
+ALTER TABLE role_policies ADD COLUMN generations_per_hour INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE role_policies ADD COLUMN daily_gpu_seconds INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE image_generations ADD COLUMN gpu_seconds REAL NOT NULL DEFAULT 0;
+`
+
+const createStylesTableIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS styles (
+guild_id TEXT NOT NULL,
+member_id TEXT NOT NULL,
+name TEXT NOT NULL COLLATE NOCASE,
+prompt TEXT NOT NULL,
+negative_prompt TEXT NOT NULL,
+created_at DATETIME NOT NULL,
+PRIMARY KEY (guild_id, member_id, name)
+);
+
+ALTER TABLE image_generations ADD COLUMN styles TEXT NOT NULL DEFAULT '';
+`
+
+const addVariationStrengthColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN variation_strength REAL NOT NULL DEFAULT 0;
+`
+
+const addResultSourceColumnsQuery string = `
+ALTER TABLE image_generations ADD COLUMN upscaler TEXT NOT NULL DEFAULT '';
+ALTER TABLE image_generations ADD COLUMN source_id INTEGER NOT NULL DEFAULT 0;
+`
+
+const addResultOwnershipColumnsQuery string = `
+ALTER TABLE image_generations ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN owner_only_buttons BOOLEAN NOT NULL DEFAULT 0;
+`
+
+const createFavoritesTablesIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS favorites (
+generation_id INTEGER NOT NULL,
+guild_id TEXT NOT NULL,
+member_id TEXT NOT NULL,
+created_at DATETIME NOT NULL,
+PRIMARY KEY (generation_id, member_id)
+);
+
+CREATE INDEX IF NOT EXISTS favorite_guild_index
+ON favorites(guild_id, created_at);
+
+CREATE TABLE IF NOT EXISTS showcased_generations (
+generation_id INTEGER PRIMARY KEY,
+guild_id TEXT NOT NULL,
+created_at DATETIME NOT NULL
+);
+
+ALTER TABLE default_settings ADD COLUMN showcase_channel_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE default_settings ADD COLUMN showcase_threshold INTEGER NOT NULL DEFAULT 5;
+`
+
+const createAPIKeysTableIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS api_keys (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name TEXT NOT NULL UNIQUE,
+guild_id TEXT NOT NULL,
+key_hash TEXT NOT NULL UNIQUE,
+created_at DATETIME NOT NULL
+);
+`
+
+const addGenerationCountColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN generations INTEGER NOT NULL DEFAULT 1;
+`
+
 type migration struct {
 	migrationName  string
 	migrationQuery string
@@ -104,6 +312,26 @@ var migrations = []migration{
 	{migrationName: "add hires reisze columns2", migrationQuery: addHiresMissingColumnsQuery},
 	{migrationName: "add settings batch columns", migrationQuery: addSettingsBatchColumnsQuery},
 	{migrationName: "add generation batch count column", migrationQuery: addGenerationBatchSizeColumnQuery},
+	{migrationName: "add generation channel column", migrationQuery: addGenerationChannelColumnQuery},
+	{migrationName: "add generation member index", migrationQuery: createMemberIndexIfNotExistsQuery},
+	{migrationName: "create generation search index", migrationQuery: createGenerationSearchIndexQuery},
+	{migrationName: "add settings limit columns", migrationQuery: addSettingsLimitColumnsQuery},
+	{migrationName: "create role policies table", migrationQuery: createRolePoliciesTableIfNotExistsQuery},
+	{migrationName: "add generation guild column", migrationQuery: addGenerationGuildColumnQuery},
+	{migrationName: "add settings guild column", migrationQuery: addSettingsGuildColumnQuery},
+	{migrationName: "add role policy guild column", migrationQuery: addRolePolicyGuildColumnQuery},
+	{migrationName: "create channel rules table", migrationQuery: createChannelRulesTableIfNotExistsQuery},
+	{migrationName: "add settings nsfw columns", migrationQuery: addSettingsNSFWColumnsQuery},
+	{migrationName: "add generation nsfw column", migrationQuery: addGenerationNSFWColumnQuery},
+	{migrationName: "create moderation tables", migrationQuery: createModerationTablesIfNotExistsQuery},
+	{migrationName: "add quota columns", migrationQuery: addQuotaColumnsQuery},
+	{migrationName: "create styles table", migrationQuery: createStylesTableIfNotExistsQuery},
+	{migrationName: "add variation strength column", migrationQuery: addVariationStrengthColumnQuery},
+	{migrationName: "add result source columns", migrationQuery: addResultSourceColumnsQuery},
+	{migrationName: "add result ownership columns", migrationQuery: addResultOwnershipColumnsQuery},
+	{migrationName: "create favorites tables", migrationQuery: createFavoritesTablesIfNotExistsQuery},
+	{migrationName: "create api keys table", migrationQuery: createAPIKeysTableIfNotExistsQuery},
+	{migrationName: "add generation count column", migrationQuery: addGenerationCountColumnQuery},
 }
 
 func New(ctx context.Context) (*sql.DB, error) {
@@ -142,13 +370,14 @@ func migrate(ctx context.Context, db *sql.DB) error {
 
 	requiredMigration := len(migrations)
 
-	log.Printf("Current DB version: %v, required DB version: %v\n", currentMigration, requiredMigration)
+	logging.FromContext(ctx).Info("Checking DB version", "current", currentMigration, "required", requiredMigration)
 
 	if currentMigration < requiredMigration {
 		for migrationNum := currentMigration + 1; migrationNum <= requiredMigration; migrationNum++ {
 			err = execMigration(ctx, db, migrationNum)
 			if err != nil {
-				log.Printf("Error running migration %v '%v'\n", migrationNum, migrations[migrationNum-1].migrationName)
+				logging.FromContext(ctx).Error("Error running migration",
+					"migration", migrationNum, "name", migrations[migrationNum-1].migrationName, "error", err)
 
 				return err
 			}
@@ -159,7 +388,7 @@ func migrate(ctx context.Context, db *sql.DB) error {
 }
 
 func execMigration(ctx context.Context, db *sql.DB, migrationNum int) error {
-	log.Printf("Running migration %v '%v'\n", migrationNum, migrations[migrationNum-1].migrationName)
+	logging.FromContext(ctx).Info("Running migration", "migration", migrationNum, "name", migrations[migrationNum-1].migrationName)
 
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
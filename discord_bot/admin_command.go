@@ -0,0 +1,995 @@
+package discord_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/moderation"
+	"kinshi_vision_bot/repositories"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// adminPermissions are the permissions that grant access to the admin command,
+// besides the optional admin role.
+const adminPermissions int64 = discordgo.PermissionAdministrator | discordgo.PermissionManageServer
+
+const adminSettingDisplaySize = 200
+
+var policyMinValue float64 = 0
+
+var moderationHitsMinCount float64 = 1
+
+const (
+	moderationHitsMaxCount     = 25
+	moderationHitsDefaultCount = 10
+	moderationPromptSize       = 80
+)
+
+var channelRuleOption = &discordgo.ApplicationCommandOption{
+	Type:         discordgo.ApplicationCommandOptionChannel,
+	Name:         "channel",
+	Description:  "The channel, threads follow the rule of their channel",
+	Required:     true,
+	ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+}
+
+type adminSetting struct {
+	name        string
+	description string
+	get         func(settings *entities.DefaultSettings) string
+	set         func(settings *entities.DefaultSettings, value string) error
+}
+
+var adminSettings = []adminSetting{
+	{
+		name:        "negative_prompt",
+		description: "Negative prompt used when none is given",
+		get:         func(settings *entities.DefaultSettings) string { return settings.NegativePrompt },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			settings.NegativePrompt = value
+
+			return nil
+		},
+	},
+	{
+		name:        "default_steps",
+		description: "Sampling steps used when --step is not given",
+		get:         func(settings *entities.DefaultSettings) string { return strconv.Itoa(settings.DefaultSteps) },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseIntSetting(value, &settings.DefaultSteps)
+		},
+	},
+	{
+		name:        "max_steps",
+		description: "Highest accepted --step value",
+		get:         func(settings *entities.DefaultSettings) string { return strconv.Itoa(settings.MaxSteps) },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseIntSetting(value, &settings.MaxSteps)
+		},
+	},
+	{
+		name:        "default_cfg_scale",
+		description: "CFG scale used when --cfgscale is not given",
+		get: func(settings *entities.DefaultSettings) string {
+			return strconv.FormatFloat(settings.DefaultCFGScale, 'f', 1, 64)
+		},
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseFloatSetting(value, &settings.DefaultCFGScale)
+		},
+	},
+	{
+		name:        "max_cfg_scale",
+		description: "Highest accepted --cfgscale value",
+		get: func(settings *entities.DefaultSettings) string {
+			return strconv.FormatFloat(settings.MaxCFGScale, 'f', 1, 64)
+		},
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseFloatSetting(value, &settings.MaxCFGScale)
+		},
+	},
+	{
+		name:        "max_dimension",
+		description: "Largest width or height in pixels before hires.fix",
+		get:         func(settings *entities.DefaultSettings) string { return strconv.Itoa(settings.MaxDimension) },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseIntSetting(value, &settings.MaxDimension)
+		},
+	},
+	{
+		name:        "max_queue_length",
+		description: "Number of invisions that can wait in line",
+		get:         func(settings *entities.DefaultSettings) string { return strconv.Itoa(settings.MaxQueueLength) },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseIntSetting(value, &settings.MaxQueueLength)
+		},
+	},
+	{
+		name:        "max_queued_per_member",
+		description: "Number of invisions a single member can have waiting in line",
+		get:         func(settings *entities.DefaultSettings) string { return strconv.Itoa(settings.MaxQueuedPerMember) },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseIntSetting(value, &settings.MaxQueuedPerMember)
+		},
+	},
+	{
+		name:        "nsfw_keywords",
+		description: "Comma separated words that flag a prompt as NSFW outside of age-restricted channels, none to clear",
+		get:         func(settings *entities.DefaultSettings) string { return settings.NSFWKeywords },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			if strings.EqualFold(strings.TrimSpace(value), "none") {
+				value = ""
+			}
+
+			settings.NSFWKeywords = value
+
+			return nil
+		},
+	},
+	{
+		name:        "nsfw_action",
+		description: "What happens to flagged invisions outside of age-restricted channels: spoiler or block",
+		get:         func(settings *entities.DefaultSettings) string { return settings.NSFWAction },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			settings.NSFWAction = strings.ToLower(strings.TrimSpace(value))
+
+			return nil
+		},
+	},
+	{
+		name:        "owner_only_buttons",
+		description: "Only the member who asked for a result and moderators can use its buttons: yes or no",
+		get:         func(settings *entities.DefaultSettings) string { return formatBoolSetting(settings.OwnerOnlyButtons) },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseBoolSetting(value, &settings.OwnerOnlyButtons)
+		},
+	},
+	{
+		name:        "showcase_channel",
+		description: "Channel that highly favorited invisions are reposted to, none to turn it off",
+		get: func(settings *entities.DefaultSettings) string {
+			if settings.ShowcaseChannelID == "" {
+				return "none"
+			}
+
+			return "<#" + settings.ShowcaseChannelID + ">"
+		},
+		set: func(settings *entities.DefaultSettings, value string) error {
+			value = strings.TrimSpace(value)
+			if strings.EqualFold(value, "none") {
+				settings.ShowcaseChannelID = ""
+
+				return nil
+			}
+
+			channelID := strings.TrimSuffix(strings.TrimPrefix(value, "<#"), ">")
+			if _, err := strconv.ParseUint(channelID, 10, 64); err != nil {
+				return fmt.Errorf("%q is not a channel", value)
+			}
+
+			settings.ShowcaseChannelID = channelID
+
+			return nil
+		},
+	},
+	{
+		name:        "showcase_threshold",
+		description: "Favorites an invision needs to be reposted to the showcase channel",
+		get:         func(settings *entities.DefaultSettings) string { return strconv.Itoa(settings.ShowcaseThreshold) },
+		set: func(settings *entities.DefaultSettings, value string) error {
+			return parseIntSetting(value, &settings.ShowcaseThreshold)
+		},
+	},
+}
+
+func parseIntSetting(value string, target *int) error {
+	parsed, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not a whole number", value)
+	}
+
+	*target = parsed
+
+	return nil
+}
+
+func parseFloatSetting(value string, target *float64) error {
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", value)
+	}
+
+	*target = parsed
+
+	return nil
+}
+
+func parseBoolSetting(value string, target *bool) error {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "true", "on":
+		*target = true
+	case "no", "false", "off":
+		*target = false
+	default:
+		return fmt.Errorf("%q is not yes or no", value)
+	}
+
+	return nil
+}
+
+func formatBoolSetting(value bool) string {
+	if value {
+		return "yes"
+	}
+
+	return "no"
+}
+
+func findAdminSetting(name string) (*adminSetting, bool) {
+	for idx := range adminSettings {
+		if adminSettings[idx].name == name {
+			return &adminSettings[idx], true
+		}
+	}
+
+	return nil, false
+}
+
+func (b *botImpl) invisionAdminCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_admin"
+	}
+
+	return b.invisionCommand + "_admin"
+}
+
+func (b *botImpl) addInvisionAdminCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionAdminCommandString())
+
+	settingChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(adminSettings))
+
+	for _, setting := range adminSettings {
+		settingChoices = append(settingChoices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  setting.name,
+			Value: setting.name,
+		})
+	}
+
+	defaultPermissions := adminPermissions
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:                     b.invisionAdminCommandString(),
+		Description:              "Change the bot configuration",
+		DefaultMemberPermissions: &defaultPermissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "settings",
+				Description: "Defaults and limits of this server",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "show",
+						Description: "Show the current settings",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "set",
+						Description: "Change a setting, it applies to every invision processed from now on",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "name",
+								Description: "The setting to change",
+								Required:    true,
+								Choices:     settingChoices,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "value",
+								Description: "The new value",
+								Required:    true,
+							},
+						},
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "policy",
+				Description: "Limits for expensive features per role",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "set",
+						Description: "Create or change the policy of a role, omitted options keep their value",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionRole,
+								Name:        "role",
+								Description: "The role to limit, use @everyone for the default policy",
+								Required:    true,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionInteger,
+								Name:        "max_pixels",
+								Description: "Highest output width x height, 0 for unlimited",
+								MinValue:    &policyMinValue,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionInteger,
+								Name:        "max_steps",
+								Description: "Highest sampling steps, 0 for unlimited",
+								MinValue:    &policyMinValue,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionBoolean,
+								Name:        "allow_hires",
+								Description: "Whether hires.fix can be used",
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionBoolean,
+								Name:        "allow_upscale",
+								Description: "Whether images can be upscaled",
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionInteger,
+								Name:        "max_batch",
+								Description: "Highest number of images per invision, 0 for unlimited",
+								MinValue:    &policyMinValue,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionInteger,
+								Name:        "generations_per_hour",
+								Description: "Invisions a member can start per hour, 0 for unlimited",
+								MinValue:    &policyMinValue,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionInteger,
+								Name:        "daily_gpu_seconds",
+								Description: "Seconds of generation time per member per day, 0 for unlimited",
+								MinValue:    &policyMinValue,
+							},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "remove",
+						Description: "Remove the policy of a role",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionRole,
+								Name:        "role",
+								Description: "The role to remove the policy of",
+								Required:    true,
+							},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "list",
+						Description: "List the role policies",
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "channel",
+				Description: "Channels where invisions can be requested",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "allow",
+						Description: "Allow a channel, once a channel is allowed all other channels are denied",
+						Options:     []*discordgo.ApplicationCommandOption{channelRuleOption},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "deny",
+						Description: "Deny a channel",
+						Options:     []*discordgo.ApplicationCommandOption{channelRuleOption},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "clear",
+						Description: "Remove the rule of a channel",
+						Options:     []*discordgo.ApplicationCommandOption{channelRuleOption},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "list",
+						Description: "List the channel rules",
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "moderation",
+				Description: "Terms that are not allowed in prompts",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "add",
+						Description: "Add a moderation rule",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "pattern",
+								Description: "A term, matched as a whole word, or a regular expression",
+								Required:    true,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "action",
+								Description: "Reject the prompt, or replace the matching text",
+								Required:    true,
+								Choices: []*discordgo.ApplicationCommandOptionChoice{
+									{Name: moderation.ActionReject, Value: moderation.ActionReject},
+									{Name: moderation.ActionRewrite, Value: moderation.ActionRewrite},
+								},
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionBoolean,
+								Name:        "regex",
+								Description: "Whether the pattern is a regular expression",
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "replacement",
+								Description: "The text that replaces a match when rewriting, empty by default",
+							},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "remove",
+						Description: "Remove a moderation rule",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionInteger,
+								Name:        "id",
+								Description: "The ID of the rule, as shown by the list command",
+								Required:    true,
+							},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "list",
+						Description: "List the moderation rules",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "hits",
+						Description: "Review the prompts that recently matched a rule",
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionInteger,
+								Name:        "count",
+								Description: "How many hits to show",
+								MinValue:    &moderationHitsMinCount,
+								MaxValue:    moderationHitsMaxCount,
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionAdminCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// isAdmin checks the member of an interaction against the admin permissions and the admin role.
+// Discord already hides the command from other members, this guards against changed overrides.
+func (b *botImpl) isAdmin(member *discordgo.Member) bool {
+	if member == nil {
+		return false
+	}
+
+	if member.Permissions&adminPermissions != 0 {
+		return true
+	}
+
+	if b.adminRoleID == "" {
+		return false
+	}
+
+	for _, roleID := range member.Roles {
+		if roleID == b.adminRoleID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// messageContentLimit is the maximum length of a Discord message.
+const messageContentLimit = 2000
+
+func (b *botImpl) respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	if runes := []rune(content); len(runes) > messageContentLimit {
+		content = string(runes[:messageContentLimit-1]) + "…"
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// subCommandOptions returns the subcommand group and subcommand names of an interaction,
+// together with the options of the subcommand.
+func subCommandOptions(data discordgo.ApplicationCommandInteractionData) (string, string, map[string]*discordgo.ApplicationCommandInteractionDataOption) {
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption)
+
+	if len(data.Options) == 0 || data.Options[0].Type != discordgo.ApplicationCommandOptionSubCommandGroup {
+		return "", "", optionMap
+	}
+
+	group := data.Options[0]
+
+	if len(group.Options) == 0 {
+		return group.Name, "", optionMap
+	}
+
+	subCommand := group.Options[0]
+
+	for _, opt := range subCommand.Options {
+		optionMap[opt.Name] = opt
+	}
+
+	return group.Name, subCommand.Name, optionMap
+}
+
+func (b *botImpl) processInvisionAdminCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !b.isAdmin(i.Member) {
+		b.respondEphemeral(s, i, "You are not allowed to change the bot configuration.")
+
+		return
+	}
+
+	group, subCommand, optionMap := subCommandOptions(i.ApplicationCommandData())
+
+	var content string
+
+	switch group + " " + subCommand {
+	case "settings show":
+		content = b.adminSettingsShow(i.GuildID)
+	case "settings set":
+		content = b.adminSettingsSet(i.Member.User.ID, i.GuildID, optionMap["name"].StringValue(), optionMap["value"].StringValue())
+	case "policy set":
+		content = b.adminPolicySet(i.Member.User.ID, i.GuildID, optionMap)
+	case "policy remove":
+		content = b.adminPolicyRemove(i.Member.User.ID, i.GuildID, optionMap["role"].RoleValue(nil, "").ID)
+	case "policy list":
+		content = b.adminPolicyList(i.GuildID)
+	case "channel allow":
+		content = b.adminChannelSet(i.Member.User.ID, i.GuildID, optionMap["channel"].ChannelValue(nil).ID, true)
+	case "channel deny":
+		content = b.adminChannelSet(i.Member.User.ID, i.GuildID, optionMap["channel"].ChannelValue(nil).ID, false)
+	case "channel clear":
+		content = b.adminChannelClear(i.Member.User.ID, i.GuildID, optionMap["channel"].ChannelValue(nil).ID)
+	case "channel list":
+		content = b.adminChannelList(i.GuildID)
+	case "moderation add":
+		content = b.adminModerationAdd(i.Member.User.ID, i.GuildID, optionMap)
+	case "moderation remove":
+		content = b.adminModerationRemove(i.Member.User.ID, i.GuildID, optionMap["id"].IntValue())
+	case "moderation list":
+		content = b.adminModerationList(i.GuildID)
+	case "moderation hits":
+		content = b.adminModerationHits(i.GuildID, optionMap)
+	default:
+		b.logger.Warn("Unknown admin subcommand", "group", group, "subcommand", subCommand)
+
+		content = "Unknown admin command."
+	}
+
+	b.respondEphemeral(s, i, content)
+}
+
+func (b *botImpl) adminSettingsShow(guildID string) string {
+	settings, err := b.invisionQueue.GetBotDefaultSettings(guildID)
+	if err != nil {
+		b.logger.Error("Error getting default settings for admin command", "error", err)
+
+		return "I'm sorry, but I couldn't read the settings."
+	}
+
+	var content strings.Builder
+
+	content.WriteString("Current settings:\n")
+
+	for _, setting := range adminSettings {
+		value := setting.get(settings)
+		if len([]rune(value)) > adminSettingDisplaySize {
+			value = string([]rune(value)[:adminSettingDisplaySize]) + "…"
+		}
+
+		fmt.Fprintf(&content, "- **%s**: `%s`\n  %s\n", setting.name, value, setting.description)
+	}
+
+	return content.String()
+}
+
+func (b *botImpl) adminSettingsSet(memberID, guildID, name, value string) string {
+	setting, ok := findAdminSetting(name)
+	if !ok {
+		return fmt.Sprintf("Unknown setting %q.", name)
+	}
+
+	current, err := b.invisionQueue.GetBotDefaultSettings(guildID)
+	if err != nil {
+		b.logger.Error("Error getting default settings for admin command", "error", err)
+
+		return "I'm sorry, but I couldn't read the settings."
+	}
+
+	// work on a copy, so a rejected value doesn't leak into the live settings
+	updated := *current
+
+	err = setting.set(&updated, value)
+	if err != nil {
+		return fmt.Sprintf("Invalid value for %s: %v", name, err)
+	}
+
+	_, err = b.invisionQueue.UpdateDefaultSettings(guildID, &updated)
+	if err != nil {
+		b.logger.Warn("Error updating default settings", "setting", name, "error", err)
+
+		if errors.Is(err, invision_queue.ErrInvalidDefaultConfig) {
+			return fmt.Sprintf("Invalid value for %s: %v", name, err)
+		}
+
+		return "I'm sorry, but I couldn't save the setting."
+	}
+
+	b.logger.Info("Admin changed setting", "guild_id", guildID, "member_id", memberID, "setting", name, "value", value)
+
+	return fmt.Sprintf("Updated **%s** to `%s`.", name, setting.get(&updated))
+}
+
+// roleMention formats a role for display, the @everyone role can't be mentioned by ID.
+func roleMention(guildID, roleID string) string {
+	if roleID == guildID {
+		return "@everyone"
+	}
+
+	return "<@&" + roleID + ">"
+}
+
+func limitString(limit int) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+
+	return strconv.Itoa(limit)
+}
+
+func policySummary(guildID string, rolePolicy *entities.RolePolicy) string {
+	return fmt.Sprintf("%s: max pixels %s, max steps %s, max batch %s, hires.fix %t, upscale %t, per hour %s, daily GPU seconds %s",
+		roleMention(guildID, rolePolicy.RoleID),
+		limitString(rolePolicy.MaxPixels),
+		limitString(rolePolicy.MaxSteps),
+		limitString(rolePolicy.MaxBatch),
+		rolePolicy.AllowHires,
+		rolePolicy.AllowUpscale,
+		limitString(rolePolicy.GenerationsPerHour),
+		limitString(rolePolicy.DailyGPUSeconds))
+}
+
+func (b *botImpl) adminPolicySet(memberID, guildID string, optionMap map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+	ctx := context.Background()
+	roleID := optionMap["role"].RoleValue(nil, "").ID
+
+	rolePolicy, err := b.rolePolicyRepo.GetByRoleID(ctx, roleID)
+	if err != nil {
+		var notFoundErr *repositories.NotFoundError
+		if !errors.As(err, &notFoundErr) {
+			b.logger.Error("Error getting role policy for admin command", "role_id", roleID, "error", err)
+
+			return "I'm sorry, but I couldn't read the role policy."
+		}
+
+		// a new policy starts without limits, so only the given options restrict the role
+		rolePolicy = &entities.RolePolicy{
+			RoleID:       roleID,
+			GuildID:      guildID,
+			AllowHires:   true,
+			AllowUpscale: true,
+		}
+	}
+
+	if option, ok := optionMap["max_pixels"]; ok {
+		rolePolicy.MaxPixels = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["max_steps"]; ok {
+		rolePolicy.MaxSteps = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["allow_hires"]; ok {
+		rolePolicy.AllowHires = option.BoolValue()
+	}
+
+	if option, ok := optionMap["allow_upscale"]; ok {
+		rolePolicy.AllowUpscale = option.BoolValue()
+	}
+
+	if option, ok := optionMap["max_batch"]; ok {
+		rolePolicy.MaxBatch = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["generations_per_hour"]; ok {
+		rolePolicy.GenerationsPerHour = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["daily_gpu_seconds"]; ok {
+		rolePolicy.DailyGPUSeconds = int(option.IntValue())
+	}
+
+	rolePolicy, err = b.rolePolicyRepo.Upsert(ctx, rolePolicy)
+	if err != nil {
+		b.logger.Error("Error saving role policy", "role_id", roleID, "error", err)
+
+		return "I'm sorry, but I couldn't save the role policy."
+	}
+
+	b.logger.Info("Admin changed role policy", "guild_id", guildID, "member_id", memberID, "role_id", roleID)
+
+	return "Updated the policy of " + policySummary(guildID, rolePolicy)
+}
+
+func (b *botImpl) adminPolicyRemove(memberID, guildID, roleID string) string {
+	err := b.rolePolicyRepo.Delete(context.Background(), roleID)
+	if err != nil {
+		var notFoundErr *repositories.NotFoundError
+		if errors.As(err, &notFoundErr) {
+			return fmt.Sprintf("%s has no policy.", roleMention(guildID, roleID))
+		}
+
+		b.logger.Error("Error removing role policy", "role_id", roleID, "error", err)
+
+		return "I'm sorry, but I couldn't remove the role policy."
+	}
+
+	b.logger.Info("Admin removed role policy", "guild_id", guildID, "member_id", memberID, "role_id", roleID)
+
+	return fmt.Sprintf("Removed the policy of %s.", roleMention(guildID, roleID))
+}
+
+func (b *botImpl) adminPolicyList(guildID string) string {
+	rolePolicies, err := b.rolePolicyRepo.GetByGuildID(context.Background(), guildID)
+	if err != nil {
+		b.logger.Error("Error listing role policies", "error", err)
+
+		return "I'm sorry, but I couldn't read the role policies."
+	}
+
+	if len(rolePolicies) == 0 {
+		return "No role has a policy, everyone can use every feature."
+	}
+
+	var content strings.Builder
+
+	content.WriteString("Role policies, members get the most permissive limits of all their roles:\n")
+
+	for _, rolePolicy := range rolePolicies {
+		content.WriteString("- " + policySummary(guildID, rolePolicy) + "\n")
+	}
+
+	return content.String()
+}
+
+func (b *botImpl) adminChannelSet(memberID, guildID, channelID string, allowed bool) string {
+	_, err := b.channelRuleRepo.Upsert(context.Background(), &entities.ChannelRule{
+		GuildID:   guildID,
+		ChannelID: channelID,
+		Allowed:   allowed,
+	})
+	if err != nil {
+		b.logger.Error("Error saving channel rule", "channel_id", channelID, "error", err)
+
+		return "I'm sorry, but I couldn't save the channel rule."
+	}
+
+	b.logger.Info("Admin changed channel rule", "guild_id", guildID, "member_id", memberID, "channel_id", channelID, "allowed", allowed)
+
+	if allowed {
+		return fmt.Sprintf("Invisions are allowed in <#%s>.", channelID)
+	}
+
+	return fmt.Sprintf("Invisions are denied in <#%s>.", channelID)
+}
+
+func (b *botImpl) adminChannelClear(memberID, guildID, channelID string) string {
+	err := b.channelRuleRepo.Delete(context.Background(), guildID, channelID)
+	if err != nil {
+		var notFoundErr *repositories.NotFoundError
+		if errors.As(err, &notFoundErr) {
+			return fmt.Sprintf("<#%s> has no rule.", channelID)
+		}
+
+		b.logger.Error("Error removing channel rule", "channel_id", channelID, "error", err)
+
+		return "I'm sorry, but I couldn't remove the channel rule."
+	}
+
+	b.logger.Info("Admin removed channel rule", "guild_id", guildID, "member_id", memberID, "channel_id", channelID)
+
+	return fmt.Sprintf("Removed the rule of <#%s>.", channelID)
+}
+
+func (b *botImpl) adminChannelList(guildID string) string {
+	rules, err := b.channelRuleRepo.GetByGuildID(context.Background(), guildID)
+	if err != nil {
+		b.logger.Error("Error listing channel rules", "error", err)
+
+		return "I'm sorry, but I couldn't read the channel rules."
+	}
+
+	if len(rules) == 0 {
+		return "No channel has a rule, invisions are allowed everywhere."
+	}
+
+	allowed := make([]string, 0)
+	denied := make([]string, 0)
+
+	for _, rule := range rules {
+		if rule.Allowed {
+			allowed = append(allowed, "<#"+rule.ChannelID+">")
+		} else {
+			denied = append(denied, "<#"+rule.ChannelID+">")
+		}
+	}
+
+	var content strings.Builder
+
+	if len(allowed) > 0 {
+		content.WriteString("Only allowed in: " + strings.Join(allowed, ", ") + "\n")
+	}
+
+	if len(denied) > 0 {
+		content.WriteString("Denied in: " + strings.Join(denied, ", ") + "\n")
+	}
+
+	return content.String()
+}
+
+func moderationRuleSummary(rule *entities.ModerationRule) string {
+	kind := "term"
+	if rule.IsRegex {
+		kind = "regex"
+	}
+
+	summary := fmt.Sprintf("#%d %s `%s`: %s", rule.ID, kind, rule.Pattern, rule.Action)
+	if rule.Action == moderation.ActionRewrite {
+		summary += fmt.Sprintf(" to `%s`", rule.Replacement)
+	}
+
+	return summary
+}
+
+func (b *botImpl) adminModerationAdd(memberID, guildID string, optionMap map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+	rule := &entities.ModerationRule{
+		GuildID: guildID,
+		Pattern: optionMap["pattern"].StringValue(),
+		Action:  optionMap["action"].StringValue(),
+	}
+
+	if option, ok := optionMap["regex"]; ok {
+		rule.IsRegex = option.BoolValue()
+	}
+
+	if option, ok := optionMap["replacement"]; ok {
+		rule.Replacement = option.StringValue()
+	}
+
+	err := moderation.ValidateRule(rule)
+	if err != nil {
+		return fmt.Sprintf("Invalid rule: %v", err)
+	}
+
+	rule, err = b.moderationRuleRepo.Create(context.Background(), rule)
+	if err != nil {
+		b.logger.Error("Error saving moderation rule", "error", err)
+
+		return "I'm sorry, but I couldn't save the moderation rule."
+	}
+
+	b.logger.Info("Admin added moderation rule", "guild_id", guildID, "member_id", memberID, "rule_id", rule.ID)
+
+	return "Added " + moderationRuleSummary(rule)
+}
+
+func (b *botImpl) adminModerationRemove(memberID, guildID string, ruleID int64) string {
+	err := b.moderationRuleRepo.Delete(context.Background(), guildID, ruleID)
+	if err != nil {
+		var notFoundErr *repositories.NotFoundError
+		if errors.As(err, &notFoundErr) {
+			return fmt.Sprintf("There is no moderation rule #%d.", ruleID)
+		}
+
+		b.logger.Error("Error removing moderation rule", "rule_id", ruleID, "error", err)
+
+		return "I'm sorry, but I couldn't remove the moderation rule."
+	}
+
+	b.logger.Info("Admin removed moderation rule", "guild_id", guildID, "member_id", memberID, "rule_id", ruleID)
+
+	return fmt.Sprintf("Removed moderation rule #%d.", ruleID)
+}
+
+func (b *botImpl) adminModerationList(guildID string) string {
+	rules, err := b.moderationRuleRepo.GetByGuildID(context.Background(), guildID)
+	if err != nil {
+		b.logger.Error("Error listing moderation rules", "error", err)
+
+		return "I'm sorry, but I couldn't read the moderation rules."
+	}
+
+	if len(rules) == 0 {
+		return "There are no moderation rules."
+	}
+
+	var content strings.Builder
+
+	content.WriteString("Moderation rules:\n")
+
+	for _, rule := range rules {
+		content.WriteString("- " + moderationRuleSummary(rule) + "\n")
+	}
+
+	return content.String()
+}
+
+func (b *botImpl) adminModerationHits(guildID string, optionMap map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+	count := moderationHitsDefaultCount
+
+	if option, ok := optionMap["count"]; ok {
+		count = int(option.IntValue())
+	}
+
+	hits, err := b.moderationHitRepo.ListRecent(context.Background(), guildID, count)
+	if err != nil {
+		b.logger.Error("Error listing moderation hits", "error", err)
+
+		return "I'm sorry, but I couldn't read the moderation hits."
+	}
+
+	if len(hits) == 0 {
+		return "No prompt has matched a moderation rule yet."
+	}
+
+	var content strings.Builder
+
+	content.WriteString("Recent moderation hits:\n")
+
+	for _, hit := range hits {
+		prompt := hit.Prompt
+		if len([]rune(prompt)) > moderationPromptSize {
+			prompt = string([]rune(prompt)[:moderationPromptSize]) + "…"
+		}
+
+		fmt.Fprintf(&content, "- <t:%d:R> <@%s> %s by #%d `%s`: `%s`\n",
+			hit.CreatedAt.Unix(), hit.MemberID, hit.Action, hit.RuleID, hit.Pattern, strings.ReplaceAll(prompt, "`", "'"))
+	}
+
+	return content.String()
+}
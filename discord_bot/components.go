@@ -0,0 +1,159 @@
+package discord_bot
+
+import (
+	"kinshi_vision_bot/invision_queue"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// upscalers are offered to upscale a single result again. They ship with the WebUI.
+var upscalers = []string{invision_queue.DefaultUpscaler, "R-ESRGAN 4x+", "R-ESRGAN 4x+ Anime6B", "SwinIR_4x", "LDSR", "Lanczos"}
+
+// gridComponents builds the variation and upscale buttons for a grid of imageCount images.
+// Discord allows five buttons per row, so the variation row keeps room for the re-roll button
+// and the upscale row for the edit button. The delete button gets a row of its own.
+func gridComponents(imageCount int) *[]discordgo.MessageComponent {
+	imageCount = min(imageCount, 4)
+
+	variationButtons := make([]discordgo.MessageComponent, 0, imageCount+1)
+	upscaleButtons := make([]discordgo.MessageComponent, 0, imageCount+1)
+	favoriteButtons := make([]discordgo.MessageComponent, 0, imageCount+1)
+
+	for idx := 1; idx <= imageCount; idx++ {
+		variationButtons = append(variationButtons, discordgo.Button{
+			Label:    strconv.Itoa(idx),
+			Style:    discordgo.SecondaryButton,
+			CustomID: "invision_variation_" + strconv.Itoa(idx),
+			Emoji: discordgo.ComponentEmoji{
+				Name: "♻️",
+			},
+		})
+
+		upscaleButtons = append(upscaleButtons, discordgo.Button{
+			Label:    strconv.Itoa(idx),
+			Style:    discordgo.SecondaryButton,
+			CustomID: "invision_upscale_" + strconv.Itoa(idx),
+			Emoji: discordgo.ComponentEmoji{
+				Name: "⬆️",
+			},
+		})
+
+		favoriteButtons = append(favoriteButtons, favoriteButton(idx, strconv.Itoa(idx)))
+	}
+
+	variationButtons = append(variationButtons, discordgo.Button{
+		Label:    "Re-roll",
+		Style:    discordgo.PrimaryButton,
+		CustomID: "invision_reroll",
+		Emoji: discordgo.ComponentEmoji{
+			Name: "🎲",
+		},
+	})
+
+	upscaleButtons = append(upscaleButtons, discordgo.Button{
+		Label:    "Edit",
+		Style:    discordgo.PrimaryButton,
+		CustomID: "invision_edit",
+		Emoji: discordgo.ComponentEmoji{
+			Name: "✏️",
+		},
+	})
+
+	return &[]discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: variationButtons},
+		discordgo.ActionsRow{Components: upscaleButtons},
+		discordgo.ActionsRow{Components: append(favoriteButtons, deleteButton())},
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{parametersButton()}},
+	}
+}
+
+// resultComponents builds the follow-up actions of a single result. The image is stored with
+// sort order 1, so the variation button works like the one of a grid image. Variations are left
+// out for img2img results, as they can't be regenerated from their prompt and seed.
+func resultComponents(canVary bool) *[]discordgo.MessageComponent {
+	buttons := make([]discordgo.MessageComponent, 0, 5)
+
+	if canVary {
+		buttons = append(buttons, discordgo.Button{
+			Label:    "Vary",
+			Style:    discordgo.SecondaryButton,
+			CustomID: "invision_variation_1",
+			Emoji: discordgo.ComponentEmoji{
+				Name: "♻️",
+			},
+		})
+	}
+
+	buttons = append(buttons,
+		discordgo.Button{
+			Label:    "img2img",
+			Style:    discordgo.SecondaryButton,
+			CustomID: "invision_img2img_1",
+			Emoji: discordgo.ComponentEmoji{
+				Name: "🖌️",
+			},
+		},
+		favoriteButton(1, "Favorite"),
+		parametersButton(),
+		deleteButton(),
+	)
+
+	upscalerOptions := make([]discordgo.SelectMenuOption, 0, len(upscalers))
+	for _, upscaler := range upscalers {
+		upscalerOptions = append(upscalerOptions, discordgo.SelectMenuOption{
+			Label: upscaler,
+			Value: upscaler,
+		})
+	}
+
+	return &[]discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: buttons},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:    "invision_upscaler",
+					Placeholder: "⬆️ Upscale again with...",
+					Options:     upscalerOptions,
+				},
+			},
+		},
+	}
+}
+
+// deleteButton removes a result, for the member who asked for it and moderators.
+func deleteButton() discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    "Delete",
+		Style:    discordgo.DangerButton,
+		CustomID: "invision_delete",
+		Emoji: discordgo.ComponentEmoji{
+			Name: "🗑️",
+		},
+	}
+}
+
+// favoriteButton adds the image with the given sort order to the favorites of whoever clicks it,
+// or removes it again.
+func favoriteButton(sortOrder int, label string) discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    label,
+		Style:    discordgo.SecondaryButton,
+		CustomID: "invision_favorite_" + strconv.Itoa(sortOrder),
+		Emoji: discordgo.ComponentEmoji{
+			Name: "⭐",
+		},
+	}
+}
+
+// parametersButton shows every stored parameter of a result and a command to make it again.
+func parametersButton() discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    "Parameters",
+		Style:    discordgo.SecondaryButton,
+		CustomID: "invision_parameters",
+		Emoji: discordgo.ComponentEmoji{
+			Name: "ℹ️",
+		},
+	}
+}
@@ -1,11 +1,23 @@
 package discord_bot
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"kinshi_vision_bot/entities"
 	"kinshi_vision_bot/invision_queue"
-	"log"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/moderation"
+	"kinshi_vision_bot/policy"
+	"kinshi_vision_bot/quota"
+	"kinshi_vision_bot/repositories/channel_rules"
+	"kinshi_vision_bot/repositories/favorites"
+	"kinshi_vision_bot/repositories/image_generations"
+	"kinshi_vision_bot/repositories/moderation_hits"
+	"kinshi_vision_bot/repositories/moderation_rules"
+	"kinshi_vision_bot/repositories/role_policies"
+	"kinshi_vision_bot/repositories/styles"
+	"log/slog"
 	"strconv"
 	"strings"
 
@@ -13,22 +25,49 @@ import (
 )
 
 type botImpl struct {
-	developmentMode    bool
-	botSession         *discordgo.Session
-	guildID            string
-	invisionQueue      invision_queue.Queue
-	registeredCommands []*discordgo.ApplicationCommand
-	invisionCommand    string
-	removeCommands     bool
+	developmentMode     bool
+	botSession          *discordgo.Session
+	guildIDs            []string
+	invisionQueue       invision_queue.Queue
+	imageGenerationRepo image_generations.Repository
+	rolePolicyRepo      role_policies.Repository
+	channelRuleRepo     channel_rules.Repository
+	moderator           moderation.Moderator
+	moderationRuleRepo  moderation_rules.Repository
+	moderationHitRepo   moderation_hits.Repository
+	quotaTracker        quota.Tracker
+	styleRepo           styles.Repository
+	favoriteRepo        favorites.Repository
+	registeredCommands  []*discordgo.ApplicationCommand
+	invisionCommand     string
+	removeCommands      bool
+	adminRoleID         string
+	logger              *slog.Logger
 }
 
 type Config struct {
 	DevelopmentMode bool
 	BotToken        string
-	GuildID         string
-	InvisionQueue   invision_queue.Queue
-	InvisionCommand string
-	RemoveCommands  bool
+	// GuildIDs are the guilds to register the commands in. The commands are
+	// registered globally, for every guild the bot is in, when empty.
+	GuildIDs            []string
+	InvisionQueue       invision_queue.Queue
+	ImageGenerationRepo image_generations.Repository
+	RolePolicyRepo      role_policies.Repository
+	ChannelRuleRepo     channel_rules.Repository
+	Moderator           moderation.Moderator
+	ModerationRuleRepo  moderation_rules.Repository
+	ModerationHitRepo   moderation_hits.Repository
+	QuotaTracker        quota.Tracker
+	StyleRepo           styles.Repository
+	FavoriteRepo        favorites.Repository
+	InvisionCommand     string
+	RemoveCommands      bool
+	// AdminRoleID optionally grants the admin command to a role, in addition
+	// to members with the Administrator or Manage Server permission.
+	AdminRoleID string
+	// Logger is optional, the default logger is used when nil.
+	Logger *slog.Logger
 }
 
 func (b *botImpl) invisionCommandString() string {
@@ -52,25 +91,62 @@ func New(cfg Config) (Bot, error) {
 		return nil, errors.New("missing bot token")
 	}
 
-	if cfg.GuildID == "" {
-		return nil, errors.New("missing guild ID")
-	}
-
 	if cfg.InvisionQueue == nil {
 		return nil, errors.New("missing invision queue")
 	}
 
+	if cfg.ImageGenerationRepo == nil {
+		return nil, errors.New("missing image generation repository")
+	}
+
+	if cfg.RolePolicyRepo == nil {
+		return nil, errors.New("missing role policy repository")
+	}
+
+	if cfg.ChannelRuleRepo == nil {
+		return nil, errors.New("missing channel rule repository")
+	}
+
+	if cfg.Moderator == nil {
+		return nil, errors.New("missing moderator")
+	}
+
+	if cfg.ModerationRuleRepo == nil {
+		return nil, errors.New("missing moderation rule repository")
+	}
+
+	if cfg.ModerationHitRepo == nil {
+		return nil, errors.New("missing moderation hit repository")
+	}
+
+	if cfg.QuotaTracker == nil {
+		return nil, errors.New("missing quota tracker")
+	}
+
+	if cfg.StyleRepo == nil {
+		return nil, errors.New("missing style repository")
+	}
+
+	if cfg.FavoriteRepo == nil {
+		return nil, errors.New("missing favorite repository")
+	}
+
 	if cfg.InvisionCommand == "" {
 		return nil, errors.New("missing invision command")
 	}
 
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	botSession, err := discordgo.New("Bot " + cfg.BotToken)
 	if err != nil {
 		return nil, err
 	}
 
 	botSession.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
-		log.Printf("Logged in as: %v#%v", s.State.User.Username, s.State.User.Discriminator)
+		logger.Info("Logged in", "user", s.State.User.Username+"#"+s.State.User.Discriminator)
 	})
 	err = botSession.Open()
 	if err != nil {
@@ -78,12 +154,24 @@ func New(cfg Config) (Bot, error) {
 	}
 
 	bot := &botImpl{
-		developmentMode:    cfg.DevelopmentMode,
-		botSession:         botSession,
-		invisionQueue:      cfg.InvisionQueue,
-		registeredCommands: make([]*discordgo.ApplicationCommand, 0),
-		invisionCommand:    cfg.InvisionCommand,
-		removeCommands:     cfg.RemoveCommands,
+		developmentMode:     cfg.DevelopmentMode,
+		botSession:          botSession,
+		guildIDs:            cfg.GuildIDs,
+		invisionQueue:       cfg.InvisionQueue,
+		imageGenerationRepo: cfg.ImageGenerationRepo,
+		rolePolicyRepo:      cfg.RolePolicyRepo,
+		channelRuleRepo:     cfg.ChannelRuleRepo,
+		moderator:           cfg.Moderator,
+		moderationRuleRepo:  cfg.ModerationRuleRepo,
+		moderationHitRepo:   cfg.ModerationHitRepo,
+		quotaTracker:        cfg.QuotaTracker,
+		styleRepo:           cfg.StyleRepo,
+		favoriteRepo:        cfg.FavoriteRepo,
+		registeredCommands:  make([]*discordgo.ApplicationCommand, 0),
+		invisionCommand:     cfg.InvisionCommand,
+		removeCommands:      cfg.RemoveCommands,
+		adminRoleID:         cfg.AdminRoleID,
+		logger:              logger,
 	}
 
 	err = bot.addInvisionCommand()
@@ -96,6 +184,56 @@ func New(cfg Config) (Bot, error) {
 		return nil, err
 	}
 
+	err = bot.addInvisionHistoryCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionSearchCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionAdminCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionQuotaCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionStyleCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionXYPlotCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionMatrixCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionSeedWalkCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addInvisionGalleryCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addMessageCommands()
+	if err != nil {
+		return nil, err
+	}
+
 	botSession.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		switch i.Type {
 		case discordgo.InteractionApplicationCommand:
@@ -104,11 +242,45 @@ func New(cfg Config) (Bot, error) {
 				bot.processInvisionCommand(s, i)
 			case bot.invisionSettingsCommandString():
 				bot.processInvisionSettingsCommand(s, i)
+			case bot.invisionHistoryCommandString():
+				bot.processInvisionHistoryCommand(s, i)
+			case bot.invisionSearchCommandString():
+				bot.processInvisionSearchCommand(s, i)
+			case bot.invisionAdminCommandString():
+				bot.processInvisionAdminCommand(s, i)
+			case bot.invisionQuotaCommandString():
+				bot.processInvisionQuotaCommand(s, i)
+			case bot.invisionStyleCommandString():
+				bot.processInvisionStyleCommand(s, i)
+			case bot.invisionXYPlotCommandString():
+				bot.processInvisionXYPlotCommand(s, i)
+			case bot.invisionMatrixCommandString():
+				bot.processInvisionMatrixCommand(s, i)
+			case bot.invisionSeedWalkCommandString():
+				bot.processInvisionSeedWalkCommand(s, i)
+			case bot.invisionGalleryCommandString():
+				bot.processInvisionGalleryCommand(s, i)
+			case bot.messageCommandString(upscaleThisCommand):
+				bot.processUpscaleThisCommand(s, i)
+			case bot.messageCommandString(showParametersCommand):
+				bot.processShowParametersCommand(s, i)
+			case bot.messageCommandString(rerunCommand):
+				bot.processRerunCommand(s, i)
 			default:
-				log.Printf("Unknown command '%v'", i.ApplicationCommandData().Name)
+				logger.Warn("Unknown command", "command", i.ApplicationCommandData().Name)
+			}
+		case discordgo.InteractionApplicationCommandAutocomplete:
+			if i.ApplicationCommandData().Name == bot.invisionCommandString() {
+				bot.processStyleAutocomplete(s, i)
 			}
 		case discordgo.InteractionMessageComponent:
-			switch customID := i.MessageComponentData().CustomID; {
+			customID := i.MessageComponentData().CustomID
+
+			if isResultComponent(customID) && !bot.mayUseResult(s, i) {
+				return
+			}
+
+			switch {
 			case customID == "invision_reroll":
 				bot.processInvisionReroll(s, i)
 			case strings.HasPrefix(customID, "invision_upscale_"):
@@ -116,26 +288,73 @@ func New(cfg Config) (Bot, error) {
 
 				interactionIndexInt, intErr := strconv.Atoi(interactionIndex)
 				if intErr != nil {
-					log.Printf("Error parsing interaction index: %v", err)
+					logger.Warn("Error parsing interaction index", "custom_id", customID, "error", intErr)
+
+					return
+				}
+
+				bot.processInvisionUpscale(s, i, interactionIndexInt, "")
+			case customID == "invision_upscaler":
+				if len(i.MessageComponentData().Values) == 0 {
+					logger.Warn("No values for invision upscaler menu", "custom_id", customID)
+
+					return
+				}
+
+				bot.processInvisionUpscale(s, i, 1, i.MessageComponentData().Values[0])
+			case strings.HasPrefix(customID, "invision_img2img_"):
+				interactionIndexInt, intErr := strconv.Atoi(strings.TrimPrefix(customID, "invision_img2img_"))
+				if intErr != nil {
+					logger.Warn("Error parsing interaction index", "custom_id", customID, "error", intErr)
 
 					return
 				}
 
-				bot.processInvisionUpscale(s, i, interactionIndexInt)
+				bot.processInvisionImageToImageButton(s, i, interactionIndexInt)
+			case customID == "invision_delete":
+				bot.processInvisionDelete(s, i)
+			case customID == "invision_parameters":
+				bot.processInvisionParameters(s, i)
+			case customID == "invision_edit":
+				bot.processInvisionEditButton(s, i)
 			case strings.HasPrefix(customID, "invision_variation_"):
 				interactionIndex := strings.TrimPrefix(customID, "invision_variation_")
 
 				interactionIndexInt, intErr := strconv.Atoi(interactionIndex)
 				if intErr != nil {
-					log.Printf("Error parsing interaction index: %v", err)
+					logger.Warn("Error parsing interaction index", "custom_id", customID, "error", intErr)
 
 					return
 				}
 
 				bot.processInvisionVariation(s, i, interactionIndexInt)
+			case strings.HasPrefix(customID, historyRerunPrefix):
+				generationID, intErr := strconv.ParseInt(strings.TrimPrefix(customID, historyRerunPrefix), 10, 64)
+				if intErr != nil {
+					logger.Warn("Error parsing generation ID", "custom_id", customID, "error", intErr)
+
+					return
+				}
+
+				bot.processInvisionHistoryRerun(s, i, generationID)
+			case strings.HasPrefix(customID, historyPagePrefix):
+				bot.processInvisionHistoryPage(s, i, customID)
+			case strings.HasPrefix(customID, "invision_favorite_"):
+				interactionIndexInt, intErr := strconv.Atoi(strings.TrimPrefix(customID, "invision_favorite_"))
+				if intErr != nil {
+					logger.Warn("Error parsing interaction index", "custom_id", customID, "error", intErr)
+
+					return
+				}
+
+				bot.processInvisionFavorite(s, i, interactionIndexInt)
+			case strings.HasPrefix(customID, galleryPagePrefix):
+				bot.processInvisionGalleryPage(s, i, customID)
+			case strings.HasPrefix(customID, contextUpscalePrefix):
+				bot.processContextUpscale(s, i, customID)
 			case customID == "invision_dimension_setting_menu":
 				if len(i.MessageComponentData().Values) == 0 {
-					log.Printf("No values for invision dimension setting menu")
+					logger.Warn("No values for invision dimension setting menu")
 
 					return
 				}
@@ -147,14 +366,14 @@ func New(cfg Config) (Bot, error) {
 
 				widthInt, intErr := strconv.Atoi(width)
 				if intErr != nil {
-					log.Printf("Error parsing width: %v", err)
+					logger.Warn("Error parsing width", "value", width, "error", intErr)
 
 					return
 				}
 
 				heightInt, intErr := strconv.Atoi(height)
 				if intErr != nil {
-					log.Printf("Error parsing height: %v", err)
+					logger.Warn("Error parsing height", "value", height, "error", intErr)
 
 					return
 				}
@@ -164,7 +383,7 @@ func New(cfg Config) (Bot, error) {
 			// patch from upstream
 			case customID == "invision_batch_count_setting_menu":
 				if len(i.MessageComponentData().Values) == 0 {
-					log.Printf("No values for invision batch count setting menu")
+					logger.Warn("No values for invision batch setting menu", "custom_id", customID)
 
 					return
 				}
@@ -173,7 +392,7 @@ func New(cfg Config) (Bot, error) {
 
 				batchCountInt, intErr := strconv.Atoi(batchCount)
 				if intErr != nil {
-					log.Printf("Error parsing batch count: %v", err)
+					logger.Warn("Error parsing batch value", "custom_id", customID, "error", intErr)
 
 					return
 				}
@@ -189,7 +408,7 @@ func New(cfg Config) (Bot, error) {
 				case 4:
 					batchSizeInt = 1
 				default:
-					log.Printf("Unknown batch count: %v", batchCountInt)
+					logger.Warn("Unknown batch count", "batch_count", batchCountInt)
 
 					return
 				}
@@ -197,7 +416,7 @@ func New(cfg Config) (Bot, error) {
 				bot.processInvisionBatchSetting(s, i, batchCountInt, batchSizeInt)
 			case customID == "invision_batch_size_setting_menu":
 				if len(i.MessageComponentData().Values) == 0 {
-					log.Printf("No values for invision batch count setting menu")
+					logger.Warn("No values for invision batch setting menu", "custom_id", customID)
 
 					return
 				}
@@ -206,7 +425,7 @@ func New(cfg Config) (Bot, error) {
 
 				batchSizeInt, intErr := strconv.Atoi(batchSize)
 				if intErr != nil {
-					log.Printf("Error parsing batch count: %v", err)
+					logger.Warn("Error parsing batch value", "custom_id", customID, "error", intErr)
 
 					return
 				}
@@ -222,7 +441,7 @@ func New(cfg Config) (Bot, error) {
 				case 4:
 					batchCountInt = 1
 				default:
-					log.Printf("Unknown batch size: %v", batchSizeInt)
+					logger.Warn("Unknown batch size", "batch_size", batchSizeInt)
 
 					return
 				}
@@ -230,7 +449,30 @@ func New(cfg Config) (Bot, error) {
 				bot.processInvisionBatchSetting(s, i, batchCountInt, batchSizeInt)
 
 			default:
-				log.Printf("Unknown message component '%v'", i.MessageComponentData().CustomID)
+				logger.Warn("Unknown message component", "custom_id", i.MessageComponentData().CustomID)
+			}
+		case discordgo.InteractionModalSubmit:
+			switch customID := i.ModalSubmitData().CustomID; {
+			case strings.HasPrefix(customID, imageToImageModalPrefix):
+				interactionIndexInt, intErr := strconv.Atoi(strings.TrimPrefix(customID, imageToImageModalPrefix))
+				if intErr != nil {
+					logger.Warn("Error parsing interaction index", "custom_id", customID, "error", intErr)
+
+					return
+				}
+
+				bot.processInvisionImageToImageModal(s, i, interactionIndexInt)
+			case strings.HasPrefix(customID, editModalPrefix):
+				generationID, intErr := strconv.ParseInt(strings.TrimPrefix(customID, editModalPrefix), 10, 64)
+				if intErr != nil {
+					logger.Warn("Error parsing generation ID", "custom_id", customID, "error", intErr)
+
+					return
+				}
+
+				bot.processInvisionEditModal(s, i, generationID)
+			default:
+				logger.Warn("Unknown modal", "custom_id", customID)
 			}
 		}
 	})
@@ -239,25 +481,50 @@ func New(cfg Config) (Bot, error) {
 }
 
 func (b *botImpl) Start() {
-	b.invisionQueue.StartPolling(b.botSession)
+	b.invisionQueue.StartPolling()
 
 	err := b.teardown()
 	if err != nil {
-		log.Printf("Error tearing down bot: %v", err)
+		b.logger.Error("Error tearing down bot", "error", err)
 	}
 }
 
+// createCommand registers a command in every configured guild, or globally when no guild is configured.
+func (b *botImpl) createCommand(command *discordgo.ApplicationCommand) error {
+	guildIDs := b.guildIDs
+	if len(guildIDs) == 0 {
+		guildIDs = []string{""}
+	}
+
+	// the commands rely on guild members, roles and settings, so they aren't offered in DMs
+	dmPermission := false
+	command.DMPermission = &dmPermission
+
+	for _, guildID := range guildIDs {
+		cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, guildID, command)
+		if err != nil {
+			return fmt.Errorf("error registering command in guild %q: %w", guildID, err)
+		}
+
+		b.registeredCommands = append(b.registeredCommands, cmd)
+	}
+
+	return nil
+}
+
 func (b *botImpl) teardown() error {
 	// Delete all commands added by the bot
 	if b.removeCommands {
-		log.Printf("Removing all commands added by bot...")
+		b.logger.Info("Removing all commands added by bot")
 
 		for _, v := range b.registeredCommands {
-			log.Printf("Removing command '%v'...", v.Name)
+			b.logger.Info("Removing command", "command", v.Name)
 
-			err := b.botSession.ApplicationCommandDelete(b.botSession.State.User.ID, b.guildID, v.ID)
+			err := b.botSession.ApplicationCommandDelete(b.botSession.State.User.ID, v.GuildID, v.ID)
 			if err != nil {
-				log.Panicf("Cannot delete '%v' command: %v", v.Name, err)
+				b.logger.Error("Cannot delete command", "command", v.Name, "error", err)
+
+				return err
 			}
 		}
 	}
@@ -266,9 +533,9 @@ func (b *botImpl) teardown() error {
 }
 
 func (b *botImpl) addInvisionCommand() error {
-	log.Printf("Adding command '%s'...", b.invisionCommandString())
+	b.logger.Info("Adding command", "command", b.invisionCommandString())
 
-	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+	err := b.createCommand(&discordgo.ApplicationCommand{
 		Name:        b.invisionCommandString(),
 		Description: "Ask the bot to invision something",
 		Options: []*discordgo.ApplicationCommandOption{
@@ -388,96 +655,110 @@ func (b *botImpl) addInvisionCommand() error {
 					},
 				},
 			},
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "style",
+				Description:  "Saved styles to merge into the prompt, comma separated",
+				Required:     false,
+				Autocomplete: true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionNumber,
+				Name:        "variation_strength",
+				Description: "How much the variation buttons change the image, or --vary 0.4 in the prompt. default=Subtle",
+				Required:    false,
+				Choices:     variationStrengthChoices(),
+			},
 		},
 	})
 	if err != nil {
-		log.Printf("Error creating '%s' command: %v", b.invisionCommandString(), err)
+		b.logger.Error("Error creating command", "command", b.invisionCommandString(), "error", err)
 
 		return err
 	}
 
-	b.registeredCommands = append(b.registeredCommands, cmd)
-
 	return nil
 }
 
 func (b *botImpl) addInvisionSettingsCommand() error {
-	log.Printf("Adding command '%s'...", b.invisionSettingsCommandString())
+	b.logger.Info("Adding command", "command", b.invisionSettingsCommandString())
 
-	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+	err := b.createCommand(&discordgo.ApplicationCommand{
 		Name:        b.invisionSettingsCommandString(),
 		Description: "Change the default settings for the invision command",
 	})
 	if err != nil {
-		log.Printf("Error creating '%s' command: %v", b.invisionSettingsCommandString(), err)
+		b.logger.Error("Error creating command", "command", b.invisionSettingsCommandString(), "error", err)
 
 		return err
 	}
 
-	b.registeredCommands = append(b.registeredCommands, cmd)
-
 	return nil
 }
 
 func (b *botImpl) processInvisionReroll(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	position, queueError := b.invisionQueue.AddInvision(&invision_queue.QueueItem{
-		Type:               invision_queue.ItemTypeReroll,
-		DiscordInteraction: i.Interaction,
-	})
-	if queueError != nil {
-		log.Printf("Error adding invision to queue: %v\n", queueError)
+	item := &invision_queue.QueueItem{
+		Type: invision_queue.ItemTypeReroll,
+	}
+
+	position, ok := b.queueInvision(s, i, item)
+	if !ok {
+		return
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("I'm reimagining that for you... You are currently #%d in line.", position),
+			Content: withPolicyNotes(fmt.Sprintf("I'm reimagining that for you... You are currently #%d in line.", position), item.PolicyNotes),
 		},
 	})
 	if err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.logger.Error("Error responding to interaction", "error", err)
 	}
 }
 
-func (b *botImpl) processInvisionUpscale(s *discordgo.Session, i *discordgo.InteractionCreate, upscaleIndex int) {
-	position, queueError := b.invisionQueue.AddInvision(&invision_queue.QueueItem{
-		Type:               invision_queue.ItemTypeUpscale,
-		InteractionIndex:   upscaleIndex,
-		DiscordInteraction: i.Interaction,
-	})
-	if queueError != nil {
-		log.Printf("Error adding invision to queue: %v\n", queueError)
+func (b *botImpl) processInvisionUpscale(s *discordgo.Session, i *discordgo.InteractionCreate, upscaleIndex int, upscaler string) {
+	item := &invision_queue.QueueItem{
+		Type:             invision_queue.ItemTypeUpscale,
+		InteractionIndex: upscaleIndex,
+		Upscaler:         upscaler,
+	}
+
+	position, ok := b.queueInvision(s, i, item)
+	if !ok {
+		return
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("I'm upscaling that for you... You are currently #%d in line.", position),
+			Content: withPolicyNotes(fmt.Sprintf("I'm upscaling that for you... You are currently #%d in line.", position), item.PolicyNotes),
 		},
 	})
 	if err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.logger.Error("Error responding to interaction", "error", err)
 	}
 }
 
 func (b *botImpl) processInvisionVariation(s *discordgo.Session, i *discordgo.InteractionCreate, variationIndex int) {
-	position, queueError := b.invisionQueue.AddInvision(&invision_queue.QueueItem{
-		Type:               invision_queue.ItemTypeVariation,
-		InteractionIndex:   variationIndex,
-		DiscordInteraction: i.Interaction,
-	})
-	if queueError != nil {
-		log.Printf("Error adding invision to queue: %v\n", queueError)
+	item := &invision_queue.QueueItem{
+		Type:             invision_queue.ItemTypeVariation,
+		InteractionIndex: variationIndex,
+	}
+
+	position, ok := b.queueInvision(s, i, item)
+	if !ok {
+		return
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("I'm imagining more variations for you... You are currently #%d in line.", position),
+			Content: withPolicyNotes(fmt.Sprintf("I'm imagining more variations for you... You are currently #%d in line.", position), item.PolicyNotes),
 		},
 	})
 	if err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.logger.Error("Error responding to interaction", "error", err)
 	}
 }
 
@@ -490,15 +771,33 @@ func (b *botImpl) processInvisionCommand(s *discordgo.Session, i *discordgo.Inte
 	}
 
 	var position int
-	var queueError error
+	var queued bool
 	var prompt string
+	var policyNotes []string
+	var appliedStyles []*entities.Style
 	negative := ""
 	sampler := "DPM++ 2M"
 	hiresfix := false
+	variationStrength := 0.0
 
 	if option, ok := optionMap["prompt"]; ok {
 		prompt = option.StringValue()
 
+		moderated, moderationErr := b.moderator.Check(logging.NewContext(context.Background(), b.logger), i.GuildID, i.Member.User.ID, prompt)
+		if moderationErr != nil {
+			b.logger.Info("Prompt refused by moderation", "member_id", i.Member.User.ID, "error", moderationErr)
+
+			b.respondQueueError(s, i, moderationErr)
+
+			return
+		}
+
+		prompt = moderated.Prompt
+
+		if moderated.Rewritten {
+			policyNotes = append(policyNotes, "Parts of your prompt were replaced by the moderation rules of this server.")
+		}
+
 		if nopt, ok := optionMap["negative_prompt"]; ok {
 			negative = nopt.StringValue()
 		}
@@ -511,32 +810,161 @@ func (b *botImpl) processInvisionCommand(s *discordgo.Session, i *discordgo.Inte
 			hiresfix, _ = strconv.ParseBool(hires.StringValue())
 		}
 
-		position, queueError = b.invisionQueue.AddInvision(&invision_queue.QueueItem{
-			Prompt:             prompt,
-			NegativePrompt:     negative,
-			SamplerName1:       sampler,
-			Type:               invision_queue.ItemTypeInvision,
-			UseHiresFix:        hiresfix,
-			DiscordInteraction: i.Interaction,
-		})
-		if queueError != nil {
-			log.Printf("Error adding invision to queue: %v\n", queueError)
+		if strengthOption, ok := optionMap["variation_strength"]; ok {
+			variationStrength = strengthOption.FloatValue()
+		}
+
+		if styleOption, ok := optionMap["style"]; ok {
+			var styleErr error
+
+			appliedStyles, styleErr = b.resolveStyles(i.GuildID, i.Member.User.ID, styleOption.StringValue())
+			if styleErr != nil {
+				b.logger.Info("Error resolving styles", "style", styleOption.StringValue(), "error", styleErr)
+
+				b.respondQueueError(s, i, styleErr)
+
+				return
+			}
+		}
+
+		item := &invision_queue.QueueItem{
+			Prompt:            prompt,
+			NegativePrompt:    negative,
+			SamplerName1:      sampler,
+			Type:              invision_queue.ItemTypeInvision,
+			UseHiresFix:       hiresfix,
+			Styles:            appliedStyles,
+			VariationStrength: variationStrength,
+		}
+
+		position, queued = b.queueInvision(s, i, item)
+		if !queued {
+			return
+		}
+
+		policyNotes = append(policyNotes, item.PolicyNotes...)
+	}
+
+	content := fmt.Sprintf(
+		"I'm dreaming something up for you. You are currently #%d in line.\n<@%s> asked me to invision \"%s\", with sampler: %s",
+		position,
+		i.Member.User.ID,
+		prompt,
+		sampler)
+
+	if len(appliedStyles) > 0 {
+		names := make([]string, 0, len(appliedStyles))
+		for _, style := range appliedStyles {
+			names = append(names, style.Name)
+		}
+
+		content += ", styles: " + strings.Join(names, ", ")
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: withPolicyNotes(content, policyNotes),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// queueInvision checks the quota of the member and adds the item to the queue, with the response
+// to the interaction showing its progress. When the item can't be queued, the member is told why
+// and false is returned.
+func (b *botImpl) queueInvision(s *discordgo.Session, i *discordgo.InteractionCreate, item *invision_queue.QueueItem) (int, bool) {
+	item.Origin = b.itemOrigin(s, i)
+	item.Notifier = &interactionNotifier{session: s, interaction: i.Interaction}
+
+	if i.Member != nil && i.Member.User != nil {
+		queued := b.invisionQueue.QueuedGenerations(i.GuildID, i.Member.User.ID)
+
+		quotaErr := b.quotaTracker.Check(logging.NewContext(context.Background(), b.logger),
+			i.GuildID, i.Member.User.ID, i.Member.Roles, item.Generations(), queued)
+		if quotaErr != nil {
+			b.logger.Info("Invision refused by quota", "member_id", i.Member.User.ID, "error", quotaErr)
+
+			b.respondQueueError(s, i, quotaErr)
+
+			return 0, false
 		}
 	}
 
+	position, queueError := b.invisionQueue.AddInvision(item)
+	if queueError != nil {
+		b.logger.Error("Error adding invision to queue", "job_id", item.JobID, "error", queueError)
+
+		b.respondQueueError(s, i, queueError)
+
+		return 0, false
+	}
+
+	return position, true
+}
+
+// withPolicyNotes appends the adjustments the role policy made to an invision to a response.
+func withPolicyNotes(content string, notes []string) string {
+	if len(notes) == 0 {
+		return content
+	}
+
+	return content + "\n⚠️ " + strings.Join(notes, "\n⚠️ ")
+}
+
+// queueErrorContent returns the message shown to a member whose invision couldn't be queued.
+func queueErrorContent(err error) string {
+	var rejectedErr *policy.RejectedError
+	var moderationErr *moderation.RejectedError
+	var quotaErr *quota.ExceededError
+	var styleErr *unknownStyleError
+
+	switch {
+	case errors.As(err, &styleErr):
+		return fmt.Sprintf("There is no style named **%s**. See your styles with the style list command.", styleErr.name)
+	case errors.As(err, &quotaErr):
+		return fmt.Sprintf("%s It resets <t:%d:R>.", quotaErr.Reason, quotaErr.ResetAt.Unix())
+	case errors.As(err, &rejectedErr):
+		return rejectedErr.Reason
+	case errors.As(err, &moderationErr):
+		return "Your prompt contains something that isn't allowed on this server."
+	case errors.Is(err, invision_queue.ErrQueueFull):
+		return "The queue is full right now, please try again later."
+	case errors.Is(err, invision_queue.ErrQueueStopped):
+		return "I'm shutting down right now, please try again later."
+	case errors.Is(err, invision_queue.ErrChannelNotAllowed):
+		return "Invisions are not allowed in this channel."
+	case errors.Is(err, invision_queue.ErrNSFWPrompt):
+		return "That prompt can only be used in an age-restricted channel."
+	case errors.Is(err, invision_queue.ErrInvalidXYPlot):
+		return fmt.Sprintf("I can't make that plot: %s.", strings.TrimPrefix(err.Error(), invision_queue.ErrInvalidXYPlot.Error()+": "))
+	case errors.Is(err, invision_queue.ErrInvalidPromptMatrix):
+		return fmt.Sprintf("I can't make that prompt matrix: %s.", strings.TrimPrefix(err.Error(), invision_queue.ErrInvalidPromptMatrix.Error()+": "))
+	case errors.Is(err, invision_queue.ErrInvalidEdit):
+		return fmt.Sprintf("I can't run that edit: %s.", strings.TrimPrefix(err.Error(), invision_queue.ErrInvalidEdit.Error()+": "))
+	case errors.Is(err, invision_queue.ErrInvalidSeedWalk):
+		return fmt.Sprintf("I can't make that seed walk: %s.", strings.TrimPrefix(err.Error(), invision_queue.ErrInvalidSeedWalk.Error()+": "))
+	case errors.Is(err, invision_queue.ErrUnknownWildcard):
+		return fmt.Sprintf("I can't expand your prompt: %s.", err)
+	case errors.Is(err, invision_queue.ErrMemberQueueLimit):
+		return "You already have the maximum number of invisions waiting in line, please wait for them to finish."
+	default:
+		return "I'm sorry, but I couldn't queue that."
+	}
+}
+
+func (b *botImpl) respondQueueError(s *discordgo.Session, i *discordgo.InteractionCreate, queueError error) {
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf(
-				"I'm dreaming something up for you. You are currently #%d in line.\n<@%s> asked me to invision \"%s\", with sampler: %s",
-				position,
-				i.Member.User.ID,
-				prompt,
-				sampler),
+			Content: queueErrorContent(queueError),
+			Flags:   discordgo.MessageFlagsEphemeral,
 		},
 	})
 	if err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.logger.Error("Error responding to interaction", "error", err)
 	}
 }
 
@@ -622,9 +1050,9 @@ func settingsMessageComponents(settings *entities.DefaultSettings) []discordgo.M
 }
 
 func (b *botImpl) processInvisionSettingsCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	botSettings, err := b.invisionQueue.GetBotDefaultSettings()
+	botSettings, err := b.invisionQueue.GetBotDefaultSettings(i.GuildID)
 	if err != nil {
-		log.Printf("error getting default settings for settings command: %v", err)
+		b.logger.Error("Error getting default settings for settings command", "error", err)
 
 		return
 	}
@@ -640,14 +1068,14 @@ func (b *botImpl) processInvisionSettingsCommand(s *discordgo.Session, i *discor
 		},
 	})
 	if err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.logger.Error("Error responding to interaction", "error", err)
 	}
 }
 
 func (b *botImpl) processInvisionDimensionSetting(s *discordgo.Session, i *discordgo.InteractionCreate, height, width int) {
-	botSettings, err := b.invisionQueue.UpdateDefaultDimensions(width, height)
+	botSettings, err := b.invisionQueue.UpdateDefaultDimensions(i.GuildID, width, height)
 	if err != nil {
-		log.Printf("error updating default dimensions: %v", err)
+		b.logger.Error("Error updating default dimensions", "error", err)
 
 		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseUpdateMessage,
@@ -656,7 +1084,7 @@ func (b *botImpl) processInvisionDimensionSetting(s *discordgo.Session, i *disco
 			},
 		})
 		if err != nil {
-			log.Printf("Error responding to interaction: %v", err)
+			b.logger.Error("Error responding to interaction", "error", err)
 		}
 
 		return
@@ -672,14 +1100,14 @@ func (b *botImpl) processInvisionDimensionSetting(s *discordgo.Session, i *disco
 		},
 	})
 	if err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.logger.Error("Error responding to interaction", "error", err)
 	}
 }
 
 func (b *botImpl) processInvisionBatchSetting(s *discordgo.Session, i *discordgo.InteractionCreate, batchCount, batchSize int) {
-	botSettings, err := b.invisionQueue.UpdateDefaultBatch(batchCount, batchSize)
+	botSettings, err := b.invisionQueue.UpdateDefaultBatch(i.GuildID, batchCount, batchSize)
 	if err != nil {
-		log.Printf("error updating batch settings: %v", err)
+		b.logger.Error("Error updating batch settings", "error", err)
 
 		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseUpdateMessage,
@@ -688,7 +1116,7 @@ func (b *botImpl) processInvisionBatchSetting(s *discordgo.Session, i *discordgo
 			},
 		})
 		if err != nil {
-			log.Printf("Error responding to interaction: %v", err)
+			b.logger.Error("Error responding to interaction", "error", err)
 		}
 
 		return
@@ -704,6 +1132,6 @@ func (b *botImpl) processInvisionBatchSetting(s *discordgo.Session, i *discordgo
 		},
 	})
 	if err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.logger.Error("Error responding to interaction", "error", err)
 	}
 }
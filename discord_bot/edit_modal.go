@@ -0,0 +1,136 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/logging"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const editModalPrefix = "invision_edit_modal_"
+
+// processInvisionEditButton opens a modal prefilled with the parameters of a grid, to run it
+// again with changes.
+func (b *botImpl) processInvisionEditButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	ctx := logging.NewContext(context.Background(), b.logger)
+
+	generation, err := b.imageGenerationRepo.GetByMessageAndSort(ctx, i.Message.ID, 0)
+	if err != nil {
+		b.logger.Error("Error getting image generation", "message_id", i.Message.ID, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't find how this grid was made.")
+
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: editModalPrefix + strconv.FormatInt(generation.ID, 10),
+			Title:    "Edit and re-run",
+			Components: []discordgo.MessageComponent{
+				textInputRow(discordgo.TextInput{
+					CustomID:  "prompt",
+					Label:     "Prompt",
+					Style:     discordgo.TextInputParagraph,
+					Value:     strings.Trim(generation.Prompt, "`"),
+					Required:  true,
+					MaxLength: 1000,
+				}),
+				textInputRow(discordgo.TextInput{
+					CustomID:  "negative_prompt",
+					Label:     "Negative prompt",
+					Style:     discordgo.TextInputParagraph,
+					Value:     generation.NegativePrompt,
+					Required:  false,
+					MaxLength: 1000,
+				}),
+				textInputRow(discordgo.TextInput{
+					CustomID:  "steps",
+					Label:     "Steps",
+					Style:     discordgo.TextInputShort,
+					Value:     strconv.Itoa(generation.Steps),
+					Required:  false,
+					MaxLength: 3,
+				}),
+				textInputRow(discordgo.TextInput{
+					CustomID:  "cfg_scale",
+					Label:     "CFG scale",
+					Style:     discordgo.TextInputShort,
+					Value:     strconv.FormatFloat(generation.CfgScale, 'f', -1, 64),
+					Required:  false,
+					MaxLength: 5,
+				}),
+				textInputRow(discordgo.TextInput{
+					CustomID:    "seed",
+					Label:       "Seed (-1 or empty for a random one)",
+					Style:       discordgo.TextInputShort,
+					Value:       strconv.FormatInt(generation.Seed, 10),
+					Placeholder: "-1",
+					Required:    false,
+					MaxLength:   20,
+				}),
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// processInvisionEditModal queues the generation of an edit modal with the submitted values.
+func (b *botImpl) processInvisionEditModal(s *discordgo.Session, i *discordgo.InteractionCreate, generationID int64) {
+	values := modalValues(i.ModalSubmitData())
+
+	edit, err := invision_queue.ParseGenerationEdit(values["steps"], values["cfg_scale"], values["seed"])
+	if err != nil {
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	var policyNotes []string
+
+	moderated, err := b.moderator.Check(logging.NewContext(context.Background(), b.logger), i.GuildID, i.Member.User.ID,
+		values["prompt"])
+	if err != nil {
+		b.logger.Info("Prompt refused by moderation", "member_id", i.Member.User.ID, "error", err)
+
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	if moderated.Rewritten {
+		policyNotes = append(policyNotes, "Parts of your prompt were replaced by the moderation rules of this server.")
+	}
+
+	item := &invision_queue.QueueItem{
+		Prompt:         moderated.Prompt,
+		NegativePrompt: values["negative_prompt"],
+		Type:           invision_queue.ItemTypeEdit,
+		GenerationID:   generationID,
+		Edit:           edit,
+	}
+
+	position, queued := b.queueInvision(s, i, item)
+	if !queued {
+		return
+	}
+
+	policyNotes = append(policyNotes, item.PolicyNotes...)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: withPolicyNotes(fmt.Sprintf("I'm invisioning your edit... You are currently #%d in line.", position), policyNotes),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
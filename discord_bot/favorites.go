@@ -0,0 +1,358 @@
+package discord_bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/repositories"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	galleryPageSize = 5
+
+	gallerySortTop    = "top"
+	gallerySortRecent = "recent"
+
+	galleryPagePrefix = "invision_gallery_page_"
+)
+
+func (b *botImpl) invisionGalleryCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_gallery"
+	}
+
+	return b.invisionCommand + "_gallery"
+}
+
+func (b *botImpl) addInvisionGalleryCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionGalleryCommandString())
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionGalleryCommandString(),
+		Description: "Browse the favorite invisions of the server",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "sort",
+				Description: "Which favorites to show first. Defaults to the most favorited",
+				Required:    false,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "Most favorited", Value: gallerySortTop},
+					{Name: "Most recently favorited", Value: gallerySortRecent},
+				},
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionGalleryCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// processInvisionFavorite toggles an image of a result in the favorites of the member who clicked
+// its favorite button.
+func (b *botImpl) processInvisionFavorite(s *discordgo.Session, i *discordgo.InteractionCreate, sortOrder int) {
+	ctx := logging.NewContext(context.Background(), b.logger)
+
+	generation, err := b.imageGenerationRepo.GetByMessageAndSort(ctx, i.Message.ID, sortOrder)
+	if err != nil {
+		b.logger.Error("Error getting image generation", "message_id", i.Message.ID, "sort_order", sortOrder, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't find this image.")
+
+		return
+	}
+
+	added, err := b.favoriteRepo.Add(ctx, &entities.Favorite{
+		GenerationID: generation.ID,
+		GuildID:      i.GuildID,
+		MemberID:     i.Member.User.ID,
+	})
+	if err == nil && !added {
+		err = b.favoriteRepo.Remove(ctx, generation.ID, i.Member.User.ID)
+		if errors.Is(err, &repositories.NotFoundError{}) {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		b.logger.Error("Error updating favorite", "generation_id", generation.ID, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't update your favorites.")
+
+		return
+	}
+
+	count, err := b.favoriteRepo.Count(ctx, generation.ID)
+	if err != nil {
+		b.logger.Error("Error counting favorites", "generation_id", generation.ID, "error", err)
+	}
+
+	if !added {
+		b.respondEphemeral(s, i, fmt.Sprintf("Removed from your favorites. It has %s now.", favoritesString(count)))
+
+		return
+	}
+
+	b.respondEphemeral(s, i, fmt.Sprintf("⭐ Added to your favorites. It has %s now.", favoritesString(count)))
+
+	b.showcaseIfPopular(ctx, s, generation, count)
+}
+
+// showcaseIfPopular reposts an image to the showcase channel of its guild the first time it
+// reaches the favorite threshold.
+func (b *botImpl) showcaseIfPopular(ctx context.Context, s *discordgo.Session, generation *entities.ImageGeneration, count int) {
+	settings, err := b.invisionQueue.GetBotDefaultSettings(generation.GuildID)
+	if err != nil {
+		b.logger.Error("Error getting bot settings", "guild_id", generation.GuildID, "error", err)
+
+		return
+	}
+
+	if settings.ShowcaseChannelID == "" || count < settings.ShowcaseThreshold {
+		return
+	}
+
+	claimed, err := b.favoriteRepo.ClaimShowcase(ctx, generation.ID, generation.GuildID)
+	if err != nil || !claimed {
+		if err != nil {
+			b.logger.Error("Error claiming showcase", "generation_id", generation.ID, "error", err)
+		}
+
+		return
+	}
+
+	message, err := s.ChannelMessage(generation.ChannelID, generation.MessageID)
+	if err != nil || len(message.Attachments) == 0 {
+		b.logger.Error("Error getting message to showcase", "message_id", generation.MessageID, "error", err)
+
+		return
+	}
+
+	attachment := message.Attachments[0]
+
+	image, err := downloadAttachment(ctx, attachment.URL)
+	if err != nil {
+		b.logger.Error("Error downloading image to showcase", "message_id", generation.MessageID, "error", err)
+
+		return
+	}
+
+	content := fmt.Sprintf("⭐ %s for this invision of <@%s>: %s", favoritesString(count), generation.MemberID,
+		galleryPrompt(generation))
+	if link := messageLink(generation.GuildID, generation); link != "" {
+		content += "\n" + link
+	}
+
+	_, err = s.ChannelMessageSendComplex(settings.ShowcaseChannelID, &discordgo.MessageSend{
+		Content: content,
+		Files: []*discordgo.File{
+			{
+				ContentType: attachment.ContentType,
+				// the file name keeps the spoiler prefix of NSFW images
+				Name:   attachment.Filename,
+				Reader: bytes.NewReader(image),
+			},
+		},
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		b.logger.Error("Error posting to showcase channel", "channel_id", settings.ShowcaseChannelID, "error", err)
+	}
+}
+
+func (b *botImpl) processInvisionGalleryCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	sort := gallerySortTop
+
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "sort" {
+			sort = option.StringValue()
+		}
+	}
+
+	responseData, err := b.galleryResponseData(s, i.GuildID, sort, 0)
+	if err != nil {
+		b.logger.Error("Error getting gallery", "guild_id", i.GuildID, "error", err)
+
+		responseData = &discordgo.InteractionResponseData{
+			Content: "I'm sorry, but I couldn't look up the gallery.",
+		}
+	}
+
+	responseData.Flags = discordgo.MessageFlagsEphemeral
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: responseData,
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// processInvisionGalleryPage handles the previous/next buttons, whose custom ID
+// is "invision_gallery_page_<sort>_<page>".
+func (b *botImpl) processInvisionGalleryPage(s *discordgo.Session, i *discordgo.InteractionCreate, customID string) {
+	sort, pageString, found := strings.Cut(strings.TrimPrefix(customID, galleryPagePrefix), "_")
+	if !found {
+		b.logger.Warn("Malformed gallery page custom ID", "custom_id", customID)
+
+		return
+	}
+
+	page, err := strconv.Atoi(pageString)
+	if err != nil {
+		b.logger.Warn("Error parsing gallery page", "custom_id", customID, "error", err)
+
+		return
+	}
+
+	responseData, err := b.galleryResponseData(s, i.GuildID, sort, page)
+	if err != nil {
+		b.logger.Error("Error getting gallery", "guild_id", i.GuildID, "error", err)
+
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: responseData,
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+func (b *botImpl) galleryResponseData(s *discordgo.Session, guildID, sort string, page int) (*discordgo.InteractionResponseData, error) {
+	ctx := context.Background()
+
+	list := b.favoriteRepo.ListTop
+	title := "Most favorited invisions"
+
+	if sort == gallerySortRecent {
+		list = b.favoriteRepo.ListRecent
+		title = "Most recently favorited invisions"
+	}
+
+	// fetch one extra row to find out whether there is a next page
+	counts, err := list(ctx, guildID, galleryPageSize+1, page*galleryPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	hasNextPage := len(counts) > galleryPageSize
+	if hasNextPage {
+		counts = counts[:galleryPageSize]
+	}
+
+	content := fmt.Sprintf("%s, page %d:", title, page+1)
+	if len(counts) == 0 {
+		content += "\nNothing favorited yet. Click the ⭐ buttons on invisions you like."
+	}
+
+	embeds := make([]*discordgo.MessageEmbed, 0, len(counts))
+
+	for idx, count := range counts {
+		generation, err := b.imageGenerationRepo.GetByID(ctx, count.GenerationID)
+		if err != nil {
+			b.logger.Warn("Error getting favorite generation", "generation_id", count.GenerationID, "error", err)
+
+			continue
+		}
+
+		embed := &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("%d. ⭐ %s", page*galleryPageSize+idx+1, favoritesString(count.Favorites)),
+			URL:         messageLink(guildID, generation),
+			Description: fmt.Sprintf("%s\nby <@%s>, <t:%d:R>", galleryPrompt(generation), generation.MemberID, generation.CreatedAt.Unix()),
+		}
+
+		// attachment links expire, so the image is looked up on the message every time
+		message, err := s.ChannelMessage(generation.ChannelID, generation.MessageID)
+		if err == nil && len(message.Attachments) > 0 && !generation.NSFW {
+			embed.Image = &discordgo.MessageEmbedImage{URL: message.Attachments[0].URL}
+		}
+
+		embeds = append(embeds, embed)
+	}
+
+	components := make([]discordgo.MessageComponent, 0, 1)
+
+	if page > 0 || hasNextPage {
+		components = append(components, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Previous",
+					Style:    discordgo.PrimaryButton,
+					Disabled: page == 0,
+					CustomID: fmt.Sprintf("%s%s_%d", galleryPagePrefix, sort, page-1),
+				},
+				discordgo.Button{
+					Label:    "Next",
+					Style:    discordgo.PrimaryButton,
+					Disabled: !hasNextPage,
+					CustomID: fmt.Sprintf("%s%s_%d", galleryPagePrefix, sort, page+1),
+				},
+			},
+		})
+	}
+
+	return &discordgo.InteractionResponseData{
+		Content:    content,
+		Embeds:     embeds,
+		Components: components,
+	}, nil
+}
+
+// galleryPrompt names the image of a generation by its prompt, and its place on the grid.
+func galleryPrompt(generation *entities.ImageGeneration) string {
+	prompt := strings.Trim(generation.Prompt, "`")
+	if len([]rune(prompt)) > historyPromptSize {
+		prompt = string([]rune(prompt)[:historyPromptSize]) + "…"
+	}
+
+	if generation.Upscaler == "" && generation.SourceID == 0 && generation.SortOrder > 0 {
+		return fmt.Sprintf("`%s` (image %d)", prompt, generation.SortOrder)
+	}
+
+	return fmt.Sprintf("`%s`", prompt)
+}
+
+func favoritesString(count int) string {
+	if count == 1 {
+		return "1 favorite"
+	}
+
+	return fmt.Sprintf("%d favorites", count)
+}
+
+func downloadAttachment(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status downloading attachment: %s", response.Status)
+	}
+
+	return io.ReadAll(response.Body)
+}
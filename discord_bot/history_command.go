@@ -0,0 +1,274 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/invision_queue"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	historyPageSize   = 5
+	historyMaxDays    = 365
+	historyPromptSize = 120
+
+	historyRerunPrefix = "invision_history_rerun_"
+	historyPagePrefix  = "invision_history_page_"
+)
+
+func (b *botImpl) invisionHistoryCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_history"
+	}
+
+	return b.invisionCommand + "_history"
+}
+
+func (b *botImpl) addInvisionHistoryCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionHistoryCommandString())
+
+	minDays := float64(1)
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionHistoryCommandString(),
+		Description: "Show the recent invisions of a member",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "member",
+				Description: "Whose invisions to show. Defaults to yourself",
+				Required:    false,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "days",
+				Description: "Only show invisions from the last N days",
+				Required:    false,
+				MinValue:    &minDays,
+				MaxValue:    historyMaxDays,
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionHistoryCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *botImpl) processInvisionHistoryCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+
+	memberID := i.Member.User.ID
+	days := 0
+
+	if option, ok := optionMap["member"]; ok {
+		memberID = option.UserValue(nil).ID
+	}
+
+	if option, ok := optionMap["days"]; ok {
+		days = int(option.IntValue())
+	}
+
+	responseData, err := b.historyResponseData(i.GuildID, memberID, days, 0)
+	if err != nil {
+		b.logger.Error("Error getting invision history", "member_id", memberID, "error", err)
+
+		responseData = &discordgo.InteractionResponseData{
+			Content: "I'm sorry, but I couldn't look up the history.",
+		}
+	}
+
+	responseData.Flags = discordgo.MessageFlagsEphemeral
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: responseData,
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// processInvisionHistoryPage handles the previous/next buttons, whose custom ID
+// is "invision_history_page_<member ID>_<days>_<page>".
+func (b *botImpl) processInvisionHistoryPage(s *discordgo.Session, i *discordgo.InteractionCreate, customID string) {
+	parts := strings.Split(strings.TrimPrefix(customID, historyPagePrefix), "_")
+	if len(parts) != 3 {
+		b.logger.Warn("Malformed history page custom ID", "custom_id", customID)
+
+		return
+	}
+
+	days, err := strconv.Atoi(parts[1])
+	if err != nil {
+		b.logger.Warn("Error parsing history days", "custom_id", customID, "error", err)
+
+		return
+	}
+
+	page, err := strconv.Atoi(parts[2])
+	if err != nil {
+		b.logger.Warn("Error parsing history page", "custom_id", customID, "error", err)
+
+		return
+	}
+
+	responseData, err := b.historyResponseData(i.GuildID, parts[0], days, page)
+	if err != nil {
+		b.logger.Error("Error getting invision history", "member_id", parts[0], "error", err)
+
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: responseData,
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+func (b *botImpl) processInvisionHistoryRerun(s *discordgo.Session, i *discordgo.InteractionCreate, generationID int64) {
+	item := &invision_queue.QueueItem{
+		Type:         invision_queue.ItemTypeReroll,
+		GenerationID: generationID,
+	}
+
+	position, ok := b.queueInvision(s, i, item)
+	if !ok {
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("I'm reimagining that for you... You are currently #%d in line.", position),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+func (b *botImpl) historyResponseData(guildID, memberID string, days, page int) (*discordgo.InteractionResponseData, error) {
+	from := time.Time{}
+	if days > 0 {
+		from = time.Now().AddDate(0, 0, -days)
+	}
+
+	// fetch one extra row to find out whether there is a next page
+	generations, err := b.imageGenerationRepo.ListByMember(context.Background(), guildID, memberID, from, time.Time{},
+		historyPageSize+1, page*historyPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	hasNextPage := len(generations) > historyPageSize
+	if hasNextPage {
+		generations = generations[:historyPageSize]
+	}
+
+	var content strings.Builder
+
+	rangeString := "all time"
+	if days > 0 {
+		rangeString = fmt.Sprintf("last %d days", days)
+	}
+
+	fmt.Fprintf(&content, "Invisions of <@%s> (%s), page %d:\n", memberID, rangeString, page+1)
+
+	if len(generations) == 0 {
+		content.WriteString("Nothing found.")
+	}
+
+	rerunButtons := make([]discordgo.MessageComponent, 0, len(generations))
+
+	for idx, generation := range generations {
+		fmt.Fprintf(&content, "\n**%d.** %s\n", idx+1, generationSummary(generation))
+
+		if link := messageLink(guildID, generation); link != "" {
+			fmt.Fprintf(&content, "<t:%d:R> — %s\n", generation.CreatedAt.Unix(), link)
+		} else {
+			fmt.Fprintf(&content, "<t:%d:R>\n", generation.CreatedAt.Unix())
+		}
+
+		rerunButtons = append(rerunButtons, discordgo.Button{
+			Label:    strconv.Itoa(idx + 1),
+			Style:    discordgo.SecondaryButton,
+			CustomID: historyRerunPrefix + strconv.FormatInt(generation.ID, 10),
+			Emoji: discordgo.ComponentEmoji{
+				Name: "🎲",
+			},
+		})
+	}
+
+	components := make([]discordgo.MessageComponent, 0, 2)
+
+	if len(rerunButtons) > 0 {
+		components = append(components, discordgo.ActionsRow{Components: rerunButtons})
+	}
+
+	if page > 0 || hasNextPage {
+		components = append(components, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Previous",
+					Style:    discordgo.PrimaryButton,
+					Disabled: page == 0,
+					CustomID: fmt.Sprintf("%s%s_%d_%d", historyPagePrefix, memberID, days, page-1),
+				},
+				discordgo.Button{
+					Label:    "Next",
+					Style:    discordgo.PrimaryButton,
+					Disabled: !hasNextPage,
+					CustomID: fmt.Sprintf("%s%s_%d_%d", historyPagePrefix, memberID, days, page+1),
+				},
+			},
+		})
+	}
+
+	return &discordgo.InteractionResponseData{
+		Content:    content.String(),
+		Components: components,
+	}, nil
+}
+
+// generationSummary renders the prompt and main parameters of a generation on a single line.
+func generationSummary(generation *entities.ImageGeneration) string {
+	prompt := strings.Trim(generation.Prompt, "`")
+	if len([]rune(prompt)) > historyPromptSize {
+		prompt = string([]rune(prompt)[:historyPromptSize]) + "…"
+	}
+
+	return fmt.Sprintf("`%s` — %dx%d, steps %d, cfg %s, seed %d, %s",
+		prompt,
+		generation.Width,
+		generation.Height,
+		generation.Steps,
+		strconv.FormatFloat(generation.CfgScale, 'f', 1, 64),
+		generation.Seed,
+		generation.SamplerName)
+}
+
+// messageLink returns a jump link to the message of a generation, or "" when the channel is unknown.
+func messageLink(guildID string, generation *entities.ImageGeneration) string {
+	if guildID == "" || generation.ChannelID == "" || generation.MessageID == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, generation.ChannelID, generation.MessageID)
+}
@@ -0,0 +1,99 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/logging"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func (b *botImpl) invisionMatrixCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_matrix"
+	}
+
+	return b.invisionCommand + "_matrix"
+}
+
+func (b *botImpl) addInvisionMatrixCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionMatrixCommandString())
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionMatrixCommandString(),
+		Description: "Invision every combination of the optional parts of a prompt",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "The base prompt followed by optional parts, e.g. a cat | wearing a hat | in space",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "negative_prompt",
+				Description: "Negative prompt",
+				Required:    false,
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionMatrixCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *botImpl) processInvisionMatrixCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+
+	var policyNotes []string
+
+	moderated, err := b.moderator.Check(logging.NewContext(context.Background(), b.logger), i.GuildID, i.Member.User.ID,
+		optionMap["prompt"].StringValue())
+	if err != nil {
+		b.logger.Info("Prompt refused by moderation", "member_id", i.Member.User.ID, "error", err)
+
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	if moderated.Rewritten {
+		policyNotes = append(policyNotes, "Parts of your prompt were replaced by the moderation rules of this server.")
+	}
+
+	item := &invision_queue.QueueItem{
+		Prompt: moderated.Prompt,
+		Type:   invision_queue.ItemTypePromptMatrix,
+	}
+
+	if option, ok := optionMap["negative_prompt"]; ok {
+		item.NegativePrompt = option.StringValue()
+	}
+
+	position, queued := b.queueInvision(s, i, item)
+	if !queued {
+		return
+	}
+
+	policyNotes = append(policyNotes, item.PolicyNotes...)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: withPolicyNotes(fmt.Sprintf("I'm setting up your prompt matrix. You are currently #%d in line.", position), policyNotes),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
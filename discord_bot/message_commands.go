@@ -0,0 +1,206 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Message commands are offered in the context menu of a message, so results keep their actions
+// after their buttons expired or were removed.
+const (
+	upscaleThisCommand    = "Upscale this"
+	showParametersCommand = "Show parameters"
+	rerunCommand          = "Re-run"
+
+	contextUpscalePrefix = "invision_context_upscale_"
+
+	// maxUpscaleChoices is the most buttons an ephemeral reply can hold.
+	maxUpscaleChoices = 25
+)
+
+func (b *botImpl) messageCommandString(name string) string {
+	if b.developmentMode {
+		return "Dev " + name
+	}
+
+	return name
+}
+
+func (b *botImpl) addMessageCommands() error {
+	for _, name := range []string{upscaleThisCommand, showParametersCommand, rerunCommand} {
+		b.logger.Info("Adding command", "command", b.messageCommandString(name))
+
+		err := b.createCommand(&discordgo.ApplicationCommand{
+			Name: b.messageCommandString(name),
+			Type: discordgo.MessageApplicationCommand,
+		})
+		if err != nil {
+			b.logger.Error("Error creating command", "command", b.messageCommandString(name), "error", err)
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// messageCommandGenerations returns the generations of the message a message command was used on,
+// and makes that message the message of the interaction, as if one of its buttons was clicked. It
+// tells the member when the message isn't a result.
+func (b *botImpl) messageCommandGenerations(s *discordgo.Session, i *discordgo.InteractionCreate) ([]*entities.ImageGeneration, bool) {
+	data := i.ApplicationCommandData()
+
+	var message *discordgo.Message
+	if data.Resolved != nil {
+		message = data.Resolved.Messages[data.TargetID]
+	}
+
+	if message == nil {
+		b.logger.Warn("Missing target message", "target_id", data.TargetID)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't find that message.")
+
+		return nil, false
+	}
+
+	generations, err := b.imageGenerationRepo.ListByMessage(logging.NewContext(context.Background(), b.logger), message.ID)
+	if err != nil {
+		b.logger.Error("Error getting image generations", "message_id", message.ID, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't look up that message.")
+
+		return nil, false
+	}
+
+	if len(generations) == 0 {
+		b.respondEphemeral(s, i, "That message isn't one of my invisions.")
+
+		return nil, false
+	}
+
+	i.Message = message
+
+	return generations, true
+}
+
+func (b *botImpl) processUpscaleThisCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	generations, ok := b.messageCommandGenerations(s, i)
+	if !ok || !b.mayUseResult(s, i) {
+		return
+	}
+
+	images := make([]*entities.ImageGeneration, 0, len(generations))
+	for _, generation := range generations {
+		if generation.SortOrder > 0 {
+			images = append(images, generation)
+		}
+	}
+
+	switch len(images) {
+	case 0:
+		b.respondEphemeral(s, i, "I'm sorry, but that invision has no images to upscale.")
+	case 1:
+		b.processInvisionUpscale(s, i, images[0].SortOrder, "")
+	default:
+		b.respondUpscaleChoices(s, i, images)
+	}
+}
+
+// respondUpscaleChoices asks which image of a grid to upscale. The custom IDs of the buttons are
+// "invision_context_upscale_<message ID>_<sort order>".
+func (b *botImpl) respondUpscaleChoices(s *discordgo.Session, i *discordgo.InteractionCreate, images []*entities.ImageGeneration) {
+	content := "Which image do you want me to upscale?"
+
+	if len(images) > maxUpscaleChoices {
+		content = fmt.Sprintf("Which image do you want me to upscale? I can offer the first %d.", maxUpscaleChoices)
+		images = images[:maxUpscaleChoices]
+	}
+
+	rows := make([]discordgo.MessageComponent, 0, (len(images)+4)/5)
+	buttons := make([]discordgo.MessageComponent, 0, 5)
+
+	for _, image := range images {
+		buttons = append(buttons, discordgo.Button{
+			Label:    strconv.Itoa(image.SortOrder),
+			Style:    discordgo.SecondaryButton,
+			CustomID: fmt.Sprintf("%s%s_%d", contextUpscalePrefix, i.Message.ID, image.SortOrder),
+			Emoji: discordgo.ComponentEmoji{
+				Name: "⬆️",
+			},
+		})
+
+		if len(buttons) == 5 {
+			rows = append(rows, discordgo.ActionsRow{Components: buttons})
+			buttons = make([]discordgo.MessageComponent, 0, 5)
+		}
+	}
+
+	if len(buttons) > 0 {
+		rows = append(rows, discordgo.ActionsRow{Components: buttons})
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: rows,
+			Flags:      discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// processContextUpscale upscales the image picked from the choices of the "Upscale this" command.
+func (b *botImpl) processContextUpscale(s *discordgo.Session, i *discordgo.InteractionCreate, customID string) {
+	messageID, sortOrderString, found := strings.Cut(strings.TrimPrefix(customID, contextUpscalePrefix), "_")
+
+	sortOrder, err := strconv.Atoi(sortOrderString)
+	if !found || err != nil {
+		b.logger.Warn("Malformed context upscale custom ID", "custom_id", customID, "error", err)
+
+		return
+	}
+
+	message, err := s.ChannelMessage(i.ChannelID, messageID)
+	if err != nil {
+		b.logger.Error("Error getting message to upscale", "message_id", messageID, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't find that message anymore.")
+
+		return
+	}
+
+	i.Message = message
+
+	if !b.mayUseResult(s, i) {
+		return
+	}
+
+	b.processInvisionUpscale(s, i, sortOrder, "")
+}
+
+func (b *botImpl) processShowParametersCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	generations, ok := b.messageCommandGenerations(s, i)
+	if !ok {
+		return
+	}
+
+	b.respondParameters(s, i, generations)
+}
+
+func (b *botImpl) processRerunCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	generations, ok := b.messageCommandGenerations(s, i)
+	if !ok || !b.mayUseResult(s, i) {
+		return
+	}
+
+	b.processInvisionHistoryRerun(s, i, generations[0].ID)
+}
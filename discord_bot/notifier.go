@@ -0,0 +1,133 @@
+package discord_bot
+
+import (
+	"context"
+	"kinshi_vision_bot/invision_queue"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// spoilerFilePrefix makes Discord hide an attachment until it is clicked.
+const spoilerFilePrefix = "SPOILER_"
+
+// interactionNotifier shows the progress and the outcome of a queue item by editing the
+// response to the interaction that requested it.
+type interactionNotifier struct {
+	session     *discordgo.Session
+	interaction *discordgo.Interaction
+}
+
+func (n *interactionNotifier) Progress(ctx context.Context, progress *invision_queue.Progress) (string, error) {
+	message, err := n.session.InteractionResponseEdit(n.interaction, &discordgo.WebhookEdit{
+		Content: &progress.Message,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return message.ID, nil
+}
+
+func (n *interactionNotifier) Deliver(ctx context.Context, result *invision_queue.Result) (string, error) {
+	fileName := result.FileName
+	if result.Spoiler {
+		fileName = spoilerFilePrefix + fileName
+	}
+
+	edit := &discordgo.WebhookEdit{
+		Content: &result.Message,
+		Files: []*discordgo.File{
+			{
+				ContentType: "image/png",
+				Name:        fileName,
+				Reader:      result.Image,
+			},
+		},
+	}
+
+	switch result.Kind {
+	case invision_queue.ResultGrid:
+		edit.Components = gridComponents(len(result.Images))
+	case invision_queue.ResultSingle:
+		edit.Components = resultComponents(result.CanVary)
+	}
+
+	message, err := n.session.InteractionResponseEdit(n.interaction, edit)
+	if err != nil {
+		return "", err
+	}
+
+	return message.ID, nil
+}
+
+func (n *interactionNotifier) Fail(ctx context.Context, message string) error {
+	_, err := n.session.InteractionResponseEdit(n.interaction, &discordgo.WebhookEdit{
+		Content: &message,
+	})
+
+	return err
+}
+
+// itemOrigin describes who used an interaction and where, for the queue. The message of the
+// interaction is the result whose buttons were clicked, if any.
+func (b *botImpl) itemOrigin(s *discordgo.Session, i *discordgo.InteractionCreate) invision_queue.Origin {
+	origin := invision_queue.Origin{
+		GuildID:       i.GuildID,
+		ChannelID:     i.ChannelID,
+		InteractionID: i.ID,
+	}
+
+	if i.Member != nil {
+		origin.RoleIDs = i.Member.Roles
+
+		if i.Member.User != nil {
+			origin.MemberID = i.Member.User.ID
+		}
+	}
+
+	if i.Message != nil {
+		origin.MessageID = i.Message.ID
+
+		if len(i.Message.Attachments) > 0 {
+			origin.SourceImageURL = i.Message.Attachments[0].URL
+		}
+	}
+
+	channel := b.channel(s, i.ChannelID)
+	if channel == nil {
+		return origin
+	}
+
+	// threads follow the rules and the age restriction of their channel
+	if channel.IsThread() {
+		origin.ParentChannelID = channel.ParentID
+
+		parent := b.channel(s, channel.ParentID)
+		origin.NSFWChannel = parent != nil && parent.NSFW
+	} else {
+		origin.NSFWChannel = channel.NSFW
+	}
+
+	return origin
+}
+
+// channel looks up a channel in the session state, falling back to the API.
+func (b *botImpl) channel(s *discordgo.Session, channelID string) *discordgo.Channel {
+	if channelID == "" {
+		return nil
+	}
+
+	channel, err := s.State.Channel(channelID)
+	if err == nil {
+		return channel
+	}
+
+	channel, err = s.Channel(channelID)
+	if err != nil {
+		b.logger.Warn("Error getting channel", "channel_id", channelID, "error", err)
+
+		return nil
+	}
+
+	return channel
+}
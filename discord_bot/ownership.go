@@ -0,0 +1,127 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/logging"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// moderatorPermissions let a member use and delete the results of others, besides the admins.
+const moderatorPermissions int64 = discordgo.PermissionManageMessages
+
+// resultComponentPrefixes are the custom IDs of the buttons and menus on results, which the
+// owner only policy applies to.
+var resultComponentPrefixes = []string{
+	"invision_reroll",
+	"invision_upscale_",
+	"invision_upscaler",
+	"invision_variation_",
+	"invision_img2img_",
+	"invision_edit",
+}
+
+func isResultComponent(customID string) bool {
+	for _, prefix := range resultComponentPrefixes {
+		if strings.HasPrefix(customID, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isModerator checks whether a member may act on the results of other members.
+func (b *botImpl) isModerator(member *discordgo.Member) bool {
+	if member == nil {
+		return false
+	}
+
+	return member.Permissions&moderatorPermissions != 0 || b.isAdmin(member)
+}
+
+// resultOwner returns the member who asked for the result posted in a message.
+func (b *botImpl) resultOwner(ctx context.Context, message *discordgo.Message) (string, error) {
+	if message == nil {
+		return "", fmt.Errorf("missing message")
+	}
+
+	generation, err := b.imageGenerationRepo.GetByMessage(ctx, message.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return generation.MemberID, nil
+}
+
+// mayUseResult applies the owner only policy of the guild to a result component. It tells the
+// member when they are not allowed to use it.
+func (b *botImpl) mayUseResult(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	settings, err := b.invisionQueue.GetBotDefaultSettings(i.GuildID)
+	if err != nil {
+		b.logger.Warn("Error getting settings for ownership check", "guild_id", i.GuildID, "error", err)
+
+		return true
+	}
+
+	if !settings.OwnerOnlyButtons || i.Member == nil || b.isModerator(i.Member) {
+		return true
+	}
+
+	owner, err := b.resultOwner(logging.NewContext(context.Background(), b.logger), i.Message)
+	if err != nil {
+		// without a stored owner, the handler reports the missing generation itself
+		b.logger.Warn("Error getting result owner", "error", err)
+
+		return true
+	}
+
+	if owner == i.Member.User.ID {
+		return true
+	}
+
+	b.respondEphemeral(s, i, fmt.Sprintf("Only <@%s> and moderators can use the buttons of this result.", owner))
+
+	return false
+}
+
+// processInvisionDelete removes the message of a result and marks its generations as deleted, when
+// the member asked for it or is a moderator.
+func (b *botImpl) processInvisionDelete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	ctx := logging.NewContext(context.Background(), b.logger)
+
+	owner, err := b.resultOwner(ctx, i.Message)
+	if err != nil {
+		b.logger.Error("Error getting result owner", "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't find who asked for this result.")
+
+		return
+	}
+
+	if owner != i.Member.User.ID && !b.isModerator(i.Member) {
+		b.respondEphemeral(s, i, fmt.Sprintf("Only <@%s> and moderators can delete this result.", owner))
+
+		return
+	}
+
+	err = s.ChannelMessageDelete(i.ChannelID, i.Message.ID)
+	if err != nil {
+		b.logger.Error("Error deleting message", "message_id", i.Message.ID, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't delete this result.")
+
+		return
+	}
+
+	err = b.imageGenerationRepo.MarkDeletedByMessage(ctx, i.Message.ID)
+	if err != nil {
+		b.logger.Error("Error marking generations as deleted", "message_id", i.Message.ID, "error", err)
+	}
+
+	b.logger.Info("Deleted result", "message_id", i.Message.ID, "owner_id", owner, "member_id", i.Member.User.ID)
+
+	b.respondEphemeral(s, i, "The result was deleted.")
+}
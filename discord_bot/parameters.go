@@ -0,0 +1,248 @@
+package discord_bot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxListedSeeds keeps the seeds of large labeled grids from filling the reply.
+	maxListedSeeds = 8
+	// parametersFieldSize shortens the prompts and styles in the details, the reproduce command keeps them whole.
+	parametersFieldSize = 350
+	// reproduceCommandFileName is the attachment for commands too long for the reply.
+	reproduceCommandFileName = "invision_command.txt"
+)
+
+// processInvisionParameters shows the stored parameters of the result a parameters button is on.
+func (b *botImpl) processInvisionParameters(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	generations, err := b.imageGenerationRepo.ListByMessage(logging.NewContext(context.Background(), b.logger), i.Message.ID)
+	if err == nil && len(generations) == 0 {
+		err = fmt.Errorf("no generations for message")
+	}
+
+	if err != nil {
+		b.logger.Error("Error getting image generations", "message_id", i.Message.ID, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't find how this result was made.")
+
+		return
+	}
+
+	b.respondParameters(s, i, generations)
+}
+
+// respondParameters replies with every stored parameter of a result and a command that makes it
+// again, only to the member who asked. The first generation is the grid or single result, the
+// others its images.
+func (b *botImpl) respondParameters(s *discordgo.Session, i *discordgo.InteractionCreate, generations []*entities.ImageGeneration) {
+	serverNegativePrompt := ""
+
+	settings, err := b.invisionQueue.GetBotDefaultSettings(i.GuildID)
+	if err != nil {
+		b.logger.Warn("Error getting bot settings", "guild_id", i.GuildID, "error", err)
+	} else {
+		serverNegativePrompt = settings.NegativePrompt
+	}
+
+	content, attachedCommand := parametersContent(b.invisionCommandString(), generations, serverNegativePrompt)
+
+	data := &discordgo.InteractionResponseData{
+		Content: content,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	}
+
+	if attachedCommand != "" {
+		data.Files = []*discordgo.File{
+			{
+				ContentType: "text/plain",
+				Name:        reproduceCommandFileName,
+				Reader:      bytes.NewReader([]byte(attachedCommand)),
+			},
+		}
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// parametersContent renders the reply of the parameters button. The reproduce command is returned
+// separately when it doesn't fit into the reply, so it can be attached as a file instead.
+func parametersContent(command string, generations []*entities.ImageGeneration, serverNegativePrompt string) (string, string) {
+	generation := generations[0]
+
+	seeds := make([]string, 0, len(generations))
+	seed := generation.Seed
+	subseed := generation.Subseed
+
+	for _, image := range generations {
+		if image.SortOrder == 0 {
+			continue
+		}
+
+		// the images know the seeds the WebUI picked, the grid may only have -1 for a random one
+		if len(seeds) == 0 {
+			seed = image.Seed
+			subseed = image.Subseed
+		}
+
+		if len(seeds) == maxListedSeeds {
+			seeds = append(seeds, "…")
+
+			break
+		}
+
+		seeds = append(seeds, strconv.FormatInt(image.Seed, 10))
+	}
+
+	var content strings.Builder
+
+	fmt.Fprintf(&content, "**Prompt:** `%s`\n", shortenField(strings.Trim(generation.Prompt, "`")))
+
+	if generation.NegativePrompt == serverNegativePrompt {
+		content.WriteString("**Negative prompt:** the default of the server\n")
+	} else {
+		fmt.Fprintf(&content, "**Negative prompt:** `%s`\n", shortenField(strings.Trim(generation.NegativePrompt, "`")))
+	}
+
+	if generation.Styles != "" {
+		fmt.Fprintf(&content, "**Styles:** %s (already merged into the prompts)\n", shortenField(generation.Styles))
+	}
+
+	fmt.Fprintf(&content, "**Size:** %dx%d, **steps** %d, **CFG scale** %s, **sampler** %s, **restore faces** %s\n",
+		generation.Width, generation.Height, generation.Steps, formatParameter(generation.CfgScale), generation.SamplerName,
+		formatBoolSetting(generation.RestoreFaces))
+
+	fmt.Fprintf(&content, "**Seed:** %s", seedString(generation.Seed))
+	if len(seeds) > 0 {
+		fmt.Fprintf(&content, " (images: %s)", strings.Join(seeds, ", "))
+	}
+
+	content.WriteString("\n")
+
+	if generation.SubseedStrength > 0 {
+		fmt.Fprintf(&content, "**Subseed:** %s at strength %s\n", seedString(int64(subseed)), formatParameter(generation.SubseedStrength))
+	}
+
+	if generation.VariationStrength > 0 {
+		fmt.Fprintf(&content, "**Variation strength:** %s\n", formatParameter(generation.VariationStrength))
+	}
+
+	if generation.EnableHR {
+		fmt.Fprintf(&content, "**Hires.fix:** %sx with %s", formatParameter(generation.HRUpscaleRate), generation.HRUpscaler)
+		if generation.HiresWidth > 0 && generation.HiresHeight > 0 {
+			fmt.Fprintf(&content, " to %dx%d", generation.HiresWidth, generation.HiresHeight)
+		}
+
+		fmt.Fprintf(&content, ", denoising %s\n", formatParameter(generation.DenoisingStrength))
+	} else {
+		content.WriteString("**Hires.fix:** off\n")
+	}
+
+	fmt.Fprintf(&content, "**Batch:** %d x %d\n", generation.BatchCount, generation.BatchSize)
+
+	if generation.Upscaler != "" {
+		fmt.Fprintf(&content, "**Upscaled with:** %s\n", generation.Upscaler)
+	} else if generation.SourceID != 0 {
+		fmt.Fprintf(&content, "**Reworked with img2img** at denoising %s\n", formatParameter(generation.DenoisingStrength))
+	}
+
+	if generation.MemberID != "" {
+		fmt.Fprintf(&content, "Made by <@%s> <t:%d:R>\n", generation.MemberID, generation.CreatedAt.Unix())
+	}
+
+	switch {
+	case generation.Upscaler == "" && generation.SourceID != 0:
+		content.WriteString("\nThe command below only makes a new image from the prompt, img2img needs the image it started from")
+	case generation.Upscaler != "":
+		content.WriteString("\nMake the image before the upscale again with")
+	case len(seeds) > 1:
+		content.WriteString("\nMake it again, starting from the seed of the first image, with")
+	default:
+		content.WriteString("\nMake it again with")
+	}
+
+	reproduced := reproduceCommand(command, generation, seed, subseed, serverNegativePrompt)
+	commandBlock := fmt.Sprintf(":\n```\n%s\n```", reproduced)
+
+	if len([]rune(content.String()))+len([]rune(commandBlock)) > messageContentLimit {
+		content.WriteString(" the attached command.")
+
+		return content.String(), reproduced
+	}
+
+	content.WriteString(commandBlock)
+
+	return content.String(), ""
+}
+
+// shortenField keeps a long prompt from filling the parameters reply.
+func shortenField(value string) string {
+	if len([]rune(value)) > parametersFieldSize {
+		return string([]rune(value)[:parametersFieldSize]) + "…"
+	}
+
+	return value
+}
+
+// reproduceCommand writes the invision command that makes a generation again, with the parameters
+// the options don't cover as flags in the prompt.
+func reproduceCommand(command string, generation *entities.ImageGeneration, seed int64, subseed int, serverNegativePrompt string) string {
+	var reproduced strings.Builder
+
+	fmt.Fprintf(&reproduced, "/%s prompt:%s --px %d,%d --step %d --cfgscale %s", command, strings.Trim(generation.Prompt, "`"),
+		generation.Width, generation.Height, generation.Steps, formatParameter(generation.CfgScale))
+
+	if seed >= 0 {
+		fmt.Fprintf(&reproduced, " --seed %d", seed)
+	}
+
+	switch {
+	case generation.SubseedStrength > 0 && subseed >= 0:
+		fmt.Fprintf(&reproduced, " --subseed %d --vary %s", subseed, formatParameter(generation.SubseedStrength))
+	case generation.VariationStrength > 0:
+		fmt.Fprintf(&reproduced, " --vary %s", formatParameter(generation.VariationStrength))
+	}
+
+	if generation.EnableHR {
+		fmt.Fprintf(&reproduced, " --zoom %s", formatParameter(generation.HRUpscaleRate))
+	}
+
+	if generation.NegativePrompt != serverNegativePrompt {
+		fmt.Fprintf(&reproduced, " negative_prompt:%s", generation.NegativePrompt)
+	}
+
+	if generation.SamplerName != "" {
+		fmt.Fprintf(&reproduced, " sampler_name:%s", generation.SamplerName)
+	}
+
+	if generation.EnableHR {
+		reproduced.WriteString(" use_hires_fix:Yes")
+	}
+
+	return reproduced.String()
+}
+
+func seedString(seed int64) string {
+	if seed < 0 {
+		return "random"
+	}
+
+	return strconv.FormatInt(seed, 10)
+}
+
+func formatParameter(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
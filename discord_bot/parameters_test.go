@@ -0,0 +1,76 @@
+package discord_bot
+
+import (
+	"kinshi_vision_bot/entities"
+	"strings"
+	"testing"
+)
+
+func TestParametersContent(t *testing.T) {
+	generation := &entities.ImageGeneration{
+		Prompt:         "a cat",
+		NegativePrompt: "blurry",
+		Width:          512,
+		Height:         512,
+		Steps:          20,
+		CfgScale:       7,
+		SamplerName:    "Euler a",
+		Seed:           42,
+	}
+	image := &entities.ImageGeneration{Seed: 42, SortOrder: 1}
+
+	tests := []struct {
+		name           string
+		prompt         string
+		negativePrompt string
+		// attached is whether the reproduce command doesn't fit into the reply.
+		attached bool
+	}{
+		{
+			name:           "short prompts",
+			prompt:         "a cat",
+			negativePrompt: "blurry",
+		},
+		{
+			name:           "long negative prompt",
+			prompt:         "a cat",
+			negativePrompt: strings.Repeat("blurry, ", 200),
+			attached:       true,
+		},
+		{
+			name:           "long prompts",
+			prompt:         strings.Repeat("a cat, ", 250),
+			negativePrompt: strings.Repeat("blurry, ", 250),
+			attached:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grid := *generation
+			grid.Prompt = tt.prompt
+			grid.NegativePrompt = tt.negativePrompt
+
+			content, attachedCommand := parametersContent("invision", []*entities.ImageGeneration{&grid, image}, "lowres")
+
+			if length := len([]rune(content)); length > messageContentLimit {
+				t.Errorf("expected the reply to fit into a message, got %d characters", length)
+			}
+
+			if (attachedCommand != "") != tt.attached {
+				t.Fatalf("expected the command to be attached: %t, got %q", tt.attached, attachedCommand)
+			}
+
+			command := attachedCommand
+			if !tt.attached {
+				command = content[strings.Index(content, "```\n")+4 : strings.LastIndex(content, "\n```")]
+			} else if strings.Contains(content, "```") {
+				t.Errorf("expected no command in the reply when it's attached, got %q", content)
+			}
+
+			if !strings.HasPrefix(command, "/invision prompt:"+tt.prompt) || !strings.Contains(command, " negative_prompt:"+tt.negativePrompt) {
+				t.Errorf("expected the command to keep the whole prompts, got %q", command)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/logging"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func (b *botImpl) invisionQuotaCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_quota"
+	}
+
+	return b.invisionCommand + "_quota"
+}
+
+func (b *botImpl) addInvisionQuotaCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionQuotaCommandString())
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionQuotaCommandString(),
+		Description: "Show how many invisions you have left",
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionQuotaCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *botImpl) processInvisionQuotaCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	ctx := logging.NewContext(context.Background(), b.logger)
+
+	usage, err := b.quotaTracker.Usage(ctx, i.GuildID, i.Member.User.ID, i.Member.Roles)
+	if err != nil {
+		b.logger.Error("Error getting quota usage", "member_id", i.Member.User.ID, "error", err)
+
+		b.respondEphemeral(s, i, "Sorry, I couldn't look up your quota.")
+
+		return
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("**Your allowance on this server**\n")
+
+	if usage.GenerationsPerHour > 0 {
+		remaining := max(usage.GenerationsPerHour-usage.GenerationsLastHour, 0)
+
+		fmt.Fprintf(&sb, "Invisions this hour: %d of %d used, %d left",
+			usage.GenerationsLastHour, usage.GenerationsPerHour, remaining)
+
+		if usage.GenerationsLastHour > 0 {
+			fmt.Fprintf(&sb, " (the oldest stops counting <t:%d:R>)", usage.HourlyResetAt.Unix())
+		}
+
+		sb.WriteString("\n")
+	} else {
+		fmt.Fprintf(&sb, "Invisions this hour: %d, unlimited\n", usage.GenerationsLastHour)
+	}
+
+	if usage.DailyGPUSeconds > 0 {
+		remaining := max(float64(usage.DailyGPUSeconds)-usage.GPUSecondsToday, 0)
+
+		fmt.Fprintf(&sb, "GPU time today: %.0fs of %ds used, %.0fs left (resets <t:%d:R>)\n",
+			usage.GPUSecondsToday, usage.DailyGPUSeconds, remaining, usage.DailyResetAt.Unix())
+	} else {
+		fmt.Fprintf(&sb, "GPU time today: %.0fs, unlimited\n", usage.GPUSecondsToday)
+	}
+
+	b.respondEphemeral(s, i, sb.String())
+}
@@ -0,0 +1,139 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const searchResultLimit = 8
+
+func (b *botImpl) invisionSearchCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_search"
+	}
+
+	return b.invisionCommand + "_search"
+}
+
+func (b *botImpl) addInvisionSearchCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionSearchCommandString())
+
+	minDays := float64(1)
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionSearchCommandString(),
+		Description: "Search all invisions by prompt",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "query",
+				Description: "Words the prompt must contain. End a word with * to match prefixes",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "days",
+				Description: "Only search invisions from the last N days",
+				Required:    false,
+				MinValue:    &minDays,
+				MaxValue:    historyMaxDays,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "include_negative",
+				Description: "Also search the negative prompts",
+				Required:    false,
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionSearchCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *botImpl) processInvisionSearchCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+
+	query := ""
+	from := time.Time{}
+	includeNegative := false
+
+	if option, ok := optionMap["query"]; ok {
+		query = option.StringValue()
+	}
+
+	if option, ok := optionMap["days"]; ok {
+		from = time.Now().AddDate(0, 0, -int(option.IntValue()))
+	}
+
+	if option, ok := optionMap["include_negative"]; ok {
+		includeNegative = option.BoolValue()
+	}
+
+	var content string
+
+	// fetch one extra row to find out whether there are more results
+	generations, err := b.imageGenerationRepo.Search(context.Background(), i.GuildID, query, includeNegative, from, searchResultLimit+1, 0)
+	if err != nil {
+		b.logger.Error("Error searching invisions", "query", query, "error", err)
+
+		content = "I'm sorry, but I couldn't search for that."
+	} else {
+		content = searchResultContent(i.GuildID, query, generations)
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+func searchResultContent(guildID, query string, generations []*entities.ImageGeneration) string {
+	var content strings.Builder
+
+	if len(generations) == 0 {
+		fmt.Fprintf(&content, "No invisions found for \"%s\".", query)
+
+		return content.String()
+	}
+
+	if len(generations) > searchResultLimit {
+		fmt.Fprintf(&content, "Newest %d invisions matching \"%s\":\n", searchResultLimit, query)
+
+		generations = generations[:searchResultLimit]
+	} else {
+		fmt.Fprintf(&content, "Invisions matching \"%s\":\n", query)
+	}
+
+	for idx, generation := range generations {
+		fmt.Fprintf(&content, "\n**%d.** <@%s> %s\n", idx+1, generation.MemberID, generationSummary(generation))
+
+		if link := messageLink(guildID, generation); link != "" {
+			fmt.Fprintf(&content, "<t:%d:R> — %s\n", generation.CreatedAt.Unix(), link)
+		} else {
+			fmt.Fprintf(&content, "<t:%d:R>\n", generation.CreatedAt.Unix())
+		}
+	}
+
+	return content.String()
+}
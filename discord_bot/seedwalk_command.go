@@ -0,0 +1,145 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/logging"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const defaultSeedWalkSteps = 5
+
+func (b *botImpl) invisionSeedWalkCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_seedwalk"
+	}
+
+	return b.invisionCommand + "_seedwalk"
+}
+
+func variationStrengthChoices() []*discordgo.ApplicationCommandOptionChoice {
+	return []*discordgo.ApplicationCommandOptionChoice{
+		{Name: "Subtle", Value: invision_queue.VariationStrengthSubtle},
+		{Name: "Medium", Value: invision_queue.VariationStrengthMedium},
+		{Name: "Strong", Value: invision_queue.VariationStrengthStrong},
+	}
+}
+
+func (b *botImpl) addInvisionSeedWalkCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionSeedWalkCommandString())
+
+	minSeed := 0.0
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionSeedWalkCommandString(),
+		Description: "Blend a prompt from one seed into another, step by step",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "The text prompt to invision",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "from_seed",
+				Description: "The seed to start from",
+				Required:    true,
+				MinValue:    &minSeed,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "to_seed",
+				Description: "The seed to end at",
+				Required:    true,
+				MinValue:    &minSeed,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "images",
+				Description: fmt.Sprintf("Number of images of the walk. default=%d", defaultSeedWalkSteps),
+				Required:    false,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "negative_prompt",
+				Description: "Negative prompt",
+				Required:    false,
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionSeedWalkCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *botImpl) processInvisionSeedWalkCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+
+	steps := defaultSeedWalkSteps
+
+	if option, ok := optionMap["images"]; ok {
+		steps = int(option.IntValue())
+	}
+
+	walk, err := invision_queue.NewSeedWalk(optionMap["from_seed"].IntValue(), optionMap["to_seed"].IntValue(), steps)
+	if err != nil {
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	var policyNotes []string
+
+	moderated, err := b.moderator.Check(logging.NewContext(context.Background(), b.logger), i.GuildID, i.Member.User.ID,
+		optionMap["prompt"].StringValue())
+	if err != nil {
+		b.logger.Info("Prompt refused by moderation", "member_id", i.Member.User.ID, "error", err)
+
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	if moderated.Rewritten {
+		policyNotes = append(policyNotes, "Parts of your prompt were replaced by the moderation rules of this server.")
+	}
+
+	item := &invision_queue.QueueItem{
+		Prompt:   moderated.Prompt,
+		Type:     invision_queue.ItemTypeSeedWalk,
+		SeedWalk: walk,
+	}
+
+	if option, ok := optionMap["negative_prompt"]; ok {
+		item.NegativePrompt = option.StringValue()
+	}
+
+	position, queued := b.queueInvision(s, i, item)
+	if !queued {
+		return
+	}
+
+	policyNotes = append(policyNotes, item.PolicyNotes...)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: withPolicyNotes(fmt.Sprintf("I'm setting up your seed walk. You are currently #%d in line.", position), policyNotes),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
@@ -0,0 +1,149 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/logging"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const imageToImageModalPrefix = "invision_img2img_modal_"
+
+// modalValues maps the custom IDs of the text inputs of a submitted modal to their values.
+func modalValues(data discordgo.ModalSubmitInteractionData) map[string]string {
+	values := make(map[string]string)
+
+	for _, component := range data.Components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+
+		for _, rowComponent := range row.Components {
+			if input, ok := rowComponent.(*discordgo.TextInput); ok {
+				values[input.CustomID] = input.Value
+			}
+		}
+	}
+
+	return values
+}
+
+func textInputRow(input discordgo.TextInput) discordgo.MessageComponent {
+	return discordgo.ActionsRow{Components: []discordgo.MessageComponent{input}}
+}
+
+// processInvisionImageToImageButton opens a modal to rework the image of a single result,
+// prefilled with the prompt it was made from.
+func (b *botImpl) processInvisionImageToImageButton(s *discordgo.Session, i *discordgo.InteractionCreate, resultIndex int) {
+	ctx := logging.NewContext(context.Background(), b.logger)
+
+	generation, err := b.imageGenerationRepo.GetByMessageAndSort(ctx, i.Message.ID, resultIndex)
+	if err != nil {
+		b.logger.Error("Error getting image generation", "message_id", i.Message.ID, "sort_order", resultIndex, "error", err)
+
+		b.respondEphemeral(s, i, "I'm sorry, but I couldn't find how this image was made.")
+
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: imageToImageModalPrefix + strconv.Itoa(resultIndex),
+			Title:    "Rework this image",
+			Components: []discordgo.MessageComponent{
+				textInputRow(discordgo.TextInput{
+					CustomID:  "prompt",
+					Label:     "Prompt",
+					Style:     discordgo.TextInputParagraph,
+					Value:     strings.Trim(generation.Prompt, "`"),
+					Required:  true,
+					MaxLength: 1000,
+				}),
+				textInputRow(discordgo.TextInput{
+					CustomID:  "negative_prompt",
+					Label:     "Negative prompt",
+					Style:     discordgo.TextInputParagraph,
+					Value:     generation.NegativePrompt,
+					Required:  false,
+					MaxLength: 1000,
+				}),
+				textInputRow(discordgo.TextInput{
+					CustomID:    "denoising_strength",
+					Label:       "Denoising strength (0.05 to 1, how much changes)",
+					Style:       discordgo.TextInputShort,
+					Placeholder: "0.5",
+					Required:    false,
+					MaxLength:   4,
+				}),
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
+
+// processInvisionImageToImageModal queues the img2img submitted with the modal of a single result.
+func (b *botImpl) processInvisionImageToImageModal(s *discordgo.Session, i *discordgo.InteractionCreate, resultIndex int) {
+	values := modalValues(i.ModalSubmitData())
+
+	denoisingStrength := 0.0
+
+	if value := strings.TrimSpace(values["denoising_strength"]); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0.05 || parsed > 1 {
+			b.respondEphemeral(s, i, "The denoising strength must be a number from 0.05 to 1.")
+
+			return
+		}
+
+		denoisingStrength = parsed
+	}
+
+	var policyNotes []string
+
+	moderated, err := b.moderator.Check(logging.NewContext(context.Background(), b.logger), i.GuildID, i.Member.User.ID,
+		values["prompt"])
+	if err != nil {
+		b.logger.Info("Prompt refused by moderation", "member_id", i.Member.User.ID, "error", err)
+
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	if moderated.Rewritten {
+		policyNotes = append(policyNotes, "Parts of your prompt were replaced by the moderation rules of this server.")
+	}
+
+	item := &invision_queue.QueueItem{
+		Prompt:            moderated.Prompt,
+		NegativePrompt:    values["negative_prompt"],
+		Type:              invision_queue.ItemTypeImageToImage,
+		InteractionIndex:  resultIndex,
+		DenoisingStrength: denoisingStrength,
+	}
+
+	position, queued := b.queueInvision(s, i, item)
+	if !queued {
+		return
+	}
+
+	policyNotes = append(policyNotes, item.PolicyNotes...)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: withPolicyNotes(fmt.Sprintf("I'm reworking that image for you... You are currently #%d in line.", position), policyNotes),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
@@ -0,0 +1,339 @@
+package discord_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/moderation"
+	"kinshi_vision_bot/repositories"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	styleNameMaxLength = 32
+	// styleChoiceLimit is the most autocomplete choices Discord shows.
+	styleChoiceLimit = 25
+)
+
+func (b *botImpl) invisionStyleCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_style"
+	}
+
+	return b.invisionCommand + "_style"
+}
+
+func (b *botImpl) addInvisionStyleCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionStyleCommandString())
+
+	sharedOption := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionBoolean,
+		Name:        "shared",
+		Description: "A style shared with the whole server instead of a personal one (admins only)",
+		Required:    false,
+	}
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionStyleCommandString(),
+		Description: "Manage saved prompt styles",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "save",
+				Description: "Save a style, replacing the one with the same name",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "name",
+						Description: "Name of the style",
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "prompt",
+						Description: "Added to the prompt. Use {prompt} to place the prompt inside it",
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "negative_prompt",
+						Description: "Added to the negative prompt",
+						Required:    false,
+					},
+					sharedOption,
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "remove",
+				Description: "Remove a style",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "name",
+						Description: "Name of the style",
+						Required:    true,
+					},
+					sharedOption,
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List your styles and the shared styles of this server",
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionStyleCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *botImpl) processInvisionStyleCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	if len(data.Options) == 0 {
+		return
+	}
+
+	subCommand := data.Options[0]
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(subCommand.Options))
+	for _, opt := range subCommand.Options {
+		optionMap[opt.Name] = opt
+	}
+
+	ownerID := i.Member.User.ID
+
+	if option, ok := optionMap["shared"]; ok && option.BoolValue() {
+		if !b.isAdmin(i.Member) {
+			b.respondEphemeral(s, i, "Only admins can change the shared styles.")
+
+			return
+		}
+
+		ownerID = ""
+	}
+
+	var content string
+
+	switch subCommand.Name {
+	case "save":
+		content = b.styleSave(i.GuildID, i.Member.User.ID, ownerID, optionMap)
+	case "remove":
+		content = b.styleRemove(i.GuildID, ownerID, optionMap["name"].StringValue())
+	case "list":
+		content = b.styleList(i.GuildID, i.Member.User.ID)
+	default:
+		b.logger.Warn("Unknown style subcommand", "subcommand", subCommand.Name)
+
+		content = "Unknown style command."
+	}
+
+	b.respondEphemeral(s, i, content)
+}
+
+// styleSave stores a style for ownerID, which is empty for a shared style. The prompt
+// fragment goes through the moderation rules, like the prompt of an invision.
+func (b *botImpl) styleSave(guildID, memberID, ownerID string, optionMap map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+	ctx := logging.NewContext(context.Background(), b.logger)
+
+	name := strings.TrimSpace(optionMap["name"].StringValue())
+	if name == "" || strings.Contains(name, ",") || utf8.RuneCountInString(name) > styleNameMaxLength {
+		return fmt.Sprintf("Style names can't be empty, contain commas or be longer than %d characters.", styleNameMaxLength)
+	}
+
+	style := &entities.Style{
+		GuildID:  guildID,
+		MemberID: ownerID,
+		Name:     name,
+		Prompt:   optionMap["prompt"].StringValue(),
+	}
+
+	if option, ok := optionMap["negative_prompt"]; ok {
+		style.NegativePrompt = option.StringValue()
+	}
+
+	moderated, err := b.moderator.Check(ctx, guildID, memberID, style.Prompt)
+	if err != nil {
+		return b.styleModerationError(name, err)
+	}
+
+	style.Prompt = moderated.Prompt
+
+	_, err = b.styleRepo.Upsert(ctx, style)
+	if err != nil {
+		b.logger.Error("Error saving style", "name", name, "error", err)
+
+		return "I'm sorry, but I couldn't save the style."
+	}
+
+	b.logger.Info("Saved style", "guild_id", guildID, "member_id", memberID, "name", name, "shared", ownerID == "")
+
+	return fmt.Sprintf("Saved the style **%s**.", name)
+}
+
+func (b *botImpl) styleModerationError(name string, err error) string {
+	var rejectedErr *moderation.RejectedError
+	if errors.As(err, &rejectedErr) {
+		return fmt.Sprintf("The style **%s** was refused by the moderation rules of this server.", name)
+	}
+
+	b.logger.Error("Error moderating style", "name", name, "error", err)
+
+	return "I'm sorry, but I couldn't check the style."
+}
+
+func (b *botImpl) styleRemove(guildID, ownerID, name string) string {
+	err := b.styleRepo.Delete(context.Background(), guildID, ownerID, strings.TrimSpace(name))
+	if err != nil {
+		var notFoundErr *repositories.NotFoundError
+		if errors.As(err, &notFoundErr) {
+			return fmt.Sprintf("There is no style named **%s**.", name)
+		}
+
+		b.logger.Error("Error removing style", "name", name, "error", err)
+
+		return "I'm sorry, but I couldn't remove the style."
+	}
+
+	return fmt.Sprintf("Removed the style **%s**.", name)
+}
+
+func (b *botImpl) styleList(guildID, memberID string) string {
+	styles, err := b.styleRepo.ListAvailable(context.Background(), guildID, memberID)
+	if err != nil {
+		b.logger.Error("Error listing styles", "error", err)
+
+		return "I'm sorry, but I couldn't list the styles."
+	}
+
+	if len(styles) == 0 {
+		return "There are no styles yet. Save one with the save subcommand."
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("**Styles**\n")
+
+	for _, style := range styles {
+		kind := "personal"
+		if style.MemberID == "" {
+			kind = "shared"
+		}
+
+		fmt.Fprintf(&sb, "**%s** (%s): `%s`", style.Name, kind, style.Prompt)
+
+		if style.NegativePrompt != "" {
+			fmt.Fprintf(&sb, " negative: `%s`", style.NegativePrompt)
+		}
+
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// unknownStyleError is returned by resolveStyles for a name without a style.
+type unknownStyleError struct {
+	name string
+}
+
+func (e *unknownStyleError) Error() string {
+	return fmt.Sprintf("unknown style %q", e.name)
+}
+
+// resolveStyles looks up the comma separated style names of an invision. Personal styles
+// take precedence over shared ones with the same name.
+func (b *botImpl) resolveStyles(guildID, memberID, value string) ([]*entities.Style, error) {
+	styles := make([]*entities.Style, 0)
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		style, err := b.styleRepo.GetByName(context.Background(), guildID, memberID, name)
+		if err != nil {
+			var notFoundErr *repositories.NotFoundError
+			if errors.As(err, &notFoundErr) {
+				return nil, &unknownStyleError{name: name}
+			}
+
+			return nil, err
+		}
+
+		styles = append(styles, style)
+	}
+
+	return styles, nil
+}
+
+// processStyleAutocomplete suggests styles for the last name in the style option of the invision command.
+func (b *botImpl) processStyleAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	typed := ""
+
+	for _, opt := range i.ApplicationCommandData().Options {
+		if opt.Name == "style" && opt.Focused {
+			typed = opt.StringValue()
+		}
+	}
+
+	// earlier names of the list are kept, only the last one is completed
+	prefix := ""
+	partial := typed
+
+	if idx := strings.LastIndex(typed, ","); idx >= 0 {
+		prefix = typed[:idx+1] + " "
+		partial = typed[idx+1:]
+	}
+
+	partial = strings.ToLower(strings.TrimSpace(partial))
+
+	styles, err := b.styleRepo.ListAvailable(context.Background(), i.GuildID, i.Member.User.ID)
+	if err != nil {
+		b.logger.Error("Error listing styles for autocomplete", "error", err)
+
+		styles = nil
+	}
+
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0)
+	seen := make(map[string]bool)
+
+	for _, style := range styles {
+		key := strings.ToLower(style.Name)
+		if seen[key] || !strings.HasPrefix(key, partial) {
+			continue
+		}
+
+		seen[key] = true
+
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  prefix + style.Name,
+			Value: prefix + style.Name,
+		})
+
+		if len(choices) == styleChoiceLimit {
+			break
+		}
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to autocomplete", "error", err)
+	}
+}
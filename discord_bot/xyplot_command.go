@@ -0,0 +1,153 @@
+package discord_bot
+
+import (
+	"context"
+	"fmt"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/logging"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func (b *botImpl) invisionXYPlotCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.invisionCommand + "_xyplot"
+	}
+
+	return b.invisionCommand + "_xyplot"
+}
+
+func xyAxisChoices() []*discordgo.ApplicationCommandOptionChoice {
+	return []*discordgo.ApplicationCommandOptionChoice{
+		{Name: "Steps", Value: invision_queue.XYAxisSteps},
+		{Name: "CFG scale", Value: invision_queue.XYAxisCFGScale},
+		{Name: "Sampler", Value: invision_queue.XYAxisSampler},
+		{Name: "Seed", Value: invision_queue.XYAxisSeed},
+		{Name: "Model", Value: invision_queue.XYAxisModel},
+	}
+}
+
+func (b *botImpl) addInvisionXYPlotCommand() error {
+	b.logger.Info("Adding command", "command", b.invisionXYPlotCommandString())
+
+	err := b.createCommand(&discordgo.ApplicationCommand{
+		Name:        b.invisionXYPlotCommandString(),
+		Description: "Compare parameter values for the same prompt in a labeled grid",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "The text prompt to invision",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "x_axis",
+				Description: "Parameter that changes from column to column",
+				Required:    true,
+				Choices:     xyAxisChoices(),
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "x_values",
+				Description: "Comma separated values for the X axis, e.g. 5, 7.5, 10",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "y_axis",
+				Description: "Parameter that changes from row to row",
+				Required:    false,
+				Choices:     xyAxisChoices(),
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "y_values",
+				Description: "Comma separated values for the Y axis",
+				Required:    false,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "negative_prompt",
+				Description: "Negative prompt",
+				Required:    false,
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error creating command", "command", b.invisionXYPlotCommandString(), "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *botImpl) processInvisionXYPlotCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+
+	yAxis, yValues := "", ""
+
+	if option, ok := optionMap["y_axis"]; ok {
+		yAxis = option.StringValue()
+	}
+
+	if option, ok := optionMap["y_values"]; ok {
+		yValues = option.StringValue()
+	}
+
+	plot, err := invision_queue.NewXYPlot(optionMap["x_axis"].StringValue(), optionMap["x_values"].StringValue(), yAxis, yValues)
+	if err != nil {
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	var policyNotes []string
+
+	moderated, err := b.moderator.Check(logging.NewContext(context.Background(), b.logger), i.GuildID, i.Member.User.ID,
+		optionMap["prompt"].StringValue())
+	if err != nil {
+		b.logger.Info("Prompt refused by moderation", "member_id", i.Member.User.ID, "error", err)
+
+		b.respondQueueError(s, i, err)
+
+		return
+	}
+
+	if moderated.Rewritten {
+		policyNotes = append(policyNotes, "Parts of your prompt were replaced by the moderation rules of this server.")
+	}
+
+	item := &invision_queue.QueueItem{
+		Prompt: moderated.Prompt,
+		Type:   invision_queue.ItemTypeXYPlot,
+		XYPlot: plot,
+	}
+
+	if option, ok := optionMap["negative_prompt"]; ok {
+		item.NegativePrompt = option.StringValue()
+	}
+
+	position, queued := b.queueInvision(s, i, item)
+	if !queued {
+		return
+	}
+
+	policyNotes = append(policyNotes, item.PolicyNotes...)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: withPolicyNotes(fmt.Sprintf("I'm setting up your plot. You are currently #%d in line.", position), policyNotes),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error responding to interaction", "error", err)
+	}
+}
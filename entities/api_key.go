@@ -0,0 +1,13 @@
+package entities
+
+import "time"
+
+// APIKey lets a script submit invisions through the REST API, with the settings of its guild.
+// Only the SHA-256 hash of the key is stored.
+type APIKey struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	GuildID   string    `json:"guild_id"`
+	KeyHash   string    `json:"key_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
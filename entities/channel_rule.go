@@ -0,0 +1,8 @@
+package entities
+
+// ChannelRule allows or denies the invision commands in a channel of a guild.
+type ChannelRule struct {
+	GuildID   string `json:"guild_id"`
+	ChannelID string `json:"channel_id"`
+	Allowed   bool   `json:"allowed"`
+}
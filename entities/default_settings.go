@@ -1,9 +1,33 @@
 package entities
 
 type DefaultSettings struct {
-	MemberID string `json:"member_id"`
-	Width    int    `json:"width"`
-	Height   int    `json:"height"`
+	// GuildID is empty for the global settings that new guilds start from.
+	GuildID    string `json:"guild_id"`
+	MemberID   string `json:"member_id"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
 	BatchCount int    `json:"batch_count"`
 	BatchSize  int    `json:"batch_size"`
+
+	// Guild-wide settings, only used on the bot's own row of a guild.
+	NegativePrompt     string  `json:"negative_prompt"`
+	DefaultSteps       int     `json:"default_steps"`
+	MaxSteps           int     `json:"max_steps"`
+	DefaultCFGScale    float64 `json:"default_cfg_scale"`
+	MaxCFGScale        float64 `json:"max_cfg_scale"`
+	MaxDimension       int     `json:"max_dimension"`
+	MaxQueueLength     int     `json:"max_queue_length"`
+	MaxQueuedPerMember int     `json:"max_queued_per_member"`
+
+	// NSFWKeywords is a comma separated list of words that flag a prompt as NSFW.
+	NSFWKeywords string `json:"nsfw_keywords"`
+	// NSFWAction is what happens to flagged invisions outside of age-restricted channels,
+	// either "spoiler" or "block".
+	NSFWAction string `json:"nsfw_action"`
+	// OwnerOnlyButtons limits the buttons of a result to the member who asked for it and moderators.
+	OwnerOnlyButtons bool `json:"owner_only_buttons"`
+	// ShowcaseChannelID is where images are reposted once they reach ShowcaseThreshold favorites.
+	// No images are reposted when empty.
+	ShowcaseChannelID string `json:"showcase_channel_id"`
+	ShowcaseThreshold int    `json:"showcase_threshold"`
 }
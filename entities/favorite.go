@@ -0,0 +1,17 @@
+package entities
+
+import "time"
+
+// Favorite marks an image generation as one of the favorites of a member.
+type Favorite struct {
+	GenerationID int64     `json:"generation_id"`
+	GuildID      string    `json:"guild_id"`
+	MemberID     string    `json:"member_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// FavoriteCount is an image generation of the gallery, with how often it was favorited.
+type FavoriteCount struct {
+	GenerationID int64 `json:"generation_id"`
+	Favorites    int   `json:"favorites"`
+}
@@ -3,30 +3,49 @@ package entities
 import "time"
 
 type ImageGeneration struct {
-	ID                int64     `json:"id"`
-	InteractionID     string    `json:"interaction_id"`
-	MessageID         string    `json:"message_id"`
-	MemberID          string    `json:"member_id"`
-	SortOrder         int       `json:"sort_order"`
-	Prompt            string    `json:"prompt"`
-	NegativePrompt    string    `json:"negative_prompt"`
-	Width             int       `json:"width"`
-	Height            int       `json:"height"`
-	RestoreFaces      bool      `json:"restore_faces"`
-	EnableHR          bool      `json:"enable_hr"`
-	HRUpscaleRate     float64   `json:"hr_scale"`
-	HRUpscaler        string    `json:"hr_upscaler"`
-	HiresWidth        int       `json:"hr_resize_x"`
-	HiresHeight       int       `json:"hr_resize_y"`
-	DenoisingStrength float64   `json:"denoising_strength"`
-	BatchCount        int       `json:"batch_count"`
-	BatchSize         int       `json:"batch_size"`
-	Seed              int64     `json:"seed"`
-	Subseed           int       `json:"subseed"`
-	SubseedStrength   float64   `json:"subseed_strength"`
-	SamplerName       string    `json:"sampler_name"`
-	CfgScale          float64   `json:"cfg_scale"`
-	Steps             int       `json:"steps"`
-	Processed         bool      `json:"processed"`
-	CreatedAt         time.Time `json:"created_at"`
+	ID                int64   `json:"id"`
+	InteractionID     string  `json:"interaction_id"`
+	MessageID         string  `json:"message_id"`
+	ChannelID         string  `json:"channel_id"`
+	GuildID           string  `json:"guild_id"`
+	MemberID          string  `json:"member_id"`
+	SortOrder         int     `json:"sort_order"`
+	Prompt            string  `json:"prompt"`
+	NegativePrompt    string  `json:"negative_prompt"`
+	Width             int     `json:"width"`
+	Height            int     `json:"height"`
+	RestoreFaces      bool    `json:"restore_faces"`
+	EnableHR          bool    `json:"enable_hr"`
+	HRUpscaleRate     float64 `json:"hr_scale"`
+	HRUpscaler        string  `json:"hr_upscaler"`
+	HiresWidth        int     `json:"hr_resize_x"`
+	HiresHeight       int     `json:"hr_resize_y"`
+	DenoisingStrength float64 `json:"denoising_strength"`
+	BatchCount        int     `json:"batch_count"`
+	BatchSize         int     `json:"batch_size"`
+	Seed              int64   `json:"seed"`
+	Subseed           int     `json:"subseed"`
+	SubseedStrength   float64 `json:"subseed_strength"`
+	SamplerName       string  `json:"sampler_name"`
+	CfgScale          float64 `json:"cfg_scale"`
+	Steps             int     `json:"steps"`
+	Processed         bool    `json:"processed"`
+	// NSFW is set when the WebUI safety checker flagged the image.
+	NSFW bool `json:"nsfw"`
+	// GPUSeconds is the measured time the WebUI spent on the generation, stored on the grid row.
+	GPUSeconds float64 `json:"gpu_seconds"`
+	// Styles lists the names of the styles merged into the prompt, comma separated.
+	Styles string `json:"styles"`
+	// VariationStrength is the subseed strength the variation buttons of the grid use, 0 for the default.
+	VariationStrength float64 `json:"variation_strength"`
+	// Upscaler is the upscaler model of an upscaled result, empty for generated images.
+	Upscaler string `json:"upscaler"`
+	// SourceID is the generation an upscale or img2img result was made from, 0 for new images.
+	SourceID int64 `json:"source_id"`
+	// Generations is how many generations the grid row counts for against the hourly limit, one
+	// for every cell of a labeled grid. Stored as 1 when 0.
+	Generations int `json:"generations"`
+	// Deleted is set when the message of the generation was deleted with its delete button.
+	Deleted   bool      `json:"deleted"`
+	CreatedAt time.Time `json:"created_at"`
 }
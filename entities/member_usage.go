@@ -0,0 +1,18 @@
+package entities
+
+import "time"
+
+// MemberUsage sums up the generations of a member within a time window.
+type MemberUsage struct {
+	Generations int       `json:"generations"`
+	GPUSeconds  float64   `json:"gpu_seconds"`
+	Oldest      time.Time `json:"oldest"`
+}
+
+// MemberStats sums up the generations of a member of a guild, for the dashboard.
+type MemberStats struct {
+	GuildID     string  `json:"guild_id"`
+	MemberID    string  `json:"member_id"`
+	Generations int     `json:"generations"`
+	GPUSeconds  float64 `json:"gpu_seconds"`
+}
@@ -0,0 +1,27 @@
+package entities
+
+import "time"
+
+// ModerationRule matches prompts that are not welcome in a guild. Pattern is a
+// whole-word term, or a regular expression when IsRegex is set.
+type ModerationRule struct {
+	ID          int64     `json:"id"`
+	GuildID     string    `json:"guild_id"`
+	Pattern     string    `json:"pattern"`
+	IsRegex     bool      `json:"is_regex"`
+	Action      string    `json:"action"`
+	Replacement string    `json:"replacement"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ModerationHit records a prompt that matched a moderation rule.
+type ModerationHit struct {
+	ID        int64     `json:"id"`
+	GuildID   string    `json:"guild_id"`
+	MemberID  string    `json:"member_id"`
+	RuleID    int64     `json:"rule_id"`
+	Pattern   string    `json:"pattern"`
+	Action    string    `json:"action"`
+	Prompt    string    `json:"prompt"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,16 @@
+package entities
+
+// RolePolicy limits what members with a Discord role can request. Zero limits mean unlimited.
+type RolePolicy struct {
+	RoleID       string `json:"role_id"`
+	GuildID      string `json:"guild_id"`
+	MaxPixels    int    `json:"max_pixels"`
+	MaxSteps     int    `json:"max_steps"`
+	AllowHires   bool   `json:"allow_hires"`
+	AllowUpscale bool   `json:"allow_upscale"`
+	MaxBatch     int    `json:"max_batch"`
+	// GenerationsPerHour caps the invisions of a member within any hour.
+	GenerationsPerHour int `json:"generations_per_hour"`
+	// DailyGPUSeconds caps the generation time of a member per UTC day.
+	DailyGPUSeconds int `json:"daily_gpu_seconds"`
+}
@@ -0,0 +1,15 @@
+package entities
+
+import "time"
+
+// Style is a named prompt fragment that can be merged into an invision. Styles without
+// a MemberID are shared with the whole guild.
+type Style struct {
+	GuildID  string `json:"guild_id"`
+	MemberID string `json:"member_id"`
+	Name     string `json:"name"`
+	// Prompt replaces the {prompt} placeholder with the prompt of the invision, or is appended to it.
+	Prompt         string    `json:"prompt"`
+	NegativePrompt string    `json:"negative_prompt"`
+	CreatedAt      time.Time `json:"created_at"`
+}
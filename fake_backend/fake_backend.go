@@ -0,0 +1,559 @@
+package fake_backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"kinshi_vision_bot/stable_diffusion_api"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	defaultSize = 512
+
+	// maxSize keeps a bad request from drawing images no real backend would make.
+	maxSize = 4096
+
+	defaultUpscaleFactor = 2
+
+	// randomSeed asks for a random seed, like in the WebUI.
+	randomSeed = -1
+
+	maxRequestSize = 64 << 20
+)
+
+var errInjected = errors.New("injected error")
+
+type backendImpl struct {
+	addr      string
+	latency   time.Duration
+	errorRate float64
+	server    *http.Server
+	url       string
+	logger    *slog.Logger
+
+	// workMu runs one request at a time, like the WebUI does.
+	workMu sync.Mutex
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	failNext int
+	// taskStart and taskEnd span the running request, both are zero when idle.
+	taskStart time.Time
+	taskEnd   time.Time
+}
+
+type Config struct {
+	// Addr is the address to listen on, like "127.0.0.1:7861". Port 0 picks a free port.
+	Addr string
+	// Latency is how long every generation and upscale takes.
+	Latency time.Duration
+	// ErrorRate is the share of generations and upscales that fail, from 0 to 1.
+	ErrorRate float64
+	// Seed picks the random seeds and the injected errors, so runs with the same requests repeat.
+	Seed int64
+	// Logger is optional, the default logger is used when nil.
+	Logger *slog.Logger
+}
+
+func New(cfg Config) (Backend, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("missing address")
+	}
+
+	if cfg.Latency < 0 {
+		return nil, errors.New("latency can't be negative")
+	}
+
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+		return nil, errors.New("error rate must be between 0 and 1")
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	newBackend := &backendImpl{
+		addr:      cfg.Addr,
+		latency:   cfg.Latency,
+		errorRate: cfg.ErrorRate,
+		rng:       rand.New(rand.NewSource(cfg.Seed)),
+		logger:    logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sdapi/v1/txt2img", newBackend.handleTextToImage)
+	mux.HandleFunc("/sdapi/v1/img2img", newBackend.handleImageToImage)
+	mux.HandleFunc("/sdapi/v1/extra-single-image", newBackend.handleUpscale)
+	mux.HandleFunc("/sdapi/v1/progress", newBackend.handleProgress)
+
+	newBackend.server = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return newBackend, nil
+}
+
+func (b *backendImpl) Start() error {
+	listener, err := net.Listen("tcp", b.addr)
+	if err != nil {
+		return err
+	}
+
+	b.url = "http://" + listener.Addr().String()
+
+	b.logger.Info("Serving fake Stable Diffusion backend", "url", b.url, "latency", b.latency, "error_rate", b.errorRate)
+
+	go func() {
+		err := b.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.logger.Error("Fake Stable Diffusion backend stopped", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (b *backendImpl) URL() string {
+	return b.url
+}
+
+func (b *backendImpl) FailNext(count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failNext += count
+}
+
+func (b *backendImpl) Shutdown(ctx context.Context) error {
+	return b.server.Shutdown(ctx)
+}
+
+// generation is what decides the images of a txt2img or img2img request.
+type generation struct {
+	prompt          string
+	width           int
+	height          int
+	seed            int64
+	subseed         int64
+	subseedStrength float64
+	count           int
+}
+
+func (b *backendImpl) handleTextToImage(w http.ResponseWriter, r *http.Request) {
+	var request stable_diffusion_api.TextToImageRequest
+
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	width, height := request.Width, request.Height
+
+	// the hires fix makes the images larger, by a factor or to a fixed size
+	if request.EnableHR {
+		if request.HRResizeX > 0 && request.HRResizeY > 0 {
+			width, height = request.HRResizeX, request.HRResizeY
+		} else if request.HRUpscaleRate > 0 {
+			width = int(float64(imageSize(width)) * request.HRUpscaleRate)
+			height = int(float64(imageSize(height)) * request.HRUpscaleRate)
+		}
+	}
+
+	b.generate(w, r, "txt2img", &generation{
+		prompt:          request.Prompt,
+		width:           width,
+		height:          height,
+		seed:            request.Seed,
+		subseed:         int64(request.Subseed),
+		subseedStrength: request.SubseedStrength,
+		count:           max(1, request.BatchSize) * max(1, request.NIter),
+	})
+}
+
+func (b *backendImpl) handleImageToImage(w http.ResponseWriter, r *http.Request) {
+	var request stable_diffusion_api.ImageToImageRequest
+
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	if len(request.InitImages) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "init_images is required")
+
+		return
+	}
+
+	b.generate(w, r, "img2img", &generation{
+		prompt:          request.Prompt,
+		width:           request.Width,
+		height:          request.Height,
+		seed:            request.Seed,
+		subseed:         int64(request.Subseed),
+		subseedStrength: request.SubseedStrength,
+		count:           max(1, request.BatchSize) * max(1, request.NIter),
+	})
+}
+
+type generationInfo struct {
+	Seed        int64   `json:"seed"`
+	Subseed     int64   `json:"subseed"`
+	AllSeeds    []int64 `json:"all_seeds"`
+	AllSubseeds []int64 `json:"all_subseeds"`
+	Prompt      string  `json:"prompt"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+}
+
+type generationResponse struct {
+	Images []string `json:"images"`
+	// Info is JSON encoded generationInfo, as the WebUI sends it.
+	Info string `json:"info"`
+}
+
+// generate answers a txt2img or img2img request. Every image gets the next seed and subseed,
+// like the images of a WebUI batch.
+func (b *backendImpl) generate(w http.ResponseWriter, r *http.Request, endpoint string, gen *generation) {
+	width, height := imageSize(gen.width), imageSize(gen.height)
+	if width > maxSize || height > maxSize {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("images are limited to %dx%d", maxSize, maxSize))
+
+		return
+	}
+
+	if !b.work(w, r, endpoint) {
+		return
+	}
+
+	info := &generationInfo{
+		Seed:        b.resolveSeed(gen.seed),
+		Subseed:     b.resolveSeed(gen.subseed),
+		AllSeeds:    make([]int64, 0, gen.count),
+		AllSubseeds: make([]int64, 0, gen.count),
+		Prompt:      gen.prompt,
+		Width:       width,
+		Height:      height,
+	}
+
+	response := &generationResponse{
+		Images: make([]string, 0, gen.count),
+	}
+
+	for idx := 0; idx < gen.count; idx++ {
+		seed := info.Seed + int64(idx)
+		subseed := info.Subseed + int64(idx)
+
+		encoded, err := encodeImage(renderImage(gen.prompt, seed, subseed, gen.subseedStrength, width, height))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+
+			return
+		}
+
+		info.AllSeeds = append(info.AllSeeds, seed)
+		info.AllSubseeds = append(info.AllSubseeds, subseed)
+		response.Images = append(response.Images, encoded)
+	}
+
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	response.Info = string(infoJSON)
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+type upscaleResponse struct {
+	HTMLInfo string `json:"html_info"`
+	Image    string `json:"image"`
+}
+
+func (b *backendImpl) handleUpscale(w http.ResponseWriter, r *http.Request) {
+	var request stable_diffusion_api.UpscaleRequest
+
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	// the WebUI also takes data URLs
+	encoded := request.Image
+	if _, data, found := strings.Cut(encoded, ";base64,"); found {
+		encoded = data
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "image is not base64 encoded")
+
+		return
+	}
+
+	source, _, err := image.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("image can't be read: %s", err))
+
+		return
+	}
+
+	factor := request.UpscalingResize
+	if factor <= 0 {
+		factor = defaultUpscaleFactor
+	}
+
+	size := source.Bounds().Size().Mul(factor)
+	if size.X > maxSize || size.Y > maxSize {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("images are limited to %dx%d", maxSize, maxSize))
+
+		return
+	}
+
+	if !b.work(w, r, "extra-single-image") {
+		return
+	}
+
+	upscaled := image.NewRGBA(image.Rectangle{Max: size})
+	xdraw.ApproxBiLinear.Scale(upscaled, upscaled.Bounds(), source, source.Bounds(), draw.Src, nil)
+
+	encodedUpscale, err := encodeImage(upscaled)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &upscaleResponse{Image: encodedUpscale})
+}
+
+func (b *backendImpl) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+
+		return
+	}
+
+	b.mu.Lock()
+	taskStart, taskEnd := b.taskStart, b.taskEnd
+	b.mu.Unlock()
+
+	response := &stable_diffusion_api.ProgressResponse{}
+
+	if !taskEnd.IsZero() {
+		now := time.Now()
+
+		if total := taskEnd.Sub(taskStart); total > 0 {
+			response.Progress = min(1, float64(now.Sub(taskStart))/float64(total))
+		} else {
+			response.Progress = 1
+		}
+
+		response.EtaRelative = max(0, taskEnd.Sub(now).Seconds())
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// work waits out the latency of a request and decides whether it fails. It writes the error
+// response and returns false when the request shouldn't be answered.
+func (b *backendImpl) work(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	b.workMu.Lock()
+	defer b.workMu.Unlock()
+
+	b.mu.Lock()
+	b.taskStart = time.Now()
+	b.taskEnd = b.taskStart.Add(b.latency)
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.taskStart = time.Time{}
+		b.taskEnd = time.Time{}
+		b.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(b.latency)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		b.logger.Debug("Request canceled", "endpoint", endpoint)
+
+		return false
+	}
+
+	if b.shouldFail() {
+		b.logger.Info("Injecting error", "endpoint", endpoint)
+
+		writeError(w, http.StatusInternalServerError, errInjected.Error())
+
+		return false
+	}
+
+	b.logger.Debug("Answering request", "endpoint", endpoint)
+
+	return true
+}
+
+func (b *backendImpl) shouldFail() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failNext > 0 {
+		b.failNext--
+
+		return true
+	}
+
+	return b.errorRate > 0 && b.rng.Float64() < b.errorRate
+}
+
+// resolveSeed picks a seed for a random seed request.
+func (b *backendImpl) resolveSeed(seed int64) int64 {
+	if seed != randomSeed {
+		return seed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rng.Int63n(1 << 32)
+}
+
+// imageSize falls back to the default size of the WebUI.
+func imageSize(size int) int {
+	if size <= 0 {
+		return defaultSize
+	}
+
+	return size
+}
+
+// renderImage draws a gradient picked by the prompt and the seeds, labelled with the seed. The
+// same request always gets the same image, and the subseed strength blends towards the gradient
+// of the subseed like a variation would.
+func renderImage(prompt string, seed, subseed int64, subseedStrength float64, width, height int) image.Image {
+	from := mixColors(seedColor(prompt, seed, 0), seedColor(prompt, subseed, 0), subseedStrength)
+	to := mixColors(seedColor(prompt, seed, 1), seedColor(prompt, subseed, 1), subseedStrength)
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	span := float64(max(1, width+height-2))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, mixColors(from, to, float64(x+y)/span))
+		}
+	}
+
+	face := basicfont.Face7x13
+
+	drawer := &font.Drawer{
+		Dst:  img,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(face.Advance, face.Height+face.Ascent),
+	}
+	drawer.DrawString(fmt.Sprintf("seed %d", seed))
+
+	return img
+}
+
+func seedColor(prompt string, seed int64, index byte) color.RGBA {
+	hash := fnv.New32a()
+	hash.Write([]byte(prompt))
+	binary.Write(hash, binary.LittleEndian, seed)
+	hash.Write([]byte{index})
+
+	sum := hash.Sum32()
+
+	return color.RGBA{R: uint8(sum), G: uint8(sum >> 8), B: uint8(sum >> 16), A: 255}
+}
+
+func mixColors(from, to color.RGBA, weight float64) color.RGBA {
+	weight = min(1, max(0, weight))
+
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a)*(1-weight) + float64(b)*weight)
+	}
+
+	return color.RGBA{R: mix(from.R, to.R), G: mix(from.G, to.G), B: mix(from.B, to.B), A: 255}
+}
+
+func encodeImage(img image.Image) (string, error) {
+	var buf bytes.Buffer
+
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeRequest reads the JSON body of a POST request. It writes the error response and returns
+// false when the request can't be read.
+func decodeRequest(w http.ResponseWriter, r *http.Request, request any) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+
+		return false
+	}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(request)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("request is not valid JSON: %s", err))
+
+		return false
+	}
+
+	return true
+}
+
+// errorResponse has the fields of the error responses of the WebUI.
+type errorResponse struct {
+	Error  string `json:"error"`
+	Detail string `json:"detail"`
+}
+
+func writeError(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, &errorResponse{
+		Error:  http.StatusText(status),
+		Detail: detail,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(response)
+}
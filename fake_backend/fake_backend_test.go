@@ -0,0 +1,291 @@
+package fake_backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"io"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/stable_diffusion_api"
+	"log/slog"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testContext keeps the API client from logging the errors the tests ask for.
+func testContext() context.Context {
+	return logging.NewContext(context.Background(), discardLogger)
+}
+
+// newTestBackend serves a backend with httptest and returns it with an API client for it.
+func newTestBackend(t *testing.T, cfg Config) (*backendImpl, stable_diffusion_api.StableDiffusionAPI) {
+	t.Helper()
+
+	cfg.Addr = "127.0.0.1:0"
+	cfg.Logger = discardLogger
+
+	backend, err := New(cfg)
+	if err != nil {
+		t.Fatalf("creating backend: %v", err)
+	}
+
+	server := httptest.NewServer(backend.(*backendImpl).server.Handler)
+	t.Cleanup(server.Close)
+
+	api, err := stable_diffusion_api.New(stable_diffusion_api.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("creating API client: %v", err)
+	}
+
+	return backend.(*backendImpl), api
+}
+
+func decodeSize(t *testing.T, encoded string) image.Point {
+	t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("decoding base64: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		t.Fatalf("decoding image: %v", err)
+	}
+
+	return img.Bounds().Size()
+}
+
+func TestTextToImage(t *testing.T) {
+	_, api := newTestBackend(t, Config{})
+
+	response, err := api.TextToImage(testContext(), &stable_diffusion_api.TextToImageRequest{
+		Prompt:    "a cat",
+		Width:     256,
+		Height:    128,
+		BatchSize: 2,
+		NIter:     2,
+		Seed:      42,
+		Subseed:   -1,
+	})
+	if err != nil {
+		t.Fatalf("txt2img failed: %v", err)
+	}
+
+	if !slices.Equal(response.Seeds, []int64{42, 43, 44, 45}) {
+		t.Errorf("expected seeds 42 to 45, got %v", response.Seeds)
+	}
+
+	if len(response.Images) != 4 || len(response.Subseeds) != 4 {
+		t.Fatalf("expected 4 images with subseeds, got %d images and %d subseeds", len(response.Images), len(response.Subseeds))
+	}
+
+	if response.Subseeds[0] < 0 {
+		t.Errorf("expected a random subseed to be picked, got %d", response.Subseeds[0])
+	}
+
+	for _, encoded := range response.Images {
+		if size := decodeSize(t, encoded); size != image.Pt(256, 128) {
+			t.Errorf("expected 256x128 images, got %s", size)
+		}
+	}
+
+	if response.Images[0] == response.Images[1] {
+		t.Error("expected every seed to get its own image")
+	}
+
+	again, err := api.TextToImage(testContext(), &stable_diffusion_api.TextToImageRequest{
+		Prompt:  "a cat",
+		Width:   256,
+		Height:  128,
+		Seed:    42,
+		Subseed: response.Subseeds[0],
+	})
+	if err != nil {
+		t.Fatalf("txt2img failed: %v", err)
+	}
+
+	if again.Images[0] != response.Images[0] {
+		t.Error("expected the same request to make the same image")
+	}
+}
+
+func TestTextToImageHiresFix(t *testing.T) {
+	_, api := newTestBackend(t, Config{})
+
+	response, err := api.TextToImage(testContext(), &stable_diffusion_api.TextToImageRequest{
+		Prompt:        "a cat",
+		Width:         128,
+		Height:        64,
+		EnableHR:      true,
+		HRUpscaleRate: 2,
+		Seed:          1,
+	})
+	if err != nil {
+		t.Fatalf("txt2img failed: %v", err)
+	}
+
+	if size := decodeSize(t, response.Images[0]); size != image.Pt(256, 128) {
+		t.Errorf("expected the hires fix to double the size, got %s", size)
+	}
+}
+
+func TestImageToImage(t *testing.T) {
+	_, api := newTestBackend(t, Config{})
+
+	source, err := api.TextToImage(testContext(), &stable_diffusion_api.TextToImageRequest{Prompt: "a cat", Width: 64, Height: 64, Seed: 1})
+	if err != nil {
+		t.Fatalf("txt2img failed: %v", err)
+	}
+
+	response, err := api.ImageToImage(testContext(), &stable_diffusion_api.ImageToImageRequest{
+		InitImages:        source.Images,
+		Prompt:            "a dog",
+		Width:             128,
+		Height:            96,
+		DenoisingStrength: 0.5,
+		Seed:              7,
+	})
+	if err != nil {
+		t.Fatalf("img2img failed: %v", err)
+	}
+
+	if !slices.Equal(response.Seeds, []int64{7}) || len(response.Images) != 1 {
+		t.Fatalf("expected 1 image with seed 7, got %d images with seeds %v", len(response.Images), response.Seeds)
+	}
+
+	if size := decodeSize(t, response.Images[0]); size != image.Pt(128, 96) {
+		t.Errorf("expected a 128x96 image, got %s", size)
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	_, api := newTestBackend(t, Config{})
+
+	textToImage := &stable_diffusion_api.TextToImageRequest{Prompt: "a cat", Width: 64, Height: 32, Seed: 1}
+
+	source, err := api.TextToImage(testContext(), textToImage)
+	if err != nil {
+		t.Fatalf("txt2img failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		request *stable_diffusion_api.UpscaleRequest
+		size    image.Point
+	}{
+		{
+			name:    "image",
+			request: &stable_diffusion_api.UpscaleRequest{UpscalingResize: 3, Upscaler1: "ESRGAN_4x", Image: source.Images[0]},
+			size:    image.Pt(192, 96),
+		},
+		{
+			name:    "data URL",
+			request: &stable_diffusion_api.UpscaleRequest{Upscaler1: "ESRGAN_4x", Image: "data:image/png;base64," + source.Images[0]},
+			size:    image.Pt(128, 64),
+		},
+		{
+			name:    "regenerated image",
+			request: &stable_diffusion_api.UpscaleRequest{UpscalingResize: 2, Upscaler1: "ESRGAN_4x", TextToImageRequest: textToImage},
+			size:    image.Pt(128, 64),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := api.UpscaleImage(testContext(), tt.request)
+			if err != nil {
+				t.Fatalf("upscale failed: %v", err)
+			}
+
+			if size := decodeSize(t, response.Image); size != tt.size {
+				t.Errorf("expected a %s image, got %s", tt.size, size)
+			}
+		})
+	}
+
+	_, err = api.UpscaleImage(testContext(), &stable_diffusion_api.UpscaleRequest{Upscaler1: "ESRGAN_4x", Image: "not an image"})
+	if err == nil || !strings.Contains(err.Error(), "422") {
+		t.Errorf("expected an unprocessable image to be rejected, got %v", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	_, api := newTestBackend(t, Config{Latency: 300 * time.Millisecond})
+
+	idle, err := api.GetCurrentProgress(testContext())
+	if err != nil {
+		t.Fatalf("getting progress failed: %v", err)
+	}
+
+	if idle.Progress != 0 || idle.EtaRelative != 0 {
+		t.Errorf("expected no progress while idle, got %+v", idle)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := api.TextToImage(testContext(), &stable_diffusion_api.TextToImageRequest{Prompt: "a cat", Width: 64, Height: 64})
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		progress, err := api.GetCurrentProgress(testContext())
+		if err != nil {
+			t.Fatalf("getting progress failed: %v", err)
+		}
+
+		if progress.Progress > 0 && progress.Progress <= 1 && progress.EtaRelative <= 0.3 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for progress, last got %+v", progress)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("txt2img failed: %v", err)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	backend, api := newTestBackend(t, Config{})
+
+	request := &stable_diffusion_api.TextToImageRequest{Prompt: "a cat", Width: 64, Height: 64}
+
+	backend.FailNext(1)
+
+	_, err := api.TextToImage(testContext(), request)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected an injected error, got %v", err)
+	}
+
+	_, err = api.TextToImage(testContext(), request)
+	if err != nil {
+		t.Errorf("expected only the next request to fail, got %v", err)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	_, api := newTestBackend(t, Config{ErrorRate: 1})
+
+	_, err := api.UpscaleImage(testContext(), &stable_diffusion_api.UpscaleRequest{
+		Upscaler1:          "ESRGAN_4x",
+		TextToImageRequest: &stable_diffusion_api.TextToImageRequest{Prompt: "a cat", Width: 64, Height: 64},
+	})
+	if err == nil {
+		t.Error("expected every request to fail")
+	}
+}
@@ -0,0 +1,13 @@
+package fake_backend
+
+import "context"
+
+type Backend interface {
+	// Start serves the backend in the background. It fails when the address can't be listened on.
+	Start() error
+	// URL is the API host of the started backend, like "http://127.0.0.1:7861".
+	URL() string
+	// FailNext makes the next count requests fail, on top of the configured error rate.
+	FailNext(count int)
+	Shutdown(ctx context.Context) error
+}
@@ -0,0 +1,167 @@
+package invision_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"regexp"
+	"strings"
+)
+
+const (
+	// NSFWActionSpoiler posts flagged images outside of age-restricted channels as spoilers.
+	NSFWActionSpoiler = "spoiler"
+	// NSFWActionBlock refuses flagged prompts and withholds flagged images outside of age-restricted channels.
+	NSFWActionBlock = "block"
+)
+
+var (
+	ErrChannelNotAllowed = errors.New("invisions are not allowed in this channel")
+	ErrNSFWPrompt        = errors.New("the prompt was flagged as NSFW")
+)
+
+// checkChannel enforces the channel rules of the guild. A thread without a rule of its own
+// follows the rule of its parent channel.
+func (q *queueImpl) checkChannel(ctx context.Context, item *QueueItem) error {
+	// items of the REST API aren't requested in a channel
+	if item.Origin.ChannelID == "" {
+		return nil
+	}
+
+	rules, err := q.channelRuleRepo.GetByGuildID(ctx, item.Origin.GuildID)
+	if err != nil {
+		return fmt.Errorf("error getting channel rules: %w", err)
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	channelIDs := []string{item.Origin.ChannelID}
+
+	if item.Origin.ParentChannelID != "" {
+		channelIDs = append(channelIDs, item.Origin.ParentChannelID)
+	}
+
+	if !channelAllowed(rules, channelIDs...) {
+		return ErrChannelNotAllowed
+	}
+
+	return nil
+}
+
+// channelAllowed applies the first rule matching one of the channel IDs. Without a matching
+// rule a channel is allowed, unless the guild uses an allow list.
+func channelAllowed(rules []*entities.ChannelRule, channelIDs ...string) bool {
+	for _, channelID := range channelIDs {
+		for _, rule := range rules {
+			if rule.ChannelID == channelID {
+				return rule.Allowed
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.Allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compileNSFWKeywords builds a regex matching any keyword of a comma separated list as a whole word,
+// nil when the list has no keywords.
+func compileNSFWKeywords(keywords string) *regexp.Regexp {
+	quoted := make([]string, 0)
+
+	for _, keyword := range strings.Split(keywords, ",") {
+		keyword = strings.TrimSpace(keyword)
+		if keyword == "" {
+			continue
+		}
+
+		quoted = append(quoted, regexp.QuoteMeta(keyword))
+	}
+
+	if len(quoted) == 0 {
+		return nil
+	}
+
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// checkNSFWPrompt refuses flagged prompts outside of age-restricted channels when the guild blocks them.
+// With the spoiler action the invision is accepted and only its output is spoilered.
+func (q *queueImpl) checkNSFWPrompt(item *QueueItem) error {
+	if !item.Type.hasPrompt() {
+		return nil
+	}
+
+	settings, err := q.GetBotDefaultSettings(item.Origin.GuildID)
+	if err != nil {
+		return fmt.Errorf("error getting default settings: %w", err)
+	}
+
+	if settings.NSFWAction != NSFWActionBlock || settings.NSFWKeywords == "" {
+		return nil
+	}
+
+	keywordRegex, err := q.nsfwKeywordRegex(item.Origin.GuildID)
+	if err != nil {
+		return fmt.Errorf("error getting NSFW keywords: %w", err)
+	}
+
+	if keywordRegex == nil || !keywordRegex.MatchString(item.Prompt) || item.Origin.NSFWChannel {
+		return nil
+	}
+
+	return ErrNSFWPrompt
+}
+
+// nsfwAction decides what happens to the output of an invision. It returns an empty action
+// when the output can be posted as is.
+func (q *queueImpl) nsfwAction(item *QueueItem, prompt string, flagged bool) string {
+	settings, err := q.GetBotDefaultSettings(item.Origin.GuildID)
+	if err != nil {
+		q.logger.Warn("Error getting default settings for NSFW check", "error", err)
+
+		return ""
+	}
+
+	if !flagged {
+		keywordRegex, err := q.nsfwKeywordRegex(item.Origin.GuildID)
+		if err != nil {
+			q.logger.Warn("Error getting NSFW keywords", "error", err)
+
+			return ""
+		}
+
+		if keywordRegex == nil || !keywordRegex.MatchString(prompt) {
+			return ""
+		}
+	}
+
+	if item.Origin.NSFWChannel {
+		return ""
+	}
+
+	return settings.NSFWAction
+}
+
+// withholdNSFWOutput replaces the progress message of an invision whose output was blocked.
+func (q *queueImpl) withholdNSFWOutput(ctx context.Context, item *QueueItem) error {
+	return q.fail(ctx, item, fmt.Sprintf("<@%s>, the result was flagged as NSFW and can only be posted in an age-restricted channel.",
+		item.Origin.MemberID), nil)
+}
+
+func anyFlagged(flags []bool) bool {
+	for _, flag := range flags {
+		if flag {
+			return true
+		}
+	}
+
+	return false
+}
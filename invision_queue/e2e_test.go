@@ -0,0 +1,717 @@
+package invision_queue_test
+
+import (
+	"context"
+	"errors"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/policy"
+	"kinshi_vision_bot/quota"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvision(t *testing.T) {
+	h := newHarness(t)
+	h.sd.configure(func(sd *fakeStableDiffusion) {
+		sd.generationDuration = 3 * time.Second
+	})
+
+	notifier := h.add(&invision_queue.QueueItem{
+		Type:         invision_queue.ItemTypeInvision,
+		Prompt:       "a cat --seed 42",
+		SamplerName1: "Euler a",
+	}, "grid")
+
+	status := h.queue.Status()
+	if len(status.Waiting) != 1 || !status.Waiting[0].Since.Equal(h.clock.Now()) {
+		t.Fatalf("expected the invision to wait since %s, got %+v", h.clock.Now(), status.Waiting)
+	}
+
+	h.tickUntil("invision to finish", notifier.isDone)
+
+	result, failure := notifier.outcome()
+	if result == nil {
+		t.Fatalf("invision failed: %s", failure)
+	}
+
+	if result.Kind != invision_queue.ResultGrid || len(result.Images) != 4 {
+		t.Errorf("expected a grid of 4 images, got kind %d with %d images", result.Kind, len(result.Images))
+	}
+
+	if !slices.Equal(result.Seeds, []int64{42, 43, 44, 45}) {
+		t.Errorf("expected seeds 42 to 45, got %v", result.Seeds)
+	}
+
+	requests := h.sd.textToImageRequests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 txt2img request, got %d", len(requests))
+	}
+
+	if requests[0].Seed != 42 || strings.Contains(requests[0].Prompt, "--seed") {
+		t.Errorf("expected the seed parameter to be taken out of the prompt, got seed %d and prompt %q", requests[0].Seed, requests[0].Prompt)
+	}
+
+	generations, _ := h.generations.ListByMessage(context.Background(), "grid")
+	if len(generations) != 5 {
+		t.Fatalf("expected a grid row and 4 image rows, got %d rows", len(generations))
+	}
+
+	grid := generations[0]
+	if grid.ID != result.GenerationID || grid.MemberID != "member" || grid.GuildID != "guild" {
+		t.Errorf("expected the grid row of the result for the member, got %+v", grid)
+	}
+
+	if grid.GPUSeconds < 3 {
+		t.Errorf("expected the generation to take at least 3 GPU seconds on the clock, got %f", grid.GPUSeconds)
+	}
+
+	for idx, generation := range generations[1:] {
+		if generation.SortOrder != idx+1 || generation.Seed != int64(42+idx) {
+			t.Errorf("expected image %d with seed %d, got sort order %d with seed %d", idx+1, 42+idx, generation.SortOrder, generation.Seed)
+		}
+	}
+}
+
+func TestInvisionProgress(t *testing.T) {
+	h := newHarness(t)
+
+	gate := make(chan struct{})
+	h.sd.configure(func(sd *fakeStableDiffusion) {
+		sd.gate = gate
+		sd.progress = 0.5
+	})
+
+	notifier := h.add(&invision_queue.QueueItem{
+		Type:         invision_queue.ItemTypeInvision,
+		Prompt:       "a cat",
+		SamplerName1: "Euler a",
+	}, "grid")
+
+	h.tickUntil("generation to start", h.sd.hasStarted)
+
+	status := h.queue.Status()
+	if status.Current == nil || status.Current.Prompt != "a cat" || len(status.Waiting) != 0 {
+		t.Errorf("expected the invision to be the current job, got %+v", status)
+	}
+
+	h.tickUntil("progress to be reported", func() bool {
+		return slices.Contains(notifier.progressFractions(), 0.5)
+	})
+
+	close(gate)
+
+	h.waitFor("invision to finish", notifier.isDone)
+
+	if result, failure := notifier.outcome(); result == nil {
+		t.Fatalf("invision failed: %s", failure)
+	}
+}
+
+func TestReroll(t *testing.T) {
+	h := newHarness(t)
+
+	h.invision("a cat", "grid-1")
+
+	notifier := h.run(&invision_queue.QueueItem{
+		Type:   invision_queue.ItemTypeReroll,
+		Origin: testOrigin("grid-1"),
+	}, "grid-2")
+
+	result, failure := notifier.outcome()
+	if result == nil {
+		t.Fatalf("reroll failed: %s", failure)
+	}
+
+	requests := h.sd.textToImageRequests()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 txt2img requests, got %d", len(requests))
+	}
+
+	if requests[1].Prompt != requests[0].Prompt || requests[1].Seed != -1 {
+		t.Errorf("expected the prompt of the invision with a random seed, got prompt %q and seed %d", requests[1].Prompt, requests[1].Seed)
+	}
+
+	generations, _ := h.generations.ListByMessage(context.Background(), "grid-2")
+	if len(generations) != 5 || generations[0].ID != result.GenerationID {
+		t.Errorf("expected the reroll to be stored as a grid of its own, got %d rows", len(generations))
+	}
+}
+
+func TestVariation(t *testing.T) {
+	h := newHarness(t)
+
+	h.invision("a cat --seed 42", "grid-1")
+
+	notifier := h.run(&invision_queue.QueueItem{
+		Type:              invision_queue.ItemTypeVariation,
+		InteractionIndex:  2,
+		VariationStrength: invision_queue.VariationStrengthStrong,
+		Origin:            testOrigin("grid-1"),
+	}, "grid-2")
+
+	if result, failure := notifier.outcome(); result == nil {
+		t.Fatalf("variation failed: %s", failure)
+	}
+
+	requests := h.sd.textToImageRequests()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 txt2img requests, got %d", len(requests))
+	}
+
+	variation := requests[1]
+	if variation.Seed != 43 || variation.Subseed != -1 || variation.SubseedStrength != invision_queue.VariationStrengthStrong {
+		t.Errorf("expected the seed of the second image with random subseeds, got seed %d, subseed %d, strength %f",
+			variation.Seed, variation.Subseed, variation.SubseedStrength)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	tests := []struct {
+		name           string
+		negativePrompt string
+		// expected is the negative prompt of the edit, empty for the default of the server.
+		expected string
+	}{
+		{
+			name:           "changed negative prompt",
+			negativePrompt: "blurry",
+			expected:       "blurry",
+		},
+		{
+			name:           "cleared negative prompt",
+			negativePrompt: " ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+
+			h.invision("a cat --seed 42", "grid-1")
+
+			notifier := h.run(&invision_queue.QueueItem{
+				Type:           invision_queue.ItemTypeEdit,
+				Prompt:         "a dog",
+				NegativePrompt: tt.negativePrompt,
+				Edit:           &invision_queue.GenerationEdit{Steps: 30, Seed: 7},
+				Origin:         testOrigin("grid-1"),
+			}, "grid-2")
+
+			if result, failure := notifier.outcome(); result == nil {
+				t.Fatalf("edit failed: %s", failure)
+			}
+
+			requests := h.sd.textToImageRequests()
+			if len(requests) != 2 {
+				t.Fatalf("expected 2 txt2img requests, got %d", len(requests))
+			}
+
+			expected := tt.expected
+			if expected == "" {
+				expected = requests[0].NegativePrompt
+			}
+
+			edited := requests[1]
+			if edited.NegativePrompt != expected || edited.NegativePrompt == "" {
+				t.Errorf("expected the negative prompt %q, got %q", expected, edited.NegativePrompt)
+			}
+
+			if edited.Steps != 30 || edited.Seed != 7 || !strings.Contains(edited.Prompt, "a dog") {
+				t.Errorf("expected the edited prompt, steps and seed, got %q with %d steps and seed %d", edited.Prompt, edited.Steps, edited.Seed)
+			}
+		})
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	h := newHarness(t)
+
+	h.invision("a cat --seed 42", "grid-1")
+
+	notifier := h.run(&invision_queue.QueueItem{
+		Type:             invision_queue.ItemTypeUpscale,
+		InteractionIndex: 1,
+		Origin:           testOrigin("grid-1"),
+	}, "upscale-1")
+
+	result, failure := notifier.outcome()
+	if result == nil {
+		t.Fatalf("upscale failed: %s", failure)
+	}
+
+	if result.Kind != invision_queue.ResultSingle || !result.CanVary {
+		t.Errorf("expected a single result that can be varied, got kind %d, can vary %t", result.Kind, result.CanVary)
+	}
+
+	requests := h.sd.upscaleRequests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 upscale request, got %d", len(requests))
+	}
+
+	// an image of a grid is regenerated from its parameters
+	if requests[0].Upscaler1 != invision_queue.DefaultUpscaler || requests[0].Image != "" || requests[0].TextToImageRequest.Seed != 42 {
+		t.Errorf("expected the first image to be regenerated and upscaled, got %+v", requests[0])
+	}
+
+	source, _ := h.generations.GetByMessageAndSort(context.Background(), "grid-1", 1)
+
+	stored, err := h.generations.GetByMessageAndSort(context.Background(), "upscale-1", 1)
+	if err != nil {
+		t.Fatalf("expected the upscale to be stored: %v", err)
+	}
+
+	if stored.Upscaler != invision_queue.DefaultUpscaler || stored.SourceID != source.ID {
+		t.Errorf("expected the upscale of generation %d, got upscaler %q of generation %d", source.ID, stored.Upscaler, stored.SourceID)
+	}
+}
+
+func TestImageToImage(t *testing.T) {
+	h := newHarness(t)
+
+	h.invision("a cat --seed 42", "grid-1")
+
+	upscale := h.run(&invision_queue.QueueItem{
+		Type:             invision_queue.ItemTypeUpscale,
+		InteractionIndex: 1,
+		Origin:           testOrigin("grid-1"),
+	}, "upscale-1")
+	if result, failure := upscale.outcome(); result == nil {
+		t.Fatalf("upscale failed: %s", failure)
+	}
+
+	origin := testOrigin("upscale-1")
+	origin.SourceImageURL = h.sourceImageURL()
+
+	notifier := h.run(&invision_queue.QueueItem{
+		Type:              invision_queue.ItemTypeImageToImage,
+		Prompt:            "a {red|green|blue} {cat|dog|fox}",
+		DenoisingStrength: 0.6,
+		InteractionIndex:  1,
+		Origin:            origin,
+	}, "rework-1")
+
+	if result, failure := notifier.outcome(); result == nil {
+		t.Fatalf("img2img failed: %s", failure)
+	}
+
+	requests := h.sd.imageToImageRequests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 img2img request, got %d", len(requests))
+	}
+
+	request := requests[0]
+	if request.Seed < 0 || strings.ContainsAny(request.Prompt, "{|}") {
+		t.Errorf("expected a fixed seed and an expanded prompt, got seed %d and prompt %q", request.Seed, request.Prompt)
+	}
+
+	// the stored result makes the same image again
+	stored, err := h.generations.GetByMessageAndSort(context.Background(), "rework-1", 1)
+	if err != nil {
+		t.Fatalf("expected the img2img to be stored: %v", err)
+	}
+
+	if stored.Prompt != request.Prompt || stored.Seed != request.Seed {
+		t.Errorf("expected the prompt %q with seed %d to be stored, got %q with seed %d", request.Prompt, request.Seed, stored.Prompt, stored.Seed)
+	}
+}
+
+func TestUpscaleQuota(t *testing.T) {
+	h := newHarness(t)
+
+	policyEnforcer, err := policy.New(policy.Config{RolePolicyRepo: guildQuota{dailyGPUSeconds: 60}})
+	if err != nil {
+		t.Fatalf("creating policy enforcer: %v", err)
+	}
+
+	tracker, err := quota.New(quota.Config{ImageGenerationRepo: h.generations, PolicyEnforcer: policyEnforcer, Clock: h.clock})
+	if err != nil {
+		t.Fatalf("creating quota tracker: %v", err)
+	}
+
+	usage := func() *quota.Usage {
+		usage, err := tracker.Usage(context.Background(), "guild", "member", nil)
+		if err != nil {
+			t.Fatalf("getting usage: %v", err)
+		}
+
+		return usage
+	}
+
+	h.invision("a cat --seed 42", "grid-1")
+
+	before := usage()
+
+	h.sd.configure(func(sd *fakeStableDiffusion) {
+		sd.generationDuration = 5 * time.Second
+	})
+
+	notifier := h.run(&invision_queue.QueueItem{
+		Type:             invision_queue.ItemTypeUpscale,
+		InteractionIndex: 1,
+		Origin:           testOrigin("grid-1"),
+	}, "upscale-1")
+
+	if result, failure := notifier.outcome(); result == nil {
+		t.Fatalf("upscale failed: %s", failure)
+	}
+
+	after := usage()
+
+	if after.GPUSecondsToday < before.GPUSecondsToday+5 {
+		t.Errorf("expected the upscale to take at least 5 GPU seconds off the budget, used %f seconds after %f", after.GPUSecondsToday, before.GPUSecondsToday)
+	}
+
+	// upscales only count against the daily GPU budget
+	if after.GenerationsLastHour != before.GenerationsLastHour {
+		t.Errorf("expected the upscale not to count as a generation, got %d generations after %d", after.GenerationsLastHour, before.GenerationsLastHour)
+	}
+
+	generations, _ := h.generations.ListByMessage(context.Background(), "upscale-1")
+	if len(generations) != 1 || generations[0].SortOrder != 1 {
+		t.Errorf("expected only the image row of the upscale, got %d rows", len(generations))
+	}
+}
+
+func TestFakeBackend(t *testing.T) {
+	h := newBackendHarness(t)
+
+	grid := h.invision("a cat --seed 42", "grid-1")
+
+	if grid.Kind != invision_queue.ResultGrid || !slices.Equal(grid.Seeds, []int64{42, 43, 44, 45}) {
+		t.Errorf("expected a grid with seeds 42 to 45, got kind %d with seeds %v", grid.Kind, grid.Seeds)
+	}
+
+	notifier := h.run(&invision_queue.QueueItem{
+		Type:             invision_queue.ItemTypeUpscale,
+		InteractionIndex: 2,
+		Origin:           testOrigin("grid-1"),
+	}, "upscale-1")
+
+	result, failure := notifier.outcome()
+	if result == nil {
+		t.Fatalf("upscale failed: %s", failure)
+	}
+
+	if result.Image == nil || result.Image.Len() == 0 {
+		t.Error("expected the upscaled image")
+	}
+
+	stored, err := h.generations.GetByMessageAndSort(context.Background(), "upscale-1", 1)
+	if err != nil || stored.Seed != 43 {
+		t.Errorf("expected the upscale of the second image to be stored, got %+v: %v", stored, err)
+	}
+}
+
+func TestLabeledGridQuota(t *testing.T) {
+	h := newHarness(t)
+
+	policyEnforcer, err := policy.New(policy.Config{RolePolicyRepo: guildQuota{generationsPerHour: 10}})
+	if err != nil {
+		t.Fatalf("creating policy enforcer: %v", err)
+	}
+
+	tracker, err := quota.New(quota.Config{ImageGenerationRepo: h.generations, PolicyEnforcer: policyEnforcer, Clock: h.clock})
+	if err != nil {
+		t.Fatalf("creating quota tracker: %v", err)
+	}
+
+	plot, err := invision_queue.NewXYPlot(invision_queue.XYAxisSteps, "10,20,30", invision_queue.XYAxisCFGScale, "5,7")
+	if err != nil {
+		t.Fatalf("creating X/Y plot: %v", err)
+	}
+
+	item := &invision_queue.QueueItem{Type: invision_queue.ItemTypeXYPlot, Prompt: "a cat", XYPlot: plot}
+	if item.Generations() != 6 {
+		t.Fatalf("expected the plot to count for its 6 cells, got %d", item.Generations())
+	}
+
+	notifier := h.run(item, "plot-1")
+	if result, failure := notifier.outcome(); result == nil {
+		t.Fatalf("X/Y plot failed: %s", failure)
+	}
+
+	usage, err := tracker.Usage(context.Background(), "guild", "member", nil)
+	if err != nil {
+		t.Fatalf("getting usage: %v", err)
+	}
+
+	if usage.GenerationsLastHour != 6 {
+		t.Errorf("expected every cell to count as a generation, got %d generations", usage.GenerationsLastHour)
+	}
+
+	// 4 invisions are left, which a plot of 6 doesn't fit into
+	var exceededErr *quota.ExceededError
+	if err := tracker.Check(context.Background(), "guild", "member", nil, item.Generations(), 0); !errors.As(err, &exceededErr) {
+		t.Errorf("expected the plot to exceed the hourly limit, got %v", err)
+	}
+
+	if err := tracker.Check(context.Background(), "guild", "member", nil, 1, 0); err != nil {
+		t.Errorf("expected an invision to fit into the hourly limit, got %v", err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup prepares the queue and returns the item that fails.
+		setup   func(h *harness) *invision_queue.QueueItem
+		failure string
+	}{
+		{
+			name: "generation error",
+			setup: func(h *harness) *invision_queue.QueueItem {
+				h.sd.configure(func(sd *fakeStableDiffusion) {
+					sd.textToImageErr = errors.New("out of memory")
+				})
+
+				return &invision_queue.QueueItem{Type: invision_queue.ItemTypeInvision, Prompt: "a cat"}
+			},
+			failure: "I'm sorry, but I had a problem imagining your image.",
+		},
+		{
+			name: "reroll of an unknown message",
+			setup: func(h *harness) *invision_queue.QueueItem {
+				return &invision_queue.QueueItem{Type: invision_queue.ItemTypeReroll, Origin: testOrigin("unknown")}
+			},
+			failure: "I'm sorry, but I couldn't prepare your invision.",
+		},
+		{
+			name: "upscale of an unknown message",
+			setup: func(h *harness) *invision_queue.QueueItem {
+				return &invision_queue.QueueItem{Type: invision_queue.ItemTypeUpscale, InteractionIndex: 1, Origin: testOrigin("unknown")}
+			},
+			failure: "I'm sorry, but I couldn't find the image to upscale.",
+		},
+		{
+			name: "upscale error",
+			setup: func(h *harness) *invision_queue.QueueItem {
+				h.invision("a cat", "grid-1")
+
+				h.sd.configure(func(sd *fakeStableDiffusion) {
+					sd.upscaleErr = errors.New("out of memory")
+				})
+
+				return &invision_queue.QueueItem{Type: invision_queue.ItemTypeUpscale, InteractionIndex: 1, Origin: testOrigin("grid-1")}
+			},
+			failure: "I'm sorry, but I had a problem upscaling your image.",
+		},
+		{
+			name: "upscale of a result without its image",
+			setup: func(h *harness) *invision_queue.QueueItem {
+				h.invision("a cat", "grid-1")
+
+				notifier := h.run(&invision_queue.QueueItem{
+					Type:             invision_queue.ItemTypeUpscale,
+					InteractionIndex: 1,
+					Origin:           testOrigin("grid-1"),
+				}, "upscale-1")
+
+				if result, failure := notifier.outcome(); result == nil {
+					h.t.Fatalf("upscale failed: %s", failure)
+				}
+
+				// the upscale is upscaled further as posted, which needs the link to the image
+				return &invision_queue.QueueItem{Type: invision_queue.ItemTypeUpscale, InteractionIndex: 1, Origin: testOrigin("upscale-1")}
+			},
+			failure: "I'm sorry, but I couldn't fetch the image to upscale.",
+		},
+		{
+			name: "corrupt image of an X/Y plot",
+			setup: func(h *harness) *invision_queue.QueueItem {
+				h.sd.configure(func(sd *fakeStableDiffusion) {
+					sd.corruptImages = true
+				})
+
+				plot, _ := invision_queue.NewXYPlot(invision_queue.XYAxisSteps, "10,20", "", "")
+
+				return &invision_queue.QueueItem{Type: invision_queue.ItemTypeXYPlot, Prompt: "a cat", XYPlot: plot}
+			},
+			failure: "I'm sorry, but I had a problem imagining your images.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+
+			notifier := h.run(tt.setup(h), "failed")
+
+			result, failure := notifier.outcome()
+			if result != nil || failure != tt.failure {
+				t.Fatalf("expected the failure %q, got %q", tt.failure, failure)
+			}
+
+			// the queue goes on with the next job
+			h.sd.configure(func(sd *fakeStableDiffusion) {
+				sd.textToImageErr = nil
+				sd.corruptImages = false
+			})
+
+			h.invision("a dog", "next")
+		})
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	h := newHarness(t)
+
+	_, err := h.queue.AddInvision(&invision_queue.QueueItem{
+		Type:   invision_queue.ItemTypeInvision,
+		Prompt: "a cat",
+		Origin: testOrigin(""),
+	})
+	if err == nil {
+		t.Error("expected an item without a notifier to be refused")
+	}
+
+	// the clock stands still, so nothing is taken out of the queue
+	for idx := 0; idx < 5; idx++ {
+		h.add(&invision_queue.QueueItem{Type: invision_queue.ItemTypeInvision, Prompt: "a cat"}, "grid")
+	}
+
+	_, err = h.queue.AddInvision(&invision_queue.QueueItem{
+		Type:     invision_queue.ItemTypeInvision,
+		Prompt:   "a cat",
+		Origin:   testOrigin(""),
+		Notifier: newFakeNotifier("grid"),
+	})
+	if !errors.Is(err, invision_queue.ErrMemberQueueLimit) {
+		t.Errorf("expected the member limit to be reached, got %v", err)
+	}
+
+	if count := h.queue.QueuedGenerations("guild", "member"); count != 5 {
+		t.Errorf("expected 5 queued jobs, got %d", count)
+	}
+}
+
+func TestNSFWKeywords(t *testing.T) {
+	h := newHarness(t)
+
+	// updateKeywords changes the keywords of the guild, the queue must check against the new ones
+	updateKeywords := func(keywords string) {
+		settings, err := h.queue.GetBotDefaultSettings("guild")
+		if err != nil {
+			t.Fatalf("getting settings: %v", err)
+		}
+
+		updated := *settings
+		updated.NSFWAction = invision_queue.NSFWActionBlock
+		updated.NSFWKeywords = keywords
+
+		_, err = h.queue.UpdateDefaultSettings("guild", &updated)
+		if err != nil {
+			t.Fatalf("updating settings: %v", err)
+		}
+	}
+
+	addInvision := func(prompt string, nsfwChannel bool) error {
+		origin := testOrigin("")
+		origin.NSFWChannel = nsfwChannel
+
+		_, err := h.queue.AddInvision(&invision_queue.QueueItem{
+			Type:     invision_queue.ItemTypeInvision,
+			Prompt:   prompt,
+			Origin:   origin,
+			Notifier: newFakeNotifier("grid"),
+		})
+
+		return err
+	}
+
+	updateKeywords("nsfw, nude")
+
+	tests := []struct {
+		prompt      string
+		nsfwChannel bool
+		blocked     bool
+	}{
+		{prompt: "an NSFW cat", blocked: true},
+		{prompt: "a Nude cat", blocked: true},
+		{prompt: "a cat in nsfwland"},
+		{prompt: "an nsfw cat", nsfwChannel: true},
+	}
+
+	for _, tt := range tests {
+		err := addInvision(tt.prompt, tt.nsfwChannel)
+		if blocked := errors.Is(err, invision_queue.ErrNSFWPrompt); blocked != tt.blocked {
+			t.Errorf("expected %q in an NSFW channel %t to be blocked: %t, got %v", tt.prompt, tt.nsfwChannel, tt.blocked, err)
+		}
+	}
+
+	updateKeywords("gore")
+
+	if err := addInvision("an NSFW cat", false); err != nil {
+		t.Errorf("expected the old keywords to be dropped, got %v", err)
+	}
+
+	if err := addInvision("a gore cat", false); !errors.Is(err, invision_queue.ErrNSFWPrompt) {
+		t.Errorf("expected the new keywords to apply, got %v", err)
+	}
+
+	updateKeywords(" , ")
+
+	if err := addInvision("a gore cat", false); err != nil {
+		t.Errorf("expected no keywords to block nothing, got %v", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	h := newHarness(t)
+
+	gate := make(chan struct{})
+	h.sd.configure(func(sd *fakeStableDiffusion) {
+		sd.gate = gate
+	})
+
+	running := h.add(&invision_queue.QueueItem{Type: invision_queue.ItemTypeInvision, Prompt: "a cat"}, "grid-1")
+	waiting := h.add(&invision_queue.QueueItem{Type: invision_queue.ItemTypeInvision, Prompt: "a dog"}, "grid-2")
+
+	h.tickUntil("first invision to start", h.sd.hasStarted)
+
+	h.queue.Stop()
+
+	_, err := h.queue.AddInvision(&invision_queue.QueueItem{
+		Type:     invision_queue.ItemTypeInvision,
+		Prompt:   "a bird",
+		Origin:   testOrigin(""),
+		Notifier: newFakeNotifier("grid-3"),
+	})
+	if !errors.Is(err, invision_queue.ErrQueueStopped) {
+		t.Errorf("expected new jobs to be refused, got %v", err)
+	}
+
+	select {
+	case <-h.stopped:
+		t.Fatal("expected polling to wait for the current job")
+	default:
+	}
+
+	close(gate)
+
+	h.waitFor("polling to stop", func() bool {
+		select {
+		case <-h.stopped:
+			return true
+		default:
+			return false
+		}
+	})
+
+	if result, failure := running.outcome(); result == nil {
+		t.Errorf("expected the current job to finish, it failed: %s", failure)
+	}
+
+	if result, failure := waiting.outcome(); result != nil || !strings.Contains(failure, "shutting down") {
+		t.Errorf("expected the waiting job to be dropped with a notice, got %q", failure)
+	}
+
+	if requests := h.sd.textToImageRequests(); len(requests) != 1 {
+		t.Errorf("expected only the current job to be generated, got %d requests", len(requests))
+	}
+
+	if count := h.queue.QueuedGenerations("guild", "member"); count != 0 || len(h.queue.Status().Waiting) != 0 {
+		t.Errorf("expected no waiting jobs, got %d", count)
+	}
+}
@@ -0,0 +1,82 @@
+package invision_queue
+
+import (
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidEdit = errors.New("invalid edit")
+
+// GenerationEdit changes the sampling parameters of a stored generation before it is run again.
+type GenerationEdit struct {
+	// Steps and CFGScale keep the stored value when 0.
+	Steps    int
+	CFGScale float64
+	// Seed is -1 for a random seed.
+	Seed int64
+}
+
+// ParseGenerationEdit reads the edited values as typed by the member. An empty steps or CFG scale
+// keeps the stored value, an empty seed picks a random one.
+func ParseGenerationEdit(steps, cfgScale, seed string) (*GenerationEdit, error) {
+	edit := &GenerationEdit{Seed: -1}
+
+	if steps = strings.TrimSpace(steps); steps != "" {
+		value, err := strconv.Atoi(steps)
+		if err != nil || value < 1 {
+			return nil, fmt.Errorf("%w: the steps must be a positive whole number", ErrInvalidEdit)
+		}
+
+		edit.Steps = value
+	}
+
+	if cfgScale = strings.TrimSpace(cfgScale); cfgScale != "" {
+		value, err := strconv.ParseFloat(cfgScale, 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("%w: the CFG scale must be a positive number", ErrInvalidEdit)
+		}
+
+		edit.CFGScale = value
+	}
+
+	if seed = strings.TrimSpace(seed); seed != "" {
+		value, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil || value < -1 {
+			return nil, fmt.Errorf("%w: the seed must be a whole number, or -1 for a random one", ErrInvalidEdit)
+		}
+
+		edit.Seed = value
+	}
+
+	return edit, nil
+}
+
+// applyEdit changes a stored generation into the edited one, within the limits of the bot settings.
+func applyEdit(generation *entities.ImageGeneration, item *QueueItem, settings *entities.DefaultSettings) {
+	if prompt := strings.TrimSpace(item.Prompt); prompt != "" {
+		generation.Prompt = quotePromptAsMonospace(prompt)
+	}
+
+	// a cleared negative prompt falls back to the default of the server, like a new invision
+	generation.NegativePrompt = settings.NegativePrompt
+	if negativePrompt := strings.TrimSpace(item.NegativePrompt); negativePrompt != "" {
+		generation.NegativePrompt = item.NegativePrompt
+	}
+
+	if item.Edit == nil {
+		return
+	}
+
+	if item.Edit.Steps > 0 {
+		generation.Steps = min(item.Edit.Steps, settings.MaxSteps)
+	}
+
+	if item.Edit.CFGScale > 0 {
+		generation.CfgScale = max(minCFGScale, min(item.Edit.CFGScale, settings.MaxCFGScale))
+	}
+
+	generation.Seed = item.Edit.Seed
+}
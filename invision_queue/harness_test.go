@@ -0,0 +1,788 @@
+package invision_queue_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/fake_backend"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/policy"
+	"kinshi_vision_bot/repositories"
+	"kinshi_vision_bot/stable_diffusion_api"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitTimeout bounds every wait of a test, so a stuck queue fails the test instead of hanging it.
+const waitTimeout = 5 * time.Second
+
+// fakeClock only moves when a test advances it.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waiter := &clockWaiter{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+
+	if d <= 0 {
+		waiter.ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, waiter)
+	}
+
+	return waiter.ch
+}
+
+// Advance moves the clock forward and fires the waiters that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	pending := c.waiters[:0]
+
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			pending = append(pending, waiter)
+		} else {
+			waiter.ch <- c.now
+		}
+	}
+
+	c.waiters = pending
+}
+
+// hasWaiters reports whether anything waits on the clock.
+func (c *fakeClock) hasWaiters() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters) > 0
+}
+
+// fakeStableDiffusion answers with tiny images. Seeds count up from the requested seed, or from
+// 1000 for a random seed, like the images of a WebUI batch.
+type fakeStableDiffusion struct {
+	clock *fakeClock
+
+	mu               sync.Mutex
+	textToImageReqs  []*stable_diffusion_api.TextToImageRequest
+	imageToImageReqs []*stable_diffusion_api.ImageToImageRequest
+	upscaleReqs      []*stable_diffusion_api.UpscaleRequest
+	textToImageErr   error
+	// corruptImages answers generations with images that aren't base64 encoded.
+	corruptImages      bool
+	upscaleErr         error
+	progress           float64
+	generationDuration time.Duration
+	// gate holds every generation and upscale until it is closed, when set.
+	gate chan struct{}
+	// started receives a value whenever a generation or upscale starts.
+	started chan struct{}
+}
+
+func newFakeStableDiffusion(clock *fakeClock) *fakeStableDiffusion {
+	return &fakeStableDiffusion{
+		clock:   clock,
+		started: make(chan struct{}, 100),
+	}
+}
+
+func (sd *fakeStableDiffusion) TextToImage(ctx context.Context, req *stable_diffusion_api.TextToImageRequest) (*stable_diffusion_api.TextToImageResponse, error) {
+	sd.mu.Lock()
+	sd.textToImageReqs = append(sd.textToImageReqs, req)
+	err := sd.textToImageErr
+	image := testImage(8)
+	if sd.corruptImages {
+		image = "not an image"
+	}
+	sd.mu.Unlock()
+
+	sd.work(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seed := req.Seed
+	if seed < 0 {
+		seed = 1000
+	}
+
+	count := max(1, req.BatchSize) * max(1, req.NIter)
+
+	resp := &stable_diffusion_api.TextToImageResponse{}
+
+	for idx := 0; idx < count; idx++ {
+		resp.Images = append(resp.Images, image)
+		resp.Seeds = append(resp.Seeds, seed+int64(idx))
+		resp.Subseeds = append(resp.Subseeds, 2000+idx)
+	}
+
+	return resp, nil
+}
+
+func (sd *fakeStableDiffusion) ImageToImage(ctx context.Context, req *stable_diffusion_api.ImageToImageRequest) (*stable_diffusion_api.TextToImageResponse, error) {
+	sd.mu.Lock()
+	sd.imageToImageReqs = append(sd.imageToImageReqs, req)
+	sd.mu.Unlock()
+
+	sd.work(ctx)
+
+	return &stable_diffusion_api.TextToImageResponse{
+		Images: []string{testImage(8)},
+		Seeds:  []int64{req.Seed},
+	}, nil
+}
+
+func (sd *fakeStableDiffusion) UpscaleImage(ctx context.Context, req *stable_diffusion_api.UpscaleRequest) (*stable_diffusion_api.UpscaleResponse, error) {
+	sd.mu.Lock()
+	sd.upscaleReqs = append(sd.upscaleReqs, req)
+	err := sd.upscaleErr
+	sd.mu.Unlock()
+
+	sd.work(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &stable_diffusion_api.UpscaleResponse{Image: testImage(16)}, nil
+}
+
+func (sd *fakeStableDiffusion) GetCurrentProgress(ctx context.Context) (*stable_diffusion_api.ProgressResponse, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return &stable_diffusion_api.ProgressResponse{Progress: sd.progress}, nil
+}
+
+// work announces a request, waits for the gate and lets the generation take its time on the clock.
+func (sd *fakeStableDiffusion) work(ctx context.Context) {
+	sd.started <- struct{}{}
+
+	sd.mu.Lock()
+	gate := sd.gate
+	duration := sd.generationDuration
+	sd.mu.Unlock()
+
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+		}
+	}
+
+	if duration > 0 {
+		sd.clock.Advance(duration)
+	}
+}
+
+// configure changes the fake while the queue may be calling it.
+func (sd *fakeStableDiffusion) configure(change func(sd *fakeStableDiffusion)) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	change(sd)
+}
+
+// hasStarted reports whether a generation or upscale has started since the last call.
+func (sd *fakeStableDiffusion) hasStarted() bool {
+	select {
+	case <-sd.started:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sd *fakeStableDiffusion) textToImageRequests() []*stable_diffusion_api.TextToImageRequest {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return append([]*stable_diffusion_api.TextToImageRequest(nil), sd.textToImageReqs...)
+}
+
+func (sd *fakeStableDiffusion) upscaleRequests() []*stable_diffusion_api.UpscaleRequest {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return append([]*stable_diffusion_api.UpscaleRequest(nil), sd.upscaleReqs...)
+}
+
+func (sd *fakeStableDiffusion) imageToImageRequests() []*stable_diffusion_api.ImageToImageRequest {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return append([]*stable_diffusion_api.ImageToImageRequest(nil), sd.imageToImageReqs...)
+}
+
+func testImage(size int) string {
+	var buf bytes.Buffer
+
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, size, size)))
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// fakeNotifier stands in for the Discord message of an interaction, which keeps its ID through
+// all its edits.
+type fakeNotifier struct {
+	messageID string
+
+	mu         sync.Mutex
+	progresses []*invision_queue.Progress
+	result     *invision_queue.Result
+	failure    string
+	// done is closed once the item is delivered or failed.
+	done chan struct{}
+}
+
+func newFakeNotifier(messageID string) *fakeNotifier {
+	return &fakeNotifier{
+		messageID: messageID,
+		done:      make(chan struct{}),
+	}
+}
+
+func (n *fakeNotifier) Progress(ctx context.Context, progress *invision_queue.Progress) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.progresses = append(n.progresses, progress)
+
+	return n.messageID, nil
+}
+
+func (n *fakeNotifier) Deliver(ctx context.Context, result *invision_queue.Result) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.result = result
+	close(n.done)
+
+	return n.messageID, nil
+}
+
+func (n *fakeNotifier) Fail(ctx context.Context, message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.failure = message
+	close(n.done)
+
+	return nil
+}
+
+func (n *fakeNotifier) isDone() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *fakeNotifier) progressFractions() []float64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fractions := make([]float64, 0, len(n.progresses))
+	for _, progress := range n.progresses {
+		fractions = append(fractions, progress.Fraction)
+	}
+
+	return fractions
+}
+
+// outcome returns the result or the failure message of a finished item.
+func (n *fakeNotifier) outcome() (*invision_queue.Result, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.result, n.failure
+}
+
+type memoryGenerationRepo struct {
+	clock *fakeClock
+
+	mu          sync.Mutex
+	generations []*entities.ImageGeneration
+}
+
+func (r *memoryGenerationRepo) Create(ctx context.Context, generation *entities.ImageGeneration) (*entities.ImageGeneration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	generation.ID = int64(len(r.generations) + 1)
+	generation.CreatedAt = r.clock.Now()
+
+	stored := *generation
+	r.generations = append(r.generations, &stored)
+
+	return generation, nil
+}
+
+func (r *memoryGenerationRepo) GetByID(ctx context.Context, id int64) (*entities.ImageGeneration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, generation := range r.generations {
+		if generation.ID == id {
+			found := *generation
+
+			return &found, nil
+		}
+	}
+
+	return nil, repositories.NewNotFoundError(fmt.Sprintf("image generation %d", id))
+}
+
+func (r *memoryGenerationRepo) GetByMessage(ctx context.Context, messageID string) (*entities.ImageGeneration, error) {
+	generations, _ := r.ListByMessage(ctx, messageID)
+	if len(generations) == 0 {
+		return nil, repositories.NewNotFoundError("image generation")
+	}
+
+	return generations[0], nil
+}
+
+func (r *memoryGenerationRepo) GetByMessageAndSort(ctx context.Context, messageID string, sortOrder int) (*entities.ImageGeneration, error) {
+	generations, _ := r.ListByMessage(ctx, messageID)
+
+	for _, generation := range generations {
+		if generation.SortOrder == sortOrder {
+			return generation, nil
+		}
+	}
+
+	return nil, repositories.NewNotFoundError("image generation")
+}
+
+func (r *memoryGenerationRepo) ListByMessage(ctx context.Context, messageID string) ([]*entities.ImageGeneration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	generations := make([]*entities.ImageGeneration, 0)
+
+	for _, generation := range r.generations {
+		if generation.MessageID == messageID {
+			found := *generation
+			generations = append(generations, &found)
+		}
+	}
+
+	sort.SliceStable(generations, func(i, j int) bool {
+		return generations[i].SortOrder < generations[j].SortOrder
+	})
+
+	return generations, nil
+}
+
+func (r *memoryGenerationRepo) ListByMember(ctx context.Context, guildID, memberID string, from, to time.Time, limit, offset int) ([]*entities.ImageGeneration, error) {
+	return nil, nil
+}
+
+func (r *memoryGenerationRepo) Search(ctx context.Context, guildID, query string, includeNegative bool, from time.Time, limit, offset int) ([]*entities.ImageGeneration, error) {
+	return nil, nil
+}
+
+func (r *memoryGenerationRepo) ListRecent(ctx context.Context, limit int) ([]*entities.ImageGeneration, error) {
+	return nil, nil
+}
+
+func (r *memoryGenerationRepo) ListMemberStats(ctx context.Context, since time.Time, limit int) ([]*entities.MemberStats, error) {
+	return nil, nil
+}
+
+func (r *memoryGenerationRepo) UpdateGPUSeconds(ctx context.Context, id int64, gpuSeconds float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, generation := range r.generations {
+		if generation.ID == id {
+			generation.GPUSeconds = gpuSeconds
+
+			return nil
+		}
+	}
+
+	return repositories.NewNotFoundError(fmt.Sprintf("image generation %d", id))
+}
+
+func (r *memoryGenerationRepo) MarkDeletedByMessage(ctx context.Context, messageID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, generation := range r.generations {
+		if generation.MessageID == messageID {
+			generation.Deleted = true
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryGenerationRepo) GetMemberUsage(ctx context.Context, guildID, memberID string, since time.Time) (*entities.MemberUsage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	usage := &entities.MemberUsage{}
+
+	for _, generation := range r.generations {
+		if generation.GuildID != guildID && generation.GuildID != "" {
+			continue
+		}
+
+		if generation.MemberID != memberID || generation.CreatedAt.Before(since) {
+			continue
+		}
+
+		usage.GPUSeconds += generation.GPUSeconds
+
+		if generation.SortOrder != 0 || generation.Upscaler != "" {
+			continue
+		}
+
+		if usage.Generations == 0 || generation.CreatedAt.Before(usage.Oldest) {
+			usage.Oldest = generation.CreatedAt
+		}
+
+		usage.Generations += max(generation.Generations, 1)
+	}
+
+	return usage, nil
+}
+
+type memoryDefaultSettingsRepo struct {
+	mu       sync.Mutex
+	settings map[string]*entities.DefaultSettings
+}
+
+func (r *memoryDefaultSettingsRepo) Upsert(ctx context.Context, setting *entities.DefaultSettings) (*entities.DefaultSettings, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := *setting
+	r.settings[setting.GuildID+"/"+setting.MemberID] = &stored
+
+	return setting, nil
+}
+
+func (r *memoryDefaultSettingsRepo) GetByGuildAndMemberID(ctx context.Context, guildID, memberID string) (*entities.DefaultSettings, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	setting, ok := r.settings[guildID+"/"+memberID]
+	if !ok {
+		return nil, repositories.NewNotFoundError("default setting")
+	}
+
+	found := *setting
+
+	return &found, nil
+}
+
+// noChannelRules allows every channel.
+type noChannelRules struct{}
+
+func (noChannelRules) Upsert(ctx context.Context, rule *entities.ChannelRule) (*entities.ChannelRule, error) {
+	return rule, nil
+}
+
+func (noChannelRules) GetByGuildID(ctx context.Context, guildID string) ([]*entities.ChannelRule, error) {
+	return nil, nil
+}
+
+func (noChannelRules) Delete(ctx context.Context, guildID, channelID string) error {
+	return nil
+}
+
+// noRolePolicies leaves every member unrestricted.
+type noRolePolicies struct{}
+
+func (noRolePolicies) Upsert(ctx context.Context, rolePolicy *entities.RolePolicy) (*entities.RolePolicy, error) {
+	return rolePolicy, nil
+}
+
+func (noRolePolicies) GetByRoleID(ctx context.Context, roleID string) (*entities.RolePolicy, error) {
+	return nil, repositories.NewNotFoundError("role policy")
+}
+
+func (noRolePolicies) GetByRoleIDs(ctx context.Context, roleIDs []string) ([]*entities.RolePolicy, error) {
+	return nil, nil
+}
+
+func (noRolePolicies) GetByGuildID(ctx context.Context, guildID string) ([]*entities.RolePolicy, error) {
+	return nil, nil
+}
+
+func (noRolePolicies) Delete(ctx context.Context, roleID string) error {
+	return nil
+}
+
+// guildQuota gives every member of a guild the same quota.
+type guildQuota struct {
+	noRolePolicies
+	generationsPerHour int
+	dailyGPUSeconds    int
+}
+
+func (r guildQuota) GetByRoleIDs(ctx context.Context, roleIDs []string) ([]*entities.RolePolicy, error) {
+	return []*entities.RolePolicy{{
+		RoleID:             roleIDs[0],
+		GuildID:            roleIDs[0],
+		GenerationsPerHour: r.generationsPerHour,
+		DailyGPUSeconds:    r.dailyGPUSeconds,
+	}}, nil
+}
+
+// harness runs a queue against the fakes. The queue only polls when the test advances the clock.
+type harness struct {
+	t     *testing.T
+	queue invision_queue.Queue
+	clock *fakeClock
+	// sd is nil when the queue runs against the fake backend.
+	sd          *fakeStableDiffusion
+	generations *memoryGenerationRepo
+	// stopped is closed once StartPolling returns.
+	stopped chan struct{}
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+
+	clock := newFakeClock()
+	sd := newFakeStableDiffusion(clock)
+
+	h := startHarness(t, clock, sd)
+	h.sd = sd
+
+	return h
+}
+
+// newBackendHarness runs the queue against the fake backend over HTTP, with the real API client.
+// The backend answers without latency, so only the polling of the queue needs the clock.
+func newBackendHarness(t *testing.T) *harness {
+	t.Helper()
+
+	backend, err := fake_backend.New(fake_backend.Config{
+		Addr:   "127.0.0.1:0",
+		Seed:   1,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("creating fake backend: %v", err)
+	}
+
+	err = backend.Start()
+	if err != nil {
+		t.Fatalf("starting fake backend: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = backend.Shutdown(context.Background())
+	})
+
+	sd, err := stable_diffusion_api.New(stable_diffusion_api.Config{Host: backend.URL()})
+	if err != nil {
+		t.Fatalf("creating API client: %v", err)
+	}
+
+	return startHarness(t, newFakeClock(), sd)
+}
+
+// startHarness starts polling a queue that generates with the given API.
+func startHarness(t *testing.T, clock *fakeClock, sd stable_diffusion_api.StableDiffusionAPI) *harness {
+	t.Helper()
+
+	generations := &memoryGenerationRepo{clock: clock}
+
+	policyEnforcer, err := policy.New(policy.Config{RolePolicyRepo: noRolePolicies{}})
+	if err != nil {
+		t.Fatalf("creating policy enforcer: %v", err)
+	}
+
+	queue, err := invision_queue.New(invision_queue.Config{
+		StableDiffusionAPI:  sd,
+		ImageGenerationRepo: generations,
+		DefaultSettingsRepo: &memoryDefaultSettingsRepo{settings: make(map[string]*entities.DefaultSettings)},
+		ChannelRuleRepo:     noChannelRules{},
+		PolicyEnforcer:      policyEnforcer,
+		Clock:               clock,
+		Logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("creating queue: %v", err)
+	}
+
+	h := &harness{
+		t:           t,
+		queue:       queue,
+		clock:       clock,
+		generations: generations,
+		stopped:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(h.stopped)
+
+		queue.StartPolling()
+	}()
+
+	t.Cleanup(func() {
+		queue.Stop()
+
+		select {
+		case <-h.stopped:
+		case <-time.After(waitTimeout):
+			t.Error("polling didn't stop")
+		}
+	})
+
+	// the polling waits on the clock once the bot defaults are set up
+	h.waitFor("polling to start", clock.hasWaiters)
+
+	return h
+}
+
+// waitFor polls a condition the queue reaches on its own, without moving the clock.
+func (h *harness) waitFor(what string, condition func() bool) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// tickUntil advances the clock a second at a time, which is how often the queue polls, until
+// the condition holds.
+func (h *harness) tickUntil(what string, condition func() bool) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+
+		h.clock.Advance(time.Second)
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// add queues an item for the test member, answered by a notifier with the given message ID.
+func (h *harness) add(item *invision_queue.QueueItem, messageID string) *fakeNotifier {
+	h.t.Helper()
+
+	notifier := newFakeNotifier(messageID)
+
+	item.Notifier = notifier
+	if item.Origin.GuildID == "" {
+		item.Origin = testOrigin(item.Origin.MessageID)
+	}
+
+	_, err := h.queue.AddInvision(item)
+	if err != nil {
+		h.t.Fatalf("queueing %s: %v", item.Type, err)
+	}
+
+	return notifier
+}
+
+// run queues an item and polls until it is delivered or failed.
+func (h *harness) run(item *invision_queue.QueueItem, messageID string) *fakeNotifier {
+	h.t.Helper()
+
+	notifier := h.add(item, messageID)
+
+	h.tickUntil(item.Type.String()+" to finish", notifier.isDone)
+
+	return notifier
+}
+
+// invision runs a new invision and returns its grid result.
+func (h *harness) invision(prompt, messageID string) *invision_queue.Result {
+	h.t.Helper()
+
+	notifier := h.run(&invision_queue.QueueItem{
+		Type:         invision_queue.ItemTypeInvision,
+		Prompt:       prompt,
+		SamplerName1: "Euler a",
+	}, messageID)
+
+	result, failure := notifier.outcome()
+	if result == nil {
+		h.t.Fatalf("invision failed: %s", failure)
+	}
+
+	return result
+}
+
+// sourceImageURL serves a result image like the Discord CDN, for the jobs that rework it.
+func (h *harness) sourceImageURL() string {
+	h.t.Helper()
+
+	image, _ := base64.StdEncoding.DecodeString(testImage(8))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(image)
+	}))
+	h.t.Cleanup(server.Close)
+
+	return server.URL + "/invision.png"
+}
+
+func testOrigin(messageID string) invision_queue.Origin {
+	return invision_queue.Origin{
+		GuildID:       "guild",
+		MemberID:      "member",
+		ChannelID:     "channel",
+		InteractionID: "interaction",
+		MessageID:     messageID,
+	}
+}
@@ -2,14 +2,22 @@ package invision_queue
 
 import (
 	"kinshi_vision_bot/entities"
-
-	"github.com/bwmarrin/discordgo"
 )
 
 type Queue interface {
 	AddInvision(item *QueueItem) (int, error)
-	StartPolling(botSession *discordgo.Session)
-	GetBotDefaultSettings() (*entities.DefaultSettings, error)
-	UpdateDefaultDimensions(width, height int) (*entities.DefaultSettings, error)
-	UpdateDefaultBatch(batchCount, batchSize int) (*entities.DefaultSettings, error)
+	// QueuedGenerations returns how many generations the jobs of a member that are waiting in the
+	// queue count for, see QueueItem.Generations.
+	QueuedGenerations(guildID, memberID string) int
+	// Status returns a snapshot of the current and the waiting jobs.
+	Status() *Status
+	// StartPolling processes the queue until the process is interrupted or Stop is called.
+	StartPolling()
+	// Stop ends the polling once the current job is done. The waiting jobs are dropped with a
+	// notice, and new ones are refused with ErrQueueStopped.
+	Stop()
+	GetBotDefaultSettings(guildID string) (*entities.DefaultSettings, error)
+	UpdateDefaultDimensions(guildID string, width, height int) (*entities.DefaultSettings, error)
+	UpdateDefaultBatch(guildID string, batchCount, batchSize int) (*entities.DefaultSettings, error)
+	UpdateDefaultSettings(guildID string, settings *entities.DefaultSettings) (*entities.DefaultSettings, error)
 }
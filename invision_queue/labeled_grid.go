@@ -0,0 +1,206 @@
+package invision_queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/policy"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// labeledGrid describes a comparison of images that differ in a few parameters, like an X/Y plot.
+type labeledGrid struct {
+	// name is used in logs, request and details describe the grid in the message,
+	// as in `asked me to <request> "<prompt>"<details>`.
+	name    string
+	request string
+	details string
+
+	columnLabels []string
+	rowLabels    []string
+	xTitle       string
+	yTitle       string
+
+	// prepare is optional and called with the base generation, after its prompt was expanded
+	// and before any cell is generated, e.g. to derive the labels from the prompt.
+	prepare func(base *entities.ImageGeneration)
+	// applyCell changes a copy of the base generation into the cell at col, row. It returns
+	// a model checkpoint to generate the cell with, or an empty string for the current one.
+	applyCell func(generation *entities.ImageGeneration, col, row int) string
+}
+
+func (g *labeledGrid) cellCount() int {
+	return len(g.columnLabels) * len(g.rowLabels)
+}
+
+func labeledGridMessageContent(item *QueueItem, grid *labeledGrid, generation *entities.ImageGeneration, done int) string {
+	content := fmt.Sprintf("<@%s> asked me to %s \"%s\"%s, at step %d cfgscale %s seed %d with sampler %s.",
+		item.Origin.MemberID,
+		grid.request,
+		generation.Prompt,
+		grid.details,
+		generation.Steps,
+		strconv.FormatFloat(generation.CfgScale, 'f', 1, 64),
+		generation.Seed,
+		generation.SamplerName)
+
+	if total := grid.cellCount(); done < total {
+		content += fmt.Sprintf(" Working on image %d of %d...", done+1, total)
+	}
+
+	return content
+}
+
+// processLabeledGrid generates the cells of a grid one by one with the same seed, and posts
+// them as one image with the labels of the grid.
+func (q *queueImpl) processLabeledGrid(ctx context.Context, item *QueueItem, grid *labeledGrid) error {
+	logger := logging.FromContext(ctx)
+
+	baseGeneration, err := q.generationForItem(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	policy.Clamp(baseGeneration, item.Limits)
+
+	// every cell shares the seed, so only the compared parameters change the result
+	if baseGeneration.Seed < 0 {
+		baseGeneration.Seed = rand.Int63n(math.MaxUint32)
+	}
+
+	baseGeneration.Prompt, err = q.promptExpander.Expand(baseGeneration.Prompt, rand.New(rand.NewSource(baseGeneration.Seed)))
+	if err != nil {
+		return err
+	}
+
+	if grid.prepare != nil {
+		grid.prepare(baseGeneration)
+	}
+
+	total := grid.cellCount()
+
+	messageID, err := item.Notifier.Progress(ctx, &Progress{
+		Message: labeledGridMessageContent(item, grid, baseGeneration, 0),
+	})
+	if err != nil {
+		logger.Error("Error notifying progress", "error", err)
+
+		return err
+	}
+
+	baseGeneration.InteractionID = item.Origin.InteractionID
+	baseGeneration.MessageID = messageID
+	baseGeneration.ChannelID = item.Origin.ChannelID
+	baseGeneration.GuildID = item.Origin.GuildID
+	baseGeneration.MemberID = item.Origin.MemberID
+	baseGeneration.SortOrder = 0
+	baseGeneration.Processed = true
+	// every cell is an image of its own, so each counts against the hourly limit
+	baseGeneration.Generations = total
+
+	_, err = q.imageGenerationRepo.Create(ctx, baseGeneration)
+	if err != nil {
+		logger.Error("Error creating image generation record", "error", err)
+	}
+
+	logger.Info("Processing "+grid.name, "prompt", baseGeneration.Prompt, "columns", grid.columnLabels,
+		"rows", grid.rowLabels, "cells", total, "seed", baseGeneration.Seed)
+
+	imageBufs := make([]*bytes.Buffer, 0, total)
+	flagged := false
+	generationStart := q.clock.Now()
+
+	for row := range grid.rowLabels {
+		for col := range grid.columnLabels {
+			cell := *baseGeneration
+			cell.ID = 0
+			cell.SortOrder = row*len(grid.columnLabels) + col + 1
+
+			model := grid.applyCell(&cell, col, row)
+
+			req := textToImageRequest(&cell)
+			req.BatchSize = 1
+			req.NIter = 1
+
+			if model != "" {
+				req.OverrideSettings = map[string]any{"sd_model_checkpoint": model}
+			}
+
+			resp, genErr := q.stableDiffusionAPI.TextToImage(ctx, req)
+			if genErr == nil && len(resp.Images) == 0 {
+				genErr = errors.New("no image returned")
+			}
+
+			if genErr != nil {
+				return q.fail(ctx, item, "I'm sorry, but I had a problem imagining your images.", genErr)
+			}
+
+			decodedImage, decodeErr := base64.StdEncoding.DecodeString(resp.Images[0])
+			if decodeErr != nil {
+				return q.fail(ctx, item, "I'm sorry, but I had a problem imagining your images.", decodeErr)
+			}
+
+			imageBufs = append(imageBufs, bytes.NewBuffer(decodedImage))
+
+			if len(resp.Seeds) > 0 {
+				cell.Seed = resp.Seeds[0]
+			}
+
+			cell.NSFW = anyFlagged(resp.NSFW)
+			flagged = flagged || cell.NSFW
+
+			_, createErr := q.imageGenerationRepo.Create(ctx, &cell)
+			if createErr != nil {
+				logger.Error("Error creating image generation record", "sort_order", cell.SortOrder, "error", createErr)
+			}
+
+			q.progress(ctx, item, labeledGridMessageContent(item, grid, baseGeneration, len(imageBufs)),
+				float64(len(imageBufs))/float64(total))
+		}
+	}
+
+	gpuSeconds := q.clock.Now().Sub(generationStart).Seconds()
+
+	err = q.imageGenerationRepo.UpdateGPUSeconds(ctx, baseGeneration.ID, gpuSeconds)
+	if err != nil {
+		logger.Error("Error storing generation duration", "error", err)
+	}
+
+	nsfwAction := q.nsfwAction(item, baseGeneration.Prompt, flagged)
+	if nsfwAction == NSFWActionBlock {
+		logger.Info("Withheld NSFW "+grid.name, "message_id", baseGeneration.MessageID)
+
+		return q.withholdNSFWOutput(ctx, item)
+	}
+
+	gridImage, err := q.compositeRenderer.LabeledGrid(imageBufs, grid.columnLabels, grid.rowLabels, grid.xTitle, grid.yTitle)
+	if err != nil {
+		logger.Error("Error rendering "+grid.name, "error", err)
+
+		return err
+	}
+
+	_, err = item.Notifier.Deliver(ctx, &Result{
+		Kind:         ResultLabeledGrid,
+		Message:      labeledGridMessageContent(item, grid, baseGeneration, total),
+		Image:        gridImage,
+		FileName:     "invision_grid_" + q.clock.Now().Format("20060102150405") + ".png",
+		Spoiler:      nsfwAction == NSFWActionSpoiler,
+		GenerationID: baseGeneration.ID,
+	})
+	if err != nil {
+		logger.Error("Error delivering result", "error", err)
+
+		return err
+	}
+
+	logger.Info("Finished "+grid.name, "message_id", baseGeneration.MessageID, "gpu_seconds", gpuSeconds)
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package invision_queue
+
+import (
+	"bytes"
+	"context"
+	"kinshi_vision_bot/logging"
+)
+
+// Notifier shows the progress and the outcome of an item to whoever requested it, like the
+// response to a Discord interaction or a job of the REST API. The queue calls it from the
+// goroutine processing the item.
+type Notifier interface {
+	// Progress replaces the status of the item. It returns the ID of the message showing it,
+	// which the generations of the item are stored under, or an empty string.
+	Progress(ctx context.Context, progress *Progress) (string, error)
+	// Deliver shows the result of the item, and returns the ID of the message showing it.
+	Deliver(ctx context.Context, result *Result) (string, error)
+	// Fail replaces the status of the item with the reason it didn't produce a result.
+	Fail(ctx context.Context, message string) error
+}
+
+// Origin tells who requested an item, and where.
+type Origin struct {
+	GuildID  string
+	MemberID string
+	// RoleIDs select the role policy of the member.
+	RoleIDs []string
+	// ChannelID is where the item was requested, ParentChannelID is the channel of a thread.
+	ChannelID       string
+	ParentChannelID string
+	// NSFWChannel is set when the channel, or the channel of the thread, is age-restricted.
+	NSFWChannel   bool
+	InteractionID string
+	// MessageID is the result whose buttons requested the item, empty for commands.
+	MessageID string
+	// SourceImageURL is the image of that result, for items that work on the image as posted.
+	SourceImageURL string
+}
+
+// Progress is a status update of an item.
+type Progress struct {
+	// Message describes the item and how far it is, mentions are written as <@member ID>.
+	Message string
+	// Fraction is how far the item is, from 0 to 1.
+	Fraction float64
+}
+
+type ResultKind int
+
+const (
+	// ResultGrid is a grid of images, every image can be varied, upscaled and favorited.
+	ResultGrid ResultKind = iota
+	// ResultLabeledGrid compares images of an X/Y plot, prompt matrix or seed walk.
+	ResultLabeledGrid
+	// ResultSingle is the image of an upscale or img2img.
+	ResultSingle
+)
+
+// Result is the outcome of an item.
+type Result struct {
+	Kind    ResultKind
+	Message string
+	// Image is the image to show, the tiled images of a grid.
+	Image    *bytes.Buffer
+	FileName string
+	// Spoiler is set when the images were flagged and the guild shows flagged images as spoilers.
+	Spoiler bool
+	// CanVary tells whether a single result offers variations.
+	CanVary bool
+
+	// GenerationID is the stored generation of the result, the images of a grid follow it by sort order.
+	GenerationID int64
+	// Images are the PNG encoded images of a grid, in the order of their seeds.
+	Images [][]byte
+	Seeds  []int64
+}
+
+// progress reports a status update of an item, and returns the message ID it is shown under.
+func (q *queueImpl) progress(ctx context.Context, item *QueueItem, message string, fraction float64) string {
+	messageID, err := item.Notifier.Progress(ctx, &Progress{Message: message, Fraction: fraction})
+	if err != nil {
+		logging.FromContext(ctx).Error("Error notifying progress", "error", err)
+	}
+
+	return messageID
+}
+
+// fail tells the requester that an item failed, and returns the cause.
+func (q *queueImpl) fail(ctx context.Context, item *QueueItem, message string, cause error) error {
+	err := item.Notifier.Fail(ctx, message)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error notifying failure", "error", err)
+	}
+
+	return cause
+}
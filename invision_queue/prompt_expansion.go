@@ -0,0 +1,241 @@
+package invision_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/stable_diffusion_api"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxExpansionDepth bounds how often wildcard files can pull in other wildcards.
+const maxExpansionDepth = 10
+
+var ErrUnknownWildcard = errors.New("unknown wildcard")
+
+var (
+	// wildcardRegex matches __name__, where name may contain sub directories of the wildcards directory.
+	wildcardRegex = regexp.MustCompile(`__([\w\-]+(?:/[\w\-]+)*)__`)
+	// alternationRegex matches the innermost {a|b|c}, so nested alternations expand inside out.
+	alternationRegex = regexp.MustCompile(`\{([^{}]*\|[^{}]*)\}`)
+)
+
+// promptExpander resolves wildcards and alternations in prompts. Wildcard files are read on
+// every expansion, so edits to them apply to the next invision.
+type promptExpander struct {
+	wildcardsDir string
+}
+
+// hasDynamicParts reports whether a prompt contains wildcards or alternations.
+func hasDynamicParts(prompt string) bool {
+	return wildcardRegex.MatchString(prompt) || alternationRegex.MatchString(prompt)
+}
+
+// Validate checks that every wildcard of a prompt has a wildcard file.
+func (e *promptExpander) Validate(prompt string) error {
+	for _, match := range wildcardRegex.FindAllStringSubmatch(prompt, -1) {
+		_, err := e.wildcardOptions(match[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Expand replaces every wildcard by a random line of its file and every alternation by one
+// of its options. The same rng state always gives the same prompt.
+func (e *promptExpander) Expand(prompt string, rng *rand.Rand) (string, error) {
+	for depth := 0; depth < maxExpansionDepth && hasDynamicParts(prompt); depth++ {
+		var expandErr error
+
+		prompt = wildcardRegex.ReplaceAllStringFunc(prompt, func(match string) string {
+			options, err := e.wildcardOptions(wildcardRegex.FindStringSubmatch(match)[1])
+			if err != nil {
+				expandErr = err
+
+				return match
+			}
+
+			return options[rng.Intn(len(options))]
+		})
+		if expandErr != nil {
+			return "", expandErr
+		}
+
+		for alternationRegex.MatchString(prompt) {
+			prompt = alternationRegex.ReplaceAllStringFunc(prompt, func(match string) string {
+				options := strings.Split(match[1:len(match)-1], "|")
+
+				return strings.TrimSpace(options[rng.Intn(len(options))])
+			})
+		}
+	}
+
+	return prompt, nil
+}
+
+// wildcardOptions reads the non-empty lines of a wildcard file, skipping # comments.
+func (e *promptExpander) wildcardOptions(name string) ([]string, error) {
+	if e.wildcardsDir == "" {
+		return nil, fmt.Errorf("%w: __%s__ (no wildcards directory)", ErrUnknownWildcard, name)
+	}
+
+	content, err := os.ReadFile(filepath.Join(e.wildcardsDir, filepath.FromSlash(name)+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: __%s__", ErrUnknownWildcard, name)
+		}
+
+		return nil, fmt.Errorf("error reading wildcard __%s__: %w", name, err)
+	}
+
+	options := make([]string, 0)
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		options = append(options, line)
+	}
+
+	if len(options) == 0 {
+		return nil, fmt.Errorf("%w: __%s__ is empty", ErrUnknownWildcard, name)
+	}
+
+	return options, nil
+}
+
+// expandBatchPrompts expands the prompt of a generation once per image, seeding each expansion
+// from the seed of the generation and the image index. It returns nil when the prompt is static.
+func (e *promptExpander) expandBatchPrompts(prompt string, seed int64, imageCount int) ([]string, error) {
+	if !hasDynamicParts(prompt) {
+		return nil, nil
+	}
+
+	// a random seed still needs a fixed base, so every image of the batch draws differently
+	if seed < 0 {
+		seed = rand.Int63()
+	}
+
+	prompts := make([]string, imageCount)
+
+	for idx := range prompts {
+		expanded, err := e.Expand(prompt, rand.New(rand.NewSource(seed+int64(idx))))
+		if err != nil {
+			return nil, err
+		}
+
+		prompts[idx] = expanded
+	}
+
+	return prompts, nil
+}
+
+// batchPrompt returns the expanded prompt of an image, or the prompt of the generation when it was static.
+func batchPrompt(prompt string, prompts []string, idx int) string {
+	if idx < len(prompts) {
+		return prompts[idx]
+	}
+
+	return prompt
+}
+
+// checkWildcards refuses invisions whose prompt or styles use a wildcard without a file.
+func (q *queueImpl) checkWildcards(item *QueueItem) error {
+	if !item.Type.hasPrompt() {
+		return nil
+	}
+
+	err := q.promptExpander.Validate(item.Prompt)
+	if err != nil {
+		return err
+	}
+
+	for _, style := range item.Styles {
+		err = q.promptExpander.Validate(style.Prompt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func textToImageRequest(generation *entities.ImageGeneration) *stable_diffusion_api.TextToImageRequest {
+	return &stable_diffusion_api.TextToImageRequest{
+		Prompt:            generation.Prompt,
+		NegativePrompt:    generation.NegativePrompt,
+		Width:             generation.Width,
+		Height:            generation.Height,
+		RestoreFaces:      generation.RestoreFaces,
+		EnableHR:          generation.EnableHR,
+		HRUpscaleRate:     generation.HRUpscaleRate,
+		HRUpscaler:        generation.HRUpscaler,
+		HRResizeX:         generation.HiresWidth,
+		HRResizeY:         generation.HiresHeight,
+		DenoisingStrength: generation.DenoisingStrength,
+		BatchSize:         generation.BatchSize,
+		Seed:              generation.Seed,
+		Subseed:           generation.Subseed,
+		SubseedStrength:   generation.SubseedStrength,
+		SamplerName:       generation.SamplerName,
+		CfgScale:          generation.CfgScale,
+		Steps:             generation.Steps,
+		NIter:             generation.BatchCount,
+	}
+}
+
+// generateImages runs the generation in one request, or with expanded prompts in one request per
+// image, as the WebUI takes a single prompt per request. A fixed seed counts up per image, like
+// the WebUI does within a batch.
+func (q *queueImpl) generateImages(ctx context.Context, generation *entities.ImageGeneration, prompts []string) (*stable_diffusion_api.TextToImageResponse, error) {
+	if prompts == nil {
+		return q.stableDiffusionAPI.TextToImage(ctx, textToImageRequest(generation))
+	}
+
+	combined := &stable_diffusion_api.TextToImageResponse{}
+	flagged := false
+
+	for idx, prompt := range prompts {
+		req := textToImageRequest(generation)
+		req.Prompt = prompt
+		req.BatchSize = 1
+		req.NIter = 1
+
+		if generation.Seed >= 0 {
+			req.Seed = generation.Seed + int64(idx)
+		}
+
+		resp, err := q.stableDiffusionAPI.TextToImage(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		combined.Images = append(combined.Images, resp.Images...)
+		combined.Seeds = append(combined.Seeds, resp.Seeds...)
+		combined.Subseeds = append(combined.Subseeds, resp.Subseeds...)
+
+		// keep the flags aligned with the images, also when the checker only ran for some requests
+		flags := make([]bool, len(resp.Images))
+		for flagIdx := range flags {
+			flags[flagIdx] = flagIdx < len(resp.NSFW) && resp.NSFW[flagIdx]
+			flagged = flagged || flags[flagIdx]
+		}
+
+		combined.NSFW = append(combined.NSFW, flags...)
+	}
+
+	if !flagged {
+		combined.NSFW = nil
+	}
+
+	return combined, nil
+}
@@ -0,0 +1,136 @@
+package invision_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/policy"
+	"strings"
+)
+
+// promptMatrixMaxParts keeps a matrix within the size of an X/Y plot, as the images double per part.
+const promptMatrixMaxParts = 4
+
+var ErrInvalidPromptMatrix = errors.New("invalid prompt matrix")
+
+// splitPromptMatrix splits a prompt at every | that is not part of a {a|b} alternation.
+// The first part is the base of the matrix, the others are the optional parts.
+func splitPromptMatrix(prompt string) []string {
+	parts := make([]string, 0)
+	depth := 0
+	start := 0
+
+	for idx, char := range prompt {
+		switch char {
+		case '{':
+			depth++
+		case '}':
+			depth = max(depth-1, 0)
+		case '|':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(prompt[start:idx]))
+				start = idx + 1
+			}
+		}
+	}
+
+	return append(parts, strings.TrimSpace(prompt[start:]))
+}
+
+// preparePromptMatrix checks that the prompt of a matrix item has optional parts, and that the
+// member's roles allow that many images.
+func (q *queueImpl) preparePromptMatrix(item *QueueItem) error {
+	if item.Type != ItemTypePromptMatrix {
+		return nil
+	}
+
+	optionalParts := len(splitPromptMatrix(item.Prompt)) - 1
+
+	switch {
+	case optionalParts == 0:
+		return fmt.Errorf("%w: separate the optional parts of the prompt with |", ErrInvalidPromptMatrix)
+	case optionalParts > promptMatrixMaxParts:
+		return fmt.Errorf("%w: %d optional parts, the limit is %d", ErrInvalidPromptMatrix, optionalParts, promptMatrixMaxParts)
+	}
+
+	images := 1 << optionalParts
+
+	if item.Limits != nil && item.Limits.MaxBatch > 0 && images > item.Limits.MaxBatch {
+		return &policy.RejectedError{Reason: fmt.Sprintf("Your roles allow up to %d images per invision, this matrix has %d.",
+			item.Limits.MaxBatch, images)}
+	}
+
+	return nil
+}
+
+// matrixCombinations lists every subset of the parts, the first part changing fastest, with a
+// label naming the parts of each subset.
+func matrixCombinations(parts []string) ([][]string, []string) {
+	combinations := make([][]string, 0, 1<<len(parts))
+	labels := make([]string, 0, 1<<len(parts))
+
+	for mask := 0; mask < 1<<len(parts); mask++ {
+		combination := make([]string, 0, len(parts))
+
+		for idx, part := range parts {
+			if mask&(1<<idx) != 0 {
+				combination = append(combination, part)
+			}
+		}
+
+		label := strings.Join(combination, " + ")
+		if label == "" {
+			label = "-"
+		}
+
+		combinations = append(combinations, combination)
+		labels = append(labels, label)
+	}
+
+	return combinations, labels
+}
+
+// processPromptMatrix generates the base of the prompt with every combination of its optional parts.
+// The first half of the parts changes from column to column, the second half from row to row.
+func (q *queueImpl) processPromptMatrix(ctx context.Context, item *QueueItem) error {
+	var base string
+	var columnParts, rowParts [][]string
+
+	grid := &labeledGrid{
+		name:    "prompt matrix",
+		request: "make a prompt matrix of",
+	}
+
+	grid.prepare = func(generation *entities.ImageGeneration) {
+		parts := splitPromptMatrix(strings.Trim(generation.Prompt, "`"))
+		base = parts[0]
+		optional := parts[1:]
+		split := (len(optional) + 1) / 2
+
+		columnParts, grid.columnLabels = matrixCombinations(optional[:split])
+		rowParts, grid.rowLabels = matrixCombinations(optional[split:])
+
+		if len(optional[split:]) == 0 {
+			grid.rowLabels = []string{""}
+		}
+
+		grid.xTitle = base
+	}
+
+	grid.applyCell = func(generation *entities.ImageGeneration, col, row int) string {
+		parts := make([]string, 0)
+
+		for _, part := range append(append([]string{base}, columnParts[col]...), rowParts[row]...) {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+
+		generation.Prompt = quotePromptAsMonospace(strings.Join(parts, ", "))
+
+		return ""
+	}
+
+	return q.processLabeledGrid(ctx, item, grid)
+}
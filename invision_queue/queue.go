@@ -6,13 +6,17 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"kinshi_vision_bot/clock"
 	"kinshi_vision_bot/composite_renderer"
 	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/policy"
 	"kinshi_vision_bot/repositories"
+	"kinshi_vision_bot/repositories/channel_rules"
 	"kinshi_vision_bot/repositories/default_settings"
 	"kinshi_vision_bot/repositories/image_generations"
 	"kinshi_vision_bot/stable_diffusion_api"
-	"log"
+	"log/slog"
 	"math"
 	"os"
 	"os/signal"
@@ -21,8 +25,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/bwmarrin/discordgo"
 )
 
 const (
@@ -32,24 +34,75 @@ const (
 	initializedHeight     = 512
 	initializedBatchCount = 4
 	initializedBatchSize  = 1
+
+	initializedDefaultSteps       = 20
+	initializedMaxSteps           = 150
+	initializedDefaultCFGScale    = 9.0
+	initializedMaxCFGScale        = 30.0
+	initializedMaxDimension       = 8192
+	initializedMaxQueueLength     = 100
+	initializedMaxQueuedPerMember = 5
+	initializedShowcaseThreshold  = 5
+
+	minCFGScale = 1.0
+
+	// queueCapacity is the hard upper bound for the configurable max queue length.
+	queueCapacity = 1000
+)
+
+var (
+	ErrQueueFull            = errors.New("the queue is full")
+	ErrMemberQueueLimit     = errors.New("too many queued invisions for this member")
+	ErrInvalidDefaultConfig = errors.New("invalid default settings")
+	ErrQueueStopped         = errors.New("the queue is stopped")
 )
 
 type queueImpl struct {
-	botSession          *discordgo.Session
 	stableDiffusionAPI  stable_diffusion_api.StableDiffusionAPI
 	queue               chan *QueueItem
 	currentInvision     *QueueItem
+	currentStartedAt    time.Time
 	mu                  sync.Mutex
 	imageGenerationRepo image_generations.Repository
 	compositeRenderer   composite_renderer.Renderer
 	defaultSettingsRepo default_settings.Repository
-	botDefaultSettings  *entities.DefaultSettings
+	channelRuleRepo     channel_rules.Repository
+	policyEnforcer      policy.Enforcer
+	promptExpander      *promptExpander
+	clock               clock.Clock
+	logger              *slog.Logger
+
+	// stop ends the polling, processing tracks the job it runs in the background.
+	stop       chan struct{}
+	stopOnce   sync.Once
+	processing sync.WaitGroup
+
+	settingsMu    sync.Mutex
+	guildSettings map[string]*entities.DefaultSettings
+	// nsfwKeywordRegexes are compiled from the NSFW keywords of the guilds in guildSettings, nil for none.
+	nsfwKeywordRegexes map[string]*regexp.Regexp
+
+	queuedMu        sync.Mutex
+	queuedPerGuild  map[string]int
+	queuedPerMember map[string]int
+	// waiting mirrors the items in the queue channel, in order, for the status.
+	waiting []*QueueItem
+	// stopped refuses new items once the queue is stopped.
+	stopped bool
 }
 
 type Config struct {
 	StableDiffusionAPI  stable_diffusion_api.StableDiffusionAPI
 	ImageGenerationRepo image_generations.Repository
 	DefaultSettingsRepo default_settings.Repository
+	ChannelRuleRepo     channel_rules.Repository
+	PolicyEnforcer      policy.Enforcer
+	// WildcardsDir holds the __name__ wildcard files as name.txt. Wildcards are refused when empty.
+	WildcardsDir string
+	// Clock is optional, the real clock is used when nil.
+	Clock clock.Clock
+	// Logger is optional, the default logger is used when nil.
+	Logger *slog.Logger
 }
 
 func New(cfg Config) (Queue, error) {
@@ -65,17 +118,45 @@ func New(cfg Config) (Queue, error) {
 		return nil, errors.New("missing default settings repository")
 	}
 
+	if cfg.ChannelRuleRepo == nil {
+		return nil, errors.New("missing channel rule repository")
+	}
+
+	if cfg.PolicyEnforcer == nil {
+		return nil, errors.New("missing policy enforcer")
+	}
+
 	compositeRenderer, err := composite_renderer.New(composite_renderer.Config{})
 	if err != nil {
 		return nil, err
 	}
 
+	queueClock := cfg.Clock
+	if queueClock == nil {
+		queueClock = clock.NewClock()
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	return &queueImpl{
 		stableDiffusionAPI:  cfg.StableDiffusionAPI,
 		imageGenerationRepo: cfg.ImageGenerationRepo,
-		queue:               make(chan *QueueItem, 100),
+		queue:               make(chan *QueueItem, queueCapacity),
 		compositeRenderer:   compositeRenderer,
 		defaultSettingsRepo: cfg.DefaultSettingsRepo,
+		channelRuleRepo:     cfg.ChannelRuleRepo,
+		policyEnforcer:      cfg.PolicyEnforcer,
+		promptExpander:      &promptExpander{wildcardsDir: cfg.WildcardsDir},
+		clock:               queueClock,
+		logger:              logger,
+		stop:                make(chan struct{}),
+		guildSettings:       make(map[string]*entities.DefaultSettings),
+		nsfwKeywordRegexes:  make(map[string]*regexp.Regexp),
+		queuedPerGuild:      make(map[string]int),
+		queuedPerMember:     make(map[string]int),
 	}, nil
 }
 
@@ -86,51 +167,231 @@ const (
 	ItemTypeReroll
 	ItemTypeUpscale
 	ItemTypeVariation
+	ItemTypeXYPlot
+	ItemTypePromptMatrix
+	ItemTypeSeedWalk
+	ItemTypeImageToImage
+	ItemTypeEdit
 )
 
+func (t ItemType) String() string {
+	switch t {
+	case ItemTypeInvision:
+		return "invision"
+	case ItemTypeReroll:
+		return "reroll"
+	case ItemTypeUpscale:
+		return "upscale"
+	case ItemTypeVariation:
+		return "variation"
+	case ItemTypeXYPlot:
+		return "xyplot"
+	case ItemTypePromptMatrix:
+		return "matrix"
+	case ItemTypeSeedWalk:
+		return "seedwalk"
+	case ItemTypeImageToImage:
+		return "img2img"
+	case ItemTypeEdit:
+		return "edit"
+	default:
+		return "unknown"
+	}
+}
+
+// hasPrompt reports whether items of the type bring their own prompt, instead of reusing a stored generation.
+func (t ItemType) hasPrompt() bool {
+	return t == ItemTypeInvision || t == ItemTypeImageToImage || t == ItemTypeEdit || t.isLabeledGrid()
+}
+
+// isLabeledGrid reports whether items of the type are generated image by image into a labeled grid.
+func (t ItemType) isLabeledGrid() bool {
+	return t == ItemTypeXYPlot || t == ItemTypePromptMatrix || t == ItemTypeSeedWalk
+}
+
 type QueueItem struct {
-	Prompt             string
-	NegativePrompt     string
-	SamplerName1       string
-	Type               ItemType
-	UseHiresFix        bool
-	InteractionIndex   int
-	DiscordInteraction *discordgo.Interaction
+	// JobID correlates all log lines of this item. It is assigned by AddInvision when empty.
+	JobID            string
+	Prompt           string
+	NegativePrompt   string
+	SamplerName1     string
+	Type             ItemType
+	UseHiresFix      bool
+	InteractionIndex int
+	// Styles are merged into the prompt of a new invision.
+	Styles []*entities.Style
+	// XYPlot holds the axes of an X/Y plot item.
+	XYPlot *XYPlot
+	// SeedWalk holds the seeds of a seed walk item.
+	SeedWalk *SeedWalk
+	// VariationStrength is the subseed strength of a variation, or of the variation buttons of a
+	// new invision. 0 keeps the strength stored with the generation, or the default.
+	VariationStrength float64
+	// Upscaler picks the upscaler model of an upscale, the default one when empty.
+	Upscaler string
+	// DenoisingStrength is how much an img2img item changes the source image, the default when 0.
+	DenoisingStrength float64
+	// Edit holds the parameters an edit item changes in the stored generation, next to its
+	// Prompt and NegativePrompt.
+	Edit *GenerationEdit
+	// GenerationID selects a stored generation to reroll directly, instead of
+	// looking it up through the message the interaction was triggered on.
+	GenerationID int64
+	Origin       Origin
+	// Notifier shows the progress and the outcome of the item to the requester.
+	Notifier Notifier
+
+	// Limits is the role policy of the member, resolved by AddInvision. nil means unrestricted.
+	Limits *entities.RolePolicy
+	// PolicyNotes explains how AddInvision clamped the request to Limits.
+	PolicyNotes []string
+
+	queuedAt time.Time
+}
+
+// Generations is how many generations the item counts for against the hourly limit of its member.
+// Every cell of a labeled grid counts, an upscale only counts against the daily GPU budget.
+func (item *QueueItem) Generations() int {
+	switch {
+	case item.Type == ItemTypeUpscale:
+		return 0
+	case item.Type == ItemTypeXYPlot && item.XYPlot != nil:
+		return item.XYPlot.cellCount()
+	case item.Type == ItemTypeSeedWalk && item.SeedWalk != nil:
+		return item.SeedWalk.Steps
+	case item.Type == ItemTypePromptMatrix:
+		optionalParts := min(len(splitPromptMatrix(item.Prompt))-1, promptMatrixMaxParts)
+
+		return 1 << max(optionalParts, 0)
+	default:
+		return 1
+	}
 }
 
 func (q *queueImpl) AddInvision(item *QueueItem) (int, error) {
-	q.queue <- item
+	if item.JobID == "" {
+		item.JobID = logging.NewJobID()
+	}
+
+	ctx := logging.NewContext(context.Background(), q.jobLogger(item))
+
+	if item.Notifier == nil {
+		return 0, errors.New("missing notifier")
+	}
+
+	err := q.checkChannel(ctx, item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	err = q.checkNSFWPrompt(item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	err = q.checkWildcards(item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	err = q.applyPolicy(item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	err = q.prepareXYPlot(item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	err = q.preparePromptMatrix(item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	err = q.prepareSeedWalk(item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	err = q.reserveQueueSlot(item)
+	if err != nil {
+		q.jobLogger(item).Info("Rejected job", "reason", err)
+
+		return 0, err
+	}
+
+	select {
+	case q.queue <- item:
+	default:
+		q.releaseQueueSlot(item)
+
+		q.jobLogger(item).Info("Rejected job", "reason", ErrQueueFull)
+
+		return 0, ErrQueueFull
+	}
 
 	linePosition := len(q.queue)
 
+	q.jobLogger(item).Info("Queued job", "position", linePosition)
+
 	return linePosition, nil
 }
 
-func (q *queueImpl) StartPolling(botSession *discordgo.Session) {
-	q.botSession = botSession
+// jobLogger returns a logger annotated with the job ID and the origin of the item.
+func (q *queueImpl) jobLogger(item *QueueItem) *slog.Logger {
+	logger := q.logger.With("job_id", item.JobID, "job_type", item.Type.String())
+
+	if item.Origin.InteractionID != "" {
+		logger = logger.With("interaction_id", item.Origin.InteractionID)
+	}
+
+	if item.Origin.MemberID != "" {
+		logger = logger.With("member_id", item.Origin.MemberID)
+	}
 
-	botDefaultSettings, err := q.initializeOrGetBotDefaults()
+	return logger
+}
+
+func (q *queueImpl) StartPolling() {
+	_, err := q.initializeOrGetBotDefaults()
 	if err != nil {
-		log.Printf("Error getting/initializing bot default settings: %v", err)
+		q.logger.Error("Error getting/initializing bot default settings", "error", err)
 
 		return
 	}
 
-	q.botDefaultSettings = botDefaultSettings
+	q.logger.Info("Press Ctrl+C to exit")
 
-	log.Println("Press Ctrl+C to exit")
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(interrupt)
 
 	stopPolling := false
 
 	for {
 		select {
-		case <-stop:
+		case <-interrupt:
+			q.Stop()
+		case <-q.stop:
 			stopPolling = true
-		case <-time.After(1 * time.Second):
-			if q.currentInvision == nil {
+		case <-q.clock.After(1 * time.Second):
+			if !q.busy() {
 				q.pullNextInQueue()
 			}
 		}
@@ -140,17 +401,65 @@ func (q *queueImpl) StartPolling(botSession *discordgo.Session) {
 		}
 	}
 
-	log.Printf("Polling stopped...\n")
+	if q.busy() {
+		q.logger.Info("Waiting for the current job to finish")
+	}
+
+	q.processing.Wait()
+
+	q.dropWaiting()
+
+	q.logger.Info("Polling stopped")
+}
+
+func (q *queueImpl) Stop() {
+	q.stopOnce.Do(func() {
+		q.queuedMu.Lock()
+		q.stopped = true
+		q.queuedMu.Unlock()
+
+		close(q.stop)
+	})
+}
+
+// busy reports whether a job is being processed.
+func (q *queueImpl) busy() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.currentInvision != nil
+}
+
+// dropWaiting tells the members whose jobs are still waiting in line that they won't be processed.
+func (q *queueImpl) dropWaiting() {
+	q.queuedMu.Lock()
+	dropped := q.waiting
+	q.waiting = nil
+	q.queuedPerGuild = make(map[string]int)
+	q.queuedPerMember = make(map[string]int)
+	q.queuedMu.Unlock()
+
+	for _, item := range dropped {
+		logger := q.jobLogger(item)
+		ctx := logging.NewContext(context.Background(), logger)
+
+		logger.Info("Dropped job")
+
+		_ = q.fail(ctx, item, "I'm sorry, but I'm shutting down and couldn't get to your invision. Please try again later.", nil)
+	}
 }
 
 func (q *queueImpl) pullNextInQueue() {
 	if len(q.queue) > 0 {
 		element := <-q.queue
 
+		q.releaseQueueSlot(element)
+
 		q.mu.Lock()
 		defer q.mu.Unlock()
 
 		q.currentInvision = element
+		q.currentStartedAt = q.clock.Now()
 
 		q.processCurrentInvision()
 	}
@@ -185,11 +494,61 @@ func (q *queueImpl) fillInBotDefaults(settings *entities.DefaultSettings) (*enti
 		updated = true
 	}
 
+	if settings.NegativePrompt == "" {
+		settings.NegativePrompt = defaultNegative
+		updated = true
+	}
+
+	if settings.DefaultSteps == 0 {
+		settings.DefaultSteps = initializedDefaultSteps
+		updated = true
+	}
+
+	if settings.MaxSteps == 0 {
+		settings.MaxSteps = initializedMaxSteps
+		updated = true
+	}
+
+	if settings.DefaultCFGScale == 0 {
+		settings.DefaultCFGScale = initializedDefaultCFGScale
+		updated = true
+	}
+
+	if settings.MaxCFGScale == 0 {
+		settings.MaxCFGScale = initializedMaxCFGScale
+		updated = true
+	}
+
+	if settings.MaxDimension == 0 {
+		settings.MaxDimension = initializedMaxDimension
+		updated = true
+	}
+
+	if settings.MaxQueueLength == 0 {
+		settings.MaxQueueLength = initializedMaxQueueLength
+		updated = true
+	}
+
+	if settings.MaxQueuedPerMember == 0 {
+		settings.MaxQueuedPerMember = initializedMaxQueuedPerMember
+		updated = true
+	}
+
+	if settings.NSFWAction == "" {
+		settings.NSFWAction = NSFWActionSpoiler
+		updated = true
+	}
+
+	if settings.ShowcaseThreshold == 0 {
+		settings.ShowcaseThreshold = initializedShowcaseThreshold
+		updated = true
+	}
+
 	return settings, updated
 }
 
 func (q *queueImpl) initializeOrGetBotDefaults() (*entities.DefaultSettings, error) {
-	botDefaultSettings, err := q.GetBotDefaultSettings()
+	botDefaultSettings, err := q.GetBotDefaultSettings("")
 	if err != nil && !errors.Is(err, &repositories.NotFoundError{}) {
 		return nil, err
 	}
@@ -201,107 +560,307 @@ func (q *queueImpl) initializeOrGetBotDefaults() (*entities.DefaultSettings, err
 			return nil, err
 		}
 
-		log.Printf("Initialized bot default settings: %+v\n", botDefaultSettings)
+		q.logger.Info("Initialized bot default settings", "settings", botDefaultSettings)
 	} else {
-		log.Printf("Retrieved bot default settings: %+v\n", botDefaultSettings)
+		q.logger.Info("Retrieved bot default settings", "settings", botDefaultSettings)
 	}
 
+	q.settingsMu.Lock()
+	q.cacheGuildSettings("", botDefaultSettings)
+	q.settingsMu.Unlock()
+
 	return botDefaultSettings, nil
 }
 
-func (q *queueImpl) GetBotDefaultSettings() (*entities.DefaultSettings, error) {
-	if q.botDefaultSettings != nil {
-		return q.botDefaultSettings, nil
+// GetBotDefaultSettings returns the settings of a guild. A guild without settings of its
+// own uses a copy of the global settings until one of them is changed.
+func (q *queueImpl) GetBotDefaultSettings(guildID string) (*entities.DefaultSettings, error) {
+	q.settingsMu.Lock()
+	defer q.settingsMu.Unlock()
+
+	return q.getGuildSettings(guildID)
+}
+
+// getGuildSettings must be called with settingsMu held.
+func (q *queueImpl) getGuildSettings(guildID string) (*entities.DefaultSettings, error) {
+	if settings, ok := q.guildSettings[guildID]; ok {
+		return settings, nil
 	}
 
-	defaultSettings, err := q.defaultSettingsRepo.GetByMemberID(context.Background(), botID)
+	settings, err := q.defaultSettingsRepo.GetByGuildAndMemberID(context.Background(), guildID, botID)
 	if err != nil {
-		return nil, err
+		if guildID == "" || !errors.Is(err, &repositories.NotFoundError{}) {
+			return nil, err
+		}
+
+		globalSettings, err := q.getGuildSettings("")
+		if err != nil {
+			return nil, err
+		}
+
+		guildSettings := *globalSettings
+		guildSettings.GuildID = guildID
+
+		settings = &guildSettings
 	}
 
-	q.botDefaultSettings = defaultSettings
+	q.cacheGuildSettings(guildID, settings)
 
-	return defaultSettings, nil
+	return settings, nil
 }
 
-func (q *queueImpl) defaultWidth() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
+// cacheGuildSettings keeps the settings of a guild, with its NSFW keywords compiled once for every
+// prompt checked against them. It must be called with settingsMu held.
+func (q *queueImpl) cacheGuildSettings(guildID string, settings *entities.DefaultSettings) {
+	q.guildSettings[guildID] = settings
+	q.nsfwKeywordRegexes[guildID] = compileNSFWKeywords(settings.NSFWKeywords)
+}
+
+// nsfwKeywordRegex returns the compiled NSFW keywords of a guild, nil when it has none.
+func (q *queueImpl) nsfwKeywordRegex(guildID string) (*regexp.Regexp, error) {
+	q.settingsMu.Lock()
+	defer q.settingsMu.Unlock()
+
+	_, err := q.getGuildSettings(guildID)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return defaultSettings.Width, nil
+	return q.nsfwKeywordRegexes[guildID], nil
 }
 
-func (q *queueImpl) defaultHeight() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
+// updateGuildSettings applies update to a copy of the settings of a guild and stores the result.
+func (q *queueImpl) updateGuildSettings(guildID string, update func(settings *entities.DefaultSettings) error) (*entities.DefaultSettings, error) {
+	q.settingsMu.Lock()
+	defer q.settingsMu.Unlock()
+
+	currentSettings, err := q.getGuildSettings(guildID)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return defaultSettings.Height, nil
-}
+	settings := *currentSettings
 
-func (q *queueImpl) defaultBatchCount() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
+	err = update(&settings)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return defaultSettings.BatchCount, nil
-}
+	settings.GuildID = guildID
+	settings.MemberID = botID
 
-func (q *queueImpl) defaultBatchSize() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
+	newDefaultSettings, err := q.defaultSettingsRepo.Upsert(context.Background(), &settings)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return defaultSettings.BatchSize, nil
+	q.cacheGuildSettings(guildID, newDefaultSettings)
+
+	return newDefaultSettings, nil
 }
 
-func (q *queueImpl) UpdateDefaultDimensions(width, height int) (*entities.DefaultSettings, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
+func (q *queueImpl) UpdateDefaultDimensions(guildID string, width, height int) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateGuildSettings(guildID, func(settings *entities.DefaultSettings) error {
+		settings.Width = width
+		settings.Height = height
+
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	defaultSettings.Width = width
-	defaultSettings.Height = height
+	q.logger.Info("Updated default dimensions", "guild_id", guildID, "width", width, "height", height)
 
-	newDefaultSettings, err := q.defaultSettingsRepo.Upsert(context.Background(), defaultSettings)
+	return newDefaultSettings, nil
+}
+
+func (q *queueImpl) UpdateDefaultBatch(guildID string, batchCount, batchSize int) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateGuildSettings(guildID, func(settings *entities.DefaultSettings) error {
+		settings.BatchCount = batchCount
+		settings.BatchSize = batchSize
+
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	q.botDefaultSettings = newDefaultSettings
-
-	log.Printf("Updated default dimensions to: %dx%d\n", width, height)
+	q.logger.Info("Updated default batch", "guild_id", guildID, "batch_count", batchCount, "batch_size", batchSize)
 
 	return newDefaultSettings, nil
 }
 
-func (q *queueImpl) UpdateDefaultBatch(batchCount, batchSize int) (*entities.DefaultSettings, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
+// UpdateDefaultSettings validates and stores the settings of a guild. They apply to every job
+// of the guild processed afterwards, including the ones already waiting in the queue.
+func (q *queueImpl) UpdateDefaultSettings(guildID string, settings *entities.DefaultSettings) (*entities.DefaultSettings, error) {
+	err := validateDefaultSettings(settings)
 	if err != nil {
 		return nil, err
 	}
 
-	defaultSettings.BatchCount = batchCount
-	defaultSettings.BatchSize = batchSize
+	newDefaultSettings, err := q.updateGuildSettings(guildID, func(current *entities.DefaultSettings) error {
+		*current = *settings
 
-	newDefaultSettings, err := q.defaultSettingsRepo.Upsert(context.Background(), defaultSettings)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	q.botDefaultSettings = newDefaultSettings
-
-	log.Printf("Updated default batch count/size to: %d/%d\n", batchCount, batchSize)
+	q.logger.Info("Updated default settings", "guild_id", guildID, "settings", newDefaultSettings)
 
 	return newDefaultSettings, nil
 }
 
+func validateDefaultSettings(settings *entities.DefaultSettings) error {
+	switch {
+	case settings.NegativePrompt == "":
+		return fmt.Errorf("%w: the negative prompt can't be empty", ErrInvalidDefaultConfig)
+	case settings.MaxSteps < 1:
+		return fmt.Errorf("%w: max steps must be at least 1", ErrInvalidDefaultConfig)
+	case settings.DefaultSteps < 1 || settings.DefaultSteps > settings.MaxSteps:
+		return fmt.Errorf("%w: default steps must be between 1 and %d", ErrInvalidDefaultConfig, settings.MaxSteps)
+	case settings.MaxCFGScale < minCFGScale:
+		return fmt.Errorf("%w: max CFG scale must be at least %.1f", ErrInvalidDefaultConfig, minCFGScale)
+	case settings.DefaultCFGScale < minCFGScale || settings.DefaultCFGScale > settings.MaxCFGScale:
+		return fmt.Errorf("%w: default CFG scale must be between %.1f and %.1f", ErrInvalidDefaultConfig, minCFGScale, settings.MaxCFGScale)
+	case settings.MaxDimension < 64:
+		return fmt.Errorf("%w: max dimension must be at least 64", ErrInvalidDefaultConfig)
+	case settings.MaxQueueLength < 1 || settings.MaxQueueLength > queueCapacity:
+		return fmt.Errorf("%w: max queue length must be between 1 and %d", ErrInvalidDefaultConfig, queueCapacity)
+	case settings.MaxQueuedPerMember < 1:
+		return fmt.Errorf("%w: max queued per member must be at least 1", ErrInvalidDefaultConfig)
+	case settings.NSFWAction != NSFWActionSpoiler && settings.NSFWAction != NSFWActionBlock:
+		return fmt.Errorf("%w: the NSFW action must be %q or %q", ErrInvalidDefaultConfig, NSFWActionSpoiler, NSFWActionBlock)
+	case settings.ShowcaseThreshold < 1:
+		return fmt.Errorf("%w: the showcase threshold must be at least 1", ErrInvalidDefaultConfig)
+	}
+
+	return nil
+}
+
+// applyPolicy resolves the role policy of the member and checks the item against it, so that
+// rejections and clamped parameters can be explained before the job is accepted.
+func (q *queueImpl) applyPolicy(item *QueueItem) error {
+	ctx := logging.NewContext(context.Background(), q.jobLogger(item))
+
+	limits, err := q.policyEnforcer.Resolve(ctx, item.Origin.GuildID, item.Origin.RoleIDs)
+	if err != nil {
+		return fmt.Errorf("error resolving role policy: %w", err)
+	}
+
+	item.Limits = limits
+
+	if limits == nil {
+		return nil
+	}
+
+	if item.Type == ItemTypeUpscale {
+		return policy.CheckUpscale(limits)
+	}
+
+	generation, err := q.generationForItem(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	item.PolicyNotes = policy.Clamp(generation, limits)
+
+	return nil
+}
+
+// reserveQueueSlot enforces the queue limits of the guild settings and counts the item for its guild and member.
+func (q *queueImpl) reserveQueueSlot(item *QueueItem) error {
+	guildID := item.Origin.GuildID
+
+	maxQueueLength := initializedMaxQueueLength
+	maxQueuedPerMember := initializedMaxQueuedPerMember
+
+	if settings, err := q.GetBotDefaultSettings(guildID); err == nil {
+		maxQueueLength = settings.MaxQueueLength
+		maxQueuedPerMember = settings.MaxQueuedPerMember
+	}
+
+	q.queuedMu.Lock()
+	defer q.queuedMu.Unlock()
+
+	if q.stopped {
+		return ErrQueueStopped
+	}
+
+	// every reserved item is waiting until it's pulled, so this bounds the sends into the queue channel
+	if len(q.waiting) >= queueCapacity || q.queuedPerGuild[guildID] >= maxQueueLength {
+		return ErrQueueFull
+	}
+
+	memberKey := queuedMemberKey(item)
+
+	if q.queuedPerMember[memberKey] >= maxQueuedPerMember {
+		return ErrMemberQueueLimit
+	}
+
+	q.queuedPerGuild[guildID]++
+	q.queuedPerMember[memberKey]++
+
+	item.queuedAt = q.clock.Now()
+	q.waiting = append(q.waiting, item)
+
+	return nil
+}
+
+func (q *queueImpl) releaseQueueSlot(item *QueueItem) {
+	q.queuedMu.Lock()
+	defer q.queuedMu.Unlock()
+
+	guildID := item.Origin.GuildID
+
+	q.queuedPerGuild[guildID]--
+	if q.queuedPerGuild[guildID] <= 0 {
+		delete(q.queuedPerGuild, guildID)
+	}
+
+	memberKey := queuedMemberKey(item)
+
+	q.queuedPerMember[memberKey]--
+	if q.queuedPerMember[memberKey] <= 0 {
+		delete(q.queuedPerMember, memberKey)
+	}
+
+	for idx, waitingItem := range q.waiting {
+		if waitingItem == item {
+			q.waiting = append(q.waiting[:idx], q.waiting[idx+1:]...)
+
+			break
+		}
+	}
+}
+
+// queuedMemberKey identifies a member within a guild, the per-member limit is a guild setting.
+func queuedMemberKey(item *QueueItem) string {
+	return memberKey(item.Origin.GuildID, item.Origin.MemberID)
+}
+
+func memberKey(guildID, memberID string) string {
+	return guildID + "/" + memberID
+}
+
+// QueuedGenerations returns how many generations the jobs of a member that are waiting in the queue count for.
+func (q *queueImpl) QueuedGenerations(guildID, memberID string) int {
+	q.queuedMu.Lock()
+	defer q.queuedMu.Unlock()
+
+	generations := 0
+
+	for _, item := range q.waiting {
+		if item.Origin.GuildID == guildID && item.Origin.MemberID == memberID {
+			generations += item.Generations()
+		}
+	}
+
+	return generations
+}
+
 type dimensionsResult struct {
 	SanitizedPrompt string
 	Width           int
@@ -353,8 +912,6 @@ func extractDimensionsFromPrompt(prompt string, width, height int) (*dimensionsR
 	arMatches := arRegex.FindStringSubmatch(prompt)
 
 	if len(arMatches) == 3 {
-		log.Printf("Aspect ratio overwrite: %#v", arMatches)
-
 		prompt = arRegex.ReplaceAllString(prompt, "")
 
 		firstDimension, err := strconv.Atoi(arMatches[1])
@@ -378,8 +935,6 @@ func extractDimensionsFromPrompt(prompt string, width, height int) (*dimensionsR
 			// Round up to the nearest 8
 			height = (int(scaledHeight) + 7) & (-8)
 		}
-
-		log.Printf("New dimensions: width: %v, height: %v", width, height)
 	}
 
 	return &dimensionsResult{
@@ -397,14 +952,12 @@ func quotePromptAsMonospace(promptIn string) (quotedprompt string) {
 // recieve sampling process steps value
 var stepRegex = regexp.MustCompile(`\s?--step ([\d]*)\s?`)
 
-func extractStepsFromPrompt(prompt string, defaultsteps int) (*stepsResult, error) {
+func extractStepsFromPrompt(prompt string, defaultsteps, maxSteps int) (*stepsResult, error) {
 
 	stepMatches := stepRegex.FindStringSubmatch(prompt)
 	stepsValue := defaultsteps
 
 	if len(stepMatches) == 2 {
-		log.Printf("steps overwrite: %#v", stepMatches)
-
 		prompt = stepRegex.ReplaceAllString(prompt, "")
 
 		s, err := strconv.Atoi(stepMatches[1])
@@ -415,6 +968,8 @@ func extractStepsFromPrompt(prompt string, defaultsteps int) (*stepsResult, erro
 
 		if s < 1 {
 			stepsValue = defaultsteps
+		} else if s > maxSteps {
+			stepsValue = maxSteps
 		}
 	}
 
@@ -426,14 +981,12 @@ func extractStepsFromPrompt(prompt string, defaultsteps int) (*stepsResult, erro
 
 var cfgscaleRegex = regexp.MustCompile(`\s?--cfgscale (\d\d?\.?\d?)\s?`)
 
-func extractCFGScaleFromPrompt(prompt string, defaultScale float64) (*cfgScaleResult, error) {
+func extractCFGScaleFromPrompt(prompt string, defaultScale, maxScale float64) (*cfgScaleResult, error) {
 
 	cfgscaleMatches := cfgscaleRegex.FindStringSubmatch(prompt)
 	cfgValue := defaultScale
 
 	if len(cfgscaleMatches) == 2 {
-		log.Printf("CFG Scale overwrite: %#v", cfgscaleMatches)
-
 		prompt = cfgscaleRegex.ReplaceAllString(prompt, "")
 		c, err := strconv.ParseFloat(cfgscaleMatches[1], 64)
 		if err != nil {
@@ -441,7 +994,7 @@ func extractCFGScaleFromPrompt(prompt string, defaultScale float64) (*cfgScaleRe
 		}
 		cfgValue = c
 
-		if c < 1.0 || c > 30.0 {
+		if c < minCFGScale || c > maxScale {
 			cfgValue = defaultScale
 		}
 	}
@@ -461,8 +1014,6 @@ func extractSeedFromPrompt(prompt string) (*seedResult, error) {
 	var Seed_MaxValue int64 = int64(math.MaxInt64) // although SD accepts: 12345678901234567890
 
 	if len(seedMatches) == 2 {
-		log.Printf("Seed overwrite: %#v", seedMatches)
-
 		prompt = seedRegex.ReplaceAllString(prompt, "")
 		s, err := strconv.ParseInt(seedMatches[1], 10, 64)
 		if err != nil {
@@ -493,8 +1044,6 @@ func extractZoomScaleFromPrompt(prompt string, defaultZoomScale float64) (*zoomS
 	zoomValue := defaultZoomScale
 
 	if len(zoomMatches) == 2 {
-		log.Printf("Zoom Scale overwrite: %#v", zoomMatches)
-
 		prompt = zoomRegex.ReplaceAllString(prompt, "")
 		z, err := strconv.ParseFloat(zoomMatches[1], 64)
 		if err != nil {
@@ -516,7 +1065,7 @@ func extractZoomScaleFromPrompt(prompt string, defaultZoomScale float64) (*zoomS
 // pixel size before zoom, accept by X,Y
 var pxRegex = regexp.MustCompile(`\s?--px (\d+)[:,] ?(\d+)\s?`)
 
-func extractPixelFromPrompt(prompt string, defaultXYValue int) (*pixelSpecifiedResult, error) {
+func extractPixelFromPrompt(prompt string, defaultXYValue, maxDimension int) (*pixelSpecifiedResult, error) {
 
 	pxMatches := pxRegex.FindStringSubmatch(prompt)
 	pxValueX := defaultXYValue
@@ -526,8 +1075,6 @@ func extractPixelFromPrompt(prompt string, defaultXYValue int) (*pixelSpecifiedR
 	var err, err2 error
 
 	if len(pxMatches) == 3 {
-		log.Printf("pixel size overwrite: %#v", pxMatches)
-
 		prompt = pxRegex.ReplaceAllString(prompt, "")
 		x, err = strconv.Atoi(pxMatches[1])
 		if err != nil {
@@ -544,13 +1091,14 @@ func extractPixelFromPrompt(prompt string, defaultXYValue int) (*pixelSpecifiedR
 		pxValueX = (int(pxValueX) + 7) & (-8)
 		pxValueY = (int(pxValueY) + 7) & (-8)
 
-		if pxValueX > 8192 {
-			pxValueX = 8192
-		} else if pxValueY > 8192 {
-			pxValueY = 8192
+		if pxValueX > maxDimension {
+			pxValueX = maxDimension
+		}
+
+		if pxValueY > maxDimension {
+			pxValueY = maxDimension
 		}
 
-		log.Printf("New base x, y: width: %v, height: %v", pxValueX, pxValueY)
 		processed = true
 	}
 
@@ -565,7 +1113,11 @@ func extractPixelFromPrompt(prompt string, defaultXYValue int) (*pixelSpecifiedR
 const defaultNegative = "(verybadimagenegative_v1.3, ng_deepnegative_v1_75t, (ugly face:0.8),cross-eyed,sketches, (worst quality:2), (low quality:2), (normal quality:2), lowres, normal quality, ((monochrome)), ((grayscale)), skin spots, acnes, skin blemishes, bad anatomy, DeepNegative, facing away, tilted head, {Multiple people}, lowres, bad anatomy, bad hands, text, error, missing fingers, extra digit, fewer digits, cropped, worstquality, low quality, normal quality, jpegartifacts, signature, watermark, username, blurry, bad feet, cropped, poorly drawn hands, poorly drawn face, mutation, deformed, worst quality, low quality, normal quality, jpeg artifacts, signature, watermark, extra fingers, fewer digits, extra limbs, extra arms,extra legs, malformed limbs, fused fingers, too many fingers, long neck, cross-eyed,mutated hands, polar lowres, bad body, bad proportions, gross proportions, text, error, missing fingers, missing arms, missing legs, extra digit, extra arms, extra leg, extra foot, ((repeating hair))"
 
 func (q *queueImpl) processCurrentInvision() {
+	q.processing.Add(1)
+
 	go func() {
+		defer q.processing.Done()
+
 		defer func() {
 			q.mu.Lock()
 			defer q.mu.Unlock()
@@ -573,211 +1125,323 @@ func (q *queueImpl) processCurrentInvision() {
 			q.currentInvision = nil
 		}()
 
+		logger := q.jobLogger(q.currentInvision)
+		ctx := logging.NewContext(context.Background(), logger)
+
+		logger.Info("Processing job")
+
 		if q.currentInvision.Type == ItemTypeUpscale {
-			q.processUpscaleInvision(q.currentInvision)
+			q.processUpscaleInvision(ctx, q.currentInvision)
 
 			return
 		}
 
-		defaultWidth, err := q.defaultWidth()
-		if err != nil {
-			log.Printf("Error getting default width: %v", err)
+		if q.currentInvision.Type == ItemTypeXYPlot {
+			err := q.processXYPlot(ctx, q.currentInvision)
+			if err != nil {
+				logger.Error("Error processing X/Y plot", "error", err)
+			}
 
 			return
 		}
 
-		defaultHeight, err := q.defaultHeight()
-		if err != nil {
-			log.Printf("Error getting default height: %v", err)
+		if q.currentInvision.Type == ItemTypePromptMatrix {
+			err := q.processPromptMatrix(ctx, q.currentInvision)
+			if err != nil {
+				logger.Error("Error processing prompt matrix", "error", err)
+			}
 
 			return
 		}
 
-		// add optional parameter: Negative prompt
-		negativePrompt := ""
+		if q.currentInvision.Type == ItemTypeImageToImage {
+			generation, err := q.generationForItem(ctx, q.currentInvision)
+			if err != nil {
+				logger.Error("Error preparing generation", "error", err)
 
-		if q.currentInvision.NegativePrompt == "" {
-			negativePrompt = defaultNegative
-		} else {
-			negativePrompt = q.currentInvision.NegativePrompt
-		}
+				_ = q.fail(ctx, q.currentInvision, "I'm sorry, but I couldn't find the image to rework.", err)
 
-		// add optional parameter: sampler
-		samplerName1 := ""
-		if q.currentInvision.SamplerName1 == "" {
-			samplerName1 = "DPM++ 2M"
-		} else {
-			samplerName1 = q.currentInvision.SamplerName1
-		}
+				return
+			}
 
-		promptRes, err := extractDimensionsFromPrompt(q.currentInvision.Prompt, defaultWidth, defaultHeight)
-		if err != nil {
-			log.Printf("Error extracting dimensions from prompt: %v", err)
+			policy.Clamp(generation, q.currentInvision.Limits)
+
+			err = q.processImageToImage(ctx, q.currentInvision, generation)
+			if err != nil {
+				logger.Error("Error processing img2img", "error", err)
+			}
 
 			return
 		}
 
-		scaledWidth := defaultWidth
-		scaledHeight := defaultHeight
-		hiresWidth := defaultWidth
-		hiresHeight := defaultHeight
+		if q.currentInvision.Type == ItemTypeSeedWalk {
+			err := q.processSeedWalk(ctx, q.currentInvision)
+			if err != nil {
+				logger.Error("Error processing seed walk", "error", err)
+			}
 
-		if promptRes.Width > defaultWidth || promptRes.Height > defaultHeight {
-			scaledWidth = promptRes.Width
-			scaledHeight = promptRes.Height
-			hiresWidth = promptRes.Width
-			hiresHeight = promptRes.Height
+			return
 		}
 
-		promptResPx, errPx := extractPixelFromPrompt(promptRes.SanitizedPrompt, defaultWidth)
-		if errPx != nil {
-			log.Printf("Error extracting px X,Y from prompt: %v", errPx)
+		newGeneration, err := q.generationForItem(ctx, q.currentInvision)
+		if err != nil {
+			logger.Error("Error preparing generation", "error", err)
+
+			_ = q.fail(ctx, q.currentInvision, "I'm sorry, but I couldn't prepare your invision.", err)
 
 			return
 		}
 
-		if promptResPx.IsProcessed {
-			scaledWidth = promptResPx.Width
-			scaledHeight = promptResPx.Height
-			hiresWidth = promptResPx.Width
-			hiresHeight = promptResPx.Height
+		notes := policy.Clamp(newGeneration, q.currentInvision.Limits)
+		if len(notes) > 0 {
+			logger.Info("Clamped generation to role policy", "notes", notes)
 		}
 
-		// add optional parameter: enable hires.fix
-		enableHR1 := false
-		upscaleRate1 := 1.0
-		upscalerName1 := ""
-
-		// extract --zoom parameter
-
-		defaultZoomValue1 := 2.0
-		promptResZ, errZ := extractZoomScaleFromPrompt(promptResPx.SanitizedPrompt, defaultZoomValue1)
-		if errZ != nil {
-			log.Printf("Error extracting zoom scale from prompt: %v", errZ)
+		err = q.processInvisionGrid(ctx, newGeneration, q.currentInvision)
+		if err != nil {
+			logger.Error("Error processing invision grid", "error", err)
 
 			return
 		}
+	}()
+}
 
-		enableHR1 = q.currentInvision.UseHiresFix
-		if enableHR1 == true {
-			upscaleRate1 = promptResZ.ZoomScale
-			upscalerName1 = "Latent"
-			hiresWidth = 0
-			hiresHeight = 0
-			// hrSecondPassSteps = 10
-		} else {
-			enableHR1 = false
-			upscaleRate1 = 1.0
-			upscalerName1 = ""
-			hiresWidth = scaledWidth
-			hiresHeight = scaledHeight
-		}
+// generationForItem builds the generation an invision, reroll or variation will produce,
+// before any role policy limits are applied.
+func (q *queueImpl) generationForItem(ctx context.Context, item *QueueItem) (*entities.ImageGeneration, error) {
+	settings, err := q.GetBotDefaultSettings(item.Origin.GuildID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting default settings: %w", err)
+	}
 
-		stepValue := 20 // default steps value
-		promptRes2, err := extractStepsFromPrompt(promptResZ.SanitizedPrompt, stepValue)
+	var newGeneration *entities.ImageGeneration
+
+	// an img2img reworks a single image, so the batch settings don't apply
+	if item.Type == ItemTypeImageToImage {
+		return q.imageToImageGeneration(ctx, item)
+	}
+
+	if item.Type == ItemTypeReroll || item.Type == ItemTypeVariation || item.Type == ItemTypeEdit {
+		foundGeneration, err := q.getPreviousGeneration(ctx, item, item.InteractionIndex)
 		if err != nil {
-			log.Printf("Error extracting step from prompt: %v", err)
-		} else if promptRes2.Steps != stepValue {
-			stepValue = promptRes2.Steps
+			return nil, fmt.Errorf("error getting prompt for reroll: %w", err)
 		}
 
-		cfgScaleValue := 9.0 // default CFG scale value
-		promptRes3, err := extractCFGScaleFromPrompt(promptRes2.SanitizedPrompt, cfgScaleValue)
-		if err != nil {
-			log.Printf("Error extracting cfg scale from prompt: %v", err)
-		} else if promptRes3.CFGScale != cfgScaleValue {
-			cfgScaleValue = promptRes3.CFGScale
+		// if we are rerolling, or generating variations, we simply replace some defaults
+		newGeneration = foundGeneration
+
+		// a new grid is generated, even when the generation was an upscale or img2img result
+		newGeneration.Upscaler = ""
+		newGeneration.SourceID = 0
+		newGeneration.Deleted = false
+
+		// for variations, we need random subseeds
+		newGeneration.Subseed = -1
+
+		// for variations, the subseed strength determines how much variation we get
+		if item.Type == ItemTypeVariation {
+			newGeneration.SubseedStrength = variationStrength(item, foundGeneration)
 		}
 
-		seedValue := int64(-1) // default seed is random
-		promptRes4, err := extractSeedFromPrompt(promptRes3.SanitizedPrompt)
+		if item.Type == ItemTypeEdit {
+			applyEdit(newGeneration, item, settings)
+		}
+	} else {
+		newGeneration, err = newGenerationFromPrompt(item, settings)
 		if err != nil {
-			log.Printf("Error extracting seed from prompt: %v", err)
-		} else if promptRes4.Seed != seedValue {
-			seedValue = promptRes4.Seed
+			return nil, fmt.Errorf("error extracting parameters from prompt: %w", err)
 		}
+	}
 
-		// prompt will displayed as Monospace in Discord
-		var quotedPrompt = quotePromptAsMonospace(promptRes4.SanitizedPrompt)
-		promptRes.SanitizedPrompt = quotedPrompt
-
-		// new generation with defaults
-		newGeneration := &entities.ImageGeneration{
-			Prompt:            promptRes.SanitizedPrompt,
-			NegativePrompt:    negativePrompt,
-			Width:             scaledWidth,
-			Height:            scaledHeight,
-			RestoreFaces:      true,
-			EnableHR:          enableHR1,
-			HRUpscaleRate:     upscaleRate1,
-			HRUpscaler:        upscalerName1,
-			HiresWidth:        hiresWidth,
-			HiresHeight:       hiresHeight,
-			DenoisingStrength: 0.7,
-			Seed:              seedValue,
-			Subseed:           -1,
-			SubseedStrength:   0,
-			SamplerName:       samplerName1,
-			CfgScale:          cfgScaleValue,
-			Steps:             stepValue,
-			Processed:         false,
-		}
+	newGeneration.BatchCount = settings.BatchCount
+	newGeneration.BatchSize = settings.BatchSize
 
-		if q.currentInvision.Type == ItemTypeReroll || q.currentInvision.Type == ItemTypeVariation {
-			foundGeneration, err := q.getPreviousGeneration(q.currentInvision, q.currentInvision.InteractionIndex)
-			if err != nil {
-				log.Printf("Error getting prompt for reroll: %v", err)
+	// the cells of a labeled grid are generated one image at a time
+	if item.Type.isLabeledGrid() {
+		newGeneration.BatchCount = 1
+		newGeneration.BatchSize = 1
+	}
 
-				return
-			}
+	return newGeneration, nil
+}
 
-			// if we are rerolling, or generating variations, we simply replace some defaults
-			newGeneration = foundGeneration
+// newGenerationFromPrompt builds a new generation from the options of an invision
+// and the parameters embedded in its prompt, within the limits of the bot settings.
+func newGenerationFromPrompt(item *QueueItem, settings *entities.DefaultSettings) (*entities.ImageGeneration, error) {
+	defaultWidth := settings.Width
+	defaultHeight := settings.Height
 
-			// for variations, we need random subseeds
-			newGeneration.Subseed = -1
+	// add optional parameter: Negative prompt
+	negativePrompt := ""
 
-			// for variations, the subseed strength determines how much variation we get
-			if q.currentInvision.Type == ItemTypeVariation {
-				newGeneration.SubseedStrength = 0.15
-			}
-		}
+	if item.NegativePrompt == "" {
+		negativePrompt = settings.NegativePrompt
+	} else {
+		negativePrompt = item.NegativePrompt
+	}
 
-		err = q.processInvisionGrid(newGeneration, q.currentInvision)
-		if err != nil {
-			log.Printf("Error processing invision grid: %v", err)
+	// add optional parameter: sampler
+	samplerName1 := ""
+	if item.SamplerName1 == "" {
+		samplerName1 = "DPM++ 2M"
+	} else {
+		samplerName1 = item.SamplerName1
+	}
 
-			return
+	promptRes, err := extractDimensionsFromPrompt(item.Prompt, defaultWidth, defaultHeight)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting dimensions from prompt: %w", err)
+	}
+
+	scaledWidth := defaultWidth
+	scaledHeight := defaultHeight
+
+	if promptRes.Width > defaultWidth || promptRes.Height > defaultHeight {
+		scaledWidth = promptRes.Width
+		scaledHeight = promptRes.Height
+	}
+
+	promptResPx, err := extractPixelFromPrompt(promptRes.SanitizedPrompt, defaultWidth, settings.MaxDimension)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting px X,Y from prompt: %w", err)
+	}
+
+	if promptResPx.IsProcessed {
+		scaledWidth = promptResPx.Width
+		scaledHeight = promptResPx.Height
+	}
+
+	scaledWidth = min(scaledWidth, settings.MaxDimension)
+	scaledHeight = min(scaledHeight, settings.MaxDimension)
+
+	// add optional parameter: enable hires.fix
+	enableHR1 := false
+	upscaleRate1 := 1.0
+	upscalerName1 := ""
+	hiresWidth := scaledWidth
+	hiresHeight := scaledHeight
+
+	// extract --zoom parameter
+	defaultZoomValue1 := 2.0
+	promptResZ, err := extractZoomScaleFromPrompt(promptResPx.SanitizedPrompt, defaultZoomValue1)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting zoom scale from prompt: %w", err)
+	}
+
+	if item.UseHiresFix {
+		enableHR1 = true
+		upscaleRate1 = promptResZ.ZoomScale
+		upscalerName1 = "Latent"
+		hiresWidth = 0
+		hiresHeight = 0
+	}
+
+	stepValue := settings.DefaultSteps
+	promptRes2, err := extractStepsFromPrompt(promptResZ.SanitizedPrompt, stepValue, settings.MaxSteps)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting steps from prompt: %w", err)
+	}
+
+	stepValue = promptRes2.Steps
+
+	cfgScaleValue := settings.DefaultCFGScale
+	promptRes3, err := extractCFGScaleFromPrompt(promptRes2.SanitizedPrompt, cfgScaleValue, settings.MaxCFGScale)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting cfg scale from prompt: %w", err)
+	}
+
+	cfgScaleValue = promptRes3.CFGScale
+
+	// default seed is random
+	promptRes4, err := extractSeedFromPrompt(promptRes3.SanitizedPrompt)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting seed from prompt: %w", err)
+	}
+
+	seedValue := promptRes4.Seed
+
+	// --vary sets the strength of the variation buttons, and blends in the --subseed when there is one
+	promptRes5, err := extractVariationFromPrompt(promptRes4.SanitizedPrompt)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting variation from prompt: %w", err)
+	}
+
+	variationStrengthValue := item.VariationStrength
+	if promptRes5.Strength > 0 {
+		variationStrengthValue = promptRes5.Strength
+	}
+
+	subseedStrengthValue := 0.0
+	if promptRes5.Subseed >= 0 {
+		subseedStrengthValue = variationStrengthValue
+		if subseedStrengthValue == 0 {
+			subseedStrengthValue = defaultVariationStrength
 		}
-	}()
+	}
+
+	styledPrompt, styledNegativePrompt := applyStyles(promptRes5.SanitizedPrompt, negativePrompt, item.Styles)
+
+	// new generation with defaults, the prompt will be displayed as monospace in Discord
+	return &entities.ImageGeneration{
+		Prompt:            quotePromptAsMonospace(styledPrompt),
+		NegativePrompt:    styledNegativePrompt,
+		Styles:            styleNames(item.Styles),
+		Width:             scaledWidth,
+		Height:            scaledHeight,
+		RestoreFaces:      true,
+		EnableHR:          enableHR1,
+		HRUpscaleRate:     upscaleRate1,
+		HRUpscaler:        upscalerName1,
+		HiresWidth:        hiresWidth,
+		HiresHeight:       hiresHeight,
+		DenoisingStrength: 0.7,
+		Seed:              seedValue,
+		Subseed:           promptRes5.Subseed,
+		SubseedStrength:   subseedStrengthValue,
+		VariationStrength: variationStrengthValue,
+		SamplerName:       samplerName1,
+		CfgScale:          cfgScaleValue,
+		Steps:             stepValue,
+		Processed:         false,
+	}, nil
 }
 
-func (q *queueImpl) getPreviousGeneration(invision *QueueItem, sortOrder int) (*entities.ImageGeneration, error) {
-	interactionID := invision.DiscordInteraction.ID
-	messageID := ""
+func (q *queueImpl) getPreviousGeneration(ctx context.Context, invision *QueueItem, sortOrder int) (*entities.ImageGeneration, error) {
+	logger := logging.FromContext(ctx)
+
+	if invision.GenerationID != 0 {
+		logger.Debug("Reimagining generation", "generation_id", invision.GenerationID)
 
-	if invision.DiscordInteraction.Message != nil {
-		messageID = invision.DiscordInteraction.Message.ID
+		generation, err := q.imageGenerationRepo.GetByID(ctx, invision.GenerationID)
+		if err != nil {
+			logger.Error("Error getting image generation", "generation_id", invision.GenerationID, "error", err)
+
+			return nil, err
+		}
+
+		return generation, nil
 	}
 
-	log.Printf("Reimagining interaction: %v, Message: %v", interactionID, messageID)
+	messageID := invision.Origin.MessageID
+
+	logger.Debug("Reimagining message", "message_id", messageID, "sort_order", sortOrder)
 
-	generation, err := q.imageGenerationRepo.GetByMessageAndSort(context.Background(), messageID, sortOrder)
+	generation, err := q.imageGenerationRepo.GetByMessageAndSort(ctx, messageID, sortOrder)
 	if err != nil {
-		log.Printf("Error getting image generation: %v", err)
+		logger.Error("Error getting image generation", "message_id", messageID, "sort_order", sortOrder, "error", err)
 
 		return nil, err
 	}
 
-	log.Printf("Found generation: %v", generation)
+	logger.Debug("Found generation", "generation_id", generation.ID)
 
 	return generation, nil
 }
 
-func invisionMessageContent(generation *entities.ImageGeneration, user *discordgo.User, progress float64) string {
+func invisionMessageContent(generation *entities.ImageGeneration, memberID string, progress float64) string {
 	if progress >= 0 && progress < 1 {
 		return fmt.Sprintf("<@%s> asked me to invision \"%s\". Currently dreaming it up for them. Progress: %.0f%%",
-			user.ID, generation.Prompt, progress*100)
+			memberID, generation.Prompt, progress*100)
 	} else {
 		seedString := fmt.Sprintf("%d", generation.Seed)
 		if seedString == "-1" {
@@ -795,55 +1459,54 @@ func invisionMessageContent(generation *entities.ImageGeneration, user *discordg
 				generation.Width,
 				generation.Height)
 		}
-		return fmt.Sprintf("<@%s> asked me to invision \"%s\" at step %d cfgscale %s seed %s with sampler %s. resolution: %s. here is what I invisiond for them.",
-			user.ID,
+		return fmt.Sprintf("<@%s> asked me to invision \"%s\" at step %d cfgscale %s seed %s%s with sampler %s. resolution: %s. here is what I invisiond for them.",
+			memberID,
 			generation.Prompt,
 			generation.Steps,
 			strconv.FormatFloat(generation.CfgScale, 'f', 1, 64),
 			seedString,
+			subseedDescription(generation),
 			generation.SamplerName,
 			sizeString,
 		)
 	}
 }
 
-func (q *queueImpl) processInvisionGrid(newGeneration *entities.ImageGeneration, invision *QueueItem) error {
-	log.Printf("Processing invision #%s: %v\n", invision.DiscordInteraction.ID, newGeneration.Prompt)
+func (q *queueImpl) processInvisionGrid(ctx context.Context, newGeneration *entities.ImageGeneration, invision *QueueItem) error {
+	logger := logging.FromContext(ctx)
 
-	newContent := invisionMessageContent(newGeneration, invision.DiscordInteraction.Member.User, 0)
+	logger.Info("Processing invision grid", "prompt", newGeneration.Prompt, "width", newGeneration.Width, "height", newGeneration.Height,
+		"steps", newGeneration.Steps, "cfg_scale", newGeneration.CfgScale, "seed", newGeneration.Seed, "sampler", newGeneration.SamplerName,
+		"enable_hr", newGeneration.EnableHR, "hr_scale", newGeneration.HRUpscaleRate)
 
-	message, err := q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-		Content: &newContent,
-	})
-	if err != nil {
-		log.Printf("Error editing interaction: %v", err)
-	}
-
-	defaultBatchCount, err := q.defaultBatchCount()
+	// dynamic prompts are expanded per image, the grid row keeps the unexpanded prompt so a reroll explores again
+	prompts, err := q.promptExpander.expandBatchPrompts(newGeneration.Prompt, newGeneration.Seed,
+		newGeneration.BatchCount*newGeneration.BatchSize)
 	if err != nil {
-		log.Printf("Error getting default batch count: %v", err)
-
-		return err
+		return q.fail(ctx, invision, "I'm sorry, but I couldn't expand the wildcards of your prompt.", err)
 	}
 
-	defaultBatchSize, err := q.defaultBatchSize()
+	messageID, err := invision.Notifier.Progress(ctx, &Progress{
+		Message: invisionMessageContent(newGeneration, invision.Origin.MemberID, 0),
+	})
 	if err != nil {
-		log.Printf("Error getting default batch size: %v", err)
+		logger.Error("Error notifying progress", "error", err)
 
 		return err
 	}
 
-	newGeneration.InteractionID = invision.DiscordInteraction.ID
-	newGeneration.MessageID = message.ID
-	newGeneration.MemberID = invision.DiscordInteraction.Member.User.ID
+	newGeneration.InteractionID = invision.Origin.InteractionID
+	newGeneration.MessageID = messageID
+	newGeneration.ChannelID = invision.Origin.ChannelID
+	newGeneration.GuildID = invision.Origin.GuildID
+	newGeneration.MemberID = invision.Origin.MemberID
 	newGeneration.SortOrder = 0
-	newGeneration.BatchCount = defaultBatchCount
-	newGeneration.BatchSize = defaultBatchSize
 	newGeneration.Processed = true
+	newGeneration.Generations = 1
 
-	_, err = q.imageGenerationRepo.Create(context.Background(), newGeneration)
+	_, err = q.imageGenerationRepo.Create(ctx, newGeneration)
 	if err != nil {
-		log.Printf("Error creating image generation record: %v\n", err)
+		logger.Error("Error creating image generation record", "error", err)
 	}
 
 	generationDone := make(chan bool)
@@ -853,10 +1516,10 @@ func (q *queueImpl) processInvisionGrid(newGeneration *entities.ImageGeneration,
 			select {
 			case <-generationDone:
 				return
-			case <-time.After(1 * time.Second):
-				progress, progressErr := q.stableDiffusionAPI.GetCurrentProgress()
+			case <-q.clock.After(1 * time.Second):
+				progress, progressErr := q.stableDiffusionAPI.GetCurrentProgress(ctx)
 				if progressErr != nil {
-					log.Printf("Error getting current progress: %v", progressErr)
+					logger.Error("Error getting current progress", "error", progressErr)
 
 					return
 				}
@@ -865,63 +1528,40 @@ func (q *queueImpl) processInvisionGrid(newGeneration *entities.ImageGeneration,
 					continue
 				}
 
-				progressContent := invisionMessageContent(newGeneration, invision.DiscordInteraction.Member.User, progress.Progress)
+				logger.Debug("Generation progress", "progress", progress.Progress)
 
-				_, progressErr = q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-					Content: &progressContent,
-				})
-				if progressErr != nil {
-					log.Printf("Error editing interaction: %v", err)
-				}
+				q.progress(ctx, invision, invisionMessageContent(newGeneration, invision.Origin.MemberID, progress.Progress),
+					progress.Progress)
 			}
 		}
 	}()
 
-	resp, err := q.stableDiffusionAPI.TextToImage(&stable_diffusion_api.TextToImageRequest{
-		Prompt:            newGeneration.Prompt,
-		NegativePrompt:    newGeneration.NegativePrompt,
-		Width:             newGeneration.Width,
-		Height:            newGeneration.Height,
-		RestoreFaces:      newGeneration.RestoreFaces,
-		EnableHR:          newGeneration.EnableHR,
-		HRUpscaleRate:     newGeneration.HRUpscaleRate,
-		HRUpscaler:        newGeneration.HRUpscaler,
-		HRResizeX:         newGeneration.HiresWidth,
-		HRResizeY:         newGeneration.HiresHeight,
-		DenoisingStrength: newGeneration.DenoisingStrength,
-		BatchSize:         newGeneration.BatchSize,
-		Seed:              newGeneration.Seed,
-		Subseed:           newGeneration.Subseed,
-		SubseedStrength:   newGeneration.SubseedStrength,
-		SamplerName:       newGeneration.SamplerName,
-		CfgScale:          newGeneration.CfgScale,
-		Steps:             newGeneration.Steps,
-		NIter:             newGeneration.BatchCount,
-	})
-	if err != nil {
-		log.Printf("Error processing image: %v\n", err)
-
-		errorContent := "I'm sorry, but I had a problem imagining your image."
+	generationStart := q.clock.Now()
 
-		_, err = q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-			Content: &errorContent,
-		})
+	resp, err := q.generateImages(ctx, newGeneration, prompts)
+	if err != nil {
+		close(generationDone)
 
-		return err
+		return q.fail(ctx, invision, "I'm sorry, but I had a problem imagining your image.", err)
 	}
 
-	generationDone <- true
+	close(generationDone)
 
-	finishedContent := invisionMessageContent(newGeneration, invision.DiscordInteraction.Member.User, 1)
+	gpuSeconds := q.clock.Now().Sub(generationStart).Seconds()
 
-	log.Printf("Seeds: %v Subseeds:%v", resp.Seeds, resp.Subseeds)
+	err = q.imageGenerationRepo.UpdateGPUSeconds(ctx, newGeneration.ID, gpuSeconds)
+	if err != nil {
+		logger.Error("Error storing generation duration", "error", err)
+	}
+
+	logger.Info("Generated images", "seeds", resp.Seeds, "subseeds", resp.Subseeds, "gpu_seconds", gpuSeconds)
 
 	imageBufs := make([]*bytes.Buffer, len(resp.Images))
 
 	for idx, image := range resp.Images {
 		decodedImage, decodeErr := base64.StdEncoding.DecodeString(image)
 		if decodeErr != nil {
-			log.Printf("Error decoding image: %v\n", decodeErr)
+			logger.Error("Error decoding image", "error", decodeErr)
 		}
 
 		imageBuf := bytes.NewBuffer(decodedImage)
@@ -933,9 +1573,11 @@ func (q *queueImpl) processInvisionGrid(newGeneration *entities.ImageGeneration,
 		subGeneration := &entities.ImageGeneration{
 			InteractionID:     newGeneration.InteractionID,
 			MessageID:         newGeneration.MessageID,
+			ChannelID:         newGeneration.ChannelID,
+			GuildID:           newGeneration.GuildID,
 			MemberID:          newGeneration.MemberID,
 			SortOrder:         idx + 1,
-			Prompt:            newGeneration.Prompt,
+			Prompt:            batchPrompt(newGeneration.Prompt, prompts, idx),
 			NegativePrompt:    newGeneration.NegativePrompt,
 			Width:             newGeneration.Width,
 			Height:            newGeneration.Height,
@@ -955,169 +1597,60 @@ func (q *queueImpl) processInvisionGrid(newGeneration *entities.ImageGeneration,
 			CfgScale:          newGeneration.CfgScale,
 			Steps:             newGeneration.Steps,
 			Processed:         true,
+			NSFW:              idx < len(resp.NSFW) && resp.NSFW[idx],
+			Styles:            newGeneration.Styles,
+			VariationStrength: newGeneration.VariationStrength,
 		}
 
-		_, createErr := q.imageGenerationRepo.Create(context.Background(), subGeneration)
+		_, createErr := q.imageGenerationRepo.Create(ctx, subGeneration)
 		if createErr != nil {
-			log.Printf("Error creating image generation record: %v\n", createErr)
+			logger.Error("Error creating image generation record", "sort_order", subGeneration.SortOrder, "error", createErr)
 		}
 	}
 
+	nsfwAction := q.nsfwAction(invision, strings.Join(append([]string{newGeneration.Prompt}, prompts...), " "), anyFlagged(resp.NSFW))
+	if nsfwAction == NSFWActionBlock {
+		logger.Info("Withheld NSFW invision grid", "message_id", newGeneration.MessageID)
+
+		return q.withholdNSFWOutput(ctx, invision)
+	}
+
+	// tiling reads the buffers, so the single images are kept first
+	images := make([][]byte, len(imageBufs))
+	for idx, imageBuf := range imageBufs {
+		images[idx] = bytes.Clone(imageBuf.Bytes())
+	}
+
 	compositeImage, err := q.compositeRenderer.TileImages(imageBufs)
 	if err != nil {
-		log.Printf("Error tiling images: %v\n", err)
+		logger.Error("Error tiling images", "error", err)
 
 		return err
 	}
 
-	_, err = q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-		Content: &finishedContent,
-		Files: []*discordgo.File{
-			{
-				ContentType: "image/png",
-				// append timestamp for grid image result
-				Name:   "invision_" + time.Now().Format("20060102150405") + ".png",
-				Reader: compositeImage,
-			},
-		},
-		Components: &[]discordgo.MessageComponent{
-			discordgo.ActionsRow{
-				Components: []discordgo.MessageComponent{
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "1",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_variation_1",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "2",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_variation_2",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "3",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_variation_3",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "4",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_variation_4",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "Re-roll",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.PrimaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_reroll",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "🎲",
-						},
-					},
-				},
-			},
-			discordgo.ActionsRow{
-				Components: []discordgo.MessageComponent{
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "1",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_upscale_1",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "2",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_upscale_2",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "3",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_upscale_3",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "4",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "invision_upscale_4",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-				},
-			},
-		},
+	_, err = invision.Notifier.Deliver(ctx, &Result{
+		Kind:    ResultGrid,
+		Message: invisionMessageContent(newGeneration, invision.Origin.MemberID, 1),
+		Image:   compositeImage,
+		// append timestamp for grid image result
+		FileName:     "invision_" + q.clock.Now().Format("20060102150405") + ".png",
+		Spoiler:      nsfwAction == NSFWActionSpoiler,
+		GenerationID: newGeneration.ID,
+		Images:       images,
+		Seeds:        resp.Seeds,
 	})
 	if err != nil {
-		log.Printf("Error editing interaction: %v\n", err)
+		logger.Error("Error delivering result", "error", err)
 
 		return err
 	}
 
+	logger.Info("Finished invision grid", "message_id", newGeneration.MessageID)
+
 	return nil
 }
 
-func upscaleMessageContent(user *discordgo.User, fetchProgress, upscaleProgress float64) string {
+func upscaleMessageContent(memberID string, fetchProgress, upscaleProgress float64) string {
 	if fetchProgress >= 0 && fetchProgress <= 1 && upscaleProgress < 1 {
 		if upscaleProgress == 0 {
 			return fmt.Sprintf("Currently upscaling the image for you... Fetch progress: %.0f%%", fetchProgress*100)
@@ -1127,38 +1660,30 @@ func upscaleMessageContent(user *discordgo.User, fetchProgress, upscaleProgress
 		}
 	} else {
 		return fmt.Sprintf("<@%s> asked me to upscale their image. Here's the result:",
-			user.ID)
+			memberID)
 	}
 }
 
-func (q *queueImpl) processUpscaleInvision(invision *QueueItem) {
-	interactionID := invision.DiscordInteraction.ID
-	messageID := ""
+func (q *queueImpl) processUpscaleInvision(ctx context.Context, invision *QueueItem) {
+	messageID := invision.Origin.MessageID
 
-	if invision.DiscordInteraction.Message != nil {
-		messageID = invision.DiscordInteraction.Message.ID
-	}
+	logger := logging.FromContext(ctx).With("message_id", messageID, "upscale_index", invision.InteractionIndex)
+	ctx = logging.NewContext(ctx, logger)
 
-	log.Printf("Upscaling image: %v, Message: %v, Upscale Index: %d",
-		interactionID, messageID, invision.InteractionIndex)
+	logger.Info("Upscaling image")
 
-	generation, err := q.imageGenerationRepo.GetByMessageAndSort(context.Background(), messageID, invision.InteractionIndex)
+	generation, err := q.imageGenerationRepo.GetByMessageAndSort(ctx, messageID, invision.InteractionIndex)
 	if err != nil {
-		log.Printf("Error getting image generation: %v", err)
+		logger.Error("Error getting image generation", "error", err)
+
+		_ = q.fail(ctx, invision, "I'm sorry, but I couldn't find the image to upscale.", err)
 
 		return
 	}
 
-	log.Printf("Found generation: %v", generation)
-
-	newContent := upscaleMessageContent(invision.DiscordInteraction.Member.User, 0, 0)
+	logger.Debug("Found generation", "generation_id", generation.ID)
 
-	_, err = q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-		Content: &newContent,
-	})
-	if err != nil {
-		log.Printf("Error editing interaction: %v", err)
-	}
+	q.progress(ctx, invision, upscaleMessageContent(invision.Origin.MemberID, 0, 0), 0)
 
 	generationDone := make(chan bool)
 
@@ -1171,10 +1696,10 @@ func (q *queueImpl) processUpscaleInvision(invision *QueueItem) {
 			select {
 			case <-generationDone:
 				return
-			case <-time.After(1 * time.Second):
-				progress, progressErr := q.stableDiffusionAPI.GetCurrentProgress()
+			case <-q.clock.After(1 * time.Second):
+				progress, progressErr := q.stableDiffusionAPI.GetCurrentProgress(ctx)
 				if progressErr != nil {
-					log.Printf("Error getting current progress: %v", progressErr)
+					logger.Error("Error getting current progress", "error", progressErr)
 
 					return
 				}
@@ -1192,22 +1717,21 @@ func (q *queueImpl) processUpscaleInvision(invision *QueueItem) {
 
 				lastProgress = progress.Progress
 
-				progressContent := upscaleMessageContent(invision.DiscordInteraction.Member.User, fetchProgress, upscaleProgress)
-
-				_, progressErr = q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-					Content: &progressContent,
-				})
-				if progressErr != nil {
-					log.Printf("Error editing interaction: %v", err)
-				}
+				q.progress(ctx, invision, upscaleMessageContent(invision.Origin.MemberID, fetchProgress, upscaleProgress),
+					(fetchProgress+upscaleProgress)/2)
 			}
 		}
 	}()
 
-	resp, err := q.stableDiffusionAPI.UpscaleImage(&stable_diffusion_api.UpscaleRequest{
+	upscaler := invision.Upscaler
+	if upscaler == "" {
+		upscaler = DefaultUpscaler
+	}
+
+	upscaleReq := &stable_diffusion_api.UpscaleRequest{
 		ResizeMode:      0,
 		UpscalingResize: 2,
-		Upscaler1:       "ESRGAN_4x",
+		Upscaler1:       upscaler,
 		TextToImageRequest: &stable_diffusion_api.TextToImageRequest{
 			Prompt:            generation.Prompt,
 			NegativePrompt:    generation.NegativePrompt,
@@ -1229,51 +1753,96 @@ func (q *queueImpl) processUpscaleInvision(invision *QueueItem) {
 			Steps:             generation.Steps,
 			NIter:             1,
 		},
-	})
+	}
+
+	// a single result is upscaled further as posted, as it can't always be regenerated
+	if isSingleResult(generation) {
+		var size int
+
+		upscaleReq.Image, size, err = sourceImage(ctx, invision.Origin.SourceImageURL)
+		if err == nil && size*upscaleReq.UpscalingResize > maxUpscaledDimension {
+			err = ErrImageTooLarge
+		}
+
+		if err != nil {
+			logger.Error("Error getting image to upscale", "error", err)
+
+			close(generationDone)
+
+			errorContent := "I'm sorry, but I couldn't fetch the image to upscale."
+			if errors.Is(err, ErrImageTooLarge) {
+				errorContent = "I'm sorry, but that image is already as large as I can make it."
+			}
+
+			_ = q.fail(ctx, invision, errorContent, err)
+
+			return
+		}
+	}
+
+	upscaleStart := q.clock.Now()
+
+	resp, err := q.stableDiffusionAPI.UpscaleImage(ctx, upscaleReq)
 	if err != nil {
-		log.Printf("Error processing image upscale: %v\n", err)
+		logger.Error("Error processing image upscale", "error", err)
 
-		errorContent := "I'm sorry, but I had a problem upscaling your image."
+		close(generationDone)
 
-		_, err = q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-			Content: &errorContent,
-		})
+		_ = q.fail(ctx, invision, "I'm sorry, but I had a problem upscaling your image.", err)
 
 		return
 	}
 
-	generationDone <- true
+	close(generationDone)
+
+	gpuSeconds := q.clock.Now().Sub(upscaleStart).Seconds()
 
 	decodedImage, decodeErr := base64.StdEncoding.DecodeString(resp.Image)
 	if decodeErr != nil {
-		log.Printf("Error decoding image: %v\n", decodeErr)
+		logger.Error("Error decoding image", "error", decodeErr)
+
+		_ = q.fail(ctx, invision, "I'm sorry, but I had a problem upscaling your image.", decodeErr)
 
 		return
 	}
 
 	imageBuf := bytes.NewBuffer(decodedImage)
 
-	log.Printf("Successfully upscaled image: %v, Message: %v, Upscale Index: %d",
-		interactionID, messageID, invision.InteractionIndex)
+	logger.Info("Successfully upscaled image", "upscaler", upscaler)
 
-	finishedContent := fmt.Sprintf("<@%s> asked me to upscale their image. (seed: %d) Here's the result:",
-		invision.DiscordInteraction.Member.User.ID,
+	finishedContent := fmt.Sprintf("<@%s> asked me to upscale their image with %s. (seed: %d) Here's the result:",
+		invision.Origin.MemberID,
+		upscaler,
 		generation.Seed)
 
-	_, err = q.botSession.InteractionResponseEdit(invision.DiscordInteraction, &discordgo.WebhookEdit{
-		Content: &finishedContent,
-		Files: []*discordgo.File{
-			{
-				ContentType: "image/png",
-				// add timestamp to output file
-				Name:   "invision_" + time.Now().Format("20060102150405") + ".png",
-				Reader: imageBuf,
-			},
-		},
+	nsfwAction := q.nsfwAction(invision, generation.Prompt, generation.NSFW)
+	if nsfwAction == NSFWActionBlock {
+		logger.Info("Withheld NSFW upscale")
+
+		_ = q.withholdNSFWOutput(ctx, invision)
+
+		return
+	}
+
+	result := *generation
+	result.Upscaler = upscaler
+	result.SourceID = generation.ID
+
+	resultMessageID, err := invision.Notifier.Deliver(ctx, &Result{
+		Kind:    ResultSingle,
+		Message: finishedContent,
+		Image:   imageBuf,
+		// add timestamp to output file
+		FileName: "invision_" + q.clock.Now().Format("20060102150405") + ".png",
+		Spoiler:  nsfwAction == NSFWActionSpoiler,
+		CanVary:  q.canVary(ctx, generation),
 	})
 	if err != nil {
-		log.Printf("Error editing interaction: %v\n", err)
+		logger.Error("Error delivering result", "error", err)
 
 		return
 	}
+
+	// the upscale isn't a generation, but its time counts against the GPU budget
+	q.storeResult(ctx, invision, resultMessageID, &result, gpuSeconds)
 }
@@ -0,0 +1,186 @@
+package invision_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/policy"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+const (
+	VariationStrengthSubtle = 0.15
+	VariationStrengthMedium = 0.3
+	VariationStrengthStrong = 0.5
+
+	defaultVariationStrength = VariationStrengthSubtle
+
+	// seedWalkMaxSteps keeps a walk on a single row that stays readable in Discord.
+	seedWalkMaxSteps = 8
+	seedWalkMinSteps = 3
+)
+
+var ErrInvalidSeedWalk = errors.New("invalid seed walk")
+
+var (
+	varyRegex    = regexp.MustCompile(`\s?--vary (\d?\.?\d+)\s?`)
+	subseedRegex = regexp.MustCompile(`\s?--subseed ([\d]+)\s?`)
+)
+
+type variationResult struct {
+	SanitizedPrompt string
+	// Strength is 0 when the prompt has no --vary parameter.
+	Strength float64
+	// Subseed is -1 when the prompt has no --subseed parameter.
+	Subseed int
+}
+
+// extractVariationFromPrompt reads the --vary strength between 0 and 1, and the --subseed to blend
+// the seed with.
+func extractVariationFromPrompt(prompt string) (*variationResult, error) {
+	result := &variationResult{Subseed: -1}
+
+	varyMatches := varyRegex.FindStringSubmatch(prompt)
+	if len(varyMatches) == 2 {
+		prompt = varyRegex.ReplaceAllString(prompt, "")
+
+		strength, err := strconv.ParseFloat(varyMatches[1], 64)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Strength = min(strength, 1)
+	}
+
+	subseedMatches := subseedRegex.FindStringSubmatch(prompt)
+	if len(subseedMatches) == 2 {
+		prompt = subseedRegex.ReplaceAllString(prompt, "")
+
+		subseed, err := strconv.ParseInt(subseedMatches[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Subseed = int(subseed)
+	}
+
+	result.SanitizedPrompt = prompt
+
+	return result, nil
+}
+
+// variationStrength picks the subseed strength of a variation: the one requested with the item,
+// the one stored with the generation it varies, or the default.
+func variationStrength(item *QueueItem, generation *entities.ImageGeneration) float64 {
+	switch {
+	case item.VariationStrength > 0:
+		return item.VariationStrength
+	case generation.VariationStrength > 0:
+		return generation.VariationStrength
+	default:
+		return defaultVariationStrength
+	}
+}
+
+// subseedDescription describes how the subseed changes a generation, empty when it doesn't.
+func subseedDescription(generation *entities.ImageGeneration) string {
+	if generation.SubseedStrength <= 0 {
+		return ""
+	}
+
+	strength := strconv.FormatFloat(generation.SubseedStrength, 'f', 2, 64)
+
+	if generation.Subseed < 0 {
+		return " varied at strength " + strength
+	}
+
+	return fmt.Sprintf(" blended with subseed %d at strength %s", generation.Subseed, strength)
+}
+
+// SeedWalk interpolates between two seeds by raising the subseed strength from 0 to 1.
+type SeedWalk struct {
+	From  int64
+	To    int
+	Steps int
+}
+
+// NewSeedWalk validates the seeds and the number of images of a walk.
+func NewSeedWalk(from, to int64, steps int) (*SeedWalk, error) {
+	if from < 0 || to < 0 {
+		return nil, fmt.Errorf("%w: seeds can't be negative", ErrInvalidSeedWalk)
+	}
+
+	// the subseed is a 32 bit integer in the WebUI
+	if to > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: the second seed can be at most %d", ErrInvalidSeedWalk, math.MaxInt32)
+	}
+
+	if from == to {
+		return nil, fmt.Errorf("%w: the seeds must be different", ErrInvalidSeedWalk)
+	}
+
+	if steps < seedWalkMinSteps || steps > seedWalkMaxSteps {
+		return nil, fmt.Errorf("%w: a walk has %d to %d images", ErrInvalidSeedWalk, seedWalkMinSteps, seedWalkMaxSteps)
+	}
+
+	return &SeedWalk{From: from, To: int(to), Steps: steps}, nil
+}
+
+// strength is the subseed strength of the image at idx, evenly spaced from 0 to 1.
+func (w *SeedWalk) strength(idx int) float64 {
+	return float64(idx) / float64(w.Steps-1)
+}
+
+func (w *SeedWalk) labels() []string {
+	labels := make([]string, w.Steps)
+
+	for idx := range labels {
+		labels[idx] = strconv.FormatFloat(w.strength(idx), 'f', 2, 64)
+	}
+
+	return labels
+}
+
+// prepareSeedWalk checks that a walk item has seeds, and that the member's roles allow that many images.
+func (q *queueImpl) prepareSeedWalk(item *QueueItem) error {
+	if item.Type != ItemTypeSeedWalk {
+		return nil
+	}
+
+	if item.SeedWalk == nil {
+		return fmt.Errorf("%w: missing seeds", ErrInvalidSeedWalk)
+	}
+
+	if item.Limits != nil && item.Limits.MaxBatch > 0 && item.SeedWalk.Steps > item.Limits.MaxBatch {
+		return &policy.RejectedError{Reason: fmt.Sprintf("Your roles allow up to %d images per invision, this walk has %d.",
+			item.Limits.MaxBatch, item.SeedWalk.Steps)}
+	}
+
+	return nil
+}
+
+// processSeedWalk generates the prompt from the first seed to the second, blending in more of the
+// second seed as subseed from image to image.
+func (q *queueImpl) processSeedWalk(ctx context.Context, item *QueueItem) error {
+	walk := item.SeedWalk
+
+	return q.processLabeledGrid(ctx, item, &labeledGrid{
+		name:         "seed walk",
+		request:      "walk from seed " + strconv.FormatInt(walk.From, 10) + " to " + strconv.Itoa(walk.To) + " for",
+		columnLabels: walk.labels(),
+		rowLabels:    []string{""},
+		xTitle:       fmt.Sprintf("Subseed strength (seed %d -> %d)", walk.From, walk.To),
+		prepare: func(generation *entities.ImageGeneration) {
+			generation.Seed = walk.From
+			generation.Subseed = walk.To
+		},
+		applyCell: func(generation *entities.ImageGeneration, col, _ int) string {
+			generation.SubseedStrength = walk.strength(col)
+
+			return ""
+		},
+	})
+}
@@ -0,0 +1,268 @@
+package invision_queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/stable_diffusion_api"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultUpscaler is used when an upscale doesn't pick one.
+	DefaultUpscaler = "ESRGAN_4x"
+
+	// maxUpscaledDimension stops further upscales before the images get too large for Discord.
+	maxUpscaledDimension = 4096
+
+	defaultImageToImageDenoising = 0.5
+
+	// sourceImageTimeout keeps a slow download from holding up the queue.
+	sourceImageTimeout = 30 * time.Second
+	// maxSourceImageSize is above the attachment limit of Discord.
+	maxSourceImageSize = 32 << 20
+)
+
+var ErrImageTooLarge = errors.New("the image is too large to upscale further")
+
+var sourceImageClient = &http.Client{Timeout: sourceImageTimeout}
+
+// isSingleResult reports whether a generation row belongs to an upscale or img2img result, whose
+// follow-ups work on the posted image instead of regenerating it.
+func isSingleResult(generation *entities.ImageGeneration) bool {
+	return generation.Upscaler != "" || generation.SourceID != 0
+}
+
+// sourceImage downloads the image of the result an item works on and returns it base64 encoded,
+// together with its larger side in pixels.
+func sourceImage(ctx context.Context, imageURL string) (string, int, error) {
+	if imageURL == "" {
+		return "", 0, errors.New("the result has no image")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	response, err := sourceImageClient.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected status downloading image: %s", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxSourceImageSize+1))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(body) > maxSourceImageSize {
+		return "", 0, fmt.Errorf("image is larger than %d bytes", maxSourceImageSize)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading image: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(body), max(config.Width, config.Height), nil
+}
+
+// canVary reports whether variations of a generation show the same image, which isn't the case
+// once an img2img was part of how it was made.
+func (q *queueImpl) canVary(ctx context.Context, generation *entities.ImageGeneration) bool {
+	for generation.SourceID != 0 {
+		if generation.Upscaler == "" {
+			return false
+		}
+
+		source, err := q.imageGenerationRepo.GetByID(ctx, generation.SourceID)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Error getting source generation", "generation_id", generation.SourceID, "error", err)
+
+			return false
+		}
+
+		generation = source
+	}
+
+	return true
+}
+
+// storeResult records the generation behind a single result message, so its buttons can find it.
+// gpuSeconds counts against the GPU budget of the member, zero when another row already counts them.
+func (q *queueImpl) storeResult(ctx context.Context, item *QueueItem, messageID string, result *entities.ImageGeneration, gpuSeconds float64) {
+	result.ID = 0
+	result.InteractionID = item.Origin.InteractionID
+	result.MessageID = messageID
+	result.ChannelID = item.Origin.ChannelID
+	result.GuildID = item.Origin.GuildID
+	result.MemberID = item.Origin.MemberID
+	result.SortOrder = 1
+	result.Processed = true
+	result.GPUSeconds = gpuSeconds
+	result.Deleted = false
+
+	_, err := q.imageGenerationRepo.Create(ctx, result)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error creating image generation record", "message_id", messageID, "error", err)
+	}
+}
+
+// imageToImageGeneration builds the generation of an img2img item from the result it reworks.
+func (q *queueImpl) imageToImageGeneration(ctx context.Context, item *QueueItem) (*entities.ImageGeneration, error) {
+	source, err := q.getPreviousGeneration(ctx, item, item.InteractionIndex)
+	if err != nil {
+		return nil, fmt.Errorf("error getting source of img2img: %w", err)
+	}
+
+	generation := *source
+	generation.SourceID = source.ID
+	generation.Upscaler = ""
+	generation.Deleted = false
+	generation.Seed = -1
+	generation.Subseed = -1
+	generation.SubseedStrength = 0
+	generation.EnableHR = false
+	generation.BatchCount = 1
+	generation.BatchSize = 1
+	generation.DenoisingStrength = defaultImageToImageDenoising
+
+	if item.DenoisingStrength > 0 {
+		generation.DenoisingStrength = min(item.DenoisingStrength, 1)
+	}
+
+	if prompt := strings.TrimSpace(item.Prompt); prompt != "" {
+		generation.Prompt = quotePromptAsMonospace(prompt)
+		generation.NegativePrompt = item.NegativePrompt
+	}
+
+	return &generation, nil
+}
+
+// processImageToImage reworks the image of a single result with a new prompt, and posts the
+// outcome as a single result again.
+func (q *queueImpl) processImageToImage(ctx context.Context, item *QueueItem, generation *entities.ImageGeneration) error {
+	logger := logging.FromContext(ctx)
+
+	q.progress(ctx, item, fmt.Sprintf("<@%s> asked me to rework their image as \"%s\". Currently dreaming it up for them.",
+		item.Origin.MemberID, generation.Prompt), 0)
+
+	initImage, _, err := sourceImage(ctx, item.Origin.SourceImageURL)
+	if err != nil {
+		return q.fail(ctx, item, "I'm sorry, but I couldn't fetch the image to rework.", err)
+	}
+
+	// the seed picks the wildcards, so it's fixed first and the same seed gives the same prompt again
+	if generation.Seed < 0 {
+		generation.Seed = rand.Int63n(math.MaxUint32)
+	}
+
+	prompts, err := q.promptExpander.expandBatchPrompts(generation.Prompt, generation.Seed, 1)
+	if err != nil {
+		return q.fail(ctx, item, "I'm sorry, but I couldn't expand the wildcards of your prompt.", err)
+	}
+
+	prompt := batchPrompt(generation.Prompt, prompts, 0)
+
+	logger.Info("Processing img2img", "source_id", generation.SourceID, "prompt", prompt,
+		"denoising_strength", generation.DenoisingStrength)
+
+	generationStart := q.clock.Now()
+
+	resp, err := q.stableDiffusionAPI.ImageToImage(ctx, &stable_diffusion_api.ImageToImageRequest{
+		InitImages:        []string{initImage},
+		Prompt:            prompt,
+		NegativePrompt:    generation.NegativePrompt,
+		Width:             generation.Width,
+		Height:            generation.Height,
+		RestoreFaces:      generation.RestoreFaces,
+		DenoisingStrength: generation.DenoisingStrength,
+		BatchSize:         1,
+		Seed:              generation.Seed,
+		Subseed:           generation.Subseed,
+		SubseedStrength:   generation.SubseedStrength,
+		SamplerName:       generation.SamplerName,
+		CfgScale:          generation.CfgScale,
+		Steps:             generation.Steps,
+		NIter:             1,
+	})
+	if err == nil && len(resp.Images) == 0 {
+		err = errors.New("no image returned")
+	}
+
+	if err != nil {
+		return q.fail(ctx, item, "I'm sorry, but I had a problem reworking your image.", err)
+	}
+
+	generation.Prompt = prompt
+	generation.GPUSeconds = q.clock.Now().Sub(generationStart).Seconds()
+	generation.NSFW = anyFlagged(resp.NSFW)
+
+	if len(resp.Seeds) > 0 {
+		generation.Seed = resp.Seeds[0]
+	}
+
+	decodedImage, err := base64.StdEncoding.DecodeString(resp.Images[0])
+	if err != nil {
+		return q.fail(ctx, item, "I'm sorry, but I had a problem reworking your image.", err)
+	}
+
+	nsfwAction := q.nsfwAction(item, generation.Prompt, generation.NSFW)
+	if nsfwAction == NSFWActionBlock {
+		logger.Info("Withheld NSFW img2img")
+
+		return q.withholdNSFWOutput(ctx, item)
+	}
+
+	messageID, err := item.Notifier.Deliver(ctx, &Result{
+		Kind: ResultSingle,
+		Message: fmt.Sprintf("<@%s> asked me to rework their image as \"%s\" (denoising %.2f, seed %d). Here's the result:",
+			item.Origin.MemberID, generation.Prompt, generation.DenoisingStrength, generation.Seed),
+		Image:    bytes.NewBuffer(decodedImage),
+		FileName: "invision_" + q.clock.Now().Format("20060102150405") + ".png",
+		Spoiler:  nsfwAction == NSFWActionSpoiler,
+	})
+	if err != nil {
+		logger.Error("Error delivering result", "error", err)
+
+		return err
+	}
+
+	// the grid row counts the img2img as an invision for history and quotas, the image row serves the buttons
+	gridRow := *generation
+	gridRow.InteractionID = item.Origin.InteractionID
+	gridRow.MessageID = messageID
+	gridRow.ChannelID = item.Origin.ChannelID
+	gridRow.GuildID = item.Origin.GuildID
+	gridRow.MemberID = item.Origin.MemberID
+	gridRow.SortOrder = 0
+	gridRow.Processed = true
+	gridRow.Generations = 1
+
+	_, err = q.imageGenerationRepo.Create(ctx, &gridRow)
+	if err != nil {
+		logger.Error("Error creating image generation record", "error", err)
+	}
+
+	q.storeResult(ctx, item, messageID, generation, 0)
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package invision_queue
+
+import (
+	"strings"
+	"time"
+)
+
+// JobStatus describes a job of the queue, for status pages.
+type JobStatus struct {
+	JobID    string
+	Type     ItemType
+	GuildID  string
+	MemberID string
+	// Prompt is empty for jobs that work on a stored generation, like rerolls and upscales.
+	Prompt string
+	// Since is when the job was queued, or when it started for the current job.
+	Since time.Time
+}
+
+// Status is a snapshot of the queue.
+type Status struct {
+	// Current is the job being generated, nil when the queue is idle.
+	Current *JobStatus
+	// Waiting lists the queued jobs, next one first.
+	Waiting []*JobStatus
+}
+
+func (q *queueImpl) Status() *Status {
+	status := &Status{}
+
+	q.mu.Lock()
+	if q.currentInvision != nil {
+		status.Current = jobStatus(q.currentInvision, q.currentStartedAt)
+	}
+	q.mu.Unlock()
+
+	q.queuedMu.Lock()
+	defer q.queuedMu.Unlock()
+
+	status.Waiting = make([]*JobStatus, 0, len(q.waiting))
+	for _, item := range q.waiting {
+		status.Waiting = append(status.Waiting, jobStatus(item, item.queuedAt))
+	}
+
+	return status
+}
+
+func jobStatus(item *QueueItem, since time.Time) *JobStatus {
+	return &JobStatus{
+		JobID:    item.JobID,
+		Type:     item.Type,
+		GuildID:  item.Origin.GuildID,
+		MemberID: item.Origin.MemberID,
+		Prompt:   strings.TrimSpace(item.Prompt),
+		Since:    since,
+	}
+}
@@ -0,0 +1,47 @@
+package invision_queue
+
+import (
+	"kinshi_vision_bot/entities"
+	"strings"
+)
+
+// stylePromptPlaceholder marks where a style puts the prompt of the invision.
+const stylePromptPlaceholder = "{prompt}"
+
+// applyStyles merges the fragments of the styles into the prompt and the negative prompt, in order.
+func applyStyles(prompt, negativePrompt string, styles []*entities.Style) (string, string) {
+	for _, style := range styles {
+		prompt = mergeStyleFragment(prompt, style.Prompt)
+		negativePrompt = mergeStyleFragment(negativePrompt, style.NegativePrompt)
+	}
+
+	return prompt, negativePrompt
+}
+
+// mergeStyleFragment puts the text in the placeholder of the fragment, or appends the fragment to it.
+func mergeStyleFragment(text, fragment string) string {
+	fragment = strings.TrimSpace(fragment)
+	text = strings.TrimSpace(text)
+
+	switch {
+	case fragment == "":
+		return text
+	case strings.Contains(fragment, stylePromptPlaceholder):
+		return strings.ReplaceAll(fragment, stylePromptPlaceholder, text)
+	case text == "":
+		return fragment
+	default:
+		return strings.TrimSuffix(text, ",") + ", " + fragment
+	}
+}
+
+// styleNames lists the names of the styles as stored on a generation.
+func styleNames(styles []*entities.Style) string {
+	names := make([]string, 0, len(styles))
+
+	for _, style := range styles {
+		names = append(names, style.Name)
+	}
+
+	return strings.Join(names, ",")
+}
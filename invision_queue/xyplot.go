@@ -0,0 +1,248 @@
+package invision_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/policy"
+	"strconv"
+	"strings"
+)
+
+const (
+	XYAxisSteps    = "steps"
+	XYAxisCFGScale = "cfg_scale"
+	XYAxisSampler  = "sampler"
+	XYAxisSeed     = "seed"
+	XYAxisModel    = "model"
+
+	// xyPlotMaxCells keeps plots to a size the WebUI finishes in reasonable time and Discord accepts.
+	xyPlotMaxCells = 16
+)
+
+var ErrInvalidXYPlot = errors.New("invalid X/Y plot")
+
+var xyAxisTitles = map[string]string{
+	XYAxisSteps:    "Steps",
+	XYAxisCFGScale: "CFG scale",
+	XYAxisSampler:  "Sampler",
+	XYAxisSeed:     "Seed",
+	XYAxisModel:    "Model",
+}
+
+// XYAxis is a parameter of an X/Y plot with the values to compare.
+type XYAxis struct {
+	Kind   string
+	Values []string
+}
+
+// XYPlot compares the values of one or two parameters for the same prompt. Y is nil for a single row.
+type XYPlot struct {
+	X *XYAxis
+	Y *XYAxis
+}
+
+// NewXYPlot parses the comma separated values of the axes. The Y axis is optional and left out when
+// yKind is empty.
+func NewXYPlot(xKind, xValues, yKind, yValues string) (*XYPlot, error) {
+	xAxis, err := parseXYAxis(xKind, xValues)
+	if err != nil {
+		return nil, err
+	}
+
+	plot := &XYPlot{X: xAxis}
+
+	if yKind != "" {
+		if yKind == xKind {
+			return nil, fmt.Errorf("%w: the X and Y axis can't be the same parameter", ErrInvalidXYPlot)
+		}
+
+		plot.Y, err = parseXYAxis(yKind, yValues)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if plot.cellCount() > xyPlotMaxCells {
+		return nil, fmt.Errorf("%w: %d combinations, the limit is %d", ErrInvalidXYPlot, plot.cellCount(), xyPlotMaxCells)
+	}
+
+	return plot, nil
+}
+
+func parseXYAxis(kind, values string) (*XYAxis, error) {
+	title, ok := xyAxisTitles[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown axis %q", ErrInvalidXYPlot, kind)
+	}
+
+	axis := &XYAxis{Kind: kind}
+
+	for _, value := range strings.Split(values, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		var err error
+
+		switch kind {
+		case XYAxisSteps:
+			var steps int
+
+			steps, err = strconv.Atoi(value)
+			if err == nil && steps < 1 {
+				err = errors.New("steps must be positive")
+			}
+		case XYAxisCFGScale:
+			_, err = strconv.ParseFloat(value, 64)
+		case XYAxisSeed:
+			_, err = strconv.ParseInt(value, 10, 64)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q is not a valid %s value", ErrInvalidXYPlot, value, title)
+		}
+
+		axis.Values = append(axis.Values, value)
+	}
+
+	if len(axis.Values) == 0 {
+		return nil, fmt.Errorf("%w: the %s axis has no values", ErrInvalidXYPlot, title)
+	}
+
+	return axis, nil
+}
+
+func (p *XYPlot) axes() []*XYAxis {
+	if p.Y == nil {
+		return []*XYAxis{p.X}
+	}
+
+	return []*XYAxis{p.X, p.Y}
+}
+
+func (p *XYPlot) rowLabels() []string {
+	if p.Y == nil {
+		return []string{""}
+	}
+
+	return p.Y.Values
+}
+
+func (p *XYPlot) cellCount() int {
+	return len(p.X.Values) * len(p.rowLabels())
+}
+
+func (a *XYAxis) title() string {
+	if a == nil {
+		return ""
+	}
+
+	return xyAxisTitles[a.Kind]
+}
+
+// apply sets the value of the axis on a generation. A model is not part of the generation and
+// is returned instead, empty for the other axes.
+func (a *XYAxis) apply(generation *entities.ImageGeneration, value string) string {
+	switch a.Kind {
+	case XYAxisSteps:
+		generation.Steps, _ = strconv.Atoi(value)
+	case XYAxisCFGScale:
+		generation.CfgScale, _ = strconv.ParseFloat(value, 64)
+	case XYAxisSampler:
+		generation.SamplerName = value
+	case XYAxisSeed:
+		generation.Seed, _ = strconv.ParseInt(value, 10, 64)
+	case XYAxisModel:
+		return value
+	}
+
+	return ""
+}
+
+// prepareXYPlot fits the axis values of a plot into the bot settings and the role policy of the
+// member, so that the labels of the plot show the values that are used.
+func (q *queueImpl) prepareXYPlot(item *QueueItem) error {
+	if item.Type != ItemTypeXYPlot {
+		return nil
+	}
+
+	if item.XYPlot == nil {
+		return fmt.Errorf("%w: missing axes", ErrInvalidXYPlot)
+	}
+
+	settings, err := q.GetBotDefaultSettings(item.Origin.GuildID)
+	if err != nil {
+		return fmt.Errorf("error getting default settings: %w", err)
+	}
+
+	maxSteps := settings.MaxSteps
+
+	if item.Limits != nil {
+		if item.Limits.MaxBatch > 0 && item.XYPlot.cellCount() > item.Limits.MaxBatch {
+			return &policy.RejectedError{Reason: fmt.Sprintf("Your roles allow up to %d images per invision, this plot has %d.",
+				item.Limits.MaxBatch, item.XYPlot.cellCount())}
+		}
+
+		if item.Limits.MaxSteps > 0 {
+			maxSteps = min(maxSteps, item.Limits.MaxSteps)
+		}
+	}
+
+	for _, axis := range item.XYPlot.axes() {
+		for idx, value := range axis.Values {
+			clamped := value
+
+			switch axis.Kind {
+			case XYAxisSteps:
+				steps, _ := strconv.Atoi(value)
+				clamped = strconv.Itoa(min(steps, maxSteps))
+			case XYAxisCFGScale:
+				cfgScale, _ := strconv.ParseFloat(value, 64)
+				clamped = strconv.FormatFloat(max(minCFGScale, min(cfgScale, settings.MaxCFGScale)), 'f', -1, 64)
+			}
+
+			if clamped != value {
+				item.PolicyNotes = append(item.PolicyNotes, fmt.Sprintf("%s %s was changed to %s, the limit for this server and your roles.",
+					axis.title(), value, clamped))
+
+				axis.Values[idx] = clamped
+			}
+		}
+	}
+
+	return nil
+}
+
+// processXYPlot generates every combination of the axis values, with the same seed unless the seed is an axis.
+func (q *queueImpl) processXYPlot(ctx context.Context, item *QueueItem) error {
+	plot := item.XYPlot
+
+	details := " with " + plot.X.title() + " on the X axis"
+	if plot.Y != nil {
+		details += " and " + plot.Y.title() + " on the Y axis"
+	}
+
+	return q.processLabeledGrid(ctx, item, &labeledGrid{
+		name:         "X/Y plot",
+		request:      "plot",
+		details:      details,
+		columnLabels: plot.X.Values,
+		rowLabels:    plot.rowLabels(),
+		xTitle:       plot.X.title(),
+		yTitle:       plot.Y.title(),
+		applyCell: func(generation *entities.ImageGeneration, col, row int) string {
+			model := plot.X.apply(generation, plot.X.Values[col])
+
+			if plot.Y != nil {
+				if yModel := plot.Y.apply(generation, plot.Y.Values[row]); yModel != "" {
+					model = yModel
+				}
+			}
+
+			return model
+		},
+	})
+}
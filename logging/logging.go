@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type Config struct {
+	// Level is one of "debug", "info", "warn" or "error". Defaults to "info".
+	Level string
+	// Format is either "text" or "json". Defaults to "text".
+	Format string
+	Output io.Writer
+}
+
+func New(cfg Config) (*slog.Logger, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Output == nil {
+		return nil, fmt.Errorf("missing log output")
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(cfg.Output, opts)
+	case "json":
+		handler = slog.NewJSONHandler(cfg.Output, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+
+	return slog.New(handler), nil
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying logger, so that code further down
+// the call chain logs with the same attributes (e.g. the job ID).
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok && logger != nil {
+			return logger
+		}
+	}
+
+	return slog.Default()
+}
+
+// NewJobID returns a short random identifier used to correlate the log lines of a queued job.
+func NewJobID() string {
+	buf := make([]byte, 6)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(buf)
+}
@@ -3,15 +3,36 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"kinshi_vision_bot/dashboard"
 	"kinshi_vision_bot/databases/sqlite"
 	"kinshi_vision_bot/discord_bot"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/fake_backend"
 	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/moderation"
+	"kinshi_vision_bot/policy"
+	"kinshi_vision_bot/quota"
+	"kinshi_vision_bot/repositories/api_keys"
+	"kinshi_vision_bot/repositories/channel_rules"
 	"kinshi_vision_bot/repositories/default_settings"
+	"kinshi_vision_bot/repositories/favorites"
 	"kinshi_vision_bot/repositories/image_generations"
+	"kinshi_vision_bot/repositories/moderation_hits"
+	"kinshi_vision_bot/repositories/moderation_rules"
+	"kinshi_vision_bot/repositories/role_policies"
+	"kinshi_vision_bot/repositories/styles"
+	"kinshi_vision_bot/rest_api"
 	"kinshi_vision_bot/stable_diffusion_api"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/joho/godotenv"
 )
 
@@ -24,12 +45,113 @@ func getEnvVar(key, defaultValue string) string {
 	return value
 }
 
+// splitEnvList splits a comma separated value, ignoring blank entries.
+func splitEnvList(value string) []string {
+	items := make([]string, 0)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// fatal logs the message at error level and exits.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
 var (
 	invisionCommand    = flag.String("invision", "invision", "Invision command name. Default is \"invision\"")
 	removeCommandsFlag = flag.Bool("remove", false, "Delete all commands when bot exits")
 	devModeFlag        = flag.Bool("dev", false, "Start in development mode, using \"dev_\" prefixed commands instead")
+	createAPIKeyFlag   = flag.String("create-api-key", "", "Create a REST API key with this name, print it and exit")
+	apiKeyGuildFlag    = flag.String("api-key-guild", "", "Guild whose settings apply to the invisions of the created API key")
+	revokeAPIKeyFlag   = flag.String("revoke-api-key", "", "Delete the REST API key with this name and exit")
+	listAPIKeysFlag    = flag.Bool("list-api-keys", false, "List the REST API keys and exit")
+	fakeBackendFlag    = flag.Bool("fake-backend", false, "Generate with a built-in fake Stable Diffusion backend instead of API_HOST")
 )
 
+// startFakeBackend serves the fake Stable Diffusion backend configured by the FAKE_BACKEND_ variables.
+func startFakeBackend(logger *slog.Logger) fake_backend.Backend {
+	latency, err := time.ParseDuration(getEnvVar("FAKE_BACKEND_LATENCY", "2s"))
+	if err != nil {
+		fatal(logger, "Invalid fake backend latency", "error", err)
+	}
+
+	errorRate, err := strconv.ParseFloat(getEnvVar("FAKE_BACKEND_ERROR_RATE", "0"), 64)
+	if err != nil {
+		fatal(logger, "Invalid fake backend error rate", "error", err)
+	}
+
+	backend, err := fake_backend.New(fake_backend.Config{
+		Addr:      getEnvVar("FAKE_BACKEND_ADDR", "127.0.0.1:7861"),
+		Latency:   latency,
+		ErrorRate: errorRate,
+		Logger:    logger.With("component", "fake_backend"),
+	})
+	if err != nil {
+		fatal(logger, "Failed to create fake backend", "error", err)
+	}
+
+	err = backend.Start()
+	if err != nil {
+		fatal(logger, "Failed to start fake backend", "error", err)
+	}
+
+	return backend
+}
+
+// manageAPIKeys runs the API key flags. It reports whether one was given, the bot doesn't start then.
+func manageAPIKeys(ctx context.Context, logger *slog.Logger, apiKeyRepo api_keys.Repository) bool {
+	switch {
+	case *createAPIKeyFlag != "":
+		if *apiKeyGuildFlag == "" {
+			fatal(logger, "An API key needs a guild, set -api-key-guild", "name", *createAPIKeyFlag)
+		}
+
+		key, keyHash, err := rest_api.NewKey()
+		if err != nil {
+			fatal(logger, "Failed to generate API key", "error", err)
+		}
+
+		_, err = apiKeyRepo.Create(ctx, &entities.APIKey{
+			Name:    *createAPIKeyFlag,
+			GuildID: *apiKeyGuildFlag,
+			KeyHash: keyHash,
+		})
+		if err != nil {
+			fatal(logger, "Failed to create API key", "name", *createAPIKeyFlag, "error", err)
+		}
+
+		fmt.Printf("API key %s: %s\nIt is only shown once, store it somewhere safe.\n", *createAPIKeyFlag, key)
+	case *revokeAPIKeyFlag != "":
+		err := apiKeyRepo.DeleteByName(ctx, *revokeAPIKeyFlag)
+		if err != nil {
+			fatal(logger, "Failed to revoke API key", "name", *revokeAPIKeyFlag, "error", err)
+		}
+
+		fmt.Printf("API key %s revoked.\n", *revokeAPIKeyFlag)
+	case *listAPIKeysFlag:
+		apiKeys, err := apiKeyRepo.List(ctx)
+		if err != nil {
+			fatal(logger, "Failed to list API keys", "error", err)
+		}
+
+		for _, apiKey := range apiKeys {
+			fmt.Printf("%s\tguild %q\tcreated %s\n", apiKey.Name, apiKey.GuildID, apiKey.CreatedAt.Format(time.RFC3339))
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -38,24 +160,70 @@ func main() {
 
 	flag.Parse()
 
-	guildID := getEnvVar("GUILD_ID", "")
+	logger, err := logging.New(logging.Config{
+		Level:  getEnvVar("LOG_LEVEL", "info"),
+		Format: getEnvVar("LOG_FORMAT", "text"),
+		Output: os.Stderr,
+	})
+	if err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+
+	slog.SetDefault(logger)
+
+	ctx := logging.NewContext(context.Background(), logger)
+
+	sqliteDB, err := sqlite.New(ctx)
+	if err != nil {
+		fatal(logger, "Failed to create sqlite database", "error", err)
+	}
+
+	// the API key flags only need the database, they work without the settings of the bot
+	apiKeyRepo, err := api_keys.NewRepository(&api_keys.Config{DB: sqliteDB})
+	if err != nil {
+		fatal(logger, "Failed to create API key repository", "error", err)
+	}
+
+	if manageAPIKeys(ctx, logger, apiKeyRepo) {
+		return
+	}
+
+	guildIDs := splitEnvList(getEnvVar("GUILD_ID", ""))
 	botToken := getEnvVar("BOT_TOKEN", "")
 	apiHost := getEnvVar("API_HOST", "")
+	adminRoleID := getEnvVar("ADMIN_ROLE_ID", "")
+	wildcardsDir := getEnvVar("WILDCARDS_DIR", "wildcards")
+	dashboardAddr := getEnvVar("DASHBOARD_ADDR", "")
+	dashboardToken := getEnvVar("DASHBOARD_TOKEN", "")
+	restAPIAddr := getEnvVar("REST_API_ADDR", "")
+
+	var fakeBackend fake_backend.Backend
 
-	if guildID == "" {
-		log.Fatal("Guild ID is required")
+	if *fakeBackendFlag {
+		fakeBackend = startFakeBackend(logger)
+		apiHost = fakeBackend.URL()
+
+		logger.Info("Generating with the fake backend, API_HOST is ignored")
+	}
+
+	if len(guildIDs) == 0 {
+		logger.Info("No guild ID configured, registering commands globally")
 	}
 
 	if botToken == "" {
-		log.Fatal("Bot token is required")
+		fatal(logger, "Bot token is required")
 	}
 
 	if apiHost == "" {
-		log.Fatal("API host is required")
+		fatal(logger, "API host is required")
+	}
+
+	if dashboardAddr != "" && dashboardToken == "" {
+		fatal(logger, "Dashboard token is required to serve the dashboard")
 	}
 
 	if invisionCommand == nil || *invisionCommand == "" {
-		log.Fatalf("Invision command flag is required")
+		fatal(logger, "Invision command flag is required")
 	}
 
 	devMode := false
@@ -63,7 +231,7 @@ func main() {
 	if devModeFlag != nil && *devModeFlag {
 		devMode = *devModeFlag
 
-		log.Printf("Starting in development mode.. all commands prefixed with \"dev_\"")
+		logger.Info("Starting in development mode.. all commands prefixed with \"dev_\"")
 	}
 
 	removeCommands := false
@@ -76,48 +244,190 @@ func main() {
 		Host: apiHost,
 	})
 	if err != nil {
-		log.Fatalf("Failed to create Stable Diffusion API: %v", err)
+		fatal(logger, "Failed to create Stable Diffusion API", "error", err)
 	}
 
-	ctx := context.Background()
+	generationRepo, err := image_generations.NewRepository(&image_generations.Config{DB: sqliteDB})
+	if err != nil {
+		fatal(logger, "Failed to create image generation repository", "error", err)
+	}
 
-	sqliteDB, err := sqlite.New(ctx)
+	defaultSettingsRepo, err := default_settings.NewRepository(&default_settings.Config{DB: sqliteDB})
 	if err != nil {
-		log.Fatalf("Failed to create sqlite database: %v", err)
+		fatal(logger, "Failed to create default settings repository", "error", err)
 	}
 
-	generationRepo, err := image_generations.NewRepository(&image_generations.Config{DB: sqliteDB})
+	rolePolicyRepo, err := role_policies.NewRepository(&role_policies.Config{DB: sqliteDB})
 	if err != nil {
-		log.Fatalf("Failed to create image generation repository: %v", err)
+		fatal(logger, "Failed to create role policy repository", "error", err)
 	}
 
-	defaultSettingsRepo, err := default_settings.NewRepository(&default_settings.Config{DB: sqliteDB})
+	channelRuleRepo, err := channel_rules.NewRepository(&channel_rules.Config{DB: sqliteDB})
+	if err != nil {
+		fatal(logger, "Failed to create channel rule repository", "error", err)
+	}
+
+	moderationRuleRepo, err := moderation_rules.NewRepository(&moderation_rules.Config{DB: sqliteDB})
+	if err != nil {
+		fatal(logger, "Failed to create moderation rule repository", "error", err)
+	}
+
+	moderationHitRepo, err := moderation_hits.NewRepository(&moderation_hits.Config{DB: sqliteDB})
+	if err != nil {
+		fatal(logger, "Failed to create moderation hit repository", "error", err)
+	}
+
+	styleRepo, err := styles.NewRepository(&styles.Config{DB: sqliteDB})
+	if err != nil {
+		fatal(logger, "Failed to create style repository", "error", err)
+	}
+
+	favoriteRepo, err := favorites.NewRepository(&favorites.Config{DB: sqliteDB})
+	if err != nil {
+		fatal(logger, "Failed to create favorite repository", "error", err)
+	}
+
+	moderator, err := moderation.New(moderation.Config{
+		RuleRepo: moderationRuleRepo,
+		HitRepo:  moderationHitRepo,
+	})
+	if err != nil {
+		fatal(logger, "Failed to create moderator", "error", err)
+	}
+
+	policyEnforcer, err := policy.New(policy.Config{RolePolicyRepo: rolePolicyRepo})
+	if err != nil {
+		fatal(logger, "Failed to create policy enforcer", "error", err)
+	}
+
+	quotaTracker, err := quota.New(quota.Config{
+		ImageGenerationRepo: generationRepo,
+		PolicyEnforcer:      policyEnforcer,
+	})
 	if err != nil {
-		log.Fatalf("Failed to create default settings repository: %v", err)
+		fatal(logger, "Failed to create quota tracker", "error", err)
 	}
 
 	invisionQueue, err := invision_queue.New(invision_queue.Config{
 		StableDiffusionAPI:  stableDiffusionAPI,
 		ImageGenerationRepo: generationRepo,
 		DefaultSettingsRepo: defaultSettingsRepo,
+		ChannelRuleRepo:     channelRuleRepo,
+		PolicyEnforcer:      policyEnforcer,
+		WildcardsDir:        wildcardsDir,
+		Logger:              logger.With("component", "queue"),
 	})
 	if err != nil {
-		log.Fatalf("Failed to create invision queue: %v", err)
+		fatal(logger, "Failed to create invision queue", "error", err)
 	}
 
 	bot, err := discord_bot.New(discord_bot.Config{
-		DevelopmentMode: devMode,
-		BotToken:        botToken,
-		GuildID:         guildID,
-		InvisionQueue:   invisionQueue,
-		InvisionCommand: *invisionCommand,
-		RemoveCommands:  removeCommands,
+		DevelopmentMode:     devMode,
+		BotToken:            botToken,
+		GuildIDs:            guildIDs,
+		InvisionQueue:       invisionQueue,
+		ImageGenerationRepo: generationRepo,
+		RolePolicyRepo:      rolePolicyRepo,
+		ChannelRuleRepo:     channelRuleRepo,
+		Moderator:           moderator,
+		ModerationRuleRepo:  moderationRuleRepo,
+		ModerationHitRepo:   moderationHitRepo,
+		QuotaTracker:        quotaTracker,
+		StyleRepo:           styleRepo,
+		FavoriteRepo:        favoriteRepo,
+		InvisionCommand:     *invisionCommand,
+		RemoveCommands:      removeCommands,
+		AdminRoleID:         adminRoleID,
+		Logger:              logger.With("component", "discord_bot"),
 	})
 	if err != nil {
-		log.Fatalf("Error creating Discord bot: %v", err)
+		fatal(logger, "Error creating Discord bot", "error", err)
+	}
+
+	var webDashboard dashboard.Dashboard
+
+	if dashboardAddr != "" {
+		// the dashboard only makes REST calls to Discord, so it gets a session of its own
+		dashboardSession, err := discordgo.New("Bot " + botToken)
+		if err != nil {
+			fatal(logger, "Failed to create dashboard Discord session", "error", err)
+		}
+
+		webDashboard, err = dashboard.New(dashboard.Config{
+			Addr:                dashboardAddr,
+			Token:               dashboardToken,
+			InvisionQueue:       invisionQueue,
+			ImageGenerationRepo: generationRepo,
+			StableDiffusionAPI:  stableDiffusionAPI,
+			DiscordSession:      dashboardSession,
+			Logger:              logger.With("component", "dashboard"),
+		})
+		if err != nil {
+			fatal(logger, "Failed to create dashboard", "error", err)
+		}
+
+		err = webDashboard.Start()
+		if err != nil {
+			fatal(logger, "Failed to start dashboard", "error", err)
+		}
+	}
+
+	var restAPI rest_api.API
+
+	if restAPIAddr != "" {
+		restAPI, err = rest_api.New(rest_api.Config{
+			Addr:          restAPIAddr,
+			APIKeyRepo:    apiKeyRepo,
+			InvisionQueue: invisionQueue,
+			Moderator:     moderator,
+			QuotaTracker:  quotaTracker,
+			StyleRepo:     styleRepo,
+			Logger:        logger.With("component", "rest_api"),
+		})
+		if err != nil {
+			fatal(logger, "Failed to create REST API", "error", err)
+		}
+
+		err = restAPI.Start()
+		if err != nil {
+			fatal(logger, "Failed to start REST API", "error", err)
+		}
 	}
 
 	bot.Start()
 
-	log.Println("Gracefully shutting down.")
+	if restAPI != nil {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+		err = restAPI.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("Error shutting down REST API", "error", err)
+		}
+
+		cancel()
+	}
+
+	if webDashboard != nil {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+		err = webDashboard.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("Error shutting down dashboard", "error", err)
+		}
+
+		cancel()
+	}
+
+	if fakeBackend != nil {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+		err = fakeBackend.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("Error shutting down fake backend", "error", err)
+		}
+
+		cancel()
+	}
+
+	logger.Info("Gracefully shutting down.")
 }
@@ -0,0 +1,11 @@
+package moderation
+
+import (
+	"context"
+)
+
+type Moderator interface {
+	// Check matches a prompt against the moderation rules of a guild. A prompt matching a reject
+	// rule returns a *RejectedError, rewrite rules replace the matching text. Every match is recorded.
+	Check(ctx context.Context, guildID, memberID, prompt string) (*Result, error)
+}
@@ -0,0 +1,151 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/repositories/moderation_hits"
+	"kinshi_vision_bot/repositories/moderation_rules"
+	"regexp"
+	"strings"
+)
+
+const (
+	ActionReject  = "reject"
+	ActionRewrite = "rewrite"
+)
+
+// RejectedError is returned when a prompt matches a reject rule.
+type RejectedError struct {
+	RuleID int64
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("prompt rejected by moderation rule %d", e.RuleID)
+}
+
+// Result is the prompt after the rewrite rules were applied.
+type Result struct {
+	Prompt    string
+	Rewritten bool
+}
+
+type moderatorImpl struct {
+	ruleRepo moderation_rules.Repository
+	hitRepo  moderation_hits.Repository
+}
+
+type Config struct {
+	RuleRepo moderation_rules.Repository
+	HitRepo  moderation_hits.Repository
+}
+
+func New(cfg Config) (Moderator, error) {
+	if cfg.RuleRepo == nil {
+		return nil, errors.New("missing moderation rule repository")
+	}
+
+	if cfg.HitRepo == nil {
+		return nil, errors.New("missing moderation hit repository")
+	}
+
+	return &moderatorImpl{
+		ruleRepo: cfg.RuleRepo,
+		hitRepo:  cfg.HitRepo,
+	}, nil
+}
+
+// RuleRegexp compiles the pattern of a rule. Terms match case-insensitively as whole words.
+func RuleRegexp(rule *entities.ModerationRule) (*regexp.Regexp, error) {
+	if rule.IsRegex {
+		return regexp.Compile(rule.Pattern)
+	}
+
+	return regexp.Compile(`(?i)\b` + regexp.QuoteMeta(strings.TrimSpace(rule.Pattern)) + `\b`)
+}
+
+// ValidateRule checks a rule before it is stored.
+func ValidateRule(rule *entities.ModerationRule) error {
+	if strings.TrimSpace(rule.Pattern) == "" {
+		return errors.New("the pattern can't be empty")
+	}
+
+	if rule.Action != ActionReject && rule.Action != ActionRewrite {
+		return fmt.Errorf("the action must be %q or %q", ActionReject, ActionRewrite)
+	}
+
+	ruleRegexp, err := RuleRegexp(rule)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression: %w", err)
+	}
+
+	if ruleRegexp.MatchString("") {
+		return errors.New("the pattern matches every prompt")
+	}
+
+	return nil
+}
+
+func (m *moderatorImpl) Check(ctx context.Context, guildID, memberID, prompt string) (*Result, error) {
+	rules, err := m.ruleRepo.GetByGuildID(ctx, guildID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting moderation rules: %w", err)
+	}
+
+	result := &Result{Prompt: prompt}
+
+	// reject rules go first, so a rewrite can't hide a rejected term
+	for _, action := range []string{ActionReject, ActionRewrite} {
+		for _, rule := range rules {
+			if rule.Action != action {
+				continue
+			}
+
+			ruleRegexp, err := RuleRegexp(rule)
+			if err != nil {
+				logging.FromContext(ctx).Warn("Skipping invalid moderation rule", "rule_id", rule.ID, "error", err)
+
+				continue
+			}
+
+			if !ruleRegexp.MatchString(result.Prompt) {
+				continue
+			}
+
+			m.recordHit(ctx, guildID, memberID, rule, prompt)
+
+			if rule.Action == ActionReject {
+				return nil, &RejectedError{RuleID: rule.ID}
+			}
+
+			result.Prompt = ruleRegexp.ReplaceAllLiteralString(result.Prompt, rule.Replacement)
+			result.Rewritten = true
+		}
+	}
+
+	if result.Rewritten {
+		result.Prompt = strings.Join(strings.Fields(result.Prompt), " ")
+	}
+
+	return result, nil
+}
+
+func (m *moderatorImpl) recordHit(ctx context.Context, guildID, memberID string, rule *entities.ModerationRule, prompt string) {
+	logger := logging.FromContext(ctx)
+
+	logger.Info("Moderation rule matched", "guild_id", guildID, "member_id", memberID, "rule_id", rule.ID, "action", rule.Action)
+
+	_, err := m.hitRepo.Create(ctx, &entities.ModerationHit{
+		GuildID:  guildID,
+		MemberID: memberID,
+		RuleID:   rule.ID,
+		Pattern:  rule.Pattern,
+		Action:   rule.Action,
+		Prompt:   prompt,
+	})
+	if err != nil {
+		logger.Error("Error recording moderation hit", "rule_id", rule.ID, "error", err)
+	}
+}
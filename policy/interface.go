@@ -0,0 +1,12 @@
+package policy
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Enforcer interface {
+	// Resolve returns the combined policy of a member's roles in a guild, or nil when
+	// none of them (including @everyone) has a policy, meaning no limits apply.
+	Resolve(ctx context.Context, guildID string, roleIDs []string) (*entities.RolePolicy, error)
+}
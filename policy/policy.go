@@ -0,0 +1,168 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories/role_policies"
+	"math"
+)
+
+const minDimension = 64
+
+// RejectedError is returned when a request is not allowed at all by the member's policy.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return e.Reason
+}
+
+type enforcerImpl struct {
+	rolePolicyRepo role_policies.Repository
+}
+
+type Config struct {
+	RolePolicyRepo role_policies.Repository
+}
+
+func New(cfg Config) (Enforcer, error) {
+	if cfg.RolePolicyRepo == nil {
+		return nil, errors.New("missing role policy repository")
+	}
+
+	return &enforcerImpl{
+		rolePolicyRepo: cfg.RolePolicyRepo,
+	}, nil
+}
+
+func (e *enforcerImpl) Resolve(ctx context.Context, guildID string, roleIDs []string) (*entities.RolePolicy, error) {
+	// the @everyone role shares its ID with the guild and is not part of the member's roles
+	allRoleIDs := append([]string{guildID}, roleIDs...)
+
+	policies, err := e.rolePolicyRepo.GetByRoleIDs(ctx, allRoleIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return Merge(policies), nil
+}
+
+// Merge combines the policies of several roles by taking the most permissive value of every limit.
+func Merge(policies []*entities.RolePolicy) *entities.RolePolicy {
+	if len(policies) == 0 {
+		return nil
+	}
+
+	merged := &entities.RolePolicy{
+		MaxPixels: policies[0].MaxPixels,
+		MaxSteps:  policies[0].MaxSteps,
+		MaxBatch:  policies[0].MaxBatch,
+
+		GenerationsPerHour: policies[0].GenerationsPerHour,
+		DailyGPUSeconds:    policies[0].DailyGPUSeconds,
+	}
+
+	for _, policy := range policies {
+		merged.MaxPixels = mostPermissive(merged.MaxPixels, policy.MaxPixels)
+		merged.MaxSteps = mostPermissive(merged.MaxSteps, policy.MaxSteps)
+		merged.MaxBatch = mostPermissive(merged.MaxBatch, policy.MaxBatch)
+		merged.GenerationsPerHour = mostPermissive(merged.GenerationsPerHour, policy.GenerationsPerHour)
+		merged.DailyGPUSeconds = mostPermissive(merged.DailyGPUSeconds, policy.DailyGPUSeconds)
+		merged.AllowHires = merged.AllowHires || policy.AllowHires
+		merged.AllowUpscale = merged.AllowUpscale || policy.AllowUpscale
+	}
+
+	return merged
+}
+
+// mostPermissive returns the higher of two limits, where 0 means unlimited.
+func mostPermissive(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return max(a, b)
+}
+
+// CheckUpscale rejects upscales for members whose roles don't allow them.
+func CheckUpscale(limits *entities.RolePolicy) error {
+	if limits != nil && !limits.AllowUpscale {
+		return &RejectedError{Reason: "Your roles don't allow upscaling images."}
+	}
+
+	return nil
+}
+
+// Clamp reduces the parameters of a generation to the limits of a policy and returns
+// an explanation for every change it made. A nil policy leaves the generation untouched.
+func Clamp(generation *entities.ImageGeneration, limits *entities.RolePolicy) []string {
+	notes := make([]string, 0)
+
+	if limits == nil {
+		return notes
+	}
+
+	if generation.EnableHR && !limits.AllowHires {
+		generation.EnableHR = false
+		generation.HRUpscaleRate = 1.0
+		generation.HRUpscaler = ""
+		generation.HiresWidth = generation.Width
+		generation.HiresHeight = generation.Height
+
+		notes = append(notes, "Hires.fix was turned off, your roles don't allow it.")
+	}
+
+	if limits.MaxSteps > 0 && generation.Steps > limits.MaxSteps {
+		notes = append(notes, fmt.Sprintf("Steps were reduced from %d to %d, the limit for your roles.",
+			generation.Steps, limits.MaxSteps))
+
+		generation.Steps = limits.MaxSteps
+	}
+
+	if pixels := OutputPixels(generation); limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		oldWidth, oldHeight := generation.Width, generation.Height
+
+		scale := math.Sqrt(float64(limits.MaxPixels) / float64(pixels))
+
+		generation.Width = max(minDimension, roundDownTo8(float64(generation.Width)*scale))
+		generation.Height = max(minDimension, roundDownTo8(float64(generation.Height)*scale))
+
+		if !generation.EnableHR {
+			generation.HiresWidth = generation.Width
+			generation.HiresHeight = generation.Height
+		}
+
+		notes = append(notes, fmt.Sprintf("The resolution was reduced from %dx%d to %dx%d, your roles allow up to %d pixels.",
+			oldWidth, oldHeight, generation.Width, generation.Height, limits.MaxPixels))
+	}
+
+	if total := generation.BatchCount * generation.BatchSize; limits.MaxBatch > 0 && total > limits.MaxBatch {
+		if generation.BatchSize <= limits.MaxBatch {
+			generation.BatchCount = limits.MaxBatch / generation.BatchSize
+		} else {
+			generation.BatchSize = limits.MaxBatch
+			generation.BatchCount = 1
+		}
+
+		notes = append(notes, fmt.Sprintf("The number of images was reduced from %d to %d, the limit for your roles.",
+			total, generation.BatchCount*generation.BatchSize))
+	}
+
+	return notes
+}
+
+// OutputPixels returns the pixel count of an image of the generation after hires.fix.
+func OutputPixels(generation *entities.ImageGeneration) int {
+	if !generation.EnableHR || generation.HRUpscaleRate <= 1 {
+		return generation.Width * generation.Height
+	}
+
+	return int(float64(generation.Width) * generation.HRUpscaleRate * float64(generation.Height) * generation.HRUpscaleRate)
+}
+
+func roundDownTo8(value float64) int {
+	return int(value) &^ 7
+}
@@ -0,0 +1,15 @@
+package quota
+
+import (
+	"context"
+)
+
+type Tracker interface {
+	// Usage returns the usage and limits of a member. The limits come from the role policy of the member.
+	Usage(ctx context.Context, guildID, memberID string, roleIDs []string) (*Usage, error)
+	// Check returns an *ExceededError when a member has no allowance left. generations is what the
+	// job counts against the hourly allowance, 0 for jobs like upscales that only count against the
+	// daily GPU budget. queued is what the member's jobs waiting in the queue count for, not yet
+	// part of the usage.
+	Check(ctx context.Context, guildID, memberID string, roleIDs []string, generations int, queued int) error
+}
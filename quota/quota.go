@@ -0,0 +1,145 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/clock"
+	"kinshi_vision_bot/policy"
+	"kinshi_vision_bot/repositories/image_generations"
+	"time"
+)
+
+// ExceededError is returned when a member used up an allowance.
+type ExceededError struct {
+	Reason  string
+	ResetAt time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return e.Reason
+}
+
+// Usage is the allowance of a member. Zero limits mean unlimited.
+type Usage struct {
+	GenerationsLastHour int
+	GenerationsPerHour  int
+	// HourlyResetAt is when the oldest generation of the last hour stops counting.
+	HourlyResetAt time.Time
+
+	GPUSecondsToday float64
+	DailyGPUSeconds int
+	// DailyResetAt is the next midnight UTC.
+	DailyResetAt time.Time
+}
+
+type trackerImpl struct {
+	imageGenerationRepo image_generations.Repository
+	policyEnforcer      policy.Enforcer
+	clock               clock.Clock
+}
+
+type Config struct {
+	ImageGenerationRepo image_generations.Repository
+	PolicyEnforcer      policy.Enforcer
+	// Clock is optional, the real clock is used when nil.
+	Clock clock.Clock
+}
+
+func New(cfg Config) (Tracker, error) {
+	if cfg.ImageGenerationRepo == nil {
+		return nil, errors.New("missing image generation repository")
+	}
+
+	if cfg.PolicyEnforcer == nil {
+		return nil, errors.New("missing policy enforcer")
+	}
+
+	trackerClock := cfg.Clock
+	if trackerClock == nil {
+		trackerClock = clock.NewClock()
+	}
+
+	return &trackerImpl{
+		imageGenerationRepo: cfg.ImageGenerationRepo,
+		policyEnforcer:      cfg.PolicyEnforcer,
+		clock:               trackerClock,
+	}, nil
+}
+
+func (t *trackerImpl) Usage(ctx context.Context, guildID, memberID string, roleIDs []string) (*Usage, error) {
+	limits, err := t.policyEnforcer.Resolve(ctx, guildID, roleIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving role policy: %w", err)
+	}
+
+	now := t.clock.Now().UTC()
+	hourStart := now.Add(-time.Hour)
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	hourlyUsage, err := t.imageGenerationRepo.GetMemberUsage(ctx, guildID, memberID, hourStart)
+	if err != nil {
+		return nil, fmt.Errorf("error getting hourly usage: %w", err)
+	}
+
+	dailyUsage, err := t.imageGenerationRepo.GetMemberUsage(ctx, guildID, memberID, dayStart)
+	if err != nil {
+		return nil, fmt.Errorf("error getting daily usage: %w", err)
+	}
+
+	usage := &Usage{
+		GenerationsLastHour: hourlyUsage.Generations,
+		HourlyResetAt:       now,
+		GPUSecondsToday:     dailyUsage.GPUSeconds,
+		DailyResetAt:        dayStart.AddDate(0, 0, 1),
+	}
+
+	if hourlyUsage.Generations > 0 {
+		usage.HourlyResetAt = hourlyUsage.Oldest.Add(time.Hour)
+	}
+
+	if limits != nil {
+		usage.GenerationsPerHour = limits.GenerationsPerHour
+		usage.DailyGPUSeconds = limits.DailyGPUSeconds
+	}
+
+	return usage, nil
+}
+
+func (t *trackerImpl) Check(ctx context.Context, guildID, memberID string, roleIDs []string, generations int, queued int) error {
+	usage, err := t.Usage(ctx, guildID, memberID, roleIDs)
+	if err != nil {
+		return err
+	}
+
+	if usage.DailyGPUSeconds > 0 && usage.GPUSecondsToday >= float64(usage.DailyGPUSeconds) {
+		return &ExceededError{
+			Reason:  fmt.Sprintf("You used your daily budget of %d GPU seconds.", usage.DailyGPUSeconds),
+			ResetAt: usage.DailyResetAt,
+		}
+	}
+
+	if generations == 0 || usage.GenerationsPerHour == 0 {
+		return nil
+	}
+
+	remaining := usage.GenerationsPerHour - usage.GenerationsLastHour - queued
+
+	if remaining <= 0 {
+		return &ExceededError{
+			Reason:  fmt.Sprintf("You reached the limit of %d invisions per hour.", usage.GenerationsPerHour),
+			ResetAt: usage.HourlyResetAt,
+		}
+	}
+
+	// a labeled grid counts every cell, it only runs when all of them fit
+	if generations > remaining {
+		return &ExceededError{
+			Reason: fmt.Sprintf("This invision makes %d images, but only %d of your %d invisions per hour are left.",
+				generations, remaining, usage.GenerationsPerHour),
+			ResetAt: usage.HourlyResetAt,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+package api_keys
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Repository interface {
+	Create(ctx context.Context, apiKey *entities.APIKey) (*entities.APIKey, error)
+	GetByHash(ctx context.Context, keyHash string) (*entities.APIKey, error)
+	List(ctx context.Context) ([]*entities.APIKey, error)
+	DeleteByName(ctx context.Context, name string) error
+}
@@ -0,0 +1,132 @@
+package api_keys
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/clock"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories"
+)
+
+const apiKeyColumns string = `id, name, guild_id, key_hash, created_at`
+
+const insertAPIKey string = `
+INSERT INTO api_keys (name, guild_id, key_hash, created_at) VALUES (?, ?, ?, ?);
+`
+
+const getAPIKeyByHash string = `
+SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ?;
+`
+
+const listAPIKeys string = `
+SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY name;
+`
+
+const deleteAPIKeyByName string = `
+DELETE FROM api_keys WHERE name = ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+	clock  clock.Clock
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+		clock:  clock.NewClock(),
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Create(ctx context.Context, apiKey *entities.APIKey) (*entities.APIKey, error) {
+	apiKey.CreatedAt = repo.clock.Now()
+
+	res, err := repo.dbConn.ExecContext(ctx, insertAPIKey, apiKey.Name, apiKey.GuildID, apiKey.KeyHash, apiKey.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey.ID = lastID
+
+	return apiKey, nil
+}
+
+func (repo *sqliteRepo) GetByHash(ctx context.Context, keyHash string) (*entities.APIKey, error) {
+	var apiKey entities.APIKey
+
+	err := repo.dbConn.QueryRowContext(ctx, getAPIKeyByHash, keyHash).Scan(
+		&apiKey.ID, &apiKey.Name, &apiKey.GuildID, &apiKey.KeyHash, &apiKey.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repositories.NewNotFoundError("api key")
+		}
+
+		return nil, err
+	}
+
+	return &apiKey, nil
+}
+
+func (repo *sqliteRepo) List(ctx context.Context) ([]*entities.APIKey, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, listAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	apiKeys := make([]*entities.APIKey, 0)
+
+	for rows.Next() {
+		var apiKey entities.APIKey
+
+		err = rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.GuildID, &apiKey.KeyHash, &apiKey.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		apiKeys = append(apiKeys, &apiKey)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+func (repo *sqliteRepo) DeleteByName(ctx context.Context, name string) error {
+	res, err := repo.dbConn.ExecContext(ctx, deleteAPIKeyByName, name)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return repositories.NewNotFoundError(fmt.Sprintf("api key %s", name))
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+package channel_rules
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Repository interface {
+	Upsert(ctx context.Context, rule *entities.ChannelRule) (*entities.ChannelRule, error)
+	GetByGuildID(ctx context.Context, guildID string) ([]*entities.ChannelRule, error)
+	Delete(ctx context.Context, guildID, channelID string) error
+}
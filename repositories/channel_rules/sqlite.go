@@ -0,0 +1,98 @@
+package channel_rules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories"
+)
+
+const upsertRule string = `
+INSERT OR REPLACE INTO channel_rules (guild_id, channel_id, allowed) VALUES (?, ?, ?);
+`
+
+const getRulesByGuildID string = `
+SELECT guild_id, channel_id, allowed FROM channel_rules WHERE guild_id = ? ORDER BY channel_id;
+`
+
+const deleteRule string = `
+DELETE FROM channel_rules WHERE guild_id = ? AND channel_id = ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Upsert(ctx context.Context, rule *entities.ChannelRule) (*entities.ChannelRule, error) {
+	_, err := repo.dbConn.ExecContext(ctx, upsertRule, rule.GuildID, rule.ChannelID, rule.Allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func (repo *sqliteRepo) GetByGuildID(ctx context.Context, guildID string) ([]*entities.ChannelRule, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, getRulesByGuildID, guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	rules := make([]*entities.ChannelRule, 0)
+
+	for rows.Next() {
+		var rule entities.ChannelRule
+
+		err = rows.Scan(&rule.GuildID, &rule.ChannelID, &rule.Allowed)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, &rule)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (repo *sqliteRepo) Delete(ctx context.Context, guildID, channelID string) error {
+	res, err := repo.dbConn.ExecContext(ctx, deleteRule, guildID, channelID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return repositories.NewNotFoundError(fmt.Sprintf("channel rule for channel ID %s", channelID))
+	}
+
+	return nil
+}
@@ -7,5 +7,7 @@ import (
 
 type Repository interface {
 	Upsert(ctx context.Context, setting *entities.DefaultSettings) (*entities.DefaultSettings, error)
-	GetByMemberID(ctx context.Context, memberID string) (*entities.DefaultSettings, error)
+	// GetByGuildAndMemberID returns the settings of a member in a guild. An empty guild ID
+	// refers to the global settings.
+	GetByGuildAndMemberID(ctx context.Context, guildID, memberID string) (*entities.DefaultSettings, error)
 }
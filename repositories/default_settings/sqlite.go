@@ -11,11 +11,11 @@ import (
 )
 
 const upsertSetting string = `
-INSERT OR REPLACE INTO default_settings (member_id, width, height, batch_count, batch_size) VALUES (?, ?, ?, ?, ?);
+INSERT OR REPLACE INTO default_settings (guild_id, member_id, width, height, batch_count, batch_size, negative_prompt, default_steps, max_steps, default_cfg_scale, max_cfg_scale, max_dimension, max_queue_length, max_queued_per_member, nsfw_keywords, nsfw_action, owner_only_buttons, showcase_channel_id, showcase_threshold) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 `
 
-const getSettingByMemberID string = `
-SELECT member_id, width, height, batch_count, batch_size FROM default_settings WHERE member_id = ?;
+const getSettingByGuildAndMemberID string = `
+SELECT guild_id, member_id, width, height, batch_count, batch_size, negative_prompt, default_steps, max_steps, default_cfg_scale, max_cfg_scale, max_dimension, max_queue_length, max_queued_per_member, nsfw_keywords, nsfw_action, owner_only_buttons, showcase_channel_id, showcase_threshold FROM default_settings WHERE guild_id = ? AND member_id = ?;
 `
 
 type sqliteRepo struct {
@@ -42,7 +42,10 @@ func NewRepository(cfg *Config) (Repository, error) {
 
 func (repo *sqliteRepo) Upsert(ctx context.Context, setting *entities.DefaultSettings) (*entities.DefaultSettings, error) {
 	_, err := repo.dbConn.ExecContext(ctx, upsertSetting,
-		setting.MemberID, setting.Width, setting.Height, setting.BatchCount, setting.BatchSize)
+		setting.GuildID, setting.MemberID, setting.Width, setting.Height, setting.BatchCount, setting.BatchSize,
+		setting.NegativePrompt, setting.DefaultSteps, setting.MaxSteps, setting.DefaultCFGScale, setting.MaxCFGScale,
+		setting.MaxDimension, setting.MaxQueueLength, setting.MaxQueuedPerMember, setting.NSFWKeywords, setting.NSFWAction, setting.OwnerOnlyButtons,
+		setting.ShowcaseChannelID, setting.ShowcaseThreshold)
 	if err != nil {
 		return nil, err
 	}
@@ -50,15 +53,18 @@ func (repo *sqliteRepo) Upsert(ctx context.Context, setting *entities.DefaultSet
 	return setting, nil
 }
 
-func (repo *sqliteRepo) GetByMemberID(ctx context.Context, memberID string) (*entities.DefaultSettings, error) {
+func (repo *sqliteRepo) GetByGuildAndMemberID(ctx context.Context, guildID, memberID string) (*entities.DefaultSettings, error) {
 	var setting entities.DefaultSettings
 
-	err := repo.dbConn.QueryRowContext(ctx, getSettingByMemberID, memberID).Scan(
-		&setting.MemberID, &setting.Width, &setting.Height, &setting.BatchCount, &setting.BatchSize)
+	err := repo.dbConn.QueryRowContext(ctx, getSettingByGuildAndMemberID, guildID, memberID).Scan(
+		&setting.GuildID, &setting.MemberID, &setting.Width, &setting.Height, &setting.BatchCount, &setting.BatchSize,
+		&setting.NegativePrompt, &setting.DefaultSteps, &setting.MaxSteps, &setting.DefaultCFGScale, &setting.MaxCFGScale,
+		&setting.MaxDimension, &setting.MaxQueueLength, &setting.MaxQueuedPerMember, &setting.NSFWKeywords, &setting.NSFWAction, &setting.OwnerOnlyButtons,
+		&setting.ShowcaseChannelID, &setting.ShowcaseThreshold)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, repositories.NewNotFoundError(fmt.Sprintf("default setting for member ID %s", memberID))
+			return nil, repositories.NewNotFoundError(fmt.Sprintf("default setting for guild ID %q and member ID %s", guildID, memberID))
 		}
 
 		return nil, err
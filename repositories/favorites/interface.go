@@ -0,0 +1,22 @@
+package favorites
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Repository interface {
+	// Add favorites an image generation for a member. It reports false when the member had
+	// already favorited it.
+	Add(ctx context.Context, favorite *entities.Favorite) (bool, error)
+	Remove(ctx context.Context, generationID int64, memberID string) error
+	Count(ctx context.Context, generationID int64) (int, error)
+	// ListTop returns the favorited generations of a guild that weren't deleted, most favorited first.
+	ListTop(ctx context.Context, guildID string, limit, offset int) ([]*entities.FavoriteCount, error)
+	// ListRecent returns the favorited generations of a guild that weren't deleted, most recently
+	// favorited first.
+	ListRecent(ctx context.Context, guildID string, limit, offset int) ([]*entities.FavoriteCount, error)
+	// ClaimShowcase records that a generation was reposted to the showcase channel of its guild.
+	// It reports false when it already was, so every image is only reposted once.
+	ClaimShowcase(ctx context.Context, generationID int64, guildID string) (bool, error)
+}
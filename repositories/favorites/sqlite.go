@@ -0,0 +1,157 @@
+package favorites
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/clock"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories"
+)
+
+const addFavorite string = `
+INSERT OR IGNORE INTO favorites (generation_id, guild_id, member_id, created_at) VALUES (?, ?, ?, ?);
+`
+
+const removeFavorite string = `
+DELETE FROM favorites WHERE generation_id = ? AND member_id = ?;
+`
+
+const countFavorites string = `
+SELECT COUNT(*) FROM favorites WHERE generation_id = ?;
+`
+
+const listFavorites string = `
+SELECT f.generation_id, COUNT(*) AS favorite_count FROM favorites f
+JOIN image_generations g ON g.id = f.generation_id
+WHERE f.guild_id = ? AND NOT g.deleted
+GROUP BY f.generation_id
+`
+
+const listTopFavorites string = listFavorites + `ORDER BY favorite_count DESC, MAX(f.created_at) DESC LIMIT ? OFFSET ?;`
+
+const listRecentFavorites string = listFavorites + `ORDER BY MAX(f.created_at) DESC LIMIT ? OFFSET ?;`
+
+const claimShowcase string = `
+INSERT OR IGNORE INTO showcased_generations (generation_id, guild_id, created_at) VALUES (?, ?, ?);
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+	clock  clock.Clock
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+		clock:  clock.NewClock(),
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Add(ctx context.Context, favorite *entities.Favorite) (bool, error) {
+	favorite.CreatedAt = repo.clock.Now()
+
+	res, err := repo.dbConn.ExecContext(ctx, addFavorite,
+		favorite.GenerationID, favorite.GuildID, favorite.MemberID, favorite.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (repo *sqliteRepo) Remove(ctx context.Context, generationID int64, memberID string) error {
+	res, err := repo.dbConn.ExecContext(ctx, removeFavorite, generationID, memberID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return repositories.NewNotFoundError(fmt.Sprintf("favorite of generation %d", generationID))
+	}
+
+	return nil
+}
+
+func (repo *sqliteRepo) Count(ctx context.Context, generationID int64) (int, error) {
+	var count int
+
+	err := repo.dbConn.QueryRowContext(ctx, countFavorites, generationID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (repo *sqliteRepo) ListTop(ctx context.Context, guildID string, limit, offset int) ([]*entities.FavoriteCount, error) {
+	return repo.list(ctx, listTopFavorites, guildID, limit, offset)
+}
+
+func (repo *sqliteRepo) ListRecent(ctx context.Context, guildID string, limit, offset int) ([]*entities.FavoriteCount, error) {
+	return repo.list(ctx, listRecentFavorites, guildID, limit, offset)
+}
+
+func (repo *sqliteRepo) list(ctx context.Context, query, guildID string, limit, offset int) ([]*entities.FavoriteCount, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, query, guildID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := make([]*entities.FavoriteCount, 0)
+
+	for rows.Next() {
+		var count entities.FavoriteCount
+
+		err = rows.Scan(&count.GenerationID, &count.Favorites)
+		if err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, &count)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (repo *sqliteRepo) ClaimShowcase(ctx context.Context, generationID int64, guildID string) (bool, error) {
+	res, err := repo.dbConn.ExecContext(ctx, claimShowcase, generationID, guildID, repo.clock.Now())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
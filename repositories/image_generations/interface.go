@@ -3,10 +3,32 @@ package image_generations
 import (
 	"context"
 	"kinshi_vision_bot/entities"
+	"time"
 )
 
 type Repository interface {
 	Create(ctx context.Context, generation *entities.ImageGeneration) (*entities.ImageGeneration, error)
+	GetByID(ctx context.Context, id int64) (*entities.ImageGeneration, error)
 	GetByMessage(ctx context.Context, messageID string) (*entities.ImageGeneration, error)
 	GetByMessageAndSort(ctx context.Context, messageID string, sortOrder int) (*entities.ImageGeneration, error)
+	// ListByMessage returns every generation of a message by sort order: the grid first, then its images.
+	ListByMessage(ctx context.Context, messageID string) ([]*entities.ImageGeneration, error)
+	// ListByMember returns the grid generations (sort order 0) of a member in a guild created within
+	// [from, to), newest first. A zero to means "until now".
+	ListByMember(ctx context.Context, guildID, memberID string, from, to time.Time, limit, offset int) ([]*entities.ImageGeneration, error)
+	// Search does a full-text search for grid generations of a guild created after from whose prompt
+	// contains every term of query. includeNegative also searches the negative prompt.
+	Search(ctx context.Context, guildID, query string, includeNegative bool, from time.Time, limit, offset int) ([]*entities.ImageGeneration, error)
+	// ListRecent returns the newest grid generations of every guild.
+	ListRecent(ctx context.Context, limit int) ([]*entities.ImageGeneration, error)
+	// ListMemberStats sums up the grid generations created since the given time per member and
+	// guild, busiest members first. Deleted generations are included, as they were generated.
+	ListMemberStats(ctx context.Context, since time.Time, limit int) ([]*entities.MemberStats, error)
+	UpdateGPUSeconds(ctx context.Context, id int64, gpuSeconds float64) error
+	// MarkDeletedByMessage flags every generation of a message as deleted. Deleted generations stay
+	// in the usage of a member, but are left out of the history and search.
+	MarkDeletedByMessage(ctx context.Context, messageID string) error
+	// GetMemberUsage counts the generations of the grids of a member in a guild created since the given
+	// time, and sums up the GPU seconds of every row, which includes upscales.
+	GetMemberUsage(ctx context.Context, guildID, memberID string, since time.Time) (*entities.MemberUsage, error)
 }
@@ -4,20 +4,87 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"kinshi_vision_bot/clock"
 	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories"
+	"strings"
+	"time"
 )
 
+const generationColumns string = `id, interaction_id, message_id, channel_id, guild_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hr_scale, hr_upscaler, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, nsfw, gpu_seconds, styles, variation_strength, upscaler, source_id, generations, deleted, created_at`
+
 const insertGenerationQuery string = `
-INSERT INTO image_generations (interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hr_scale, hr_upscaler, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+INSERT INTO image_generations (interaction_id, message_id, channel_id, guild_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hr_scale, hr_upscaler, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, nsfw, gpu_seconds, styles, variation_strength, upscaler, source_id, generations, deleted, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+const getGenerationByID string = `
+SELECT ` + generationColumns + ` FROM image_generations WHERE id = ?;
 `
 
 const getGenerationByMessageID string = `
-SELECT id, interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hr_scale, hr_upscaler, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, created_at FROM image_generations WHERE message_id = ?;
+SELECT ` + generationColumns + ` FROM image_generations WHERE message_id = ?;
+`
+
+const listGenerationsByMessageID string = `
+SELECT ` + generationColumns + ` FROM image_generations WHERE message_id = ? ORDER BY sort_order;
 `
 
 const getGenerationByMessageIDAndSortOrder string = `
-SELECT id, interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hr_scale, hr_upscaler, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, created_at FROM image_generations WHERE message_id = ? AND sort_order = ?;
+SELECT ` + generationColumns + ` FROM image_generations WHERE message_id = ? AND sort_order = ?;
+`
+
+// created_at is stored in the driver's text format, which sorts chronologically
+// as long as every timestamp uses the same location.
+// Generations from before multi-guild support have no guild and are visible in every guild.
+const listGenerationsByMember string = `
+SELECT ` + generationColumns + ` FROM image_generations
+WHERE (guild_id = ? OR guild_id = '') AND member_id = ? AND sort_order = 0 AND NOT deleted AND created_at >= ? AND created_at < ?
+ORDER BY created_at DESC, id DESC
+LIMIT ? OFFSET ?;
+`
+
+const searchGenerations string = `
+SELECT ` + generationColumns + ` FROM image_generations
+WHERE id IN (SELECT rowid FROM image_generations_fts WHERE image_generations_fts MATCH ?)
+AND (guild_id = ? OR guild_id = '') AND sort_order = 0 AND NOT deleted AND created_at >= ?
+ORDER BY created_at DESC, id DESC
+LIMIT ? OFFSET ?;
+`
+
+const listRecentGenerations string = `
+SELECT ` + generationColumns + ` FROM image_generations
+WHERE sort_order = 0 AND NOT deleted
+ORDER BY created_at DESC, id DESC
+LIMIT ?;
+`
+
+const listMemberStatsSince string = `
+SELECT guild_id, member_id, COUNT(*), COALESCE(SUM(gpu_seconds), 0) FROM image_generations
+WHERE sort_order = 0 AND created_at >= ?
+GROUP BY guild_id, member_id
+ORDER BY COUNT(*) DESC, SUM(gpu_seconds) DESC
+LIMIT ?;
+`
+
+const markGenerationsDeletedByMessageID string = `
+UPDATE image_generations SET deleted = 1 WHERE message_id = ?;
+`
+
+const updateGenerationGPUSeconds string = `
+UPDATE image_generations SET gpu_seconds = ? WHERE id = ?;
+`
+
+const getMemberUsageSince string = `
+SELECT COALESCE(SUM(CASE WHEN sort_order = 0 AND upscaler = '' THEN generations END), 0), COALESCE(SUM(gpu_seconds), 0) FROM image_generations
+WHERE (guild_id = ? OR guild_id = '') AND member_id = ? AND created_at >= ?;
+`
+
+const getOldestMemberGenerationSince string = `
+SELECT created_at FROM image_generations
+WHERE (guild_id = ? OR guild_id = '') AND member_id = ? AND sort_order = 0 AND upscaler = '' AND created_at >= ?
+ORDER BY created_at ASC
+LIMIT 1;
 `
 
 type sqliteRepo struct {
@@ -42,15 +109,57 @@ func NewRepository(cfg *Config) (Repository, error) {
 	return newRepo, nil
 }
 
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanGeneration(row rowScanner) (*entities.ImageGeneration, error) {
+	var generation entities.ImageGeneration
+
+	err := row.Scan(
+		&generation.ID, &generation.InteractionID, &generation.MessageID, &generation.ChannelID, &generation.GuildID, &generation.MemberID, &generation.SortOrder, &generation.Prompt,
+		&generation.NegativePrompt, &generation.Width, &generation.Height, &generation.RestoreFaces,
+		&generation.EnableHR, &generation.HRUpscaleRate, &generation.HRUpscaler, &generation.HiresWidth, &generation.HiresHeight, &generation.DenoisingStrength,
+		&generation.BatchCount, &generation.BatchSize, &generation.Seed, &generation.Subseed,
+		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps, &generation.Processed, &generation.NSFW, &generation.GPUSeconds, &generation.Styles, &generation.VariationStrength, &generation.Upscaler, &generation.SourceID, &generation.Generations, &generation.Deleted, &generation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &generation, nil
+}
+
+func scanGenerations(rows *sql.Rows) ([]*entities.ImageGeneration, error) {
+	defer rows.Close()
+
+	generations := make([]*entities.ImageGeneration, 0)
+
+	for rows.Next() {
+		generation, err := scanGeneration(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		generations = append(generations, generation)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return generations, nil
+}
+
 func (repo *sqliteRepo) Create(ctx context.Context, generation *entities.ImageGeneration) (*entities.ImageGeneration, error) {
 	generation.CreatedAt = repo.clock.Now()
 
 	res, err := repo.dbConn.ExecContext(ctx, insertGenerationQuery,
-		generation.InteractionID, generation.MessageID, generation.MemberID, generation.SortOrder, generation.Prompt,
+		generation.InteractionID, generation.MessageID, generation.ChannelID, generation.GuildID, generation.MemberID, generation.SortOrder, generation.Prompt,
 		generation.NegativePrompt, generation.Width, generation.Height, generation.RestoreFaces,
 		generation.EnableHR, generation.HRUpscaleRate, generation.HRUpscaler, generation.HiresWidth, generation.HiresHeight, generation.DenoisingStrength,
 		generation.BatchCount, generation.BatchSize, generation.Seed, generation.Subseed,
-		generation.SubseedStrength, generation.SamplerName, generation.CfgScale, generation.Steps, generation.Processed, generation.CreatedAt)
+		generation.SubseedStrength, generation.SamplerName, generation.CfgScale, generation.Steps, generation.Processed, generation.NSFW, generation.GPUSeconds, generation.Styles, generation.VariationStrength, generation.Upscaler, generation.SourceID, max(generation.Generations, 1), generation.Deleted, generation.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -65,34 +174,164 @@ func (repo *sqliteRepo) Create(ctx context.Context, generation *entities.ImageGe
 	return generation, nil
 }
 
+func (repo *sqliteRepo) GetByID(ctx context.Context, id int64) (*entities.ImageGeneration, error) {
+	generation, err := scanGeneration(repo.dbConn.QueryRowContext(ctx, getGenerationByID, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repositories.NewNotFoundError(fmt.Sprintf("image generation %d", id))
+		}
+
+		return nil, err
+	}
+
+	return generation, nil
+}
+
 func (repo *sqliteRepo) GetByMessage(ctx context.Context, messageID string) (*entities.ImageGeneration, error) {
-	var generation entities.ImageGeneration
+	return scanGeneration(repo.dbConn.QueryRowContext(ctx, getGenerationByMessageID, messageID))
+}
 
-	err := repo.dbConn.QueryRowContext(ctx, getGenerationByMessageID, messageID).Scan(
-		&generation.ID, &generation.InteractionID, &generation.MessageID, &generation.MemberID, &generation.SortOrder, &generation.Prompt,
-		&generation.NegativePrompt, &generation.Width, &generation.Height, &generation.RestoreFaces,
-		&generation.EnableHR, &generation.HRUpscaleRate, &generation.HRUpscaler, &generation.HiresWidth, &generation.HiresHeight, &generation.DenoisingStrength,
-		&generation.BatchCount, &generation.BatchSize, &generation.Seed, &generation.Subseed,
-		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps, &generation.Processed, &generation.CreatedAt)
+func (repo *sqliteRepo) GetByMessageAndSort(ctx context.Context, messageID string, sortOrder int) (*entities.ImageGeneration, error) {
+	return scanGeneration(repo.dbConn.QueryRowContext(ctx, getGenerationByMessageIDAndSortOrder, messageID, sortOrder))
+}
+
+func (repo *sqliteRepo) ListByMessage(ctx context.Context, messageID string) ([]*entities.ImageGeneration, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, listGenerationsByMessageID, messageID)
 	if err != nil {
 		return nil, err
 	}
 
-	return &generation, nil
+	return scanGenerations(rows)
 }
 
-func (repo *sqliteRepo) GetByMessageAndSort(ctx context.Context, messageID string, sortOrder int) (*entities.ImageGeneration, error) {
-	var generation entities.ImageGeneration
+func (repo *sqliteRepo) ListByMember(ctx context.Context, guildID, memberID string, from, to time.Time, limit, offset int) ([]*entities.ImageGeneration, error) {
+	if to.IsZero() {
+		to = repo.clock.Now().Add(time.Minute)
+	}
 
-	err := repo.dbConn.QueryRowContext(ctx, getGenerationByMessageIDAndSortOrder, messageID, sortOrder).Scan(
-		&generation.ID, &generation.InteractionID, &generation.MessageID, &generation.MemberID, &generation.SortOrder, &generation.Prompt,
-		&generation.NegativePrompt, &generation.Width, &generation.Height, &generation.RestoreFaces,
-		&generation.EnableHR, &generation.HRUpscaleRate, &generation.HRUpscaler, &generation.HiresWidth, &generation.HiresHeight, &generation.DenoisingStrength,
-		&generation.BatchCount, &generation.BatchSize, &generation.Seed, &generation.Subseed,
-		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps, &generation.Processed, &generation.CreatedAt)
+	rows, err := repo.dbConn.QueryContext(ctx, listGenerationsByMember, guildID, memberID, from.Local(), to.Local(), limit, offset)
 	if err != nil {
 		return nil, err
 	}
 
-	return &generation, nil
+	return scanGenerations(rows)
+}
+
+func (repo *sqliteRepo) ListRecent(ctx context.Context, limit int) ([]*entities.ImageGeneration, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, listRecentGenerations, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanGenerations(rows)
+}
+
+func (repo *sqliteRepo) ListMemberStats(ctx context.Context, since time.Time, limit int) ([]*entities.MemberStats, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, listMemberStatsSince, since.Local(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stats := make([]*entities.MemberStats, 0)
+
+	for rows.Next() {
+		var memberStats entities.MemberStats
+
+		err = rows.Scan(&memberStats.GuildID, &memberStats.MemberID, &memberStats.Generations, &memberStats.GPUSeconds)
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, &memberStats)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (repo *sqliteRepo) Search(ctx context.Context, guildID, query string, includeNegative bool, from time.Time, limit, offset int) ([]*entities.ImageGeneration, error) {
+	matchExpression, err := searchMatchExpression(query, includeNegative)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := repo.dbConn.QueryContext(ctx, searchGenerations, matchExpression, guildID, from.Local(), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanGenerations(rows)
+}
+
+func (repo *sqliteRepo) UpdateGPUSeconds(ctx context.Context, id int64, gpuSeconds float64) error {
+	_, err := repo.dbConn.ExecContext(ctx, updateGenerationGPUSeconds, gpuSeconds, id)
+
+	return err
+}
+
+func (repo *sqliteRepo) MarkDeletedByMessage(ctx context.Context, messageID string) error {
+	_, err := repo.dbConn.ExecContext(ctx, markGenerationsDeletedByMessageID, messageID)
+
+	return err
+}
+
+func (repo *sqliteRepo) GetMemberUsage(ctx context.Context, guildID, memberID string, since time.Time) (*entities.MemberUsage, error) {
+	usage := &entities.MemberUsage{}
+
+	err := repo.dbConn.QueryRowContext(ctx, getMemberUsageSince, guildID, memberID, since.Local()).Scan(&usage.Generations, &usage.GPUSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	if usage.Generations == 0 {
+		return usage, nil
+	}
+
+	err = repo.dbConn.QueryRowContext(ctx, getOldestMemberGenerationSince, guildID, memberID, since.Local()).Scan(&usage.Oldest)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// searchMatchExpression turns free text into an FTS5 query that matches rows containing
+// every term. Terms are quoted so that user input can't break the query syntax; a
+// trailing "*" is kept to allow prefix searches.
+func searchMatchExpression(query string, includeNegative bool) (string, error) {
+	terms := make([]string, 0)
+
+	for _, field := range strings.Fields(query) {
+		prefix := strings.HasSuffix(field, "*")
+
+		field = strings.Trim(field, "*")
+		if field == "" {
+			continue
+		}
+
+		term := `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 0 {
+		return "", errors.New("empty search query")
+	}
+
+	expression := strings.Join(terms, " ")
+
+	if includeNegative {
+		return expression, nil
+	}
+
+	return "prompt : (" + expression + ")", nil
 }
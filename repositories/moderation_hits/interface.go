@@ -0,0 +1,12 @@
+package moderation_hits
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Repository interface {
+	Create(ctx context.Context, hit *entities.ModerationHit) (*entities.ModerationHit, error)
+	// ListRecent returns the latest hits of a guild, newest first.
+	ListRecent(ctx context.Context, guildID string, limit int) ([]*entities.ModerationHit, error)
+}
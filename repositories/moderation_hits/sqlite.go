@@ -0,0 +1,90 @@
+package moderation_hits
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"kinshi_vision_bot/clock"
+	"kinshi_vision_bot/entities"
+)
+
+const insertHitQuery string = `
+INSERT INTO moderation_hits (guild_id, member_id, rule_id, pattern, action, prompt, created_at) VALUES (?, ?, ?, ?, ?, ?, ?);
+`
+
+const listRecentHits string = `
+SELECT id, guild_id, member_id, rule_id, pattern, action, prompt, created_at FROM moderation_hits
+WHERE guild_id = ?
+ORDER BY id DESC
+LIMIT ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+	clock  clock.Clock
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+		clock:  clock.NewClock(),
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Create(ctx context.Context, hit *entities.ModerationHit) (*entities.ModerationHit, error) {
+	hit.CreatedAt = repo.clock.Now()
+
+	res, err := repo.dbConn.ExecContext(ctx, insertHitQuery,
+		hit.GuildID, hit.MemberID, hit.RuleID, hit.Pattern, hit.Action, hit.Prompt, hit.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	hit.ID = lastID
+
+	return hit, nil
+}
+
+func (repo *sqliteRepo) ListRecent(ctx context.Context, guildID string, limit int) ([]*entities.ModerationHit, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, listRecentHits, guildID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	hits := make([]*entities.ModerationHit, 0)
+
+	for rows.Next() {
+		var hit entities.ModerationHit
+
+		err = rows.Scan(&hit.ID, &hit.GuildID, &hit.MemberID, &hit.RuleID, &hit.Pattern, &hit.Action, &hit.Prompt, &hit.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		hits = append(hits, &hit)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
@@ -0,0 +1,12 @@
+package moderation_rules
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Repository interface {
+	Create(ctx context.Context, rule *entities.ModerationRule) (*entities.ModerationRule, error)
+	GetByGuildID(ctx context.Context, guildID string) ([]*entities.ModerationRule, error)
+	Delete(ctx context.Context, guildID string, id int64) error
+}
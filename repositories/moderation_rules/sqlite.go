@@ -0,0 +1,111 @@
+package moderation_rules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/clock"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories"
+)
+
+const insertRuleQuery string = `
+INSERT INTO moderation_rules (guild_id, pattern, is_regex, action, replacement, created_at) VALUES (?, ?, ?, ?, ?, ?);
+`
+
+const getRulesByGuildID string = `
+SELECT id, guild_id, pattern, is_regex, action, replacement, created_at FROM moderation_rules WHERE guild_id = ? ORDER BY id;
+`
+
+const deleteRule string = `
+DELETE FROM moderation_rules WHERE guild_id = ? AND id = ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+	clock  clock.Clock
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+		clock:  clock.NewClock(),
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Create(ctx context.Context, rule *entities.ModerationRule) (*entities.ModerationRule, error) {
+	rule.CreatedAt = repo.clock.Now()
+
+	res, err := repo.dbConn.ExecContext(ctx, insertRuleQuery,
+		rule.GuildID, rule.Pattern, rule.IsRegex, rule.Action, rule.Replacement, rule.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	rule.ID = lastID
+
+	return rule, nil
+}
+
+func (repo *sqliteRepo) GetByGuildID(ctx context.Context, guildID string) ([]*entities.ModerationRule, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, getRulesByGuildID, guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	rules := make([]*entities.ModerationRule, 0)
+
+	for rows.Next() {
+		var rule entities.ModerationRule
+
+		err = rows.Scan(&rule.ID, &rule.GuildID, &rule.Pattern, &rule.IsRegex, &rule.Action, &rule.Replacement, &rule.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, &rule)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (repo *sqliteRepo) Delete(ctx context.Context, guildID string, id int64) error {
+	res, err := repo.dbConn.ExecContext(ctx, deleteRule, guildID, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return repositories.NewNotFoundError(fmt.Sprintf("moderation rule %d", id))
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package role_policies
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Repository interface {
+	Upsert(ctx context.Context, policy *entities.RolePolicy) (*entities.RolePolicy, error)
+	GetByRoleID(ctx context.Context, roleID string) (*entities.RolePolicy, error)
+	GetByRoleIDs(ctx context.Context, roleIDs []string) ([]*entities.RolePolicy, error)
+	GetByGuildID(ctx context.Context, guildID string) ([]*entities.RolePolicy, error)
+	Delete(ctx context.Context, roleID string) error
+}
@@ -0,0 +1,152 @@
+package role_policies
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories"
+	"strings"
+)
+
+const upsertPolicy string = `
+INSERT OR REPLACE INTO role_policies (role_id, guild_id, max_pixels, max_steps, allow_hires, allow_upscale, max_batch, generations_per_hour, daily_gpu_seconds) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+const getPolicyByRoleID string = `
+SELECT role_id, guild_id, max_pixels, max_steps, allow_hires, allow_upscale, max_batch, generations_per_hour, daily_gpu_seconds FROM role_policies WHERE role_id = ?;
+`
+
+// Policies from before multi-guild support have no guild and are listed in every guild.
+const getPoliciesByGuildID string = `
+SELECT role_id, guild_id, max_pixels, max_steps, allow_hires, allow_upscale, max_batch, generations_per_hour, daily_gpu_seconds FROM role_policies WHERE guild_id = ? OR guild_id = '' ORDER BY role_id;
+`
+
+const deletePolicy string = `
+DELETE FROM role_policies WHERE role_id = ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+	}
+
+	return newRepo, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPolicy(row rowScanner) (*entities.RolePolicy, error) {
+	var policy entities.RolePolicy
+
+	err := row.Scan(&policy.RoleID, &policy.GuildID, &policy.MaxPixels, &policy.MaxSteps, &policy.AllowHires, &policy.AllowUpscale, &policy.MaxBatch, &policy.GenerationsPerHour, &policy.DailyGPUSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+func (repo *sqliteRepo) queryPolicies(ctx context.Context, query string, args ...any) ([]*entities.RolePolicy, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	policies := make([]*entities.RolePolicy, 0)
+
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, policy)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+func (repo *sqliteRepo) Upsert(ctx context.Context, policy *entities.RolePolicy) (*entities.RolePolicy, error) {
+	_, err := repo.dbConn.ExecContext(ctx, upsertPolicy,
+		policy.RoleID, policy.GuildID, policy.MaxPixels, policy.MaxSteps, policy.AllowHires, policy.AllowUpscale, policy.MaxBatch, policy.GenerationsPerHour, policy.DailyGPUSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func (repo *sqliteRepo) GetByRoleID(ctx context.Context, roleID string) (*entities.RolePolicy, error) {
+	policy, err := scanPolicy(repo.dbConn.QueryRowContext(ctx, getPolicyByRoleID, roleID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repositories.NewNotFoundError(fmt.Sprintf("role policy for role ID %s", roleID))
+		}
+
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func (repo *sqliteRepo) GetByRoleIDs(ctx context.Context, roleIDs []string) ([]*entities.RolePolicy, error) {
+	if len(roleIDs) == 0 {
+		return []*entities.RolePolicy{}, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(roleIDs)), ", ")
+
+	args := make([]any, len(roleIDs))
+	for idx, roleID := range roleIDs {
+		args[idx] = roleID
+	}
+
+	query := `SELECT role_id, guild_id, max_pixels, max_steps, allow_hires, allow_upscale, max_batch, generations_per_hour, daily_gpu_seconds FROM role_policies WHERE role_id IN (` + placeholders + `);`
+
+	return repo.queryPolicies(ctx, query, args...)
+}
+
+func (repo *sqliteRepo) GetByGuildID(ctx context.Context, guildID string) ([]*entities.RolePolicy, error) {
+	return repo.queryPolicies(ctx, getPoliciesByGuildID, guildID)
+}
+
+func (repo *sqliteRepo) Delete(ctx context.Context, roleID string) error {
+	res, err := repo.dbConn.ExecContext(ctx, deletePolicy, roleID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return repositories.NewNotFoundError(fmt.Sprintf("role policy for role ID %s", roleID))
+	}
+
+	return nil
+}
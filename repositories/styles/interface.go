@@ -0,0 +1,15 @@
+package styles
+
+import (
+	"context"
+	"kinshi_vision_bot/entities"
+)
+
+type Repository interface {
+	Upsert(ctx context.Context, style *entities.Style) (*entities.Style, error)
+	// GetByName returns the personal style of a member with that name, or else the shared style of the guild.
+	GetByName(ctx context.Context, guildID, memberID, name string) (*entities.Style, error)
+	// ListAvailable returns the personal styles of a member and the shared styles of the guild, by name.
+	ListAvailable(ctx context.Context, guildID, memberID string) ([]*entities.Style, error)
+	Delete(ctx context.Context, guildID, memberID, name string) error
+}
@@ -0,0 +1,130 @@
+package styles
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/clock"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/repositories"
+)
+
+const styleColumns string = `guild_id, member_id, name, prompt, negative_prompt, created_at`
+
+const upsertStyle string = `
+INSERT OR REPLACE INTO styles (` + styleColumns + `) VALUES (?, ?, ?, ?, ?, ?);
+`
+
+const getStyleByName string = `
+SELECT ` + styleColumns + ` FROM styles
+WHERE guild_id = ? AND member_id IN (?, '') AND name = ?
+ORDER BY member_id = '' LIMIT 1;
+`
+
+const listAvailableStyles string = `
+SELECT ` + styleColumns + ` FROM styles
+WHERE guild_id = ? AND member_id IN (?, '')
+ORDER BY name, member_id = '';
+`
+
+const deleteStyle string = `
+DELETE FROM styles WHERE guild_id = ? AND member_id = ? AND name = ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+	clock  clock.Clock
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+		clock:  clock.NewClock(),
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Upsert(ctx context.Context, style *entities.Style) (*entities.Style, error) {
+	style.CreatedAt = repo.clock.Now()
+
+	_, err := repo.dbConn.ExecContext(ctx, upsertStyle,
+		style.GuildID, style.MemberID, style.Name, style.Prompt, style.NegativePrompt, style.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return style, nil
+}
+
+func (repo *sqliteRepo) GetByName(ctx context.Context, guildID, memberID, name string) (*entities.Style, error) {
+	var style entities.Style
+
+	err := repo.dbConn.QueryRowContext(ctx, getStyleByName, guildID, memberID, name).Scan(
+		&style.GuildID, &style.MemberID, &style.Name, &style.Prompt, &style.NegativePrompt, &style.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repositories.NewNotFoundError(fmt.Sprintf("style %s", name))
+		}
+
+		return nil, err
+	}
+
+	return &style, nil
+}
+
+func (repo *sqliteRepo) ListAvailable(ctx context.Context, guildID, memberID string) ([]*entities.Style, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, listAvailableStyles, guildID, memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	styles := make([]*entities.Style, 0)
+
+	for rows.Next() {
+		var style entities.Style
+
+		err = rows.Scan(&style.GuildID, &style.MemberID, &style.Name, &style.Prompt, &style.NegativePrompt, &style.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		styles = append(styles, &style)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return styles, nil
+}
+
+func (repo *sqliteRepo) Delete(ctx context.Context, guildID, memberID, name string) error {
+	res, err := repo.dbConn.ExecContext(ctx, deleteStyle, guildID, memberID, name)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return repositories.NewNotFoundError(fmt.Sprintf("style %s", name))
+	}
+
+	return nil
+}
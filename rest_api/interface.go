@@ -0,0 +1,9 @@
+package rest_api
+
+import "context"
+
+type API interface {
+	// Start serves the API in the background. It fails when the address can't be listened on.
+	Start() error
+	Shutdown(ctx context.Context) error
+}
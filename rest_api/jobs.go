@@ -0,0 +1,120 @@
+package rest_api
+
+import (
+	"context"
+	"kinshi_vision_bot/invision_queue"
+	"sync"
+	"time"
+)
+
+const (
+	jobStatusQueued   = "queued"
+	jobStatusRunning  = "running"
+	jobStatusFinished = "finished"
+	jobStatusFailed   = "failed"
+)
+
+// job follows an invision of the API through the queue. It is the notifier of its queue item.
+type job struct {
+	id string
+	// keyID is the API key that submitted the job, only that key can see it.
+	keyID int64
+
+	mu         sync.Mutex
+	status     string
+	progress   float64
+	message    string
+	result     *invision_queue.Result
+	finishedAt time.Time
+}
+
+// Progress marks the job as running. The jobs have no messages, so no message ID is returned.
+func (j *job) Progress(ctx context.Context, progress *invision_queue.Progress) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status = jobStatusRunning
+	j.progress = progress.Fraction
+
+	return "", nil
+}
+
+func (j *job) Deliver(ctx context.Context, result *invision_queue.Result) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status = jobStatusFinished
+	j.progress = 1
+	j.result = result
+	j.finishedAt = time.Now()
+
+	return "", nil
+}
+
+func (j *job) Fail(ctx context.Context, message string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status = jobStatusFailed
+	j.message = message
+	j.finishedAt = time.Now()
+
+	return nil
+}
+
+// expired reports whether the job finished longer than the retention ago.
+func (j *job) expired(now time.Time, retention time.Duration) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return !j.finishedAt.IsZero() && now.Sub(j.finishedAt) > retention
+}
+
+// jobStore keeps the jobs of the API in memory, finished jobs are kept until they expire.
+type jobStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	retention time.Duration
+}
+
+func newJobStore(retention time.Duration) *jobStore {
+	return &jobStore{
+		jobs:      make(map[string]*job),
+		retention: retention,
+	}
+}
+
+func (s *jobStore) add(newJob *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for jobID, storedJob := range s.jobs {
+		if storedJob.expired(now, s.retention) {
+			delete(s.jobs, jobID)
+		}
+	}
+
+	s.jobs[newJob.id] = newJob
+}
+
+func (s *jobStore) remove(jobID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, jobID)
+}
+
+// get returns a job of an API key, nil when the key has no such job or it expired.
+func (s *jobStore) get(jobID string, keyID int64) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	storedJob, ok := s.jobs[jobID]
+	if !ok || storedJob.keyID != keyID || storedJob.expired(time.Now(), s.retention) {
+		return nil
+	}
+
+	return storedJob
+}
@@ -0,0 +1,30 @@
+package rest_api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const keyPrefix = "kvb_"
+
+// NewKey returns a new random API key and the hash to store for it.
+func NewKey() (string, string, error) {
+	secret := make([]byte, 24)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := keyPrefix + hex.EncodeToString(secret)
+
+	return key, HashKey(key), nil
+}
+
+// HashKey returns the hash under which an API key is stored.
+func HashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(hash[:])
+}
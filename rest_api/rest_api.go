@@ -0,0 +1,473 @@
+package rest_api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/logging"
+	"kinshi_vision_bot/moderation"
+	"kinshi_vision_bot/policy"
+	"kinshi_vision_bot/quota"
+	"kinshi_vision_bot/repositories"
+	"kinshi_vision_bot/repositories/api_keys"
+	"kinshi_vision_bot/repositories/styles"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// jobRetention is how long the images of a finished job can be downloaded.
+	jobRetention = time.Hour
+
+	// memberPrefix marks the jobs of an API key as those of a member named after the key, for the
+	// queue limits, quotas and the stored generations.
+	memberPrefix = "api:"
+
+	defaultSampler = "DPM++ 2M"
+
+	maxRequestSize = 64 * 1024
+)
+
+type apiImpl struct {
+	addr          string
+	apiKeyRepo    api_keys.Repository
+	invisionQueue invision_queue.Queue
+	moderator     moderation.Moderator
+	quotaTracker  quota.Tracker
+	styleRepo     styles.Repository
+	jobs          *jobStore
+	server        *http.Server
+	logger        *slog.Logger
+}
+
+type Config struct {
+	// Addr is the address to listen on, like "127.0.0.1:8081".
+	Addr          string
+	APIKeyRepo    api_keys.Repository
+	InvisionQueue invision_queue.Queue
+	Moderator     moderation.Moderator
+	QuotaTracker  quota.Tracker
+	StyleRepo     styles.Repository
+	// Logger is optional, the default logger is used when nil.
+	Logger *slog.Logger
+}
+
+func New(cfg Config) (API, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("missing address")
+	}
+
+	if cfg.APIKeyRepo == nil {
+		return nil, errors.New("missing API key repository")
+	}
+
+	if cfg.InvisionQueue == nil {
+		return nil, errors.New("missing invision queue")
+	}
+
+	if cfg.Moderator == nil {
+		return nil, errors.New("missing moderator")
+	}
+
+	if cfg.QuotaTracker == nil {
+		return nil, errors.New("missing quota tracker")
+	}
+
+	if cfg.StyleRepo == nil {
+		return nil, errors.New("missing style repository")
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	newAPI := &apiImpl{
+		addr:          cfg.Addr,
+		apiKeyRepo:    cfg.APIKeyRepo,
+		invisionQueue: cfg.InvisionQueue,
+		moderator:     cfg.Moderator,
+		quotaTracker:  cfg.QuotaTracker,
+		styleRepo:     cfg.StyleRepo,
+		jobs:          newJobStore(jobRetention),
+		logger:        logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/invisions", newAPI.authenticate(newAPI.handleInvisions))
+	mux.Handle("/v1/jobs/", newAPI.authenticate(newAPI.handleJob))
+
+	newAPI.server = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return newAPI, nil
+}
+
+func (a *apiImpl) Start() error {
+	listener, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+
+	a.logger.Info("Serving REST API", "addr", listener.Addr().String())
+
+	go func() {
+		err := a.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Error("REST API stopped", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (a *apiImpl) Shutdown(ctx context.Context) error {
+	return a.server.Shutdown(ctx)
+}
+
+type authenticatedHandler func(w http.ResponseWriter, r *http.Request, apiKey *entities.APIKey)
+
+// authenticate looks up the API key of the bearer token of a request.
+func (a *apiImpl) authenticate(next authenticatedHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || key == "" {
+			writeError(w, http.StatusUnauthorized, "An API key is required as a bearer token.")
+
+			return
+		}
+
+		apiKey, err := a.apiKeyRepo.GetByHash(r.Context(), HashKey(key))
+		if err != nil {
+			if !errors.Is(err, &repositories.NotFoundError{}) {
+				a.logger.Error("Error getting API key", "error", err)
+
+				writeError(w, http.StatusInternalServerError, "The API key couldn't be checked.")
+
+				return
+			}
+
+			writeError(w, http.StatusUnauthorized, "The API key is not valid.")
+
+			return
+		}
+
+		// without a guild no role policy applies, and the invisions of the key would have no limits
+		if apiKey.GuildID == "" {
+			writeError(w, http.StatusForbidden, "The API key belongs to no guild, create a new one with -api-key-guild.")
+
+			return
+		}
+
+		next(w, r, apiKey)
+	})
+}
+
+// invisionRequest holds the options of the invision command.
+type invisionRequest struct {
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt"`
+	SamplerName    string `json:"sampler_name"`
+	UseHiresFix    bool   `json:"use_hires_fix"`
+	// Style lists shared styles of the guild to merge into the prompt, comma separated.
+	Style             string  `json:"style"`
+	VariationStrength float64 `json:"variation_strength"`
+}
+
+type jobResponse struct {
+	JobID string `json:"job_id"`
+	// Status is "queued", "running", "finished" or "failed".
+	Status string `json:"status"`
+	// Position is the place of a queued job in line.
+	Position int     `json:"position,omitempty"`
+	Progress float64 `json:"progress"`
+	// Notes explain how the role policy of the guild adjusted the job.
+	Notes []string `json:"notes,omitempty"`
+	// Error explains why a failed job failed.
+	Error        string   `json:"error,omitempty"`
+	GenerationID int64    `json:"generation_id,omitempty"`
+	Seeds        []int64  `json:"seeds,omitempty"`
+	Images       []string `json:"images,omitempty"`
+	NSFW         bool     `json:"nsfw,omitempty"`
+}
+
+// handleInvisions queues an invision for the guild of the API key.
+func (a *apiImpl) handleInvisions(w http.ResponseWriter, r *http.Request, apiKey *entities.APIKey) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Use POST to submit an invision.")
+
+		return
+	}
+
+	var request invisionRequest
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(&request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("The request is not valid JSON: %s.", err))
+
+		return
+	}
+
+	if strings.TrimSpace(request.Prompt) == "" {
+		writeError(w, http.StatusBadRequest, "The prompt is required.")
+
+		return
+	}
+
+	memberID := memberPrefix + apiKey.Name
+	ctx := logging.NewContext(r.Context(), a.logger)
+
+	moderated, err := a.moderator.Check(ctx, apiKey.GuildID, memberID, request.Prompt)
+	if err != nil {
+		a.logger.Info("Prompt refused by moderation", "api_key", apiKey.Name, "error", err)
+
+		writeQueueError(w, err)
+
+		return
+	}
+
+	appliedStyles, err := a.resolveStyles(ctx, apiKey.GuildID, request.Style)
+	if err != nil {
+		writeQueueError(w, err)
+
+		return
+	}
+
+	err = a.quotaTracker.Check(ctx, apiKey.GuildID, memberID, nil, 1,
+		a.invisionQueue.QueuedGenerations(apiKey.GuildID, memberID))
+	if err != nil {
+		a.logger.Info("Invision refused by quota", "api_key", apiKey.Name, "error", err)
+
+		writeQueueError(w, err)
+
+		return
+	}
+
+	sampler := request.SamplerName
+	if sampler == "" {
+		sampler = defaultSampler
+	}
+
+	newJob := &job{
+		id:     logging.NewJobID(),
+		keyID:  apiKey.ID,
+		status: jobStatusQueued,
+	}
+
+	notes := make([]string, 0)
+	if moderated.Rewritten {
+		notes = append(notes, "Parts of your prompt were replaced by the moderation rules of this server.")
+	}
+
+	item := &invision_queue.QueueItem{
+		JobID:             newJob.id,
+		Prompt:            moderated.Prompt,
+		NegativePrompt:    request.NegativePrompt,
+		SamplerName1:      sampler,
+		Type:              invision_queue.ItemTypeInvision,
+		UseHiresFix:       request.UseHiresFix,
+		Styles:            appliedStyles,
+		VariationStrength: request.VariationStrength,
+		Origin: invision_queue.Origin{
+			GuildID:  apiKey.GuildID,
+			MemberID: memberID,
+		},
+		Notifier: newJob,
+	}
+
+	// the job is stored first, the queue may start delivering to it right away
+	a.jobs.add(newJob)
+
+	position, err := a.invisionQueue.AddInvision(item)
+	if err != nil {
+		a.jobs.remove(newJob.id)
+
+		a.logger.Info("Error adding invision to queue", "job_id", newJob.id, "api_key", apiKey.Name, "error", err)
+
+		writeQueueError(w, err)
+
+		return
+	}
+
+	response := a.jobResponse(newJob)
+	response.Position = position
+	response.Notes = append(notes, item.PolicyNotes...)
+
+	w.Header().Set("Location", "/v1/jobs/"+newJob.id)
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+func (a *apiImpl) resolveStyles(ctx context.Context, guildID, value string) ([]*entities.Style, error) {
+	appliedStyles := make([]*entities.Style, 0)
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		style, err := a.styleRepo.GetByName(ctx, guildID, "", name)
+		if err != nil {
+			if errors.Is(err, &repositories.NotFoundError{}) {
+				return nil, &unknownStyleError{name: name}
+			}
+
+			return nil, err
+		}
+
+		appliedStyles = append(appliedStyles, style)
+	}
+
+	return appliedStyles, nil
+}
+
+// handleJob serves the status of a job at /v1/jobs/<job ID>, and its images at
+// /v1/jobs/<job ID>/images/<number>, counting from 1.
+func (a *apiImpl) handleJob(w http.ResponseWriter, r *http.Request, apiKey *entities.APIKey) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "Use GET to look up a job.")
+
+		return
+	}
+
+	jobID, imagePath, isImage := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/images/")
+
+	storedJob := a.jobs.get(jobID, apiKey.ID)
+	if storedJob == nil {
+		writeError(w, http.StatusNotFound, "There is no such job, or it expired.")
+
+		return
+	}
+
+	if !isImage {
+		response := a.jobResponse(storedJob)
+
+		if response.Status == jobStatusQueued {
+			response.Position = a.queuePosition(jobID)
+		}
+
+		writeJSON(w, http.StatusOK, response)
+
+		return
+	}
+
+	imageNumber, err := strconv.Atoi(imagePath)
+
+	storedJob.mu.Lock()
+	result := storedJob.result
+	storedJob.mu.Unlock()
+
+	if err != nil || result == nil || imageNumber < 1 || imageNumber > len(result.Images) {
+		writeError(w, http.StatusNotFound, "There is no such image.")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(result.Images[imageNumber-1])))
+
+	_, err = w.Write(result.Images[imageNumber-1])
+	if err != nil {
+		a.logger.Warn("Error writing image", "job_id", jobID, "error", err)
+	}
+}
+
+func (a *apiImpl) jobResponse(storedJob *job) *jobResponse {
+	storedJob.mu.Lock()
+	defer storedJob.mu.Unlock()
+
+	response := &jobResponse{
+		JobID:    storedJob.id,
+		Status:   storedJob.status,
+		Progress: storedJob.progress,
+		Error:    storedJob.message,
+	}
+
+	if storedJob.result != nil {
+		response.GenerationID = storedJob.result.GenerationID
+		response.Seeds = storedJob.result.Seeds
+		response.NSFW = storedJob.result.Spoiler
+
+		for idx := range storedJob.result.Images {
+			response.Images = append(response.Images, fmt.Sprintf("/v1/jobs/%s/images/%d", storedJob.id, idx+1))
+		}
+	}
+
+	return response
+}
+
+// queuePosition returns the place of a job in line, 0 when it isn't waiting.
+func (a *apiImpl) queuePosition(jobID string) int {
+	for idx, waitingJob := range a.invisionQueue.Status().Waiting {
+		if waitingJob.JobID == jobID {
+			return idx + 1
+		}
+	}
+
+	return 0
+}
+
+type unknownStyleError struct {
+	name string
+}
+
+func (e *unknownStyleError) Error() string {
+	return fmt.Sprintf("unknown style %s", e.name)
+}
+
+// writeQueueError explains why an invision couldn't be queued, with the status code of the reason.
+func writeQueueError(w http.ResponseWriter, err error) {
+	var rejectedErr *policy.RejectedError
+	var moderationErr *moderation.RejectedError
+	var quotaErr *quota.ExceededError
+	var styleErr *unknownStyleError
+
+	switch {
+	case errors.As(err, &styleErr):
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("There is no shared style named %s.", styleErr.name))
+	case errors.As(err, &quotaErr):
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("%s It resets at %s.", quotaErr.Reason, quotaErr.ResetAt.UTC().Format(time.RFC3339)))
+	case errors.As(err, &rejectedErr):
+		writeError(w, http.StatusBadRequest, rejectedErr.Reason)
+	case errors.As(err, &moderationErr):
+		writeError(w, http.StatusBadRequest, "The prompt contains something that isn't allowed on this server.")
+	case errors.Is(err, invision_queue.ErrQueueFull):
+		writeError(w, http.StatusServiceUnavailable, "The queue is full right now, please try again later.")
+	case errors.Is(err, invision_queue.ErrQueueStopped):
+		writeError(w, http.StatusServiceUnavailable, "The bot is shutting down, please try again later.")
+	case errors.Is(err, invision_queue.ErrMemberQueueLimit):
+		writeError(w, http.StatusTooManyRequests, "This API key already has the maximum number of invisions waiting in line.")
+	case errors.Is(err, invision_queue.ErrNSFWPrompt):
+		writeError(w, http.StatusBadRequest, "The prompt was flagged as NSFW.")
+	case errors.Is(err, invision_queue.ErrUnknownWildcard):
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("The prompt can't be expanded: %s.", err))
+	default:
+		writeError(w, http.StatusInternalServerError, "The invision couldn't be queued.")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,439 @@
+package rest_api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"kinshi_vision_bot/entities"
+	"kinshi_vision_bot/invision_queue"
+	"kinshi_vision_bot/moderation"
+	"kinshi_vision_bot/quota"
+	"kinshi_vision_bot/repositories"
+	"kinshi_vision_bot/repositories/styles"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// memoryAPIKeyRepo keeps API keys by their hash.
+type memoryAPIKeyRepo struct {
+	keys map[string]*entities.APIKey
+}
+
+func (r *memoryAPIKeyRepo) Create(ctx context.Context, apiKey *entities.APIKey) (*entities.APIKey, error) {
+	apiKey.ID = int64(len(r.keys) + 1)
+	r.keys[apiKey.KeyHash] = apiKey
+
+	return apiKey, nil
+}
+
+func (r *memoryAPIKeyRepo) GetByHash(ctx context.Context, keyHash string) (*entities.APIKey, error) {
+	apiKey, ok := r.keys[keyHash]
+	if !ok {
+		return nil, repositories.NewNotFoundError("api key")
+	}
+
+	return apiKey, nil
+}
+
+func (r *memoryAPIKeyRepo) List(ctx context.Context) ([]*entities.APIKey, error) {
+	apiKeys := make([]*entities.APIKey, 0, len(r.keys))
+	for _, apiKey := range r.keys {
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, nil
+}
+
+func (r *memoryAPIKeyRepo) DeleteByName(ctx context.Context, name string) error {
+	for keyHash, apiKey := range r.keys {
+		if apiKey.Name == name {
+			delete(r.keys, keyHash)
+		}
+	}
+
+	return nil
+}
+
+// fakeQueue keeps the added items waiting, the tests deliver to them through their notifiers.
+type fakeQueue struct {
+	invision_queue.Queue
+
+	mu      sync.Mutex
+	waiting []*invision_queue.QueueItem
+}
+
+func (q *fakeQueue) AddInvision(item *invision_queue.QueueItem) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.waiting = append(q.waiting, item)
+
+	return len(q.waiting), nil
+}
+
+func (q *fakeQueue) QueuedGenerations(guildID, memberID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.waiting)
+}
+
+func (q *fakeQueue) Status() *invision_queue.Status {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := &invision_queue.Status{}
+	for _, item := range q.waiting {
+		status.Waiting = append(status.Waiting, &invision_queue.JobStatus{JobID: item.JobID})
+	}
+
+	return status
+}
+
+// start takes the next item out of the line, like the queue does when it starts a job.
+func (q *fakeQueue) start() *invision_queue.QueueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item := q.waiting[0]
+	q.waiting = q.waiting[1:]
+
+	return item
+}
+
+// fakeModerator rejects prompts mentioning "forbidden".
+type fakeModerator struct{}
+
+func (m *fakeModerator) Check(ctx context.Context, guildID, memberID, prompt string) (*moderation.Result, error) {
+	if strings.Contains(prompt, "forbidden") {
+		return nil, &moderation.RejectedError{RuleID: 1}
+	}
+
+	return &moderation.Result{Prompt: prompt}, nil
+}
+
+// fakeQuotaTracker refuses every invision when exceeded is set.
+type fakeQuotaTracker struct {
+	exceeded bool
+}
+
+func (t *fakeQuotaTracker) Usage(ctx context.Context, guildID, memberID string, roleIDs []string) (*quota.Usage, error) {
+	return &quota.Usage{}, nil
+}
+
+func (t *fakeQuotaTracker) Check(ctx context.Context, guildID, memberID string, roleIDs []string, generations int, queued int) error {
+	if t.exceeded {
+		return &quota.ExceededError{Reason: "You reached the limit of 1 invisions per hour.", ResetAt: time.Now().Add(time.Hour)}
+	}
+
+	return nil
+}
+
+// noStyles finds no style.
+type noStyles struct {
+	styles.Repository
+}
+
+func (s *noStyles) GetByName(ctx context.Context, guildID, memberID, name string) (*entities.Style, error) {
+	return nil, repositories.NewNotFoundError("style")
+}
+
+type testAPI struct {
+	api    *apiImpl
+	server *httptest.Server
+	queue  *fakeQueue
+	quota  *fakeQuotaTracker
+	// keys are the API keys of the test by name.
+	keys map[string]string
+}
+
+// newTestAPI serves the API with httptest, with a key "ci" of the guild "guild" and a key "other"
+// of the same guild.
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+
+	keyRepo := &memoryAPIKeyRepo{keys: make(map[string]*entities.APIKey)}
+	testAPI := &testAPI{
+		queue: &fakeQueue{},
+		quota: &fakeQuotaTracker{},
+		keys:  make(map[string]string),
+	}
+
+	for _, name := range []string{"ci", "other"} {
+		key, keyHash, err := NewKey()
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+
+		_, _ = keyRepo.Create(context.Background(), &entities.APIKey{Name: name, GuildID: "guild", KeyHash: keyHash})
+		testAPI.keys[name] = key
+	}
+
+	api, err := New(Config{
+		Addr:          "127.0.0.1:0",
+		APIKeyRepo:    keyRepo,
+		InvisionQueue: testAPI.queue,
+		Moderator:     &fakeModerator{},
+		QuotaTracker:  testAPI.quota,
+		StyleRepo:     &noStyles{},
+		Logger:        discardLogger,
+	})
+	if err != nil {
+		t.Fatalf("creating API: %v", err)
+	}
+
+	testAPI.api = api.(*apiImpl)
+	testAPI.server = httptest.NewServer(testAPI.api.server.Handler)
+	t.Cleanup(testAPI.server.Close)
+
+	return testAPI
+}
+
+// do sends a request with the key as bearer token, none when empty, and decodes a JSON answer into response.
+func (a *testAPI) do(t *testing.T, method, path, key, body string, response any) *http.Response {
+	t.Helper()
+
+	request, err := http.NewRequest(method, a.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	if key != "" {
+		request.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := a.server.Client().Do(request)
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if response != nil {
+		err = json.NewDecoder(resp.Body).Decode(response)
+		if err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+	}
+
+	return resp
+}
+
+func TestAuthentication(t *testing.T) {
+	api := newTestAPI(t)
+
+	_, keyHash, err := NewKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	noGuildKey, noGuildHash, err := NewKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	repo := api.api.apiKeyRepo.(*memoryAPIKeyRepo)
+	_, _ = repo.Create(context.Background(), &entities.APIKey{Name: "no guild", KeyHash: noGuildHash})
+
+	tests := []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{name: "missing key", status: http.StatusUnauthorized},
+		{name: "unknown key", key: "kvb_" + keyHash, status: http.StatusUnauthorized},
+		{name: "key without a guild", key: noGuildKey, status: http.StatusForbidden},
+		{name: "valid key", key: api.keys["ci"], status: http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response map[string]any
+
+			resp := api.do(t, http.MethodPost, "/v1/invisions", tt.key, `{"prompt": "a cat"}`, &response)
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d: %v", tt.status, resp.StatusCode, response)
+			}
+		})
+	}
+
+	api.queue.mu.Lock()
+	defer api.queue.mu.Unlock()
+
+	if len(api.queue.waiting) != 1 {
+		t.Errorf("expected only the valid key to queue an invision, got %d", len(api.queue.waiting))
+	}
+}
+
+func TestInvisionRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		exceeded bool
+		status   int
+		error    string
+	}{
+		{
+			name:   "missing prompt",
+			body:   `{"prompt": " "}`,
+			status: http.StatusBadRequest,
+			error:  "The prompt is required.",
+		},
+		{
+			name:   "unknown field",
+			body:   `{"prompt": "a cat", "steps": 20}`,
+			status: http.StatusBadRequest,
+			error:  "The request is not valid JSON",
+		},
+		{
+			name:   "moderation",
+			body:   `{"prompt": "a forbidden cat"}`,
+			status: http.StatusBadRequest,
+			error:  "The prompt contains something that isn't allowed on this server.",
+		},
+		{
+			name:   "unknown style",
+			body:   `{"prompt": "a cat", "style": "anime"}`,
+			status: http.StatusBadRequest,
+			error:  "There is no shared style named anime.",
+		},
+		{
+			name:     "quota",
+			body:     `{"prompt": "a cat"}`,
+			exceeded: true,
+			status:   http.StatusTooManyRequests,
+			error:    "You reached the limit of 1 invisions per hour. It resets at ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			api.quota.exceeded = tt.exceeded
+
+			var response map[string]string
+
+			resp := api.do(t, http.MethodPost, "/v1/invisions", api.keys["ci"], tt.body, &response)
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+
+			if !strings.HasPrefix(response["error"], tt.error) {
+				t.Errorf("expected error %q, got %q", tt.error, response["error"])
+			}
+
+			if len(api.queue.waiting) != 0 {
+				t.Errorf("expected nothing to be queued, got %d items", len(api.queue.waiting))
+			}
+		})
+	}
+}
+
+func TestJobPolling(t *testing.T) {
+	api := newTestAPI(t)
+
+	var submitted jobResponse
+
+	resp := api.do(t, http.MethodPost, "/v1/invisions", api.keys["ci"], `{"prompt": "a cat"}`, &submitted)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	jobPath := "/v1/jobs/" + submitted.JobID
+	if location := resp.Header.Get("Location"); location != jobPath {
+		t.Errorf("expected location %s, got %s", jobPath, location)
+	}
+
+	if submitted.Status != jobStatusQueued || submitted.Position != 1 {
+		t.Errorf("expected the job to be queued first in line, got %+v", submitted)
+	}
+
+	item := api.queue.waiting[0]
+	if item.Prompt != "a cat" || item.Origin.GuildID != "guild" || item.Origin.MemberID != "api:ci" {
+		t.Errorf("expected an invision of api:ci in the guild of the key, got %+v", item)
+	}
+
+	if item.SamplerName1 != defaultSampler {
+		t.Errorf("expected the default sampler, got %s", item.SamplerName1)
+	}
+
+	// poll decodes into a fresh response every time, the omitted fields would keep their old values
+	poll := func() *jobResponse {
+		polled := &jobResponse{}
+		api.do(t, http.MethodGet, jobPath, api.keys["ci"], "", polled)
+
+		return polled
+	}
+
+	resp = api.do(t, http.MethodGet, jobPath, api.keys["other"], "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the job to be hidden from other keys, got status %d", resp.StatusCode)
+	}
+
+	polled := poll()
+	if polled.Status != jobStatusQueued || polled.Position != 1 {
+		t.Errorf("expected the job to wait first in line, got %+v", polled)
+	}
+
+	ctx := context.Background()
+	started := api.queue.start()
+
+	_, _ = started.Notifier.Progress(ctx, &invision_queue.Progress{Fraction: 0.5})
+
+	polled = poll()
+	if polled.Status != jobStatusRunning || polled.Progress != 0.5 || polled.Position != 0 {
+		t.Errorf("expected the job to be running halfway, got %+v", polled)
+	}
+
+	image := []byte("\x89PNG image")
+	_, _ = started.Notifier.Deliver(ctx, &invision_queue.Result{
+		GenerationID: 7,
+		Images:       [][]byte{image},
+		Seeds:        []int64{42},
+	})
+
+	polled = poll()
+	if polled.Status != jobStatusFinished || polled.GenerationID != 7 || len(polled.Seeds) != 1 || polled.Seeds[0] != 42 {
+		t.Errorf("expected the job to be finished with its generation, got %+v", polled)
+	}
+
+	if len(polled.Images) != 1 || polled.Images[0] != jobPath+"/images/1" {
+		t.Fatalf("expected a link to the image, got %v", polled.Images)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, api.server.URL+polled.Images[0], nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	request.Header.Set("Authorization", "Bearer "+api.keys["ci"])
+
+	resp, err = api.server.Client().Do(request)
+	if err != nil {
+		t.Fatalf("downloading image: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading image: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(body, image) {
+		t.Errorf("expected the PNG image, got status %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	resp = api.do(t, http.MethodGet, jobPath+"/images/2", api.keys["ci"], "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected no second image, got status %d", resp.StatusCode)
+	}
+}
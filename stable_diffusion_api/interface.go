@@ -1,7 +1,10 @@
 package stable_diffusion_api
 
+import "context"
+
 type StableDiffusionAPI interface {
-	TextToImage(req *TextToImageRequest) (*TextToImageResponse, error)
-	UpscaleImage(upscaleReq *UpscaleRequest) (*UpscaleResponse, error)
-	GetCurrentProgress() (*ProgressResponse, error)
+	TextToImage(ctx context.Context, req *TextToImageRequest) (*TextToImageResponse, error)
+	ImageToImage(ctx context.Context, req *ImageToImageRequest) (*TextToImageResponse, error)
+	UpscaleImage(ctx context.Context, upscaleReq *UpscaleRequest) (*UpscaleResponse, error)
+	GetCurrentProgress(ctx context.Context) (*ProgressResponse, error)
 }
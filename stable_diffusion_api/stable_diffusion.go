@@ -2,10 +2,12 @@ package stable_diffusion_api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"kinshi_vision_bot/logging"
 	"net/http"
 )
 
@@ -36,12 +38,17 @@ type jsonInfoResponse struct {
 	Seed        int64   `json:"seed"`
 	AllSeeds    []int64 `json:"all_seeds"`
 	AllSubseeds []int   `json:"all_subseeds"`
+	// NSFW is only present when a safety checker extension runs on the WebUI,
+	// either as one flag for the whole batch or one flag per image.
+	NSFW json.RawMessage `json:"nsfw"`
 }
 
 type TextToImageResponse struct {
 	Images   []string `json:"images"`
 	Seeds    []int64  `json:"seeds"`
 	Subseeds []int    `json:"subseeds"`
+	// NSFW flags every image the WebUI safety checker reported, nil when no checker ran.
+	NSFW []bool `json:"nsfw"`
 }
 
 type TextToImageRequest struct {
@@ -64,21 +71,65 @@ type TextToImageRequest struct {
 	CfgScale          float64 `json:"cfg_scale"`
 	Steps             int     `json:"steps"`
 	NIter             int     `json:"n_iter"`
+	// OverrideSettings changes WebUI options like sd_model_checkpoint for this request only.
+	OverrideSettings map[string]any `json:"override_settings,omitempty"`
 }
 
-func (api *apiImpl) TextToImage(req *TextToImageRequest) (*TextToImageResponse, error) {
+func (api *apiImpl) TextToImage(ctx context.Context, req *TextToImageRequest) (*TextToImageResponse, error) {
 	if req == nil {
 		return nil, errors.New("missing request")
 	}
 
 	postURL := api.host + "/sdapi/v1/txt2img"
 
+	logging.FromContext(ctx).Debug("Calling txt2img", "url", postURL, "seed", req.Seed, "batch_size", req.BatchSize, "n_iter", req.NIter)
+
+	return api.generate(ctx, postURL, req)
+}
+
+type ImageToImageRequest struct {
+	// InitImages are the base64 encoded source images.
+	InitImages        []string `json:"init_images"`
+	Prompt            string   `json:"prompt"`
+	NegativePrompt    string   `json:"negative_prompt"`
+	Width             int      `json:"width"`
+	Height            int      `json:"height"`
+	RestoreFaces      bool     `json:"restore_faces"`
+	DenoisingStrength float64  `json:"denoising_strength"`
+	BatchSize         int      `json:"batch_size"`
+	Seed              int64    `json:"seed"`
+	Subseed           int      `json:"subseed"`
+	SubseedStrength   float64  `json:"subseed_strength"`
+	SamplerName       string   `json:"sampler_name"`
+	CfgScale          float64  `json:"cfg_scale"`
+	Steps             int      `json:"steps"`
+	NIter             int      `json:"n_iter"`
+}
+
+func (api *apiImpl) ImageToImage(ctx context.Context, req *ImageToImageRequest) (*TextToImageResponse, error) {
+	if req == nil {
+		return nil, errors.New("missing request")
+	}
+
+	if len(req.InitImages) == 0 {
+		return nil, errors.New("missing source image")
+	}
+
+	postURL := api.host + "/sdapi/v1/img2img"
+
+	logging.FromContext(ctx).Debug("Calling img2img", "url", postURL, "seed", req.Seed, "denoising_strength", req.DenoisingStrength)
+
+	return api.generate(ctx, postURL, req)
+}
+
+// generate posts a txt2img or img2img request, which share the response format.
+func (api *apiImpl) generate(ctx context.Context, postURL string, req any) (*TextToImageResponse, error) {
 	jsonData, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := http.NewRequest("POST", postURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", postURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, err
 	}
@@ -89,8 +140,7 @@ func (api *apiImpl) TextToImage(req *TextToImageRequest) (*TextToImageResponse,
 
 	response, err := client.Do(request)
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Error with API Request: %s", string(jsonData))
+		logging.FromContext(ctx).Error("Error with API request", "url", postURL, "request", string(jsonData), "error", err)
 
 		return nil, err
 	}
@@ -99,12 +149,16 @@ func (api *apiImpl) TextToImage(req *TextToImageRequest) (*TextToImageResponse,
 
 	body, _ := io.ReadAll(response.Body)
 
+	err = checkStatus(ctx, postURL, response, body)
+	if err != nil {
+		return nil, err
+	}
+
 	respStruct := &jsonTextToImageResponse{}
 
 	err = json.Unmarshal(body, respStruct)
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Unexpected API response: %s", string(body))
+		logging.FromContext(ctx).Error("Unexpected API response", "url", postURL, "response", string(body), "error", err)
 
 		return nil, err
 	}
@@ -113,8 +167,7 @@ func (api *apiImpl) TextToImage(req *TextToImageRequest) (*TextToImageResponse,
 
 	err = json.Unmarshal([]byte(respStruct.Info), infoStruct)
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Unexpected API response: %s", string(body))
+		logging.FromContext(ctx).Error("Unexpected API response", "url", postURL, "response", string(body), "error", err)
 
 		return nil, err
 	}
@@ -123,13 +176,55 @@ func (api *apiImpl) TextToImage(req *TextToImageRequest) (*TextToImageResponse,
 		Images:   respStruct.Images,
 		Seeds:    infoStruct.AllSeeds,
 		Subseeds: infoStruct.AllSubseeds,
+		NSFW:     parseNSFWInfo(infoStruct.NSFW, len(respStruct.Images)),
 	}, nil
 }
 
+// checkStatus turns an error response of the WebUI into an error, instead of an empty result.
+func checkStatus(ctx context.Context, requestURL string, response *http.Response, body []byte) error {
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	logging.FromContext(ctx).Error("API request failed", "url", requestURL, "status", response.Status, "response", string(body))
+
+	return fmt.Errorf("unexpected status from API: %s", response.Status)
+}
+
+// parseNSFWInfo reads the safety checker result, which is either a single flag or one flag per image.
+// Anything else is treated as no result.
+func parseNSFWInfo(raw json.RawMessage, imageCount int) []bool {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var perImage []bool
+
+	if err := json.Unmarshal(raw, &perImage); err == nil {
+		return perImage
+	}
+
+	var single bool
+
+	if err := json.Unmarshal(raw, &single); err == nil {
+		flags := make([]bool, imageCount)
+		for idx := range flags {
+			flags[idx] = single
+		}
+
+		return flags
+	}
+
+	return nil
+}
+
 type UpscaleRequest struct {
-	ResizeMode         int                 `json:"resize_mode"`
-	UpscalingResize    int                 `json:"upscaling_resize"`
-	Upscaler1          string              `json:"upscaler1"`
+	ResizeMode      int    `json:"resize_mode"`
+	UpscalingResize int    `json:"upscaling_resize"`
+	Upscaler1       string `json:"upscaler1"`
+	// Image is the base64 encoded image to upscale. When empty, the image is regenerated
+	// with TextToImageRequest first.
+	Image              string              `json:"image"`
 	TextToImageRequest *TextToImageRequest `json:"text_to_image_request"`
 }
 
@@ -144,39 +239,47 @@ type UpscaleResponse struct {
 	Image string `json:"image"`
 }
 
-func (api *apiImpl) UpscaleImage(upscaleReq *UpscaleRequest) (*UpscaleResponse, error) {
+func (api *apiImpl) UpscaleImage(ctx context.Context, upscaleReq *UpscaleRequest) (*UpscaleResponse, error) {
 	if upscaleReq == nil {
 		return nil, errors.New("missing request")
 	}
 
-	textToImageReq := upscaleReq.TextToImageRequest
+	image := upscaleReq.Image
 
-	if textToImageReq == nil {
-		return nil, errors.New("missing text to image request")
-	}
+	if image == "" {
+		textToImageReq := upscaleReq.TextToImageRequest
 
-	textToImageReq.NIter = 1
+		if textToImageReq == nil {
+			return nil, errors.New("missing text to image request")
+		}
 
-	regeneratedImage, err := api.TextToImage(textToImageReq)
-	if err != nil {
-		return nil, err
+		textToImageReq.NIter = 1
+
+		regeneratedImage, err := api.TextToImage(ctx, textToImageReq)
+		if err != nil {
+			return nil, err
+		}
+
+		image = regeneratedImage.Images[0]
 	}
 
 	jsonReq := &upscaleJSONRequest{
 		ResizeMode:      upscaleReq.ResizeMode,
 		UpscalingResize: upscaleReq.UpscalingResize,
 		Upscaler1:       upscaleReq.Upscaler1,
-		Image:           regeneratedImage.Images[0],
+		Image:           image,
 	}
 
 	postURL := api.host + "/sdapi/v1/extra-single-image"
 
+	logging.FromContext(ctx).Debug("Calling extra-single-image", "url", postURL, "upscaler", jsonReq.Upscaler1)
+
 	jsonData, err := json.Marshal(jsonReq)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := http.NewRequest("POST", postURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", postURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, err
 	}
@@ -187,8 +290,7 @@ func (api *apiImpl) UpscaleImage(upscaleReq *UpscaleRequest) (*UpscaleResponse,
 
 	response, err := client.Do(request)
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Error with API Request: %s", string(jsonData))
+		logging.FromContext(ctx).Error("Error with API request", "url", postURL, "request", string(jsonData), "error", err)
 
 		return nil, err
 	}
@@ -197,12 +299,16 @@ func (api *apiImpl) UpscaleImage(upscaleReq *UpscaleRequest) (*UpscaleResponse,
 
 	body, _ := io.ReadAll(response.Body)
 
+	err = checkStatus(ctx, postURL, response, body)
+	if err != nil {
+		return nil, err
+	}
+
 	respStruct := &UpscaleResponse{}
 
 	err = json.Unmarshal(body, respStruct)
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Unexpected API response: %s", string(body))
+		logging.FromContext(ctx).Error("Unexpected API response", "url", postURL, "response", string(body), "error", err)
 
 		return nil, err
 	}
@@ -215,10 +321,10 @@ type ProgressResponse struct {
 	EtaRelative float64 `json:"eta_relative"`
 }
 
-func (api *apiImpl) GetCurrentProgress() (*ProgressResponse, error) {
+func (api *apiImpl) GetCurrentProgress(ctx context.Context) (*ProgressResponse, error) {
 	getURL := api.host + "/sdapi/v1/progress"
 
-	request, err := http.NewRequest("GET", getURL, bytes.NewBuffer([]byte{}))
+	request, err := http.NewRequestWithContext(ctx, "GET", getURL, bytes.NewBuffer([]byte{}))
 	if err != nil {
 		return nil, err
 	}
@@ -227,8 +333,7 @@ func (api *apiImpl) GetCurrentProgress() (*ProgressResponse, error) {
 
 	response, err := client.Do(request)
 	if err != nil {
-		log.Printf("API URL: %s", getURL)
-		log.Printf("Error with API Request: %v", err)
+		logging.FromContext(ctx).Error("Error with API request", "url", getURL, "error", err)
 
 		return nil, err
 	}
@@ -237,12 +342,16 @@ func (api *apiImpl) GetCurrentProgress() (*ProgressResponse, error) {
 
 	body, _ := io.ReadAll(response.Body)
 
+	err = checkStatus(ctx, getURL, response, body)
+	if err != nil {
+		return nil, err
+	}
+
 	respStruct := &ProgressResponse{}
 
 	err = json.Unmarshal(body, respStruct)
 	if err != nil {
-		log.Printf("API URL: %s", getURL)
-		log.Printf("Unexpected API response: %s", string(body))
+		logging.FromContext(ctx).Error("Unexpected API response", "url", getURL, "response", string(body), "error", err)
 
 		return nil, err
 	}